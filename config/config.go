@@ -0,0 +1,471 @@
+// Package config loads the LDOups configuration from a YAML file, overridden
+// by `LDOUPS_*` environment variables. Secrets can be read from files, as
+// mounted by Docker or Kubernetes secrets.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix prefixes the environment variables overriding the file.
+const EnvPrefix = "LDOUPS_"
+
+type Config struct {
+	Server struct {
+		Host string `yaml:"host"`
+		Port string `yaml:"port"`
+	} `yaml:"server"`
+	Ldap        Directory            `yaml:"ldap"`
+	Directories map[string]Directory `yaml:"directories"`
+	Scim        struct {
+		UserMapping        map[string]string `yaml:"userMapping"`
+		UserObjectClasses  []string          `yaml:"userObjectClasses"`
+		UsersDN            string            `yaml:"usersDN"`
+		GroupMapping       map[string]string `yaml:"groupMapping"`
+		GroupObjectClasses []string          `yaml:"groupObjectClasses"`
+		GroupsDN           string            `yaml:"groupsDN"`
+		MaxResults         int               `yaml:"maxResults"`
+	} `yaml:"scim"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+	Health struct {
+		CacheTTL time.Duration `yaml:"cacheTTL"`
+		Timeout  time.Duration `yaml:"timeout"`
+	} `yaml:"health"`
+	Audit struct {
+		Sink         string   `yaml:"sink"`
+		Path         string   `yaml:"path"`
+		Key          string   `yaml:"key"`
+		KeyFile      string   `yaml:"keyFile"`
+		PreviousKeys []string `yaml:"previousKeys"`
+		Syslog       struct {
+			Network string `yaml:"network"`
+			Address string `yaml:"address"`
+			Tag     string `yaml:"tag"`
+		} `yaml:"syslog"`
+	} `yaml:"audit"`
+	Store struct {
+		Path string `yaml:"path"`
+	} `yaml:"store"`
+	Webhooks struct {
+		Endpoints   []WebhookEndpoint `yaml:"endpoints"`
+		MaxAttempts int               `yaml:"maxAttempts"`
+		Backoff     time.Duration     `yaml:"backoff"`
+		MaxBackoff  time.Duration     `yaml:"maxBackoff"`
+		Timeout     time.Duration     `yaml:"timeout"`
+		Retention   time.Duration     `yaml:"retention"`
+	} `yaml:"webhooks"`
+	Watch struct {
+		Mode     string        `yaml:"mode"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"watch"`
+	Jobs struct {
+		Interval  time.Duration `yaml:"interval"`
+		Retention time.Duration `yaml:"retention"`
+	} `yaml:"jobs"`
+}
+
+// DefaultDirectory names the directory configured by the `ldap` section.
+const DefaultDirectory = "default"
+
+// Directory describes one LDAP directory: the top-level `ldap` section, and
+// each of the named `directories`. EmptyMember is the member put in the
+// groups losing their last one, groupOfNames requiring a member.
+type Directory struct {
+	BaseDN                  string            `yaml:"baseDN"`
+	RO                      Credentials       `yaml:"ro"`
+	RW                      Credentials       `yaml:"rw"`
+	Url                     string            `yaml:"url"`
+	UserAttributes          map[string]string `yaml:"userAttributes"`
+	UsersObjectClassSearch  string            `yaml:"usersObjectClassSearch"`
+	GroupAttributes         map[string]string `yaml:"groupAttributes"`
+	GroupsObjectClassSearch string            `yaml:"groupsObjectClassSearch"`
+	EmptyMember             string            `yaml:"emptyMember"`
+	UserRules               map[string]Rule   `yaml:"userRules"`
+	GroupRules              map[string]Rule   `yaml:"groupRules"`
+	Accounts                Accounts          `yaml:"accounts"`
+	Expiry                  Expiry            `yaml:"expiry"`
+	Posix                   Posix             `yaml:"posix"`
+	SSHKeys                 SSHKeys           `yaml:"sshKeys"`
+	Sudo                    Sudo              `yaml:"sudo"`
+	ServiceAccounts         ServiceAccounts   `yaml:"serviceAccounts"`
+	GroupOwners             GroupOwners       `yaml:"groupOwners"`
+	AccessRequests          AccessRequests    `yaml:"accessRequests"`
+	DynamicGroups           DynamicGroups     `yaml:"dynamicGroups"`
+	Apply                   Apply             `yaml:"apply"`
+	Audit                   Audit             `yaml:"audit"`
+}
+
+// Credentials of an account binding to the directory.
+type Credentials struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+// Accounts describes how users are disabled and locked. Disable strategies
+// are `ppolicy` (permanent `pwdAccountLockedTime`), `ou` (move to
+// DisabledOU), `groups` (remove from every group, restored on enable) and
+// `attribute` (DisabledValue added to StatusAttribute). Lock strategies are
+// `ppolicy` and `attribute`.
+type Accounts struct {
+	Disable         []string `yaml:"disable"`
+	Lock            []string `yaml:"lock"`
+	DisabledOU      string   `yaml:"disabledOU"`
+	StatusAttribute string   `yaml:"statusAttribute"`
+	DisabledValue   string   `yaml:"disabledValue"`
+	LockedValue     string   `yaml:"lockedValue"`
+}
+
+// Posix describes the POSIX accounts and groups, entries with the
+// posixAccount or posixGroup object class. Missing uidNumber and gidNumber
+// are allocated from UIDNumbers and GIDNumbers. HomeDirectory is a template
+// where `{uid}` is replaced by the user uid.
+type Posix struct {
+	UIDNumbers       IDRange  `yaml:"uidNumbers"`
+	GIDNumbers       IDRange  `yaml:"gidNumbers"`
+	DefaultGIDNumber int      `yaml:"defaultGidNumber"`
+	HomeDirectory    string   `yaml:"homeDirectory"`
+	Shells           []string `yaml:"shells"`
+	DefaultShell     string   `yaml:"defaultShell"`
+}
+
+// SSHKeys describes the SSH public keys of users, kept in Attribute
+// (openssh-lpk schema). Members of the Admins groups manage the keys of
+// every user, other users only theirs. Without Admins, the directory ACLs
+// decide.
+type SSHKeys struct {
+	Attribute   string   `yaml:"attribute"`
+	ObjectClass string   `yaml:"objectClass"`
+	Admins      []string `yaml:"admins"`
+	MinRSABits  int      `yaml:"minRSABits"`
+}
+
+// Sudo describes where the sudoRole entries of the sudo rules are kept.
+type Sudo struct {
+	BaseDN string `yaml:"baseDN"`
+}
+
+// ServiceAccounts describes the accounts of automation, kept in OU. They
+// authenticate with API keys issued by the members of the Admins groups,
+// their requests being done with the read-write account.
+type ServiceAccounts struct {
+	OU     string   `yaml:"ou"`
+	Admins []string `yaml:"admins"`
+}
+
+// GroupOwners describes who owns groups: the users and the members of the
+// groups, nested or not, listed in Attribute. With Delegate, owners manage
+// the members of their groups, the changes being done with the read-write
+// account. Other changes are left to the directory ACLs.
+type GroupOwners struct {
+	Attribute string `yaml:"attribute"`
+	Delegate  bool   `yaml:"delegate"`
+}
+
+// AccessRequests describes the group membership requests of users. They
+// are approved by the owners of the group and the members of the Approvers
+// groups, and applied with the read-write account.
+type AccessRequests struct {
+	Enabled   bool     `yaml:"enabled"`
+	Approvers []string `yaml:"approvers"`
+}
+
+// DynamicGroups describes who manages the groups whose members are the users
+// matching a filter: the members of the Admins groups, and the owners of the
+// group when they manage its members (GroupOwners.Delegate). Their members
+// are kept in sync with the read-write account. The groups whose filter
+// matches nobody are only synced with an EmptyMember.
+type DynamicGroups struct {
+	Admins []string `yaml:"admins"`
+}
+
+// Apply describes how the entries managed by declarative documents are
+// marked: with an `ldoups:<owner>` value of TagAttribute, so that pruning
+// only deletes the entries of the document owner.
+type Apply struct {
+	TagAttribute string `yaml:"tagAttribute"`
+}
+
+// Audit describes who reads the audit log and the webhook deliveries of the
+// directory: the members of the Admins groups. Nobody does without them.
+type Audit struct {
+	Admins []string `yaml:"admins"`
+}
+
+// IDRange is an inclusive range of uid or gid numbers.
+type IDRange struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+// Expiry describes the account expiry enforced by the job scheduler. The
+// expiry date of users is read from Attribute, in days since the epoch
+// (`days`, as `shadowExpire`), as generalized time (`generalizedTime`) or
+// as `YYYY-MM-DD` (`date`).
+type Expiry struct {
+	Attribute   string        `yaml:"attribute"`
+	Format      string        `yaml:"format"`
+	WarnDays    []int         `yaml:"warnDays"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+// Directory returns the configuration of the named directory, the default
+// one for an empty name.
+func (c *Config) Directory(name string) (Directory, bool) {
+	if name == "" || name == DefaultDirectory {
+		return c.Ldap, true
+	}
+	d, ok := c.Directories[name]
+	return d, ok
+}
+
+// Rule describes the constraints applied to the values of one attribute.
+type Rule struct {
+	Syntax       string   `yaml:"syntax"`
+	SingleValued bool     `yaml:"singleValued"`
+	Pattern      string   `yaml:"pattern"`
+	Enum         []string `yaml:"enum"`
+	MaxLength    int      `yaml:"maxLength"`
+}
+
+type WebhookEndpoint struct {
+	Name        string   `yaml:"name"`
+	Url         string   `yaml:"url"`
+	Secret      string   `yaml:"secret"`
+	SecretFile  string   `yaml:"secretFile"`
+	Events      []string `yaml:"events"`
+	Directories []string `yaml:"directories"`
+}
+
+// Load reads the configuration file at path, then applies the environment
+// overrides and the defaults, and validates the result. A missing file is
+// allowed when the environment provides the whole configuration.
+func Load(path string) (*Config, error) {
+	c := &Config{}
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(content, c); err != nil {
+			return nil, fmt.Errorf("can't parse %s: %s", path, readableYAMLError(err))
+		}
+	case os.IsNotExist(err) && hasEnv():
+	default:
+		return nil, fmt.Errorf("can't read config: %w", err)
+	}
+
+	if err := applyEnv(c, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var unknownFieldRe = regexp.MustCompile(`field (\S+) not found in type .*`)
+
+// readableYAMLError shortens the unknown field errors, which otherwise dump
+// the whole Go type.
+func readableYAMLError(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err.Error()
+	}
+	problems := make([]string, len(typeErr.Errors))
+	for i, problem := range typeErr.Errors {
+		problems[i] = unknownFieldRe.ReplaceAllString(problem, "unknown field $1")
+	}
+	return "\n  " + strings.Join(problems, "\n  ")
+}
+
+func hasEnv() bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSecretFiles replaces the secrets given as files by their content.
+func (c *Config) readSecretFiles() error {
+	if err := c.Ldap.readSecretFiles("ldap"); err != nil {
+		return err
+	}
+	for name, d := range c.Directories {
+		if err := d.readSecretFiles("directories." + name); err != nil {
+			return err
+		}
+		c.Directories[name] = d
+	}
+	if c.Audit.KeyFile != "" {
+		key, err := readSecret(c.Audit.KeyFile)
+		if err != nil {
+			return fmt.Errorf("audit.keyFile: %w", err)
+		}
+		c.Audit.Key = key
+	}
+	for i, endpoint := range c.Webhooks.Endpoints {
+		if endpoint.SecretFile != "" {
+			secret, err := readSecret(endpoint.SecretFile)
+			if err != nil {
+				return fmt.Errorf("webhooks.endpoints[%d].secretFile: %w", i, err)
+			}
+			c.Webhooks.Endpoints[i].Secret = secret
+		}
+	}
+	return nil
+}
+
+func (d *Directory) readSecretFiles(path string) error {
+	for name, credentials := range map[string]*Credentials{"ro": &d.RO, "rw": &d.RW} {
+		if credentials.PasswordFile != "" {
+			secret, err := readSecret(credentials.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("%s.%s.passwordFile: %w", path, name, err)
+			}
+			credentials.Password = secret
+		}
+	}
+	return nil
+}
+
+// readSecret returns the content of a secret file, without the trailing
+// newline editors add.
+func readSecret(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func (c *Config) setDefaults() {
+	c.Ldap.setDefaults()
+	for name, d := range c.Directories {
+		d.setDefaults()
+		c.Directories[name] = d
+	}
+	if c.Server.Port == "" {
+		c.Server.Port = "8000"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = "json"
+	}
+	if c.Health.CacheTTL == 0 {
+		c.Health.CacheTTL = 5 * time.Second
+	}
+	if c.Health.Timeout == 0 {
+		c.Health.Timeout = 2 * time.Second
+	}
+	if c.Audit.Sink == "" {
+		c.Audit.Sink = "none"
+	}
+	if c.Store.Path == "" {
+		c.Store.Path = "ldoups.db"
+	}
+	if c.Webhooks.MaxAttempts == 0 {
+		c.Webhooks.MaxAttempts = 8
+	}
+	if c.Webhooks.Backoff == 0 {
+		c.Webhooks.Backoff = 10 * time.Second
+	}
+	if c.Webhooks.MaxBackoff == 0 {
+		c.Webhooks.MaxBackoff = time.Hour
+	}
+	if c.Webhooks.Timeout == 0 {
+		c.Webhooks.Timeout = 10 * time.Second
+	}
+	if c.Webhooks.Retention == 0 {
+		c.Webhooks.Retention = 7 * 24 * time.Hour
+	}
+	if c.Watch.Mode == "" {
+		c.Watch.Mode = "none"
+	}
+	if c.Watch.Interval == 0 {
+		c.Watch.Interval = 30 * time.Second
+	}
+	if c.Scim.MaxResults == 0 {
+		c.Scim.MaxResults = 100
+	}
+	if c.Jobs.Interval == 0 {
+		c.Jobs.Interval = time.Hour
+	}
+	if c.Jobs.Retention == 0 {
+		c.Jobs.Retention = 90 * 24 * time.Hour
+	}
+}
+
+func (d *Directory) setDefaults() {
+	if len(d.Accounts.Disable) == 0 {
+		d.Accounts.Disable = []string{"ppolicy"}
+	}
+	if len(d.Accounts.Lock) == 0 {
+		d.Accounts.Lock = []string{"ppolicy"}
+	}
+	if d.Accounts.DisabledValue == "" {
+		d.Accounts.DisabledValue = "disabled"
+	}
+	if d.Accounts.LockedValue == "" {
+		d.Accounts.LockedValue = "locked"
+	}
+	if d.Expiry.Format == "" {
+		d.Expiry.Format = "generalizedTime"
+		if strings.EqualFold(d.Expiry.Attribute, "shadowExpire") {
+			d.Expiry.Format = "days"
+		}
+	}
+	for _, r := range []*IDRange{&d.Posix.UIDNumbers, &d.Posix.GIDNumbers} {
+		if *r == (IDRange{}) {
+			*r = IDRange{Min: 10000, Max: 59999}
+		}
+	}
+	if d.Posix.HomeDirectory == "" {
+		d.Posix.HomeDirectory = "/home/{uid}"
+	}
+	if len(d.Posix.Shells) == 0 {
+		d.Posix.Shells = []string{"/bin/bash", "/bin/sh", "/bin/zsh", "/usr/sbin/nologin"}
+	}
+	if d.Posix.DefaultShell == "" {
+		d.Posix.DefaultShell = "/bin/bash"
+	}
+	if d.SSHKeys.Attribute == "" {
+		d.SSHKeys.Attribute = "sshPublicKey"
+	}
+	if d.SSHKeys.ObjectClass == "" {
+		d.SSHKeys.ObjectClass = "ldapPublicKey"
+	}
+	if d.SSHKeys.MinRSABits == 0 {
+		d.SSHKeys.MinRSABits = 3072
+	}
+	if d.Sudo.BaseDN == "" && d.BaseDN != "" {
+		d.Sudo.BaseDN = "ou=SUDOers," + d.BaseDN
+	}
+	if d.ServiceAccounts.OU == "" && d.BaseDN != "" {
+		d.ServiceAccounts.OU = "ou=services," + d.BaseDN
+	}
+	if d.GroupOwners.Attribute == "" {
+		d.GroupOwners.Attribute = "owner"
+	}
+	if d.Apply.TagAttribute == "" {
+		d.Apply.TagAttribute = "businessCategory"
+	}
+}
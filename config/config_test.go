@@ -0,0 +1,117 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const minimalConfig = `
+ldap:
+  url: ldap://localhost
+  baseDN: dc=example,dc=org
+  ro:
+    username: cn=reader,dc=example,dc=org
+  usersObjectClassSearch: inetOrgPerson
+  groupsObjectClassSearch: groupOfNames
+`
+
+func TestLoadSecretFiles(t *testing.T) {
+	content := minimalConfig + `
+  rw:
+    username: cn=admin,dc=example,dc=org
+    passwordFile: ` + writeSecret(t, "rw-secret\r\n") + `
+directories:
+  lab:
+    url: ldaps://lab.example.org
+    baseDN: dc=lab,dc=example,dc=org
+    ro:
+      username: cn=reader,dc=lab,dc=example,dc=org
+      passwordFile: ` + writeSecret(t, "lab-secret") + `
+    usersObjectClassSearch: inetOrgPerson
+    groupsObjectClassSearch: groupOfNames
+audit:
+  sink: file
+  path: audit.log
+  keyFile: ` + writeSecret(t, "audit-key\n") + `
+webhooks:
+  endpoints:
+    - name: jira
+      url: https://jira.example.org/hooks
+      secretFile: ` + writeSecret(t, "hook-secret\n") + `
+`
+	c, err := Load(writeConfig(t, content))
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if c.Ldap.RW.Password != "rw-secret" {
+		t.Errorf("ldap.rw.password = %q, want rw-secret", c.Ldap.RW.Password)
+	}
+	if lab, _ := c.Directory("lab"); lab.RO.Password != "lab-secret" {
+		t.Errorf("directories.lab.ro.password = %q, want lab-secret", lab.RO.Password)
+	}
+	if c.Audit.Key != "audit-key" {
+		t.Errorf("audit.key = %q, want audit-key", c.Audit.Key)
+	}
+	if c.Webhooks.Endpoints[0].Secret != "hook-secret" {
+		t.Errorf("webhooks.endpoints[0].secret = %q, want hook-secret", c.Webhooks.Endpoints[0].Secret)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown field", minimalConfig + "  baseDn: dc=example,dc=org\n", "unknown field baseDn"},
+		{"missing password file", minimalConfig + "  rw:\n    passwordFile: /nonexistent/password\n", "ldap.rw.passwordFile: open /nonexistent/password"},
+		{"missing key file", minimalConfig + "audit:\n  keyFile: /nonexistent/key\n", "audit.keyFile: open /nonexistent/key"},
+		{"missing secret file", minimalConfig + "webhooks:\n  endpoints:\n    - name: jira\n      url: https://jira.example.org\n      secretFile: /nonexistent/secret\n", "webhooks.endpoints[0].secretFile: open /nonexistent/secret"},
+	}
+	for _, tt := range tests {
+		if _, err := Load(writeConfig(t, tt.content)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load() = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("LDOUPS_LDAP_URL", "ldaps://ldap.example.org")
+	t.Setenv("LDOUPS_LDAP_RO_PASSWORD_FILE", writeSecret(t, "ro-secret\n"))
+	c, err := Load(writeConfig(t, minimalConfig))
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if c.Ldap.Url != "ldaps://ldap.example.org" {
+		t.Errorf("ldap.url = %s, want the environment one", c.Ldap.Url)
+	}
+	if c.Ldap.RO.Password != "ro-secret" {
+		t.Errorf("ldap.ro.password = %q, want ro-secret", c.Ldap.RO.Password)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	c := &Config{
+		Ldap:        Directory{BaseDN: "dc=example,dc=org"},
+		Directories: map[string]Directory{"lab": {BaseDN: "dc=lab,dc=example,dc=org"}},
+	}
+	for name, want := range map[string]string{"": "dc=example,dc=org", DefaultDirectory: "dc=example,dc=org", "lab": "dc=lab,dc=example,dc=org"} {
+		if d, ok := c.Directory(name); !ok || d.BaseDN != want {
+			t.Errorf("Directory(%q) = %s, %v, want %s", name, d.BaseDN, ok, want)
+		}
+	}
+	if _, ok := c.Directory("prod"); ok {
+		t.Error("Directory(prod) found an unknown directory")
+	}
+}
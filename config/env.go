@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the fields of c with the environment. Variables are
+// named after the YAML path of the field, e.g. `LDOUPS_LDAP_RO_PASSWORD`
+// for `ldap.ro.password` or `LDOUPS_HEALTH_CACHE_TTL` for
+// `health.cacheTTL`. A `_FILE` suffix reads the value from a file instead.
+// Lists are comma-separated. Maps and lists of objects can only be set in the
+// file.
+func applyEnv(c *Config, lookup func(string) (string, bool)) error {
+	return applyEnvFields(reflect.ValueOf(c).Elem(), "", EnvPrefix, lookup)
+}
+
+func applyEnvFields(v reflect.Value, path string, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fieldPath := tag
+		if path != "" {
+			fieldPath = path + "." + tag
+		}
+		name := prefix + envName(tag)
+
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct {
+			if err := applyEnvFields(value, fieldPath, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := lookup(name)
+		file, fromFile := lookup(name + "_FILE")
+		if ok && fromFile {
+			return fmt.Errorf("%s: both %s and %s_FILE are set", fieldPath, name, name)
+		}
+		if fromFile {
+			secret, err := readSecret(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fieldPath, err)
+			}
+			raw, ok = secret, true
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(value, raw); err != nil {
+			return fmt.Errorf("%s: invalid %s value %q: %w", fieldPath, name, raw, err)
+		}
+	}
+	return nil
+}
+
+func setValue(value reflect.Value, raw string) error {
+	if value.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the config file")
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
+
+// envName turns a camelCase YAML key into an environment variable name:
+// `baseDN` becomes `BASE_DN`, `cacheTTL` becomes `CACHE_TTL`.
+func envName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"ro":                     "RO",
+		"baseDN":                 "BASE_DN",
+		"cacheTTL":               "CACHE_TTL",
+		"disabledOU":             "DISABLED_OU",
+		"minRSABits":             "MIN_RSA_BITS",
+		"defaultGidNumber":       "DEFAULT_GID_NUMBER",
+		"usersObjectClassSearch": "USERS_OBJECT_CLASS_SEARCH",
+		"uidNumbers":             "UID_NUMBERS",
+	}
+	for key, want := range tests {
+		if got := envName(key); got != want {
+			t.Errorf("envName(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func writeSecret(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"LDOUPS_LDAP_BASE_DN":                  "dc=example,dc=org",
+		"LDOUPS_LDAP_RO_PASSWORD_FILE":         writeSecret(t, "s3cret\n"),
+		"LDOUPS_LDAP_ACCOUNTS_DISABLE":         "ppolicy, ou,",
+		"LDOUPS_LDAP_GROUP_OWNERS_DELEGATE":    "true",
+		"LDOUPS_LDAP_POSIX_UID_NUMBERS_MIN":    "20000",
+		"LDOUPS_HEALTH_CACHE_TTL":              "10s",
+		"LDOUPS_WEBHOOKS_MAX_ATTEMPTS":         "3",
+		"LDOUPS_DIRECTORIES":                   "ignored, maps are only set in the file",
+		"LDOUPS_LDAP_USERS_OBJECT_CLASS":       "ignored, not a field",
+		"LDOUPS_SCIM_USER_OBJECT_CLASSES_FILE": writeSecret(t, "inetOrgPerson,posixAccount"),
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	c := &Config{}
+	c.Ldap.Url = "ldap://localhost"
+	if err := applyEnv(c, lookup); err == nil || !strings.Contains(err.Error(), "can only be set in the config file") {
+		t.Fatalf("applyEnv() with a map = %v, want an error", err)
+	}
+	delete(env, "LDOUPS_DIRECTORIES")
+
+	c = &Config{}
+	c.Ldap.Url = "ldap://localhost"
+	if err := applyEnv(c, lookup); err != nil {
+		t.Fatalf("applyEnv(): %v", err)
+	}
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"ldap.url", c.Ldap.Url, "ldap://localhost"},
+		{"ldap.baseDN", c.Ldap.BaseDN, "dc=example,dc=org"},
+		{"ldap.ro.password", c.Ldap.RO.Password, "s3cret"},
+		{"ldap.accounts.disable", c.Ldap.Accounts.Disable, []string{"ppolicy", "ou"}},
+		{"ldap.groupOwners.delegate", c.Ldap.GroupOwners.Delegate, true},
+		{"ldap.posix.uidNumbers.min", c.Ldap.Posix.UIDNumbers.Min, 20000},
+		{"health.cacheTTL", c.Health.CacheTTL, 10 * time.Second},
+		{"webhooks.maxAttempts", c.Webhooks.MaxAttempts, 3},
+		{"scim.userObjectClasses", c.Scim.UserObjectClasses, []string{"inetOrgPerson", "posixAccount"}},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.want) {
+			t.Errorf("%s = %v, want %v", check.name, check.got, check.want)
+		}
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"invalid int", map[string]string{"LDOUPS_WEBHOOKS_MAX_ATTEMPTS": "many"}, `webhooks.maxAttempts: invalid LDOUPS_WEBHOOKS_MAX_ATTEMPTS value "many"`},
+		{"invalid duration", map[string]string{"LDOUPS_JOBS_INTERVAL": "hourly"}, `jobs.interval: invalid LDOUPS_JOBS_INTERVAL value "hourly"`},
+		{"invalid bool", map[string]string{"LDOUPS_LDAP_GROUP_OWNERS_DELEGATE": "maybe"}, `ldap.groupOwners.delegate: invalid LDOUPS_LDAP_GROUP_OWNERS_DELEGATE value "maybe"`},
+		{"value and file", map[string]string{"LDOUPS_AUDIT_KEY": "key", "LDOUPS_AUDIT_KEY_FILE": "/run/secrets/key"}, "audit.key: both LDOUPS_AUDIT_KEY and LDOUPS_AUDIT_KEY_FILE are set"},
+		{"missing file", map[string]string{"LDOUPS_AUDIT_KEY_FILE": "/nonexistent/key"}, "audit.key: open /nonexistent/key"},
+		{"list of objects", map[string]string{"LDOUPS_WEBHOOKS_ENDPOINTS": "jira"}, "can only be set in the config file"},
+	}
+	for _, tt := range tests {
+		lookup := func(name string) (string, bool) {
+			value, ok := tt.env[name]
+			return value, ok
+		}
+		if err := applyEnv(&Config{}, lookup); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: applyEnv() = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ValidationError lists every problem found in the configuration, so that
+// they can all be fixed at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) required(path string, value string) bool {
+	if value == "" {
+		if strings.HasPrefix(path, "directories.") || strings.HasPrefix(path, "webhooks.endpoints") {
+			// Maps and lists of objects can't be set by the environment
+			v.addf(path, "is required")
+		} else {
+			v.addf(path, "is required (or %s%s)", EnvPrefix, envPath(path))
+		}
+		return false
+	}
+	return true
+}
+
+func (v *validator) oneOf(path string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf(path, "%q must be one of %s", value, strings.Join(allowed, ", "))
+}
+
+func envPath(path string) string {
+	var parts []string
+	for _, key := range strings.Split(path, ".") {
+		parts = append(parts, envName(key))
+	}
+	return strings.Join(parts, "_")
+}
+
+var directoryNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// directory checks the settings of one directory, found at path.
+func (v *validator) directory(path string, d Directory) {
+	if v.required(path+".url", d.Url) {
+		for _, raw := range strings.Fields(d.Url) {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps" && u.Scheme != "ldapi") {
+				v.addf(path+".url", "%q is not an ldap://, ldaps:// or ldapi:// url", raw)
+			}
+		}
+	}
+	if v.required(path+".baseDN", d.BaseDN) {
+		if _, err := ldap.ParseDN(d.BaseDN); err != nil {
+			v.addf(path+".baseDN", "%q is not a valid DN", d.BaseDN)
+		}
+	}
+	v.required(path+".ro.username", d.RO.Username)
+	v.required(path+".usersObjectClassSearch", d.UsersObjectClassSearch)
+	v.required(path+".groupsObjectClassSearch", d.GroupsObjectClassSearch)
+	if d.EmptyMember != "" {
+		if _, err := ldap.ParseDN(d.EmptyMember); err != nil {
+			v.addf(path+".emptyMember", "%q is not a valid DN", d.EmptyMember)
+		}
+	}
+	for name, value := range d.UserAttributes {
+		if value != "" && value != "required" {
+			v.addf(path+".userAttributes."+name, "%q must be empty or required", value)
+		}
+	}
+	for name, value := range d.GroupAttributes {
+		if value != "" && value != "required" {
+			v.addf(path+".groupAttributes."+name, "%q must be empty or required", value)
+		}
+	}
+
+	strategies := make(map[string]bool)
+	for _, strategy := range d.Accounts.Disable {
+		v.oneOf(path+".accounts.disable", strategy, "ppolicy", "ou", "groups", "attribute")
+		strategies[strategy] = true
+	}
+	for _, strategy := range d.Accounts.Lock {
+		v.oneOf(path+".accounts.lock", strategy, "ppolicy", "attribute")
+		strategies[strategy] = true
+	}
+	if strategies["ou"] && v.required(path+".accounts.disabledOU", d.Accounts.DisabledOU) {
+		if _, err := ldap.ParseDN(d.Accounts.DisabledOU); err != nil {
+			v.addf(path+".accounts.disabledOU", "%q is not a valid DN", d.Accounts.DisabledOU)
+		}
+	}
+	if strategies["attribute"] {
+		v.required(path+".accounts.statusAttribute", d.Accounts.StatusAttribute)
+	}
+
+	if d.Expiry.Attribute != "" {
+		v.oneOf(path+".expiry.format", d.Expiry.Format, "days", "generalizedTime", "date")
+		for _, days := range d.Expiry.WarnDays {
+			if days <= 0 {
+				v.addf(path+".expiry.warnDays", "%d must be positive", days)
+			}
+		}
+		if d.Expiry.GracePeriod < 0 {
+			v.addf(path+".expiry.gracePeriod", "must be positive")
+		}
+		// The read-only account can't disable nor delete users
+		v.required(path+".rw.username", d.RW.Username)
+	}
+
+	for name, r := range map[string]IDRange{"uidNumbers": d.Posix.UIDNumbers, "gidNumbers": d.Posix.GIDNumbers} {
+		if r.Min <= 0 || r.Max < r.Min {
+			v.addf(path+".posix."+name, "[%d, %d] is not a valid range", r.Min, r.Max)
+		}
+	}
+	if d.Posix.DefaultGIDNumber < 0 {
+		v.addf(path+".posix.defaultGidNumber", "must be positive")
+	}
+	if !strings.HasPrefix(d.Posix.HomeDirectory, "/") {
+		v.addf(path+".posix.homeDirectory", "%q is not an absolute path", d.Posix.HomeDirectory)
+	}
+	for _, shell := range d.Posix.Shells {
+		if !strings.HasPrefix(shell, "/") {
+			v.addf(path+".posix.shells", "%q is not an absolute path", shell)
+		}
+	}
+	v.oneOf(path+".posix.defaultShell", d.Posix.DefaultShell, d.Posix.Shells...)
+
+	for _, admins := range d.SSHKeys.Admins {
+		if _, err := ldap.ParseDN(admins); err != nil {
+			v.addf(path+".sshKeys.admins", "%q is not a valid DN", admins)
+		}
+	}
+	if d.SSHKeys.MinRSABits < 2048 {
+		v.addf(path+".sshKeys.minRSABits", "%d is less than 2048", d.SSHKeys.MinRSABits)
+	}
+	if d.Sudo.BaseDN != "" {
+		if _, err := ldap.ParseDN(d.Sudo.BaseDN); err != nil {
+			v.addf(path+".sudo.baseDN", "%q is not a valid DN", d.Sudo.BaseDN)
+		}
+	}
+
+	if d.ServiceAccounts.OU != "" {
+		if _, err := ldap.ParseDN(d.ServiceAccounts.OU); err != nil {
+			v.addf(path+".serviceAccounts.ou", "%q is not a valid DN", d.ServiceAccounts.OU)
+		}
+	}
+	for _, admins := range d.ServiceAccounts.Admins {
+		if _, err := ldap.ParseDN(admins); err != nil {
+			v.addf(path+".serviceAccounts.admins", "%q is not a valid DN", admins)
+		}
+	}
+	if len(d.ServiceAccounts.Admins) > 0 {
+		// Requests authenticated with API keys are done with the read-write account
+		v.required(path+".rw.username", d.RW.Username)
+	}
+	if d.GroupOwners.Delegate {
+		// Owners' member changes are done with the read-write account
+		v.required(path+".rw.username", d.RW.Username)
+	}
+	for _, approvers := range d.AccessRequests.Approvers {
+		if _, err := ldap.ParseDN(approvers); err != nil {
+			v.addf(path+".accessRequests.approvers", "%q is not a valid DN", approvers)
+		}
+	}
+	if d.AccessRequests.Enabled {
+		// Approved requests are applied with the read-write account
+		v.required(path+".rw.username", d.RW.Username)
+	}
+	for _, admins := range d.DynamicGroups.Admins {
+		if _, err := ldap.ParseDN(admins); err != nil {
+			v.addf(path+".dynamicGroups.admins", "%q is not a valid DN", admins)
+		}
+	}
+	for _, admins := range d.Audit.Admins {
+		if _, err := ldap.ParseDN(admins); err != nil {
+			v.addf(path+".audit.admins", "%q is not a valid DN", admins)
+		}
+	}
+}
+
+// Validate checks the configuration is complete and consistent.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port <= 0 || port > 65535 {
+		v.addf("server.port", "%q is not a valid port", c.Server.Port)
+	}
+
+	v.directory("ldap", c.Ldap)
+	for name, d := range c.Directories {
+		path := "directories." + name
+		if !directoryNameRe.MatchString(name) || name == DefaultDirectory {
+			v.addf(path, "%q must be lowercase letters, digits and dashes, and not %q", name, DefaultDirectory)
+		}
+		v.directory(path, d)
+	}
+
+	v.oneOf("log.level", strings.ToLower(c.Log.Level), "debug", "info", "warn", "error")
+	v.oneOf("log.format", c.Log.Format, "json", "console")
+
+	v.oneOf("audit.sink", c.Audit.Sink, "none", "stdout", "file", "syslog")
+	if c.Audit.Sink == "file" {
+		v.required("audit.path", c.Audit.Path)
+		// The records are chained with an HMAC, so that the chain can't be
+		// rewritten without the key
+		v.required("audit.key", c.Audit.Key)
+	}
+
+	v.oneOf("watch.mode", c.Watch.Mode, "none", "auto", "syncrepl", "psearch", "poll")
+
+	names := make(map[string]bool)
+	for i, endpoint := range c.Webhooks.Endpoints {
+		path := fmt.Sprintf("webhooks.endpoints[%d]", i)
+		if v.required(path+".name", endpoint.Name) {
+			if names[endpoint.Name] {
+				v.addf(path+".name", "%q is already used by another endpoint", endpoint.Name)
+			}
+			names[endpoint.Name] = true
+		}
+		if v.required(path+".url", endpoint.Url) {
+			if u, err := url.Parse(endpoint.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				v.addf(path+".url", "%q is not an http:// or https:// url", endpoint.Url)
+			}
+		}
+		for _, name := range endpoint.Directories {
+			if _, ok := c.Directory(name); !ok {
+				v.addf(path+".directories", "%q is not a configured directory", name)
+			}
+		}
+	}
+	if c.Webhooks.MaxAttempts < 0 {
+		v.addf("webhooks.maxAttempts", "must be positive")
+	}
+	if c.Webhooks.MaxBackoff < c.Webhooks.Backoff {
+		v.addf("webhooks.maxBackoff", "must be greater than webhooks.backoff")
+	}
+
+	for path, d := range map[string]time.Duration{
+		"health.cacheTTL":    c.Health.CacheTTL,
+		"health.timeout":     c.Health.Timeout,
+		"webhooks.backoff":   c.Webhooks.Backoff,
+		"webhooks.timeout":   c.Webhooks.Timeout,
+		"webhooks.retention": c.Webhooks.Retention,
+		"watch.interval":     c.Watch.Interval,
+		"jobs.interval":      c.Jobs.Interval,
+		"jobs.retention":     c.Jobs.Retention,
+	} {
+		if d < 0 {
+			v.addf(path, "must be positive")
+		}
+	}
+	if c.Scim.MaxResults < 0 {
+		v.addf("scim.maxResults", "must be positive")
+	}
+
+	if len(v.problems) > 0 {
+		sort.Strings(v.problems)
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// validConfig returns a configuration passing Validate.
+func validConfig() *Config {
+	c := &Config{}
+	c.Ldap = Directory{
+		Url:                     "ldap://localhost",
+		BaseDN:                  "dc=example,dc=org",
+		RO:                      Credentials{Username: "cn=reader,dc=example,dc=org"},
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+	}
+	c.setDefaults()
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() of a valid configuration: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"missing settings", func(c *Config) {
+			c.Ldap.Url = ""
+			c.Ldap.RO.Username = ""
+		}, []string{
+			"ldap.ro.username: is required (or LDOUPS_LDAP_RO_USERNAME)",
+			"ldap.url: is required (or LDOUPS_LDAP_URL)",
+		}},
+		{"invalid url and DN", func(c *Config) {
+			c.Ldap.Url = "ldap://a http://b"
+			c.Ldap.BaseDN = "example.org"
+		}, []string{
+			`ldap.baseDN: "example.org" is not a valid DN`,
+			`ldap.url: "http://b" is not an ldap://, ldaps:// or ldapi:// url`,
+		}},
+		{"invalid port and level", func(c *Config) {
+			c.Server.Port = "http"
+			c.Log.Level = "verbose"
+		}, []string{
+			`log.level: "verbose" must be one of debug, info, warn, error`,
+			`server.port: "http" is not a valid port`,
+		}},
+		{"named directory", func(c *Config) {
+			lab := c.Ldap
+			lab.Url = ""
+			c.Directories = map[string]Directory{"Lab": lab}
+		}, []string{
+			"directories.Lab.url: is required",
+			`directories.Lab: "Lab" must be lowercase letters, digits and dashes, and not "default"`,
+		}},
+		{"accounts", func(c *Config) {
+			c.Ldap.Accounts.Disable = []string{"ou", "delete"}
+			c.Ldap.Expiry.Attribute = "shadowExpire"
+			c.Ldap.Expiry.WarnDays = []int{7, 0}
+		}, []string{
+			`ldap.accounts.disable: "delete" must be one of ppolicy, ou, groups, attribute`,
+			"ldap.accounts.disabledOU: is required (or LDOUPS_LDAP_ACCOUNTS_DISABLED_OU)",
+			"ldap.expiry.warnDays: 0 must be positive",
+			"ldap.rw.username: is required (or LDOUPS_LDAP_RW_USERNAME)",
+		}},
+		{"posix", func(c *Config) {
+			c.Ldap.Posix.UIDNumbers = IDRange{Min: 2000, Max: 1000}
+			c.Ldap.Posix.DefaultShell = "/bin/fish"
+		}, []string{
+			`ldap.posix.defaultShell: "/bin/fish" must be one of /bin/bash, /bin/sh, /bin/zsh, /usr/sbin/nologin`,
+			"ldap.posix.uidNumbers: [2000, 1000] is not a valid range",
+		}},
+		{"audit file", func(c *Config) {
+			c.Audit.Sink = "file"
+		}, []string{
+			"audit.key: is required (or LDOUPS_AUDIT_KEY)",
+			"audit.path: is required (or LDOUPS_AUDIT_PATH)",
+		}},
+		{"webhooks", func(c *Config) {
+			c.Webhooks.Endpoints = []WebhookEndpoint{
+				{Name: "jira", Url: "https://jira.example.org", Directories: []string{"default", "lab"}},
+				{Name: "jira", Url: "ftp://jira.example.org"},
+			}
+			c.Webhooks.MaxBackoff = c.Webhooks.Backoff / 2
+		}, []string{
+			`webhooks.endpoints[0].directories: "lab" is not a configured directory`,
+			`webhooks.endpoints[1].name: "jira" is already used by another endpoint`,
+			`webhooks.endpoints[1].url: "ftp://jira.example.org" is not an http:// or https:// url`,
+			"webhooks.maxBackoff: must be greater than webhooks.backoff",
+		}},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(c)
+		err := c.Validate()
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: Validate() = %v, want a validation error", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(validationErr.Problems, tt.want) {
+			t.Errorf("%s: Validate() problems = %q, want %q", tt.name, validationErr.Problems, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay groups the file events of one save, editors often write a
+// file in several steps.
+const reloadDelay = 500 * time.Millisecond
+
+// Watch loads the configuration at path again each time the process receives
+// SIGHUP or the file changes, and passes the result to reload. Load errors
+// are passed along, so that the caller can report them and keep running
+// with the current configuration. An error is returned when the file can't
+// be watched, SIGHUP is still handled then.
+func Watch(path string, reload func(c *Config, trigger string, err error)) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// The directory is watched rather than the file, so that files replaced by
+	// a rename, as editors and Kubernetes config maps do, are still followed.
+	// SIGHUP keeps working when the directory can't be watched.
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+		} else {
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	go func() {
+		var timer <-chan time.Time
+		name := filepath.Clean(path)
+		for {
+			select {
+			case <-hup:
+				c, err := Load(path)
+				reload(c, "signal", err)
+			case e := <-events:
+				if filepath.Clean(e.Name) == name || filepath.Base(e.Name) == "..data" {
+					timer = time.After(reloadDelay)
+				}
+			case <-timer:
+				timer = nil
+				c, err := Load(path)
+				reload(c, "file", err)
+			case err := <-errs:
+				reload(nil, "file", err)
+			}
+		}
+	}()
+	return err
+}
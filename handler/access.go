@@ -0,0 +1,615 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const accessRequestsBucket = "access_requests"
+
+const (
+	accessPending   = "pending"
+	accessApproved  = "approved"
+	accessDenied    = "denied"
+	accessCancelled = "cancelled"
+	accessExpired   = "expired"
+)
+
+// accessRequest is the request of a user to join a group, until EndsAt when
+// set, kept with the history of its decisions.
+type accessRequest struct {
+	ID            string               `json:"id"`
+	Directory     string               `json:"directory,omitempty"`
+	Requester     string               `json:"requester"`
+	Group         string               `json:"group"`
+	Justification string               `json:"justification"`
+	EndsAt        *time.Time           `json:"endsAt,omitempty"`
+	Status        string               `json:"status"`
+	CreatedAt     time.Time            `json:"createdAt"`
+	DecidedBy     string               `json:"decidedBy,omitempty"`
+	DecidedAt     *time.Time           `json:"decidedAt,omitempty"`
+	History       []accessRequestEvent `json:"history"`
+}
+
+// accessRequestEvent is a step of a request. Failed steps leave the status
+// unchanged.
+type accessRequestEvent struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor,omitempty"`
+	Status  string    `json:"status"`
+	Comment string    `json:"comment,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type accessRequestInput struct {
+	Group         string     `json:"group"`
+	Justification string     `json:"justification"`
+	EndsAt        *time.Time `json:"endsAt"`
+}
+
+type decisionInput struct {
+	Comment string `json:"comment"`
+}
+
+var (
+	errAccessRequestsDisabled = errors.New("access requests aren't enabled")
+	errNoSuchAccessRequest    = errors.New("no such access request")
+	errNotPending             = errors.New("access request isn't pending")
+	errNotApproved            = errors.New("access request isn't approved")
+	errAlreadyRequested       = errors.New("access already requested")
+	errNotApprover            = errors.New("only the group owners and the approvers can decide on the request")
+	errOwnRequest             = errors.New("requesters can't decide on their own request")
+	errNotRequester           = errors.New("only the requester can cancel the request")
+)
+
+// decisionActions are the audit actions of the decisions, e.g.
+// `access_request.approve`.
+var decisionActions = map[string]string{
+	accessApproved:  "approve",
+	accessDenied:    "deny",
+	accessCancelled: "cancel",
+}
+
+func (r *accessRequest) record(actor string, status string, comment string, err error) {
+	step := accessRequestEvent{Time: time.Now().UTC(), Actor: actor, Status: status, Comment: comment}
+	if err != nil {
+		step.Error = err.Error()
+	} else {
+		r.Status = status
+	}
+	r.History = append(r.History, step)
+}
+
+func (r accessRequest) attributes() map[string][]string {
+	attributes := map[string][]string{
+		"id":            {r.ID},
+		"requester":     {r.Requester},
+		"status":        {r.Status},
+		"justification": {r.Justification},
+	}
+	if r.EndsAt != nil {
+		attributes["endsAt"] = []string{r.EndsAt.Format(time.RFC3339)}
+	}
+	return attributes
+}
+
+// recordAccessRequest audits and publishes a step of the request, the
+// group being its target.
+func (l *ldapConn) recordAccessRequest(action string, previous string, r accessRequest, err error) {
+	var before map[string][]string
+	if previous != "" {
+		before = r.attributes()
+		before["status"] = []string{previous}
+	}
+	source := l.source
+	if source == "" {
+		source = "api"
+	}
+	l.recordChange(source, "access_request."+action, r.Group, before, r.attributes(), err)
+}
+
+func getAccessRequest(tx *bolt.Tx, dir directory, id string) (accessRequest, error) {
+	var r accessRequest
+	err := getJSON(tx, accessRequestsBucket, id, &r)
+	if err == errNotFound || (err == nil && r.Directory != dir.auditName()) {
+		return r, fmt.Errorf("%w: %s", errNoSuchAccessRequest, id)
+	}
+	return r, err
+}
+
+// updateAccessRequest changes the request with the given ID within a store
+// transaction, so that its status is checked and set at once by concurrent
+// decisions. The request is left unchanged when fn fails.
+func updateAccessRequest(dir directory, id string, fn func(r *accessRequest) error) (accessRequest, error) {
+	db, err := openStore()
+	if err != nil {
+		return accessRequest{}, err
+	}
+	var r accessRequest
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if r, err = getAccessRequest(tx, dir, id); err != nil {
+			return err
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+		return putJSON(tx, accessRequestsBucket, r.ID, r)
+	})
+	return r, err
+}
+
+// accessRequestsOf returns the requests of dir, most recent first.
+func accessRequestsOf(dir directory) ([]accessRequest, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	requests := []accessRequest{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accessRequestsBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r accessRequest
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.Directory == dir.auditName() {
+				requests = append(requests, r)
+			}
+		}
+		return nil
+	})
+	return requests, err
+}
+
+// approvers decides who can approve requests: the members of
+// `accessRequests.approvers` and the owners of the requested group.
+type approvers struct {
+	l      *ldapConn
+	dn     string
+	admin  *bool
+	owners map[string]bool
+}
+
+func newApprovers(l *ldapConn, dn string) *approvers {
+	return &approvers{l: l, dn: dn, owners: make(map[string]bool)}
+}
+
+func (a *approvers) canDecide(groupDN string) (bool, error) {
+	if a.admin == nil {
+		admin := false
+		if approvers := a.l.dir.AccessRequests.Approvers; len(approvers) > 0 {
+			var err error
+			if admin, err = isMemberOfAny(a.l, a.dn, approvers); err != nil {
+				return false, err
+			}
+		}
+		a.admin = &admin
+	}
+	if *a.admin {
+		return true, nil
+	}
+	key := strings.ToLower(groupDN)
+	if owner, ok := a.owners[key]; ok {
+		return owner, nil
+	}
+	owner, err := ownsGroup(a.l, a.dn, groupDN)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		owner, err = false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	a.owners[key] = owner
+	return owner, nil
+}
+
+// checkAccessRequests aborts with 404 and returns false unless access
+// requests are enabled in the request directory.
+func checkAccessRequests(c *gin.Context, l *ldapConn) bool {
+	if !l.dir.AccessRequests.Enabled {
+		abort(c, errAccessRequestsDisabled, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func abortAccessRequests(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoSuchAccessRequest):
+		abort(c, err, http.StatusNotFound)
+	case errors.Is(err, errNotPending), errors.Is(err, errAlreadyRequested), errors.Is(err, errAlreadyMember):
+		abort(c, err, http.StatusConflict)
+	case errors.Is(err, errNotApprover), errors.Is(err, errOwnRequest), errors.Is(err, errNotRequester),
+		ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// GetAccessRequests lists the requests of the logged in user and the ones
+// it can decide on, most recent first, filtered by `status`, `group`,
+// `requester` and `approver=me` (only the ones it can decide on).
+func GetAccessRequests(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccessRequests(c, ldp) {
+		return
+	}
+
+	status, group, requester := c.Query("status"), c.Query("group"), c.Query("requester")
+	if requester == "me" {
+		requester = ldp.actor
+	}
+	onlyDecidable := c.Query("approver") == "me"
+
+	all, err := accessRequestsOf(ldp.dir)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	approvers := newApprovers(ldp, ldp.actor)
+	requests := []accessRequest{}
+	for _, r := range all {
+		if (status != "" && r.Status != status) || (group != "" && !strings.EqualFold(r.Group, group)) || (requester != "" && !strings.EqualFold(r.Requester, requester)) {
+			continue
+		}
+		own := strings.EqualFold(r.Requester, ldp.actor)
+		if own && !onlyDecidable {
+			requests = append(requests, r)
+			continue
+		}
+		decidable, err := approvers.canDecide(r.Group)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if decidable && !(own && onlyDecidable) {
+			requests = append(requests, r)
+		}
+	}
+	c.JSON(http.StatusOK, requests)
+}
+
+// GetAccessRequest returns a request, with its history, to its requester
+// and the ones who can decide on it.
+func GetAccessRequest(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccessRequests(c, ldp) {
+		return
+	}
+
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	var r accessRequest
+	err = db.View(func(tx *bolt.Tx) error {
+		r, err = getAccessRequest(tx, ldp.dir, c.Param("id"))
+		return err
+	})
+	if err != nil {
+		abortAccessRequests(c, err)
+		return
+	}
+	if !strings.EqualFold(r.Requester, ldp.actor) {
+		decidable, err := newApprovers(ldp, ldp.actor).canDecide(r.Group)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if !decidable {
+			abortAccessRequests(c, errNotApprover)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// AddAccessRequest requests the membership of the logged in user to a group
+// with a justification, until `endsAt` when given.
+func AddAccessRequest(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccessRequests(c, ldp) {
+		return
+	}
+
+	var input accessRequestInput
+	if err := c.BindJSON(&input); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	errs := make(map[string]string)
+	if strings.TrimSpace(input.Justification) == "" {
+		errs["justification"] = "missing attribute"
+	}
+	if input.EndsAt != nil && !input.EndsAt.After(time.Now()) {
+		errs["endsAt"] = "must be in the future"
+	}
+	var members []string
+	if input.Group == "" {
+		errs["group"] = "missing attribute"
+	} else {
+		group, err := readAttributes(ldp, input.Group, []string{"objectClass", "member"})
+		switch {
+		case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidDNSyntax):
+			errs["group"] = "no such group"
+		case err != nil:
+			abort(c, err, http.StatusInternalServerError)
+			return
+		case !containsFold(attributeValues(group, "objectClass"), ldp.dir.GroupsObjectClassSearch):
+			errs["group"] = "not a group"
+		}
+		members = attributeValues(group, "member")
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if containsFold(members, ldp.actor) {
+		abortAccessRequests(c, fmt.Errorf("%w: %s", errAlreadyMember, input.Group))
+		return
+	}
+
+	r := accessRequest{
+		ID:            newID(),
+		Directory:     ldp.dir.auditName(),
+		Requester:     ldp.actor,
+		Group:         input.Group,
+		Justification: strings.TrimSpace(input.Justification),
+		EndsAt:        input.EndsAt,
+		CreatedAt:     time.Now().UTC(),
+	}
+	r.record(ldp.actor, accessPending, "", nil)
+	err := createAccessRequest(r)
+	if errors.Is(err, errAlreadyRequested) {
+		abortAccessRequests(c, err)
+		return
+	}
+	ldp.recordAccessRequest("create", "", r, err)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusCreated, r)
+}
+
+// createAccessRequest saves a new request unless the requester has a pending
+// one for the group, checked within the same store transaction.
+func createAccessRequest(r accessRequest) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(accessRequestsBucket)); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				var pending accessRequest
+				if err := json.Unmarshal(v, &pending); err != nil {
+					return err
+				}
+				if pending.Directory == r.Directory && pending.Status == accessPending &&
+					strings.EqualFold(pending.Requester, r.Requester) && strings.EqualFold(pending.Group, r.Group) {
+					return fmt.Errorf("%w: request %s is pending", errAlreadyRequested, pending.ID)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, accessRequestsBucket, r.ID, r)
+	})
+}
+
+// ApproveAccessRequest approves a pending request, adding the requester to
+// the group with the read-write account.
+func ApproveAccessRequest(c *gin.Context) {
+	decideAccessRequest(c, accessApproved)
+}
+
+// DenyAccessRequest denies a pending request.
+func DenyAccessRequest(c *gin.Context) {
+	decideAccessRequest(c, accessDenied)
+}
+
+// CancelAccessRequest withdraws a pending request of the logged in user.
+func CancelAccessRequest(c *gin.Context) {
+	decideAccessRequest(c, accessCancelled)
+}
+
+func decideAccessRequest(c *gin.Context, status string) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccessRequests(c, ldp) {
+		return
+	}
+
+	var input decisionInput
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&input); err != nil {
+			abort(c, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	var r accessRequest
+	err = db.View(func(tx *bolt.Tx) error {
+		r, err = getAccessRequest(tx, ldp.dir, c.Param("id"))
+		return err
+	})
+	if err != nil {
+		abortAccessRequests(c, err)
+		return
+	}
+	if r.Status != accessPending {
+		abortAccessRequests(c, fmt.Errorf("%w: %s", errNotPending, r.Status))
+		return
+	}
+
+	own := strings.EqualFold(r.Requester, ldp.actor)
+	if status == accessCancelled {
+		if !own {
+			abortAccessRequests(c, errNotRequester)
+			return
+		}
+	} else {
+		if own {
+			abortAccessRequests(c, errOwnRequest)
+			return
+		}
+		decidable, err := newApprovers(ldp, ldp.actor).canDecide(r.Group)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if !decidable {
+			abortAccessRequests(c, errNotApprover)
+			return
+		}
+	}
+	if status == accessApproved && r.EndsAt != nil && !r.EndsAt.After(time.Now()) {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"endsAt": "has already passed, deny the request"})
+		return
+	}
+
+	// The decision is recorded before the membership is added, so that a
+	// concurrent one finds the request decided. A failed approval leaves the
+	// request pending again.
+	r, err = updateAccessRequest(ldp.dir, r.ID, func(r *accessRequest) error {
+		if r.Status != accessPending {
+			return fmt.Errorf("%w: %s", errNotPending, r.Status)
+		}
+		r.record(ldp.actor, status, input.Comment, nil)
+		if status != accessCancelled {
+			now := time.Now().UTC()
+			r.DecidedBy = ldp.actor
+			r.DecidedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		abortAccessRequests(c, err)
+		return
+	}
+	var applyErr error
+	if status == accessApproved {
+		applyErr = approveAccessRequest(ldp, r)
+	}
+	if applyErr != nil {
+		r, err = updateAccessRequest(ldp.dir, r.ID, func(r *accessRequest) error {
+			r.History[len(r.History)-1].Error = applyErr.Error()
+			r.Status = accessPending
+			r.DecidedBy = ""
+			r.DecidedAt = nil
+			return nil
+		})
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	ldp.recordAccessRequest(decisionActions[status], accessPending, r, applyErr)
+	if applyErr != nil {
+		abortGroupChange(c, applyErr)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// approveAccessRequest adds the requester to the group, with the read-write
+// account acting for the approver, until the end of the request.
+func approveAccessRequest(l *ldapConn, r accessRequest) error {
+	delegated, err := delegatedConn(l)
+	if err != nil {
+		return err
+	}
+	defer delegated.Close()
+	if err := changeMember(delegated, r.Group, r.Requester, true); err != nil {
+		return err
+	}
+	if r.EndsAt == nil {
+		return forgetMembership(l.dir, r.Group, r.Requester)
+	}
+	return setMembershipExpiry(l.dir, timedMembership{
+		Group:         r.Group,
+		Member:        r.Requester,
+		ExpiresAt:     r.EndsAt.UTC(),
+		AddedBy:       l.actor,
+		AddedAt:       time.Now().UTC(),
+		AccessRequest: r.ID,
+	})
+}
+
+// expireAccessRequest marks expired the approved request with the given ID,
+// once its time-bound membership was removed.
+func expireAccessRequest(l *ldapConn, id string) error {
+	r, err := updateAccessRequest(l.dir, id, func(r *accessRequest) error {
+		if r.Status != accessApproved {
+			return errNotApproved
+		}
+		r.record(l.actor, accessExpired, "", nil)
+		return nil
+	})
+	if errors.Is(err, errNotApproved) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l.recordAccessRequest("expire", accessApproved, r, nil)
+	return nil
+}
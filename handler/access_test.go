@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testApprover = "cn=admin,ou=users,dc=example,dc=org"
+
+// newAccessDirectory returns a fake directory where testOtherDN owns
+// testGroup and testApprover is an approver, and the connection to it.
+func newAccessDirectory(t *testing.T) (*fakeDirectory, *ldapConn) {
+	approvers := "cn=approvers,ou=groups,dc=example,dc=org"
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}},
+		testOtherDN:         {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}},
+		testApprover:        {"objectClass": {"inetOrgPerson"}, "cn": {"admin"}},
+		testGroup:           {"objectClass": {"groupOfNames"}, "cn": {"devs"}, "member": {testOtherDN}, "owner": {testOtherDN}},
+		approvers:           {"objectClass": {"groupOfNames"}, "cn": {"approvers"}, "member": {testApprover}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		RW:                      testReader,
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		GroupOwners:             config.GroupOwners{Attribute: "owner"},
+		AccessRequests:          config.AccessRequests{Enabled: true, Approvers: []string{approvers}},
+	}
+	useTestConfig(t, c)
+	return d, d.dial(t, defaultDirectory())
+}
+
+// pendingAccessRequest saves a pending request of testUser to join
+// testGroup, until endsAt when set.
+func pendingAccessRequest(t *testing.T, l *ldapConn, endsAt *time.Time) accessRequest {
+	t.Helper()
+	r := accessRequest{
+		ID:            newID(),
+		Directory:     l.dir.auditName(),
+		Requester:     testUser,
+		Group:         testGroup,
+		Justification: "on call",
+		EndsAt:        endsAt,
+		CreatedAt:     time.Now().UTC(),
+	}
+	r.record(testUser, accessPending, "", nil)
+	if err := createAccessRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// decide calls handler on the request with the given ID as actor.
+func decide(l *ldapConn, handler gin.HandlerFunc, actor string, id string) *httptest.ResponseRecorder {
+	l.actor = actor
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/access-requests/"+id, strings.NewReader(`{"comment":"ok"}`))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	ctx.Params = gin.Params{{Key: "id", Value: id}}
+	ctx.Set("LDAP", l)
+	handler(ctx)
+	return w
+}
+
+func storedAccessRequest(t *testing.T, l *ldapConn, id string) accessRequest {
+	t.Helper()
+	db, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r accessRequest
+	if err := db.View(func(tx *bolt.Tx) error {
+		r, err = getAccessRequest(tx, l.dir, id)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDecideAccessRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		handler  gin.HandlerFunc
+		actor    string
+		want     int
+		status   string
+		decided  bool
+		isMember bool
+	}{
+		{"approved by the owner", ApproveAccessRequest, testOtherDN, http.StatusOK, accessApproved, true, true},
+		{"approved by an approver", ApproveAccessRequest, "CN=Admin,ou=users,dc=example,dc=org", http.StatusOK, accessApproved, true, true},
+		{"approved by the requester", ApproveAccessRequest, testUser, http.StatusForbidden, accessPending, false, false},
+		{"approved by someone else", ApproveAccessRequest, "cn=other,ou=users,dc=example,dc=org", http.StatusForbidden, accessPending, false, false},
+		{"denied by the owner", DenyAccessRequest, testOtherDN, http.StatusOK, accessDenied, true, false},
+		{"denied by the requester", DenyAccessRequest, testUser, http.StatusForbidden, accessPending, false, false},
+		{"cancelled by the requester", CancelAccessRequest, testUser, http.StatusOK, accessCancelled, false, false},
+		{"cancelled by the owner", CancelAccessRequest, testOtherDN, http.StatusForbidden, accessPending, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, l := newAccessDirectory(t)
+			r := pendingAccessRequest(t, l, nil)
+			if w := decide(l, tt.handler, tt.actor, r.ID); w.Code != tt.want {
+				t.Errorf("code = %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+			r = storedAccessRequest(t, l, r.ID)
+			if r.Status != tt.status || (r.DecidedBy == tt.actor) != tt.decided || (r.DecidedAt != nil) != tt.decided {
+				t.Errorf("request = %s, decided by %q at %v, want %s", r.Status, r.DecidedBy, r.DecidedAt, tt.status)
+			}
+			if tt.want == http.StatusOK {
+				if step := r.History[len(r.History)-1]; step.Status != tt.status || step.Actor != tt.actor || step.Comment != "ok" {
+					t.Errorf("last step = %+v", step)
+				}
+			}
+			if isMember := containsFold(d.get(testGroup, "member"), testUser); isMember != tt.isMember {
+				t.Errorf("member of the group = %v, want %v", isMember, tt.isMember)
+			}
+		})
+	}
+}
+
+func TestDecideAccessRequestOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, l := newAccessDirectory(t)
+	r := pendingAccessRequest(t, l, nil)
+	if w := decide(l, DenyAccessRequest, testOtherDN, r.ID); w.Code != http.StatusOK {
+		t.Fatalf("deny = %d %s", w.Code, w.Body)
+	}
+	for name, handler := range map[string]gin.HandlerFunc{"approve": ApproveAccessRequest, "deny": DenyAccessRequest} {
+		if w := decide(l, handler, testApprover, r.ID); w.Code != http.StatusConflict {
+			t.Errorf("%s of a denied request = %d %s, want %d", name, w.Code, w.Body, http.StatusConflict)
+		}
+	}
+	if w := decide(l, CancelAccessRequest, testUser, r.ID); w.Code != http.StatusConflict {
+		t.Errorf("cancel of a denied request = %d %s, want %d", w.Code, w.Body, http.StatusConflict)
+	}
+	if w := decide(l, ApproveAccessRequest, testOtherDN, "unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("approve of an unknown request = %d %s, want %d", w.Code, w.Body, http.StatusNotFound)
+	}
+	if r := storedAccessRequest(t, l, r.ID); r.Status != accessDenied || len(r.History) != 2 {
+		t.Errorf("request = %s with %d steps, want denied with 2 steps", r.Status, len(r.History))
+	}
+}
+
+func TestApproveAccessRequestTimed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, l := newAccessDirectory(t)
+	endsAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	r := pendingAccessRequest(t, l, &endsAt)
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusOK {
+		t.Fatalf("approve = %d %s", w.Code, w.Body)
+	}
+	memberships, err := timedMemberships(l.dir, testGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 1 || memberships[0].Member != testUser || !memberships[0].ExpiresAt.Equal(endsAt) || memberships[0].AccessRequest != r.ID {
+		t.Errorf("memberships = %+v, want the one of the request, until %s", memberships, endsAt)
+	}
+
+	// An approval is refused once the end of the request has passed
+	past := time.Now().Add(-time.Minute)
+	r = pendingAccessRequest(t, l, &past)
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("approve of a passed request = %d %s, want %d", w.Code, w.Body, http.StatusUnprocessableEntity)
+	}
+	if r := storedAccessRequest(t, l, r.ID); r.Status != accessPending {
+		t.Errorf("request = %s, want pending", r.Status)
+	}
+}
+
+// TestApproveAccessRequestFailed checks that a request stays pending when
+// the membership can't be added, with the error in its history.
+func TestApproveAccessRequestFailed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	d, l := newAccessDirectory(t)
+	d.failOn("modify", testGroup, ldap.LDAPResultInsufficientAccessRights)
+	r := pendingAccessRequest(t, l, nil)
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusForbidden {
+		t.Errorf("approve = %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+	r = storedAccessRequest(t, l, r.ID)
+	if r.Status != accessPending || r.DecidedBy != "" || r.DecidedAt != nil {
+		t.Errorf("request = %s, decided by %q at %v, want pending", r.Status, r.DecidedBy, r.DecidedAt)
+	}
+	steps := make([]string, len(r.History))
+	for i, step := range r.History {
+		steps[i] = step.Status
+	}
+	if step := r.History[len(r.History)-1]; !reflect.DeepEqual(steps, []string{accessPending, accessApproved}) || step.Error == "" {
+		t.Errorf("history = %+v, want the failed approval last", r.History)
+	}
+
+	// It can be approved once the directory accepts the change
+	d.failOn("modify", testGroup, 0)
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusOK {
+		t.Errorf("approve again = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestExpireAccessRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, l := newAccessDirectory(t)
+	r := pendingAccessRequest(t, l, nil)
+	if err := expireAccessRequest(l, r.ID); err != nil {
+		t.Fatalf("expireAccessRequest() of a pending request: %v", err)
+	}
+	if got := storedAccessRequest(t, l, r.ID); got.Status != accessPending {
+		t.Errorf("pending request = %s once expired, want it unchanged", got.Status)
+	}
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusOK {
+		t.Fatalf("approve = %d %s", w.Code, w.Body)
+	}
+	if err := expireAccessRequest(l, r.ID); err != nil {
+		t.Fatalf("expireAccessRequest(): %v", err)
+	}
+	if got := storedAccessRequest(t, l, r.ID); got.Status != accessExpired {
+		t.Errorf("approved request = %s once expired, want expired", got.Status)
+	}
+}
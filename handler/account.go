@@ -0,0 +1,683 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// permanentLock is the pwdAccountLockedTime value of accounts locked until
+// an administrator unlocks them (draft-behera-ldap-password-policy).
+const permanentLock = "000001010000Z"
+
+const disabledBucket = "disabled_accounts"
+
+// Account statuses, returned with users.
+const (
+	statusActive   = "active"
+	statusLocked   = "locked"
+	statusDisabled = "disabled"
+)
+
+// disabledAccount records how a user was disabled, so that enabling it
+// undoes exactly that: its DN before being moved and the groups it was
+// removed from.
+type disabledAccount struct {
+	Directory  string    `json:"directory,omitempty"`
+	DN         string    `json:"dn"`
+	DisabledDN string    `json:"disabledDn"`
+	Strategies []string  `json:"strategies"`
+	Groups     []string  `json:"groups,omitempty"`
+	DisabledAt time.Time `json:"disabledAt"`
+	DisabledBy string    `json:"disabledBy,omitempty"`
+}
+
+type accountState struct {
+	DN     string `json:"dn"`
+	Status string `json:"status"`
+}
+
+func disabledKey(dir directory, dn string) string {
+	return dir.name + ":" + strings.ToLower(dn)
+}
+
+func saveDisabledAccount(dir directory, account disabledAccount) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx, disabledBucket, disabledKey(dir, account.DisabledDN), account)
+	})
+}
+
+// getDisabledAccount returns how the user at dn was disabled, errNotFound
+// when it wasn't through LDOups.
+func getDisabledAccount(dir directory, dn string) (disabledAccount, error) {
+	var account disabledAccount
+	db, err := openStore()
+	if err != nil {
+		return account, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx, disabledBucket, disabledKey(dir, dn), &account)
+	})
+	return account, err
+}
+
+func deleteDisabledAccount(dir directory, dn string) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(disabledBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(disabledKey(dir, dn)))
+	})
+}
+
+// disabledAccounts returns the keys of the users of dir disabled through
+// LDOups.
+func disabledAccounts(dir directory) (map[string]bool, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	disabled := make(map[string]bool)
+	prefix := []byte(disabledKey(dir, ""))
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(disabledBucket))
+		if b == nil {
+			return nil
+		}
+		cursor := b.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			disabled[string(k)] = true
+		}
+		return nil
+	})
+	return disabled, err
+}
+
+// statusAttributes are the attributes telling the status of an account.
+func statusAttributes(dir directory) []string {
+	names := []string{"pwdAccountLockedTime"}
+	if dir.Accounts.StatusAttribute != "" {
+		names = append(names, dir.Accounts.StatusAttribute)
+	}
+	if dir.Expiry.Attribute != "" {
+		names = append(names, dir.Expiry.Attribute)
+	}
+	return names
+}
+
+// statusSearchAttributes returns the attributes to search for users, so
+// that their status can be told along with the requested attributes.
+func statusSearchAttributes(dir directory, attr []string) []string {
+	if len(attr) == 0 {
+		attr = []string{"*"}
+	}
+	return append(append([]string{}, attr...), statusAttributes(dir)...)
+}
+
+func attributeValues(attributes map[string][]string, name string) []string {
+	for attr, values := range attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// accountStatus tells whether the user at dn is active, locked or disabled,
+// from its attributes and the accounts disabled through LDOups.
+func accountStatus(dir directory, dn string, attributes map[string][]string, disabled map[string]bool) string {
+	var lockedTime string
+	if values := attributeValues(attributes, "pwdAccountLockedTime"); len(values) > 0 {
+		lockedTime = values[0]
+	}
+	var status []string
+	if dir.Accounts.StatusAttribute != "" {
+		status = attributeValues(attributes, dir.Accounts.StatusAttribute)
+	}
+
+	switch {
+	case disabled[disabledKey(dir, dn)],
+		lockedTime == permanentLock,
+		containsFold(status, dir.Accounts.DisabledValue),
+		isUnder(dn, dir.Accounts.DisabledOU):
+		return statusDisabled
+	case lockedTime != "",
+		containsFold(status, dir.Accounts.LockedValue):
+		return statusLocked
+	}
+	return statusActive
+}
+
+// isUnder tells whether dn is below the parent DN.
+func isUnder(dn string, parent string) bool {
+	if parent == "" {
+		return false
+	}
+	d, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+	p, err := ldap.ParseDN(parent)
+	if err != nil {
+		return false
+	}
+	return p.AncestorOfFold(d)
+}
+
+// setStatuses sets the status and expiry date of the user entries, and
+// leaves out the status attributes which weren't requested.
+func setStatuses(l *ldapConn, entries []entry, attr []string) error {
+	disabled, err := disabledAccounts(l.dir)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].Status = accountStatus(l.dir, entries[i].DN, entries[i].Attributes, disabled)
+		entries[i].ExpiresAt = accountExpiry(l.dir, entries[i].Attributes)
+		for _, name := range statusAttributes(l.dir) {
+			// Status and expiry attributes are user attributes, returned when all are
+			if containsFold(attr, name) || (len(attr) == 0 && name != "pwdAccountLockedTime") {
+				continue
+			}
+			for a := range entries[i].Attributes {
+				if strings.EqualFold(a, name) {
+					delete(entries[i].Attributes, a)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// accountExpiry returns the expiry date of an account, if any.
+func accountExpiry(dir directory, attributes map[string][]string) *time.Time {
+	if dir.Expiry.Attribute == "" {
+		return nil
+	}
+	values := attributeValues(attributes, dir.Expiry.Attribute)
+	if len(values) == 0 {
+		return nil
+	}
+	if t, ok := parseExpiry(dir.Expiry.Format, values[0]); ok {
+		return &t
+	}
+	return nil
+}
+
+// setStatus sets the status and expiry date of the user entry.
+func setStatus(l *ldapConn, e *entry) error {
+	attributes, err := readAttributes(l, e.DN, statusAttributes(l.dir))
+	if err != nil {
+		return err
+	}
+	disabled, err := disabledAccounts(l.dir)
+	if err != nil {
+		return err
+	}
+	e.Status = accountStatus(l.dir, e.DN, attributes, disabled)
+	e.ExpiresAt = accountExpiry(l.dir, attributes)
+	return nil
+}
+
+// userStatus returns the status of the user at dn.
+func userStatus(l *ldapConn, dn string) (string, error) {
+	attributes, err := readAttributes(l, dn, statusAttributes(l.dir))
+	if err != nil {
+		return "", err
+	}
+	disabled, err := disabledAccounts(l.dir)
+	if err != nil {
+		return "", err
+	}
+	return accountStatus(l.dir, dn, attributes, disabled), nil
+}
+
+// splitDN returns the first RDN of dn and the DN of its parent.
+func splitDN(dn string) (string, string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", "", err
+	}
+	if len(parsed.RDNs) == 0 {
+		return "", "", errors.New("empty DN")
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		var attributes []string
+		for _, attr := range rdn.Attributes {
+			attributes = append(attributes, attr.Type+"="+escapeDN(attr.Value))
+		}
+		rdns[i] = strings.Join(attributes, "+")
+	}
+	return rdns[0], strings.Join(rdns[1:], ","), nil
+}
+
+// moveEntry moves the entry at dn below parent, and returns its new DN.
+func moveEntry(l *ldapConn, dn string, parent string) (string, error) {
+	rdn, _, err := splitDN(dn)
+	if err != nil {
+		return "", err
+	}
+	modDNReq := ldap.NewModifyDNRequest(dn, rdn, true, parent)
+	if err := l.ModifyDN(modDNReq); err != nil {
+		return "", err
+	}
+	// Audited with its previous DN
+	l.markChanged(rdn + "," + parent)
+	return rdn + "," + parent, nil
+}
+
+// changeMember adds or removes dn from the members of the group, recording
+// the change.
+func changeMember(l *ldapConn, groupDN string, dn string, add bool) error {
+	before, err := readAttributes(l, groupDN, []string{"member"})
+	if err != nil {
+		return err
+	}
+	modReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
+	action := "group.remove_member"
+	var after []string
+	if add {
+		modReq.Add("member", []string{dn})
+		action = "group.add_member"
+		after = append(append([]string{}, before["member"]...), dn)
+		err = syncMemberUid(l, modReq, groupDN, []string{dn}, nil)
+	} else {
+		modReq.Delete("member", []string{dn})
+		after = removeElement(before["member"], dn)
+		err = syncMemberUid(l, modReq, groupDN, nil, []string{dn})
+	}
+	if err != nil {
+		return err
+	}
+	err = l.Modify(modReq)
+	if ldap.IsErrorAnyOf(err, ldap.LDAPResultAttributeOrValueExists, ldap.LDAPResultNoSuchAttribute) {
+		// Already done
+		err = nil
+	} else {
+		l.recordAudit(action, groupDN, before, map[string][]string{"member": after}, err)
+	}
+	if err == nil && !add {
+		// Time-bound memberships end with the membership
+		err = forgetMembership(l.dir, groupDN, dn)
+	}
+	return err
+}
+
+func copyAttributes(attributes map[string][]string) map[string][]string {
+	copied := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		copied[name] = values
+	}
+	return copied
+}
+
+var (
+	errAlreadyDisabled = errors.New("account is already disabled")
+	errNotDisabled     = errors.New("account isn't disabled")
+	errNotActive       = errors.New("account isn't active")
+	errNotLocked       = errors.New("account isn't locked")
+	errDisabled        = errors.New("account is disabled, enable it instead")
+	// errNothingToDisable is returned when no strategy changes the entry,
+	// e.g. `groups` alone for a user member of none.
+	errNothingToDisable = errors.New("no disable strategy applies to the account")
+)
+
+// abortAccount reports err, with 409 when the account isn't in the expected
+// status.
+func abortAccount(c *gin.Context, err error) {
+	switch err {
+	case errAlreadyDisabled, errNotDisabled, errNotActive, errNotLocked, errDisabled, errNothingToDisable:
+		abort(c, err, http.StatusConflict)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// disableAccount disables the user at dn with the strategies of
+// `accounts.disable`, and returns its DN once disabled. How it was disabled
+// is saved once the directory accepted a first change, so that enableAccount
+// can undo it, even partly done. Groups are left first and the entry moved
+// last, once its attributes are set.
+func disableAccount(l *ldapConn, dn string) (string, error) {
+	strategies := l.dir.Accounts.Disable
+	status, err := userStatus(l, dn)
+	if err != nil {
+		return "", err
+	}
+	if status == statusDisabled {
+		return "", errAlreadyDisabled
+	}
+
+	account := disabledAccount{
+		Directory:  l.dir.auditName(),
+		DN:         dn,
+		DisabledDN: dn,
+		Strategies: strategies,
+		DisabledAt: time.Now().UTC(),
+		DisabledBy: l.actor,
+	}
+	if contains(strategies, "groups") {
+		if account.Groups, err = groupsOf(l, dn); err != nil {
+			return "", err
+		}
+	}
+	// Only saved after a change, the record alone disabling the account
+	saved := false
+	save := func() error {
+		if saved {
+			return nil
+		}
+		saved = true
+		return saveDisabledAccount(l.dir, account)
+	}
+
+	before, err := readAttributes(l, dn, statusAttributes(l.dir))
+	if err != nil {
+		return "", err
+	}
+	after := copyAttributes(before)
+
+	for _, groupDN := range account.Groups {
+		if err := changeMember(l, groupDN, dn, false); err != nil {
+			return "", err
+		}
+		if err := save(); err != nil {
+			return "", err
+		}
+	}
+
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	if contains(strategies, "ppolicy") {
+		modReq.Replace("pwdAccountLockedTime", []string{permanentLock})
+		after["pwdAccountLockedTime"] = []string{permanentLock}
+	}
+	attribute := l.dir.Accounts.StatusAttribute
+	if contains(strategies, "attribute") && !containsFold(before[attribute], l.dir.Accounts.DisabledValue) {
+		modReq.Add(attribute, []string{l.dir.Accounts.DisabledValue})
+		after[attribute] = append(append([]string{}, before[attribute]...), l.dir.Accounts.DisabledValue)
+	}
+	if len(modReq.Changes) > 0 {
+		if err := l.Modify(modReq); err != nil {
+			l.recordAudit("user.disable", dn, before, after, err)
+			return "", err
+		}
+		if err := save(); err != nil {
+			return "", err
+		}
+	}
+
+	if contains(strategies, "ou") && !isUnder(dn, l.dir.Accounts.DisabledOU) {
+		newDN, err := moveEntry(l, dn, l.dir.Accounts.DisabledOU)
+		if err != nil {
+			l.recordAudit("user.disable", dn, before, after, err)
+			return "", err
+		}
+		before["dn"] = []string{dn}
+		after["dn"] = []string{newDN}
+		account.DisabledDN = newDN
+		if saved {
+			if err := deleteDisabledAccount(l.dir, dn); err != nil {
+				return "", err
+			}
+			saved = false
+		}
+		if err := save(); err != nil {
+			return "", err
+		}
+	}
+
+	if !saved {
+		return "", errNothingToDisable
+	}
+	l.recordAudit("user.disable", dn, before, after, nil)
+	return account.DisabledDN, nil
+}
+
+// enableAccount undoes what disableAccount did, and returns the DN of the
+// user once enabled. Users disabled outside of LDOups are enabled with the
+// `ppolicy` and `attribute` strategies.
+func enableAccount(l *ldapConn, dn string) (string, error) {
+	status, err := userStatus(l, dn)
+	if err != nil {
+		return "", err
+	}
+	if status != statusDisabled {
+		return "", errNotDisabled
+	}
+	account, err := getDisabledAccount(l.dir, dn)
+	if errors.Is(err, errNotFound) {
+		account = disabledAccount{DN: dn, DisabledDN: dn, Strategies: []string{"ppolicy", "attribute"}}
+	} else if err != nil {
+		return "", err
+	}
+
+	before, err := readAttributes(l, dn, statusAttributes(l.dir))
+	if err != nil {
+		return "", err
+	}
+	after := copyAttributes(before)
+
+	enabledDN := dn
+	if contains(account.Strategies, "ou") && !strings.EqualFold(account.DN, dn) {
+		_, parent, err := splitDN(account.DN)
+		if err == nil {
+			enabledDN, err = moveEntry(l, dn, parent)
+		}
+		if err != nil {
+			l.recordAudit("user.enable", dn, before, after, err)
+			return "", err
+		}
+		before["dn"] = []string{dn}
+		after["dn"] = []string{enabledDN}
+	}
+
+	modReq := ldap.NewModifyRequest(enabledDN, []ldap.Control{})
+	if contains(account.Strategies, "ppolicy") && len(attributeValues(before, "pwdAccountLockedTime")) > 0 {
+		modReq.Delete("pwdAccountLockedTime", []string{})
+		delete(after, "pwdAccountLockedTime")
+	}
+	attribute := l.dir.Accounts.StatusAttribute
+	if contains(account.Strategies, "attribute") && containsFold(before[attribute], l.dir.Accounts.DisabledValue) {
+		modReq.Delete(attribute, []string{l.dir.Accounts.DisabledValue})
+		after[attribute] = removeElement(before[attribute], l.dir.Accounts.DisabledValue)
+	}
+	if len(modReq.Changes) > 0 {
+		if err := l.Modify(modReq); err != nil {
+			l.recordAudit("user.enable", dn, before, after, err)
+			return "", err
+		}
+	}
+
+	for _, groupDN := range account.Groups {
+		if err := changeMember(l, groupDN, enabledDN, true); err != nil {
+			// Groups deleted meanwhile are skipped
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				l.logger.Warn().Str("group", groupDN).Msg("group of the disabled account no longer exists")
+				continue
+			}
+			return "", err
+		}
+	}
+
+	if err := deleteDisabledAccount(l.dir, dn); err != nil {
+		return "", err
+	}
+	l.recordAudit("user.enable", dn, before, after, nil)
+	return enabledDN, nil
+}
+
+// lockAccount locks the user at dn with the strategies of `accounts.lock`.
+// With `ppolicy`, the lock lasts `pwdLockoutDuration` of the password
+// policy.
+func lockAccount(l *ldapConn, dn string) error {
+	status, err := userStatus(l, dn)
+	if err != nil {
+		return err
+	}
+	if status != statusActive {
+		return errNotActive
+	}
+
+	before, err := readAttributes(l, dn, statusAttributes(l.dir))
+	if err != nil {
+		return err
+	}
+	after := copyAttributes(before)
+
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	if contains(l.dir.Accounts.Lock, "ppolicy") {
+		now := time.Now().UTC().Format("20060102150405Z")
+		modReq.Replace("pwdAccountLockedTime", []string{now})
+		after["pwdAccountLockedTime"] = []string{now}
+	}
+	attribute := l.dir.Accounts.StatusAttribute
+	if contains(l.dir.Accounts.Lock, "attribute") && !containsFold(before[attribute], l.dir.Accounts.LockedValue) {
+		modReq.Add(attribute, []string{l.dir.Accounts.LockedValue})
+		after[attribute] = append(append([]string{}, before[attribute]...), l.dir.Accounts.LockedValue)
+	}
+
+	err = l.Modify(modReq)
+	l.recordAudit("user.lock", dn, before, after, err)
+	return err
+}
+
+// unlockAccount lifts the lock of the user at dn, along with its recorded
+// password failures. Disabled users must be enabled instead.
+func unlockAccount(l *ldapConn, dn string) error {
+	status, err := userStatus(l, dn)
+	if err != nil {
+		return err
+	}
+	if status == statusDisabled {
+		return errDisabled
+	}
+	if status != statusLocked {
+		return errNotLocked
+	}
+
+	names := append(statusAttributes(l.dir), "pwdFailureTime")
+	before, err := readAttributes(l, dn, names)
+	if err != nil {
+		return err
+	}
+	after := copyAttributes(before)
+
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	for _, name := range []string{"pwdAccountLockedTime", "pwdFailureTime"} {
+		if len(attributeValues(before, name)) > 0 {
+			modReq.Delete(name, []string{})
+			delete(after, name)
+		}
+	}
+	attribute := l.dir.Accounts.StatusAttribute
+	if containsFold(before[attribute], l.dir.Accounts.LockedValue) {
+		modReq.Delete(attribute, []string{l.dir.Accounts.LockedValue})
+		after[attribute] = removeElement(before[attribute], l.dir.Accounts.LockedValue)
+	}
+
+	err = l.Modify(modReq)
+	l.recordAudit("user.unlock", dn, before, after, err)
+	return err
+}
+
+func DisableUser(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	dn, err := disableAccount(ldp, c.Param("id"))
+	if err != nil {
+		abortAccount(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accountState{DN: dn, Status: statusDisabled})
+}
+
+func EnableUser(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	dn, err := enableAccount(ldp, c.Param("id"))
+	if err != nil {
+		abortAccount(c, err)
+		return
+	}
+	// The user may still be locked
+	status, err := userStatus(ldp, dn)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, accountState{DN: dn, Status: status})
+}
+
+func LockUser(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	id := c.Param("id")
+	if err := lockAccount(ldp, id); err != nil {
+		abortAccount(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accountState{DN: id, Status: statusLocked})
+}
+
+func UnlockUser(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	id := c.Param("id")
+	if err := unlockAccount(ldp, id); err != nil {
+		abortAccount(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accountState{DN: id, Status: statusActive})
+}
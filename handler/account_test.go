@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestAccountStatus(t *testing.T) {
+	dir := directory{name: config.DefaultDirectory, Directory: &config.Directory{
+		Accounts: config.Accounts{
+			DisabledOU:      "ou=disabled,dc=example,dc=org",
+			StatusAttribute: "employeeType",
+			DisabledValue:   "disabled",
+			LockedValue:     "locked",
+		},
+	}}
+	jdoe := "cn=jdoe,ou=users,dc=example,dc=org"
+
+	tests := []struct {
+		name       string
+		dn         string
+		attributes map[string][]string
+		disabled   map[string]bool
+		want       string
+	}{
+		{"active", jdoe, map[string][]string{"employeeType": {"staff"}}, nil, statusActive},
+		{"disabled through LDOups", jdoe, nil, map[string]bool{disabledKey(dir, "CN=JDoe,ou=users,dc=example,dc=org"): true}, statusDisabled},
+		{"disabled in another directory", jdoe, nil, map[string]bool{"lab:" + jdoe: true}, statusActive},
+		{"permanent lock", jdoe, map[string][]string{"pwdAccountLockedTime": {permanentLock}}, nil, statusDisabled},
+		{"disabled value", jdoe, map[string][]string{"EmployeeType": {"staff", "Disabled"}}, nil, statusDisabled},
+		{"disabled OU", "cn=jdoe,ou=Disabled,dc=example,dc=org", nil, nil, statusDisabled},
+		{"lockout", jdoe, map[string][]string{"pwdAccountLockedTime": {"20230131120000Z"}}, nil, statusLocked},
+		{"locked value", jdoe, map[string][]string{"employeeType": {"locked"}}, nil, statusLocked},
+		{"disabled and locked", jdoe, map[string][]string{"pwdAccountLockedTime": {"20230131120000Z"}, "employeeType": {"disabled"}}, nil, statusDisabled},
+	}
+	for _, tt := range tests {
+		if got := accountStatus(dir, tt.dn, tt.attributes, tt.disabled); got != tt.want {
+			t.Errorf("%s: accountStatus() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+const (
+	testUser     = "cn=jdoe,ou=users,dc=example,dc=org"
+	testGroup    = "cn=devs,ou=groups,dc=example,dc=org"
+	testOtherDN  = "cn=jane,ou=users,dc=example,dc=org"
+	testDisabled = "ou=disabled,dc=example,dc=org"
+)
+
+// newAccountDirectory returns a fake directory with a user member of a
+// group, and the directory configuration disabling it with strategies.
+func newAccountDirectory(t *testing.T, strategies ...string) (*fakeDirectory, directory) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org":                  {"objectClass": {"domain"}},
+		"ou=users,dc=example,dc=org":         {"objectClass": {"organizationalUnit"}},
+		"ou=groups,dc=example,dc=org":        {"objectClass": {"organizationalUnit"}},
+		testDisabled:                         {"objectClass": {"organizationalUnit"}},
+		testUser:                             {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "employeeType": {"staff"}},
+		testOtherDN:                          {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}},
+		testGroup:                            {"objectClass": {"groupOfNames"}, "cn": {"devs"}, "member": {testUser, testOtherDN}},
+		"cn=ops,ou=groups,dc=example,dc=org": {"objectClass": {"groupOfNames"}, "cn": {"ops"}, "member": {testOtherDN}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		Accounts: config.Accounts{
+			Disable:         strategies,
+			DisabledOU:      testDisabled,
+			StatusAttribute: "employeeType",
+			DisabledValue:   "disabled",
+			LockedValue:     "locked",
+		},
+	}
+	useTestConfig(t, c)
+	return d, defaultDirectory()
+}
+
+func TestDisableAccount(t *testing.T) {
+	d, dir := newAccountDirectory(t, "ppolicy", "groups", "ou", "attribute")
+	l := d.dial(t, dir)
+
+	disabledDN, err := disableAccount(l, testUser)
+	if err != nil {
+		t.Fatalf("disableAccount(): %v", err)
+	}
+	if want := "cn=jdoe," + testDisabled; disabledDN != want {
+		t.Errorf("disableAccount() = %s, want %s", disabledDN, want)
+	}
+	if got := d.get(disabledDN, "pwdAccountLockedTime"); !reflect.DeepEqual(got, []string{permanentLock}) {
+		t.Errorf("pwdAccountLockedTime = %q, want %s", got, permanentLock)
+	}
+	if got := d.get(disabledDN, "employeeType"); !reflect.DeepEqual(got, []string{"staff", "disabled"}) {
+		t.Errorf("employeeType = %q, want staff and disabled", got)
+	}
+	if got := d.get(testGroup, "member"); !reflect.DeepEqual(got, []string{testOtherDN}) {
+		t.Errorf("members of the group = %q, want only %s", got, testOtherDN)
+	}
+	account, err := getDisabledAccount(dir, disabledDN)
+	if err != nil {
+		t.Fatalf("getDisabledAccount(): %v", err)
+	}
+	if account.DN != testUser || !reflect.DeepEqual(account.Groups, []string{testGroup}) {
+		t.Errorf("disabled account = %+v, want %s member of %s", account, testUser, testGroup)
+	}
+	if _, err := getDisabledAccount(dir, testUser); !errors.Is(err, errNotFound) {
+		t.Errorf("the account is still recorded at its previous DN: %v", err)
+	}
+	if _, err := disableAccount(l, disabledDN); err != errAlreadyDisabled {
+		t.Errorf("disabling again = %v, want errAlreadyDisabled", err)
+	}
+
+	enabledDN, err := enableAccount(l, disabledDN)
+	if err != nil {
+		t.Fatalf("enableAccount(): %v", err)
+	}
+	if enabledDN != testUser {
+		t.Errorf("enableAccount() = %s, want %s", enabledDN, testUser)
+	}
+	if got := d.get(testUser, "pwdAccountLockedTime"); got != nil {
+		t.Errorf("pwdAccountLockedTime = %q, want none", got)
+	}
+	if got := d.get(testUser, "employeeType"); !reflect.DeepEqual(got, []string{"staff"}) {
+		t.Errorf("employeeType = %q, want staff", got)
+	}
+	if got := d.get(testGroup, "member"); !containsFold(got, testUser) {
+		t.Errorf("members of the group = %q, want %s back", got, testUser)
+	}
+	if _, err := getDisabledAccount(dir, disabledDN); !errors.Is(err, errNotFound) {
+		t.Errorf("the disabled account is still recorded: %v", err)
+	}
+	if status, err := userStatus(l, testUser); err != nil || status != statusActive {
+		t.Errorf("userStatus() = %s, %v, want active", status, err)
+	}
+	if _, err := enableAccount(l, testUser); err != errNotDisabled {
+		t.Errorf("enabling again = %v, want errNotDisabled", err)
+	}
+}
+
+// TestDisableAccountRefused checks that users without the rights to change
+// the entry can't disable it by the record alone.
+func TestDisableAccountRefused(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategies []string
+		operation  string
+		dn         string
+	}{
+		{"ppolicy", []string{"ppolicy"}, "modify", testUser},
+		{"groups", []string{"groups", "ppolicy"}, "modify", testGroup},
+		{"ou", []string{"ou"}, "modify_dn", testUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, dir := newAccountDirectory(t, tt.strategies...)
+			d.failOn(tt.operation, tt.dn, ldap.LDAPResultInsufficientAccessRights)
+			l := d.dial(t, dir)
+
+			if _, err := disableAccount(l, testUser); !ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) {
+				t.Errorf("disableAccount() = %v, want insufficient access rights", err)
+			}
+			if _, err := getDisabledAccount(dir, testUser); !errors.Is(err, errNotFound) {
+				t.Errorf("the account is recorded as disabled: %v", err)
+			}
+			if status, err := userStatus(l, testUser); err != nil || status != statusActive {
+				t.Errorf("userStatus() = %s, %v, want active", status, err)
+			}
+		})
+	}
+}
+
+// TestDisableAccountPartly checks that an account partly disabled is
+// recorded, so that it can be enabled back.
+func TestDisableAccountPartly(t *testing.T) {
+	d, dir := newAccountDirectory(t, "groups", "ppolicy")
+	d.failOn("modify", testUser, ldap.LDAPResultUnwillingToPerform)
+	l := d.dial(t, dir)
+
+	if _, err := disableAccount(l, testUser); err == nil {
+		t.Fatal("disableAccount() didn't fail")
+	}
+	account, err := getDisabledAccount(dir, testUser)
+	if err != nil {
+		t.Fatalf("getDisabledAccount(): %v", err)
+	}
+	if !reflect.DeepEqual(account.Groups, []string{testGroup}) {
+		t.Errorf("recorded groups = %q, want %s", account.Groups, testGroup)
+	}
+
+	if _, err := enableAccount(l, testUser); err != nil {
+		t.Fatalf("enableAccount(): %v", err)
+	}
+	if got := d.get(testGroup, "member"); !containsFold(got, testUser) {
+		t.Errorf("members of the group = %q, want %s back", got, testUser)
+	}
+}
+
+func TestDisableAccountNothingToDo(t *testing.T) {
+	d, dir := newAccountDirectory(t, "groups")
+	l := d.dial(t, dir)
+
+	if _, err := disableAccount(l, testUser); err != nil {
+		t.Fatalf("disableAccount() of a group member: %v", err)
+	}
+	lonely := "cn=lonely,ou=users,dc=example,dc=org"
+	d.Lock()
+	d.put(lonely, map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {"lonely"}})
+	d.Unlock()
+	if _, err := disableAccount(l, lonely); err != errNothingToDisable {
+		t.Errorf("disableAccount() of a user member of no group = %v, want errNothingToDisable", err)
+	}
+	if status, err := userStatus(l, lonely); err != nil || status != statusActive {
+		t.Errorf("userStatus() = %s, %v, want active", status, err)
+	}
+}
+
+// TestEnableAccountDisabledOutside checks that users disabled outside of
+// LDOups are enabled with the ppolicy and attribute strategies.
+func TestEnableAccountDisabledOutside(t *testing.T) {
+	d, dir := newAccountDirectory(t, "ppolicy")
+	d.Lock()
+	d.put(testUser, map[string][]string{
+		"objectClass":          {"inetOrgPerson"},
+		"cn":                   {"jdoe"},
+		"pwdAccountLockedTime": {permanentLock},
+		"employeeType":         {"staff", "disabled"},
+	})
+	d.Unlock()
+	l := d.dial(t, dir)
+
+	if _, err := enableAccount(l, testUser); err != nil {
+		t.Fatalf("enableAccount(): %v", err)
+	}
+	if got := d.get(testUser, "pwdAccountLockedTime"); got != nil {
+		t.Errorf("pwdAccountLockedTime = %q, want none", got)
+	}
+	if got := d.get(testUser, "employeeType"); !reflect.DeepEqual(got, []string{"staff"}) {
+		t.Errorf("employeeType = %q, want staff", got)
+	}
+}
@@ -0,0 +1,665 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	apiKeysBucket = "api_keys"
+	// apiKeyPrefix starts API keys, so that they can be told apart and
+	// caught by secret scanners
+	apiKeyPrefix = "ldoups_"
+)
+
+// apiKeyResources are the resources API keys are scoped to, as
+// `<resource>:read` or `<resource>:write`. `*` grants them all.
+var apiKeyResources = []string{"users", "groups", "dynamic-groups", "sudo-rules", "access-requests", "audit", "events", "jobs", "webhooks", "apply", "snapshot", "scim"}
+
+// apiKey is an API key of a service account. Only the SHA-256 hash of its
+// secret is kept.
+type apiKey struct {
+	ID         string     `json:"id"`
+	Directory  string     `json:"directory,omitempty"`
+	Account    string     `json:"account"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreatedBy  string     `json:"createdBy,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RotatedAt  *time.Time `json:"rotatedAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	// Token is only returned once, when the key is issued or rotated
+	Token string `json:"token,omitempty"`
+}
+
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type serviceAccount struct {
+	Name        string `json:"name"`
+	DN          string `json:"dn,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+var (
+	errInvalidAPIKey        = errors.New("invalid api key")
+	errNotAccountsAdmin     = errors.New("only service accounts admins can manage service accounts")
+	errNoSuchAPIKey         = errors.New("no such api key")
+	errNoSuchServiceAccount = errors.New("no such service account")
+)
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret sets a new secret to the key, and returns its token.
+func (k *apiKey) newSecret() error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := hex.EncodeToString(b)
+	k.Hash = hashSecret(secret)
+	k.Token = apiKeyPrefix + k.ID + "_" + secret
+	return nil
+}
+
+// allows tells whether the key scopes grant the route, reads being granted
+// by `read` and `write` scopes. Service accounts can't be managed with keys.
+func (k apiKey) allows(method string, route string) bool {
+	if route == "/api/login" {
+		return true
+	}
+	resource := ""
+	if strings.HasPrefix(route, "/scim/") {
+		resource = "scim"
+	} else if _, segment := splitPrefix(route); segment != "" {
+		resource = segment
+	}
+	if !contains(apiKeyResources, resource) {
+		return false
+	}
+	for _, scope := range k.Scopes {
+		if scope == "*" || scope == resource+":write" || (scope == resource+":read" && method == http.MethodGet) {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	resource := strings.TrimSuffix(strings.TrimSuffix(scope, ":read"), ":write")
+	return resource != scope && contains(apiKeyResources, resource)
+}
+
+func getAPIKey(tx *bolt.Tx, id string) (apiKey, error) {
+	var key apiKey
+	err := getJSON(tx, apiKeysBucket, id, &key)
+	if err == errNotFound {
+		return key, fmt.Errorf("%w: %s", errNoSuchAPIKey, id)
+	}
+	return key, err
+}
+
+// checkAPIKey returns the key of token, when it is valid for dir.
+func checkAPIKey(dir directory, token string) (apiKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if !strings.HasPrefix(token, apiKeyPrefix) || len(parts) != 2 {
+		return apiKey{}, errInvalidAPIKey
+	}
+	db, err := openStore()
+	if err != nil {
+		return apiKey{}, err
+	}
+	var key apiKey
+	err = db.View(func(tx *bolt.Tx) error {
+		key, err = getAPIKey(tx, parts[0])
+		return err
+	})
+	if errors.Is(err, errNoSuchAPIKey) {
+		return apiKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return apiKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(key.Hash)) != 1 {
+		return apiKey{}, errInvalidAPIKey
+	}
+	switch {
+	case key.RevokedAt != nil:
+		return apiKey{}, fmt.Errorf("%w: revoked", errInvalidAPIKey)
+	case key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt):
+		return apiKey{}, fmt.Errorf("%w: expired", errInvalidAPIKey)
+	case key.Directory != dir.name:
+		return apiKey{}, fmt.Errorf("%w: issued for another directory", errInvalidAPIKey)
+	}
+	return key, nil
+}
+
+// touchAPIKey records the key use, at most once a minute.
+func touchAPIKey(key apiKey) error {
+	if key.LastUsedAt != nil && time.Since(*key.LastUsedAt) < time.Minute {
+		return nil
+	}
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		key, err := getAPIKey(tx, key.ID)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		key.LastUsedAt = &now
+		return putJSON(tx, apiKeysBucket, key.ID, key)
+	})
+}
+
+// APIKeyLogin authenticates requests bearing the API key of a service
+// account. They are done with the read-write account, within the scopes
+// of the key.
+func APIKeyLogin(l *ldapConn, c *gin.Context) bool {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	key, err := checkAPIKey(l.dir, token)
+	if err != nil && !errors.Is(err, errInvalidAPIKey) {
+		abort(c, err, http.StatusInternalServerError)
+		return false
+	}
+	if err != nil {
+		// Why the key is refused is only logged
+		requestLogger(c).Info().Err(err).Msg("api key refused")
+		loginFailures.WithLabelValues("invalid_api_key").Inc()
+		c.Header("WWW-Authenticate", `Bearer realm="Restricted"`)
+		abort(c, errInvalidAPIKey, http.StatusUnauthorized)
+		return false
+	}
+	if !key.allows(c.Request.Method, c.FullPath()) {
+		loginFailures.WithLabelValues("insufficient_scope").Inc()
+		abort(c, fmt.Errorf("api key scopes %s don't grant %s %s", strings.Join(key.Scopes, ", "), c.Request.Method, c.FullPath()), http.StatusForbidden)
+		return false
+	}
+
+	if l.dir.RW.Username == "" {
+		abort(c, errors.New("api keys need ldap.rw to be set"), http.StatusServiceUnavailable)
+		return false
+	}
+	if err := l.Bind(l.dir.RW.Username, l.dir.RW.Password); err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return false
+	}
+	// Keys of deleted service accounts are void
+	if _, err := readAttributes(l, key.Account, []string{"1.1"}); err != nil {
+		loginFailures.WithLabelValues("invalid_api_key").Inc()
+		c.Header("WWW-Authenticate", `Bearer realm="Restricted"`)
+		abort(c, fmt.Errorf("%w: no service account %s", errInvalidAPIKey, key.Account), http.StatusUnauthorized)
+		return false
+	}
+
+	setActor(c, key.Account)
+	l.logger = requestLogger(c)
+	l.actor = key.Account
+	if err := touchAPIKey(key); err != nil {
+		l.logger.Warn().Err(err).Str("key", key.ID).Msg("can't record api key use")
+	}
+	c.Header("Access-Control-Allow-Origin", "*")
+	if c.FullPath() == "/api/login" {
+		var profile profile
+		profile.Username = key.Account
+		c.JSON(http.StatusOK, profile)
+	}
+	return true
+}
+
+// isMemberOfAny tells whether dn is a member of one of the groups.
+func isMemberOfAny(l *ldapConn, dn string, groups []string) (bool, error) {
+	memberOf, err := groupsOf(l, dn)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range memberOf {
+		if containsFold(groups, group) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkAccountsAdmin aborts with 403 and returns false unless the logged in
+// user is a service accounts admin.
+func checkAccountsAdmin(c *gin.Context, l *ldapConn) bool {
+	admins := l.dir.ServiceAccounts.Admins
+	ok := false
+	if len(admins) > 0 {
+		var err error
+		if ok, err = isMemberOfAny(l, l.actor, admins); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return false
+		}
+	}
+	if !ok {
+		abort(c, errNotAccountsAdmin, http.StatusForbidden)
+	}
+	return ok
+}
+
+func serviceAccountDN(l *ldapConn, name string) string {
+	return "uid=" + escapeDN(name) + "," + l.dir.ServiceAccounts.OU
+}
+
+func abortAPIKeys(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoSuchAPIKey), errors.Is(err, errNoSuchServiceAccount), ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		abort(c, err, http.StatusNotFound)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists):
+		abort(c, err, http.StatusConflict)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// accountKeys returns the keys of the service account at dn, most recent
+// first.
+func accountKeys(dir directory, dn string) ([]apiKey, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	keys := []apiKey{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeysBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var key apiKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			if key.Directory == dir.name && strings.EqualFold(key.Account, dn) {
+				key.Hash = ""
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, err
+}
+
+// updateAPIKey applies update to the key id of the service account at dn.
+func updateAPIKey(dir directory, dn string, id string, update func(key *apiKey) error) (apiKey, error) {
+	db, err := openStore()
+	if err != nil {
+		return apiKey{}, err
+	}
+	var key apiKey
+	err = db.Update(func(tx *bolt.Tx) error {
+		key, err = getAPIKey(tx, id)
+		if err != nil {
+			return err
+		}
+		if key.Directory != dir.name || !strings.EqualFold(key.Account, dn) {
+			return fmt.Errorf("%w: %s", errNoSuchAPIKey, id)
+		}
+		if err := update(&key); err != nil {
+			return err
+		}
+		token := key.Token
+		key.Token = ""
+		if err := putJSON(tx, apiKeysBucket, key.ID, key); err != nil {
+			return err
+		}
+		key.Token = token
+		return nil
+	})
+	key.Hash = ""
+	return key, err
+}
+
+// getServiceAccount returns the DN of the named service account.
+func getServiceAccount(l *ldapConn, name string) (string, error) {
+	dn := serviceAccountDN(l, name)
+	if _, err := readAttributes(l, dn, []string{"1.1"}); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", fmt.Errorf("%w: %s", errNoSuchServiceAccount, name)
+		}
+		return "", err
+	}
+	return dn, nil
+}
+
+func GetServiceAccounts(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	searchReq := ldap.NewSearchRequest(ldp.dir.ServiceAccounts.OU, ldap.ScopeSingleLevel, 0, 0, 0, false, "(objectClass=account)", []string{"uid", "description"}, []ldap.Control{})
+	result, err := ldp.Search(searchReq)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		abortAPIKeys(c, err)
+		return
+	}
+	accounts := []serviceAccount{}
+	if result != nil {
+		for _, ent := range result.Entries {
+			accounts = append(accounts, serviceAccount{Name: ent.GetAttributeValue("uid"), DN: ent.DN, Description: ent.GetAttributeValue("description")})
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+	entriesReturned.WithLabelValues("service_accounts").Observe(float64(len(accounts)))
+	c.JSON(http.StatusOK, accounts)
+}
+
+// AddServiceAccount creates a service account, an `account` entry which
+// can't log in with a password.
+func AddServiceAccount(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	var account serviceAccount
+	if err := c.BindJSON(&account); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	if account.Name == "" {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"name": "missing attribute"})
+		return
+	}
+
+	account.DN = serviceAccountDN(ldp, account.Name)
+	added := map[string][]string{"objectClass": {"top", "account"}, "uid": {account.Name}}
+	if account.Description != "" {
+		added["description"] = []string{account.Description}
+	}
+	addReq := ldap.NewAddRequest(account.DN, []ldap.Control{})
+	for attr, values := range added {
+		addReq.Attribute(attr, values)
+	}
+
+	err := ldp.Add(addReq)
+	ldp.recordAudit("service_account.create", account.DN, nil, added, err)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, account)
+}
+
+// DeleteServiceAccount deletes a service account, and revokes its keys.
+func DeleteServiceAccount(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	dn, err := getServiceAccount(ldp, c.Param("name"))
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	err = ldp.Del(ldap.NewDelRequest(dn, []ldap.Control{}))
+	ldp.recordAudit("service_account.delete", dn, map[string][]string{"uid": {c.Param("name")}}, nil, err)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+
+	keys, err := accountKeys(ldp.dir, dn)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	for _, key := range keys {
+		if key.RevokedAt != nil {
+			continue
+		}
+		if _, err := updateAPIKey(ldp.dir, dn, key.ID, revokeAPIKey); err != nil {
+			abortAPIKeys(c, err)
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func GetAPIKeys(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	dn, err := getServiceAccount(ldp, c.Param("name"))
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	keys, err := accountKeys(ldp.dir, dn)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// AddAPIKey issues an API key to a service account. Its token is only
+// returned in the response.
+func AddAPIKey(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	var req apiKeyRequest
+	if err := c.BindJSON(&req); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	errs := make(map[string]string)
+	if req.Name == "" {
+		errs["name"] = "missing attribute"
+	}
+	if len(req.Scopes) == 0 {
+		errs["scopes"] = "missing attribute"
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			errs["scopes"] = fmt.Sprintf("%q must be * or <resource>:read or <resource>:write, resources being %s", scope, strings.Join(apiKeyResources, ", "))
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errs["expiresAt"] = "already expired"
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	dn, err := getServiceAccount(ldp, c.Param("name"))
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	key := apiKey{
+		ID:        newID(),
+		Directory: ldp.dir.name,
+		Account:   dn,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: ldp.actor,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := key.newSecret(); err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	db, err := openStore()
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			stored := key
+			stored.Token = ""
+			return putJSON(tx, apiKeysBucket, key.ID, stored)
+		})
+	}
+	ldp.recordAudit("api_key.create", dn, nil, map[string][]string{"apiKey": {key.ID}, "scopes": key.Scopes}, err)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	key.Hash = ""
+	c.JSON(http.StatusCreated, key)
+}
+
+// RotateAPIKey gives a new secret to an API key, the former one being
+// refused from then on.
+func RotateAPIKey(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	dn, err := getServiceAccount(ldp, c.Param("name"))
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	key, err := updateAPIKey(ldp.dir, dn, c.Param("key"), func(key *apiKey) error {
+		if key.RevokedAt != nil {
+			return fmt.Errorf("%w: %s is revoked", errNoSuchAPIKey, key.ID)
+		}
+		now := time.Now().UTC()
+		key.RotatedAt = &now
+		return key.newSecret()
+	})
+	ldp.recordAudit("api_key.rotate", dn, nil, map[string][]string{"apiKey": {c.Param("key")}}, err)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+func revokeAPIKey(key *apiKey) error {
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+	}
+	return nil
+}
+
+// RevokeAPIKey revokes an API key, which is kept for the record.
+func RevokeAPIKey(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAccountsAdmin(c, ldp) {
+		return
+	}
+
+	dn, err := getServiceAccount(ldp, c.Param("name"))
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	_, err = updateAPIKey(ldp.dir, dn, c.Param("key"), revokeAPIKey)
+	ldp.recordAudit("api_key.revoke", dn, map[string][]string{"apiKey": {c.Param("key")}}, nil, err)
+	if err != nil {
+		abortAPIKeys(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
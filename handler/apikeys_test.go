@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAPIKeyAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		route  string
+		want   bool
+	}{
+		{[]string{"users:read"}, http.MethodGet, "/api/users/:id", true},
+		{[]string{"users:read"}, http.MethodPut, "/api/users/:id", false},
+		{[]string{"users:write"}, http.MethodPut, "/api/users/:id", true},
+		{[]string{"users:write"}, http.MethodGet, "/api/users", true},
+		{[]string{"users:write"}, http.MethodGet, "/api/groups", false},
+		{[]string{"groups:read", "users:write"}, http.MethodDelete, "/api/users/:id", true},
+		{[]string{"dynamic-groups:read"}, http.MethodGet, "/api/dynamic-groups", true},
+		{[]string{"scim:write"}, http.MethodPost, "/scim/v2/Users", true},
+		{[]string{"users:write"}, http.MethodPost, "/scim/v2/Users", false},
+		{[]string{"*"}, http.MethodPost, "/api/apply", true},
+		{nil, http.MethodGet, "/api/login", true},
+		// Service accounts can't be managed with keys, whatever their scopes
+		{[]string{"*"}, http.MethodPost, "/api/service-accounts/:name/keys", false},
+		{[]string{"*"}, http.MethodGet, "/readyz", false},
+	}
+	for _, tt := range tests {
+		key := apiKey{Scopes: tt.scopes}
+		if got := key.allows(tt.method, tt.route); got != tt.want {
+			t.Errorf("%q allows(%s %s) = %v, want %v", tt.scopes, tt.method, tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	tests := map[string]bool{
+		"*":                     true,
+		"users:read":            true,
+		"sudo-rules:write":      true,
+		"scim:read":             true,
+		"users":                 false,
+		"users:admin":           false,
+		"service-accounts:read": false,
+		":read":                 false,
+		"*:read":                false,
+	}
+	for scope, want := range tests {
+		if got := validScope(scope); got != want {
+			t.Errorf("validScope(%s) = %v, want %v", scope, got, want)
+		}
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	useTestConfig(t, &config.Config{})
+	db, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	issue := func(id string, directory string, expiresAt *time.Time, revokedAt *time.Time) string {
+		key := apiKey{ID: id, Directory: directory, Account: "uid=ci,ou=services,dc=example,dc=org", Scopes: []string{"users:read"}, ExpiresAt: expiresAt, RevokedAt: revokedAt}
+		if err := key.newSecret(); err != nil {
+			t.Fatal(err)
+		}
+		token := key.Token
+		key.Token = ""
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return putJSON(tx, apiKeysBucket, key.ID, key)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := issue("valid", config.DefaultDirectory, &future, nil)
+	expired := issue("expired", config.DefaultDirectory, &past, nil)
+	revoked := issue("revoked", config.DefaultDirectory, nil, &past)
+	lab := issue("lab", "lab", nil, nil)
+	dir := directory{name: config.DefaultDirectory, Directory: &config.Directory{}}
+
+	key, err := checkAPIKey(dir, valid)
+	if err != nil {
+		t.Fatalf("checkAPIKey(): %v", err)
+	}
+	if key.ID != "valid" || key.Token != "" {
+		t.Errorf("checkAPIKey() = %+v, want the valid key, without token", key)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"wrong secret", apiKeyPrefix + "valid_" + strings.Repeat("0", 64), "invalid api key"},
+		{"unknown key", strings.Replace(valid, "_valid_", "_other_", 1), "invalid api key"},
+		{"no prefix", strings.TrimPrefix(valid, apiKeyPrefix), "invalid api key"},
+		{"no secret", apiKeyPrefix + "valid", "invalid api key"},
+		{"expired", expired, "invalid api key: expired"},
+		{"revoked", revoked, "invalid api key: revoked"},
+		{"other directory", lab, "invalid api key: issued for another directory"},
+	}
+	for _, tt := range tests {
+		_, err := checkAPIKey(dir, tt.token)
+		if !errors.Is(err, errInvalidAPIKey) || err.Error() != tt.want {
+			t.Errorf("%s: checkAPIKey() = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// applyTagPrefix starts the tag values of the entries managed by
+// declarative documents, followed by the document owner.
+const applyTagPrefix = "ldoups:"
+
+// applyDocument is the desired state of some users and groups. Only the
+// attributes it lists are managed, the others are left as they are.
+type applyDocument struct {
+	Owner  string       `json:"owner" yaml:"owner"`
+	Users  []applyEntry `json:"users" yaml:"users"`
+	Groups []applyEntry `json:"groups" yaml:"groups"`
+}
+
+type applyEntry struct {
+	DN         string              `json:"dn" yaml:"dn"`
+	Attributes map[string][]string `json:"attributes" yaml:"attributes"`
+	// Members are the `member` values of groups
+	Members []string `json:"members" yaml:"members"`
+}
+
+// planChange is a change of an entry needed to reach the desired state:
+// `create`, `update` or `delete`.
+type planChange struct {
+	Action  string            `json:"action"`
+	Kind    string            `json:"kind"`
+	DN      string            `json:"dn"`
+	Changes []attributeChange `json:"changes,omitempty"`
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	before  map[string][]string
+	after   map[string][]string
+}
+
+type applyPlan struct {
+	Owner   string       `json:"owner"`
+	DryRun  bool         `json:"dryRun"`
+	Prune   bool         `json:"prune"`
+	Adopt   bool         `json:"adopt"`
+	Changes []planChange `json:"changes"`
+}
+
+// ApplyOptions are the options of the apply command.
+type ApplyOptions struct {
+	// URL is the one of the LDOups server
+	URL       string
+	Directory string
+	// Token is an API key, used instead of Username and Password when set
+	Token    string
+	Username string
+	Password string
+	DryRun   bool
+	Prune    bool
+	Adopt    bool
+	// Output is `text` or `json`
+	Output string
+}
+
+var errApplyFailed = errors.New("apply failed")
+
+// parseApplyDocument reads a YAML or JSON document.
+func parseApplyDocument(data []byte) (applyDocument, error) {
+	var doc applyDocument
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return doc, fmt.Errorf("can't parse document: %w", err)
+	}
+	return doc, nil
+}
+
+// desiredAttributes returns the attributes e manages, its members included.
+func (e applyEntry) desiredAttributes() map[string][]string {
+	desired := make(map[string][]string, len(e.Attributes)+1)
+	for name, values := range e.Attributes {
+		desired[name] = values
+	}
+	if e.Members != nil {
+		desired["member"] = e.Members
+	}
+	return desired
+}
+
+// checkApplyDocument returns the errors of doc, keyed by their path, e.g.
+// `users[0].attributes.mail`.
+func checkApplyDocument(dir directory, doc applyDocument) map[string]string {
+	errs := make(map[string]string)
+	if strings.TrimSpace(doc.Owner) == "" {
+		errs["owner"] = "missing attribute"
+	}
+	seen := make(map[string]string)
+	kinds := []struct {
+		name       string
+		entries    []applyEntry
+		attributes map[string]string
+		rules      map[string]rule
+	}{
+		{"users", doc.Users, dir.UserAttributes, dir.UserRules},
+		{"groups", doc.Groups, dir.GroupAttributes, dir.GroupRules},
+	}
+	for _, kind := range kinds {
+		for i, e := range kind.entries {
+			path := fmt.Sprintf("%s[%d]", kind.name, i)
+			if _, err := ldap.ParseDN(e.DN); err != nil || e.DN == "" {
+				errs[path+".dn"] = "must be a DN"
+			} else if other, ok := seen[strings.ToLower(e.DN)]; ok {
+				errs[path+".dn"] = "already declared by " + other
+			} else {
+				seen[strings.ToLower(e.DN)] = path
+			}
+			for name := range e.Attributes {
+				switch {
+				case strings.EqualFold(name, dir.Apply.TagAttribute):
+					errs[path+".attributes."+name] = "attribute is set by apply"
+				case !hasKey(kind.attributes, name):
+					errs[path+".attributes."+name] = "attribute is not managed"
+				}
+			}
+			if e.Members != nil {
+				if kind.name == "users" {
+					errs[path+".members"] = "only groups have members"
+				} else if _, ok := e.Attributes["member"]; ok {
+					errs[path+".members"] = "members and attributes.member can't be both set"
+				}
+				for _, member := range e.Members {
+					if _, err := ldap.ParseDN(member); err != nil || member == "" {
+						errs[path+".members"] = fmt.Sprintf("%q is not a DN", member)
+					}
+				}
+			}
+			for name, msg := range validateEntry(entry{DN: e.DN, Attributes: e.Attributes}, kind.attributes, kind.rules, false) {
+				errs[path+".attributes."+name] = msg
+			}
+		}
+	}
+	return errs
+}
+
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// storedCase returns values, written as in stored when they only differ by
+// case, as DNs are compared by the directory.
+func storedCase(values []string, stored []string) []string {
+	cased := make([]string, len(values))
+	for i, value := range values {
+		cased[i] = value
+		for _, s := range stored {
+			if strings.EqualFold(s, value) {
+				cased[i] = s
+				break
+			}
+		}
+	}
+	return cased
+}
+
+// planApply computes the changes bringing the directory to the state of
+// doc. Existing entries which no document manages are only taken over, by
+// tagging them, with adopt. With prune, the entries tagged with the document
+// owner and missing from it are deleted. It returns the errors preventing the
+// plan, keyed like checkApplyDocument ones.
+func planApply(l *ldapConn, doc applyDocument, prune bool, adopt bool) (applyPlan, map[string]string, error) {
+	plan := applyPlan{Owner: doc.Owner, Prune: prune, Adopt: adopt}
+	errs := make(map[string]string)
+	tagAttr := l.dir.Apply.TagAttribute
+	tag := applyTagPrefix + doc.Owner
+
+	var creates, updates, deletes []planChange
+	declared := make(map[string]bool)
+	kinds := []struct {
+		name       string
+		entries    []applyEntry
+		attributes map[string]string
+		rules      map[string]rule
+	}{
+		{"user", doc.Users, l.dir.UserAttributes, l.dir.UserRules},
+		{"group", doc.Groups, l.dir.GroupAttributes, l.dir.GroupRules},
+	}
+	for _, kind := range kinds {
+		for i, e := range kind.entries {
+			path := fmt.Sprintf("%ss[%d]", kind.name, i)
+			declared[strings.ToLower(e.DN)] = true
+			desired := e.desiredAttributes()
+			names := append(attributeNames(kind.attributes), "member", tagAttr)
+
+			live, err := readAttributes(l, e.DN, names)
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				for name, msg := range validateEntry(entry{DN: e.DN, Attributes: desired}, kind.attributes, kind.rules, true) {
+					errs[path+".attributes."+name] = msg
+				}
+				desired[tagAttr] = []string{tag}
+				creates = append(creates, planChange{Action: "create", Kind: kind.name, DN: e.DN, after: desired})
+				continue
+			}
+			if err != nil {
+				return plan, nil, err
+			}
+
+			tags := attributeValues(live, tagAttr)
+			for _, t := range tags {
+				if strings.HasPrefix(t, applyTagPrefix) && t != tag {
+					errs[path+".dn"] = "managed by " + strings.TrimPrefix(t, applyTagPrefix)
+				}
+			}
+			if _, ok := errs[path+".dn"]; !ok && !contains(tags, tag) && !adopt {
+				// Tagging it would let pruning delete an entry apply didn't create
+				errs[path+".dn"] = "exists and isn't managed by apply, adopt it to take it over"
+			}
+			before := map[string][]string{tagAttr: tags}
+			for name := range desired {
+				before[name] = attributeValues(live, name)
+			}
+			if members, ok := desired["member"]; ok {
+				desired["member"] = storedCase(members, before["member"])
+			}
+			desired[tagAttr] = tags
+			if !contains(tags, tag) {
+				desired[tagAttr] = append(append([]string{}, tags...), tag)
+			}
+			if len(diffAttributes(before, desired)) > 0 {
+				updates = append(updates, planChange{Action: "update", Kind: kind.name, DN: e.DN, before: before, after: desired})
+			}
+		}
+	}
+
+	if prune {
+		for _, kind := range []struct{ name, objectClass string }{{"group", l.dir.GroupsObjectClassSearch}, {"user", l.dir.UsersObjectClassSearch}} {
+			attributes := l.dir.UserAttributes
+			if kind.name == "group" {
+				attributes = l.dir.GroupAttributes
+			}
+			filter := "(&(objectClass=" + kind.objectClass + ")(" + tagAttr + "=" + ldap.EscapeFilter(tag) + "))"
+			names := append(attributeNames(attributes), tagAttr)
+			searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, names, []ldap.Control{})
+			result, err := l.Search(searchReq)
+			if err != nil {
+				return plan, nil, err
+			}
+			var pruned []planChange
+			for _, ent := range result.Entries {
+				if !declared[strings.ToLower(ent.DN)] {
+					pruned = append(pruned, planChange{Action: "delete", Kind: kind.name, DN: ent.DN, before: entryAttributes(ent, names)})
+				}
+			}
+			sort.Slice(pruned, func(i, j int) bool { return pruned[i].DN < pruned[j].DN })
+			deletes = append(deletes, pruned...)
+		}
+	}
+
+	// Users are created before the groups they belong to, and groups
+	// deleted before their members
+	plan.Changes = append(append(creates, updates...), deletes...)
+	if plan.Changes == nil {
+		plan.Changes = []planChange{}
+	}
+	for i := range plan.Changes {
+		plan.Changes[i].Changes = diffAttributes(plan.Changes[i].before, plan.Changes[i].after)
+		plan.Changes[i].Status = "planned"
+	}
+	return plan, errs, nil
+}
+
+// executePlan applies the changes of plan in order, and stops at the first
+// failure, the following changes being skipped. It returns the error of the
+// failed change.
+func executePlan(l *ldapConn, plan *applyPlan) error {
+	var failure error
+	for i := range plan.Changes {
+		change := &plan.Changes[i]
+		if failure != nil {
+			change.Status = "skipped"
+			continue
+		}
+		if err := applyChange(l, *change); err != nil {
+			change.Status = "failed"
+			change.Error = err.Error()
+			failure = err
+			continue
+		}
+		change.Status = "applied"
+	}
+	return failure
+}
+
+func applyChange(l *ldapConn, change planChange) error {
+	switch change.Action {
+	case "create":
+		addReq := ldap.NewAddRequest(change.DN, []ldap.Control{})
+		for _, name := range attributeNamesOf(change.after) {
+			addReq.Attribute(name, change.after[name])
+		}
+		err := l.Add(addReq)
+		l.recordAudit(change.Kind+".create", change.DN, nil, change.after, err)
+		if err != nil {
+			return err
+		}
+		return forgetChangedMemberships(l.dir, change.DN, nil, change.after["member"])
+	case "update":
+		modReq := ldap.NewModifyRequest(change.DN, []ldap.Control{})
+		diffModifications(modReq, change.before, change.after)
+		if members, ok := change.after["member"]; ok && change.Kind == "group" {
+			if err := syncMemberUid(l, modReq, change.DN, foldDifference(members, change.before["member"]), foldDifference(change.before["member"], members)); err != nil {
+				return err
+			}
+		}
+		err := l.Modify(modReq)
+		l.recordAudit(change.Kind+".update", change.DN, change.before, change.after, err)
+		if err != nil {
+			return err
+		}
+		return forgetChangedMemberships(l.dir, change.DN, change.before["member"], change.after["member"])
+	case "delete":
+		err := l.Del(ldap.NewDelRequest(change.DN, []ldap.Control{}))
+		l.recordAudit(change.Kind+".delete", change.DN, change.before, nil, err)
+		if err != nil || change.Kind != "user" {
+			return err
+		}
+		return removeFromGroups(l, change.DN)
+	}
+	return fmt.Errorf("unknown change %q", change.Action)
+}
+
+// attributeNamesOf returns the names of attributes, sorted.
+func attributeNamesOf(attributes map[string][]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writePlan writes plan as text, one line per entry followed by its
+// attribute changes, and a summary.
+func writePlan(w io.Writer, plan applyPlan) {
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-"}
+	counts := make(map[string]int)
+	for _, change := range plan.Changes {
+		counts[change.Action]++
+		status := ""
+		switch change.Status {
+		case "applied", "skipped":
+			status = " (" + change.Status + ")"
+		case "failed":
+			status = " (failed: " + change.Error + ")"
+		}
+		fmt.Fprintf(w, "%s %s %s%s\n", symbols[change.Action], change.Kind, change.DN, status)
+		if change.Action == "delete" {
+			continue
+		}
+		for _, attr := range change.Changes {
+			if change.Action == "create" {
+				fmt.Fprintf(w, "    %s: %s\n", attr.Attribute, strings.Join(attr.After, ", "))
+				continue
+			}
+			writeValueChanges(w, attr)
+		}
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	summary := fmt.Sprintf("%d to create, %d to update, %d to delete", counts["create"], counts["update"], counts["delete"])
+	if plan.DryRun {
+		summary += " (dry run)"
+	}
+	fmt.Fprintln(w, "Plan: "+summary+".")
+}
+
+// writeValueChanges writes the values added to and removed from an
+// attribute, one per line.
+func writeValueChanges(w io.Writer, attr attributeChange) {
+	for _, value := range difference(attr.After, attr.Before) {
+		fmt.Fprintf(w, "    + %s: %s\n", attr.Attribute, value)
+	}
+	for _, value := range difference(attr.Before, attr.After) {
+		fmt.Fprintf(w, "    - %s: %s\n", attr.Attribute, value)
+	}
+}
+
+// pathErrors lists errs as `path: error` lines, sorted.
+func pathErrors(errs map[string]string) []string {
+	var problems []string
+	for path, msg := range errs {
+		problems = append(problems, path+": "+msg)
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Apply brings the users and groups of the request directory to the state
+// of a YAML or JSON document, with the rights of the logged in user. With
+// `dryRun=true`, the plan is only returned. Existing entries are only taken
+// over with `adopt=true`. With `prune=true`, the entries of the document owner
+// missing from it are deleted.
+func Apply(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	doc, err := parseApplyDocument(body)
+	if err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	if errs := checkApplyDocument(ldp.dir, doc); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	plan, errs, err := planApply(ldp, doc, c.Query("prune") == "true", c.Query("adopt") == "true")
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	plan.DryRun = c.Query("dryRun") == "true"
+	if !plan.DryRun {
+		if err := executePlan(ldp, &plan); err != nil {
+			status := http.StatusInternalServerError
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) {
+				status = http.StatusForbidden
+			}
+			requestLogger(c).Error().Err(err).Msg("apply failed")
+			c.JSON(status, plan)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// ApplyCommand sends a document to the LDOups server at opts.URL, which
+// applies it with the rights of the given credentials, and writes the
+// returned plan to w. Going through the server keeps a single writer of the
+// audit log and the local database.
+func ApplyCommand(data []byte, opts ApplyOptions, w io.Writer) error {
+	query := url.Values{}
+	query.Set("dryRun", strconv.FormatBool(opts.DryRun))
+	query.Set("prune", strconv.FormatBool(opts.Prune))
+	query.Set("adopt", strconv.FormatBool(opts.Adopt))
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(opts.URL, "/")+"/api/apply?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	if opts.Directory != "" {
+		req.Header.Set(directoryHeader, opts.Directory)
+	}
+	if opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	} else {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The body is a plan, or an error message
+	var result struct {
+		applyPlan
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response %s: %w", resp.Status, err)
+	}
+	if result.Changes == nil {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("%s:\n  %s", result.Message, strings.Join(pathErrors(result.Errors), "\n  "))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, result.Message)
+	}
+
+	if opts.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result.applyPlan); err != nil {
+			return err
+		}
+	} else {
+		writePlan(w, result.applyPlan)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", errApplyFailed, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+const (
+	testManaged = "ldoups:team"
+	testStale   = "cn=old,ou=users,dc=example,dc=org"
+	testNewUser = "cn=bob,ou=users,dc=example,dc=org"
+)
+
+// newApplyDirectory returns a fake directory with entries managed by the
+// `team` document, by the `other` one, and by none.
+func newApplyDirectory(t *testing.T) *ldapConn {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org":                   {"objectClass": {"domain"}},
+		testUser:                              {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "mail": {"jdoe@example.org"}, "businessCategory": {testManaged}},
+		testOtherDN:                           {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}, "mail": {"jane@example.org"}},
+		testAlice:                             {"objectClass": {"inetOrgPerson"}, "cn": {"alice"}, "businessCategory": {"ldoups:other"}},
+		testStale:                             {"objectClass": {"inetOrgPerson"}, "cn": {"old"}, "businessCategory": {testManaged}},
+		testGroup:                             {"objectClass": {"groupOfNames"}, "cn": {"devs"}, "member": {"CN=JDoe,ou=users,dc=example,dc=org"}, "businessCategory": {testManaged}},
+		"cn=old,ou=groups,dc=example,dc=org":  {"objectClass": {"groupOfNames"}, "cn": {"old"}, "member": {testStale}, "businessCategory": {testManaged}},
+		"cn=misc,ou=groups,dc=example,dc=org": {"objectClass": {"groupOfNames"}, "cn": {"misc"}, "member": {testAlice}, "businessCategory": {"ldoups:other"}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		UserAttributes:          map[string]string{"cn": "required", "mail": ""},
+		GroupAttributes:         map[string]string{"cn": "required"},
+		Apply:                   config.Apply{TagAttribute: "businessCategory"},
+	}
+	useTestConfig(t, c)
+	return d.dial(t, defaultDirectory())
+}
+
+// planned returns the `action kind dn` of the changes of plan.
+func planned(plan applyPlan) []string {
+	changes := []string{}
+	for _, change := range plan.Changes {
+		changes = append(changes, change.Action+" "+change.Kind+" "+change.DN)
+	}
+	return changes
+}
+
+func TestPlanApply(t *testing.T) {
+	l := newApplyDirectory(t)
+	doc := applyDocument{
+		Owner: "team",
+		Users: []applyEntry{
+			{DN: testUser, Attributes: map[string][]string{"mail": {"john@example.org"}}},
+			{DN: testNewUser, Attributes: map[string][]string{"cn": {"bob"}}},
+		},
+		Groups: []applyEntry{
+			{DN: testGroup, Members: []string{testUser, testNewUser}},
+		},
+	}
+
+	plan, errs, err := planApply(l, doc, false, false)
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("planApply() = %v, %v", errs, err)
+	}
+	want := []string{"create user " + testNewUser, "update user " + testUser, "update group " + testGroup}
+	if got := planned(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("planApply() = %q, want %q", got, want)
+	}
+	if got := plan.Changes[0].Changes; !reflect.DeepEqual(got, []attributeChange{{Attribute: "businessCategory", After: []string{testManaged}}, {Attribute: "cn", After: []string{"bob"}}}) {
+		t.Errorf("created attributes = %+v, want cn and the tag", got)
+	}
+	if got := plan.Changes[1].Changes; !reflect.DeepEqual(got, []attributeChange{{Attribute: "mail", Before: []string{"jdoe@example.org"}, After: []string{"john@example.org"}}}) {
+		t.Errorf("updated attributes = %+v, want mail only", got)
+	}
+	// Members differing by case only are left as stored
+	if got := plan.Changes[2].after["member"]; !reflect.DeepEqual(got, []string{"CN=JDoe,ou=users,dc=example,dc=org", testNewUser}) {
+		t.Errorf("members = %q, want the stored case kept", got)
+	}
+	for _, change := range plan.Changes {
+		if change.Status != "planned" {
+			t.Errorf("%s %s status = %s, want planned", change.Action, change.DN, change.Status)
+		}
+	}
+
+	// Applying the same document twice plans nothing
+	doc.Users[0].Attributes["mail"] = []string{"jdoe@example.org"}
+	doc.Users = doc.Users[:1]
+	doc.Groups[0].Members = []string{testUser}
+	if plan, errs, err := planApply(l, doc, false, false); err != nil || len(errs) > 0 || len(plan.Changes) != 0 {
+		t.Errorf("planApply() of the current state = %q, %v, %v, want no change", planned(plan), errs, err)
+	}
+}
+
+func TestPlanApplyAdopt(t *testing.T) {
+	l := newApplyDirectory(t)
+	doc := applyDocument{
+		Owner: "team",
+		Users: []applyEntry{
+			{DN: testOtherDN, Attributes: map[string][]string{"mail": {"jane@example.org"}}},
+			{DN: testAlice, Attributes: map[string][]string{"cn": {"alice"}}},
+			{DN: testNewUser, Attributes: map[string][]string{"mail": {"bob@example.org"}}},
+		},
+	}
+
+	_, errs, err := planApply(l, doc, false, false)
+	if err != nil {
+		t.Fatalf("planApply(): %v", err)
+	}
+	want := map[string]string{
+		"users[0].dn":            "exists and isn't managed by apply, adopt it to take it over",
+		"users[1].dn":            "managed by other",
+		"users[2].attributes.cn": "missing attribute",
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("planApply() errors = %v, want %v", errs, want)
+	}
+
+	// Adopting takes over the unmanaged entries only
+	doc.Users = doc.Users[:2]
+	plan, errs, err := planApply(l, doc, false, true)
+	if err != nil {
+		t.Fatalf("planApply(): %v", err)
+	}
+	if want := map[string]string{"users[1].dn": "managed by other"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("planApply() errors with adopt = %v, want %v", errs, want)
+	}
+	if len(plan.Changes) == 0 || plan.Changes[0].DN != testOtherDN || !reflect.DeepEqual(plan.Changes[0].Changes, []attributeChange{{Attribute: "businessCategory", After: []string{testManaged}}}) {
+		t.Errorf("planApply() with adopt = %+v, want %s tagged", plan.Changes, testOtherDN)
+	}
+}
+
+func TestPlanApplyPrune(t *testing.T) {
+	l := newApplyDirectory(t)
+	doc := applyDocument{
+		Owner:  "team",
+		Users:  []applyEntry{{DN: "CN=JDoe,ou=users,dc=example,dc=org", Attributes: map[string][]string{"mail": {"jdoe@example.org"}}}},
+		Groups: []applyEntry{{DN: testGroup}},
+	}
+
+	plan, errs, err := planApply(l, doc, false, false)
+	if err != nil || len(errs) > 0 || len(plan.Changes) != 0 {
+		t.Errorf("planApply() without prune = %q, %v, %v, want no change", planned(plan), errs, err)
+	}
+
+	// Groups are deleted before their members, and the entries of the other
+	// documents are kept
+	plan, errs, err = planApply(l, doc, true, false)
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("planApply() = %v, %v", errs, err)
+	}
+	want := []string{"delete group cn=old,ou=groups,dc=example,dc=org", "delete user " + testStale}
+	if got := planned(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("planApply() with prune = %q, want %q", got, want)
+	}
+	if !plan.Prune || plan.Adopt || plan.Owner != "team" {
+		t.Errorf("plan = owner %s, prune %v, adopt %v", plan.Owner, plan.Prune, plan.Adopt)
+	}
+}
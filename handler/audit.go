@@ -0,0 +1,476 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+// auditRecord describes one change done to the directory.
+type auditRecord struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"requestId,omitempty"`
+	Actor     string            `json:"actor"`
+	SourceIP  string            `json:"sourceIp,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Directory string            `json:"directory,omitempty"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target"`
+	Changes   []attributeChange `json:"changes,omitempty"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+	PrevHash  string            `json:"prevHash,omitempty"`
+	KeyID     string            `json:"keyId,omitempty"`
+	Hash      string            `json:"hash,omitempty"`
+}
+
+type attributeChange struct {
+	Attribute string   `json:"attribute"`
+	Before    []string `json:"before,omitempty"`
+	After     []string `json:"after,omitempty"`
+}
+
+type auditFilter struct {
+	Directory string
+	Actor     string
+	Target    string
+	Action    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (f auditFilter) match(record auditRecord) bool {
+	return record.Directory == f.Directory &&
+		(f.Actor == "" || strings.EqualFold(record.Actor, f.Actor)) &&
+		(f.Target == "" || strings.EqualFold(record.Target, f.Target)) &&
+		(f.Action == "" || record.Action == f.Action || strings.HasPrefix(record.Action, f.Action+".")) &&
+		(f.Since.IsZero() || !record.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || record.Time.Before(f.Until))
+}
+
+// auditSink stores audit records. Sinks able to read them back also
+// implement auditQuerier.
+type auditSink interface {
+	write(record *auditRecord) error
+}
+
+type auditQuerier interface {
+	query(filter auditFilter) (records []auditRecord, verified bool, err error)
+}
+
+// audit holds the sink in use, swapped on reload.
+var audit struct {
+	sync.RWMutex
+	sink auditSink
+}
+
+func currentAudit() auditSink {
+	audit.RLock()
+	defer audit.RUnlock()
+	return audit.sink
+}
+
+// setAudit swaps the sink in use, and closes the previous one.
+func setAudit(sink auditSink) {
+	audit.Lock()
+	previous := audit.sink
+	audit.sink = sink
+	audit.Unlock()
+
+	if closer, ok := previous.(io.Closer); ok && previous != sink {
+		closer.Close()
+	}
+}
+
+// newAuditSink opens the sink configured by `audit.sink`. The file sink in
+// use is kept when its path and keys don't change, so that its hash chain
+// goes on.
+func newAuditSink(c *config.Config) (auditSink, error) {
+	switch c.Audit.Sink {
+	case "none":
+		return nil, nil
+	case "stdout":
+		return &writerAuditSink{encoder: json.NewEncoder(os.Stdout)}, nil
+	case "file":
+		keys := auditKeys(c.Audit.Key, c.Audit.PreviousKeys)
+		if sink, ok := currentAudit().(*fileAuditSink); ok && sink.path == c.Audit.Path && sink.keyID == auditKeyID(c.Audit.Key) && reflect.DeepEqual(sink.keys, keys) {
+			return sink, nil
+		}
+		return openFileAuditSink(c.Audit.Path, c.Audit.Key, keys)
+	case "syslog":
+		tag := c.Audit.Syslog.Tag
+		if tag == "" {
+			tag = "ldoups-audit"
+		}
+		w, err := syslog.Dial(c.Audit.Syslog.Network, c.Audit.Syslog.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+		if err != nil {
+			return nil, err
+		}
+		return &writerAuditSink{encoder: json.NewEncoder(w), closer: w}, nil
+	default:
+		return nil, errors.New("unknown audit sink: " + c.Audit.Sink)
+	}
+}
+
+// writerAuditSink writes records as JSON lines, to stdout or syslog.
+type writerAuditSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+func (s *writerAuditSink) write(record *auditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(record)
+}
+
+func (s *writerAuditSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// fileAuditSink appends records as JSON lines to a file. Each record holds
+// the hash of the previous one, an HMAC keyed with `audit.key`, so that
+// removing or altering a record breaks the chain, and that the chain can't be
+// rebuilt without the key. Records name the key they are hashed with, so
+// that the records hashed with `audit.previousKeys` are still verified once
+// the key is rotated.
+type fileAuditSink struct {
+	sync.Mutex
+	path     string
+	keyID    string
+	keys     map[string][]byte
+	file     *os.File
+	lastHash string
+}
+
+// auditKeyID identifies an audit key in the records, without revealing it.
+func auditKeyID(key string) string {
+	sum := sha256.Sum256([]byte("ldoups-audit-key:" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditKeys returns the audit keys by ID, the current one and the previous
+// ones.
+func auditKeys(key string, previous []string) map[string][]byte {
+	keys := make(map[string][]byte)
+	for _, k := range append([]string{key}, previous...) {
+		if k != "" {
+			keys[auditKeyID(k)] = []byte(k)
+		}
+	}
+	return keys
+}
+
+func openFileAuditSink(path string, key string, keys map[string][]byte) (*fileAuditSink, error) {
+	if path == "" {
+		return nil, errors.New("missing audit.path")
+	}
+	if key == "" {
+		return nil, errors.New("missing audit.key")
+	}
+	sink := &fileAuditSink{path: path, keyID: auditKeyID(key), keys: keys}
+	records, _, err := sink.read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(records) > 0 {
+		sink.lastHash = records[len(records)-1].Hash
+	}
+	if sink.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *fileAuditSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+func hashRecord(key []byte, record auditRecord) string {
+	record.Hash = ""
+	b, _ := json.Marshal(record)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(record.PrevHash))
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *fileAuditSink) write(record *auditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record.PrevHash = s.lastHash
+	record.KeyID = s.keyID
+	record.Hash = hashRecord(s.keys[s.keyID], *record)
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.lastHash = record.Hash
+	return nil
+}
+
+// read returns every record of the file, and whether their hash chain is
+// intact. Records without key ID predate them, and are hashed with the
+// current key.
+func (s *fileAuditSink) read() ([]auditRecord, bool, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	verified := true
+	prevHash := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			verified = false
+			continue
+		}
+		keyID := record.KeyID
+		if keyID == "" {
+			keyID = s.keyID
+		}
+		key, ok := s.keys[keyID]
+		if !ok || record.PrevHash != prevHash || !hmac.Equal([]byte(record.Hash), []byte(hashRecord(key, record))) {
+			verified = false
+		}
+		prevHash = record.Hash
+		records = append(records, record)
+	}
+	return records, verified, scanner.Err()
+}
+
+func (s *fileAuditSink) query(filter auditFilter) ([]auditRecord, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	all, verified, err := s.read()
+	if err != nil {
+		return nil, false, err
+	}
+	records := []auditRecord{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if filter.match(all[i]) {
+			records = append(records, all[i])
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				break
+			}
+		}
+	}
+	return records, verified, nil
+}
+
+// diffAttributes returns the attribute-level changes between two states of
+// an entry. Secret values are redacted.
+func diffAttributes(before map[string][]string, after map[string][]string) []attributeChange {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	var changes []attributeChange
+	for name := range names {
+		b, a := before[name], after[name]
+		if len(difference(a, b)) == 0 && len(difference(b, a)) == 0 && len(a) == len(b) {
+			continue
+		}
+		if isSecret(name) {
+			b, a = redactValues(b), redactValues(a)
+		}
+		changes = append(changes, attributeChange{Attribute: name, Before: b, After: a})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Attribute < changes[j].Attribute
+	})
+	return changes
+}
+
+func redactValues(values []string) []string {
+	if len(values) == 0 {
+		return values
+	}
+	return []string{"REDACTED"}
+}
+
+// recordAudit records a change done through l to the audit sink, along with
+// the actor and request l is bound to. Successful changes are also published
+// as events.
+func (l *ldapConn) recordAudit(action string, target string, before map[string][]string, after map[string][]string, err error) {
+	if err == nil {
+		l.markChanged(target)
+	}
+	source := l.source
+	if source == "" {
+		source = "api"
+	}
+	l.recordChange(source, action, target, before, after, err)
+}
+
+// recordChange audits and publishes a change, done through LDOups (`api`
+// source), by its scheduled jobs (`job` source) or seen in the directory
+// (`directory` source).
+func (l *ldapConn) recordChange(source string, action string, target string, before map[string][]string, after map[string][]string, err error) {
+	changes := diffAttributes(before, after)
+	if err == nil {
+		publish(event{
+			ID:        newID(),
+			Type:      action,
+			Source:    source,
+			Time:      time.Now().UTC(),
+			Directory: l.dir.auditName(),
+			Actor:     l.actor,
+			Target:    target,
+			Changes:   changes,
+			RequestID: l.requestID,
+		})
+	}
+	sink := currentAudit()
+	if sink == nil {
+		return
+	}
+
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		RequestID: l.requestID,
+		Actor:     l.actor,
+		SourceIP:  l.sourceIP,
+		Source:    source,
+		Directory: l.dir.auditName(),
+		Action:    action,
+		Target:    target,
+		Changes:   changes,
+		Result:    "success",
+	}
+	if err != nil {
+		record.Result = "failure"
+		record.Error = err.Error()
+	}
+	if werr := sink.write(&record); werr != nil {
+		l.logger.Error().Err(werr).Str("action", action).Str("target", target).Msg("can't write audit record")
+	}
+}
+
+var errNotAuditAdmin = errors.New("only audit admins can read the audit log, the events, the jobs and the webhook deliveries")
+
+// checkAuditAdmin aborts with 403 and returns false unless the logged in
+// user is a member of `audit.admins`. The audit log, the events, the jobs
+// and the webhook deliveries are kept by LDOups, so the directory ACLs don't
+// apply to them.
+func checkAuditAdmin(c *gin.Context, l *ldapConn) bool {
+	admins := l.dir.Audit.Admins
+	ok := false
+	if len(admins) > 0 {
+		var err error
+		if ok, err = isMemberOfAny(l, l.actor, admins); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return false
+		}
+	}
+	if !ok {
+		abort(c, errNotAuditAdmin, http.StatusForbidden)
+	}
+	return ok
+}
+
+// GetAudit returns the audit records of the request directory matching the
+// actor, target, action, since and until (RFC 3339) query parameters, most
+// recent first. Only audit admins read them.
+func GetAudit(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+
+	querier, ok := currentAudit().(auditQuerier)
+	if !ok {
+		abort(c, errors.New("audit sink can't be queried, use the file sink"), http.StatusNotImplemented)
+		return
+	}
+
+	filter := auditFilter{
+		Directory: ldp.dir.auditName(),
+		Actor:     c.Query("actor"),
+		Target:    c.Query("target"),
+		Action:    c.Query("action"),
+		Limit:     100,
+	}
+	errs := make(map[string]string)
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				errs[name] = "invalid date, RFC 3339 expected"
+			}
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			errs["limit"] = "invalid limit"
+		}
+		filter.Limit = limit
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errors.New("invalid query"), http.StatusBadRequest, errs)
+		return
+	}
+
+	records, verified, err := querier.query(filter)
+	if err != nil {
+		abort(c, fmt.Errorf("can't read audit records: %w", err), http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"records":  records,
+		"verified": verified,
+	})
+}
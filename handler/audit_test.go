@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeAuditRecords appends a record per target to the audit file at path,
+// hashed with key.
+func writeAuditRecords(t *testing.T, path string, key string, previous []string, targets ...string) {
+	t.Helper()
+	sink, err := openFileAuditSink(path, key, auditKeys(key, previous))
+	if err != nil {
+		t.Fatalf("openFileAuditSink(): %v", err)
+	}
+	defer sink.Close()
+	for _, target := range targets {
+		record := auditRecord{Time: time.Now().UTC(), Actor: testUser, Action: "user.update", Target: target, Result: "success"}
+		if err := sink.write(&record); err != nil {
+			t.Fatalf("write(): %v", err)
+		}
+	}
+}
+
+func readAuditRecords(t *testing.T, path string, key string, previous []string) ([]auditRecord, bool) {
+	t.Helper()
+	sink, err := openFileAuditSink(path, key, auditKeys(key, previous))
+	if err != nil {
+		t.Fatalf("openFileAuditSink(): %v", err)
+	}
+	defer sink.Close()
+	records, verified, err := sink.read()
+	if err != nil {
+		t.Fatalf("read(): %v", err)
+	}
+	return records, verified
+}
+
+func TestFileAuditSinkChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, path, "secret", nil, "cn=a", "cn=b")
+	// Reopening the file goes on with its chain
+	writeAuditRecords(t, path, "secret", nil, "cn=c")
+
+	records, verified := readAuditRecords(t, path, "secret", nil)
+	if !verified {
+		t.Error("the chain isn't verified")
+	}
+	if len(records) != 3 {
+		t.Fatalf("read %d records, want 3", len(records))
+	}
+	for i, record := range records {
+		if i > 0 && record.PrevHash != records[i-1].Hash {
+			t.Errorf("record %d isn't chained to the previous one", i)
+		}
+		if record.KeyID != auditKeyID("secret") {
+			t.Errorf("record %d key ID = %s, want %s", i, record.KeyID, auditKeyID("secret"))
+		}
+	}
+
+	if _, verified := readAuditRecords(t, path, "other", nil); verified {
+		t.Error("the chain is verified with another key")
+	}
+}
+
+func TestFileAuditSinkTampering(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	writeAuditRecords(t, path, "secret", nil, "cn=a", "cn=b", "cn=c")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+
+	tests := map[string][]byte{
+		"altered record": bytes.Replace(content, []byte(`"target":"cn=b"`), []byte(`"target":"cn=x"`), 1),
+		"removed record": append(append([]byte{}, lines[0]...), lines[2]...),
+		"invalid record": append(append([]byte{}, content...), []byte("{\n")...),
+	}
+	for name, altered := range tests {
+		tampered := filepath.Join(dir, "tampered.log")
+		if err := ioutil.WriteFile(tampered, altered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, verified := readAuditRecords(t, tampered, "secret", nil); verified {
+			t.Errorf("%s: the chain is verified", name)
+		}
+	}
+}
+
+// TestFileAuditSinkRotation checks that the records hashed with a previous
+// key are verified once the key is rotated.
+func TestFileAuditSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, path, "old", nil, "cn=a")
+	writeAuditRecords(t, path, "new", []string{"old"}, "cn=b")
+
+	records, verified := readAuditRecords(t, path, "new", []string{"old"})
+	if !verified {
+		t.Error("the chain isn't verified with the previous key")
+	}
+	if len(records) != 2 || records[0].KeyID != auditKeyID("old") || records[1].KeyID != auditKeyID("new") {
+		t.Errorf("records = %+v, want one per key", records)
+	}
+	if _, verified := readAuditRecords(t, path, "new", nil); verified {
+		t.Error("the chain is verified without the previous key")
+	}
+}
+
+func TestFileAuditSinkQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := openFileAuditSink(path, "secret", auditKeys("secret", nil))
+	if err != nil {
+		t.Fatalf("openFileAuditSink(): %v", err)
+	}
+	defer sink.Close()
+	start := time.Date(2023, 1, 31, 12, 0, 0, 0, time.UTC)
+	for i, r := range []auditRecord{
+		{Actor: testUser, Action: "user.update", Target: testOtherDN},
+		{Actor: testOtherDN, Action: "group.add_member", Target: testGroup},
+		{Actor: testUser, Action: "user.disable", Target: testOtherDN, Directory: "lab"},
+		{Actor: testUser, Action: "group.update", Target: testGroup},
+	} {
+		r.Time = start.Add(time.Duration(i) * time.Hour)
+		if err := sink.write(&r); err != nil {
+			t.Fatalf("write(): %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter auditFilter
+		want   []string
+	}{
+		{"all", auditFilter{}, []string{"group.update", "group.add_member", "user.update"}},
+		{"directory", auditFilter{Directory: "lab"}, []string{"user.disable"}},
+		{"actor", auditFilter{Actor: "CN=JDoe,ou=users,dc=example,dc=org"}, []string{"group.update", "user.update"}},
+		{"target", auditFilter{Target: testGroup}, []string{"group.update", "group.add_member"}},
+		{"action prefix", auditFilter{Action: "group"}, []string{"group.update", "group.add_member"}},
+		{"period", auditFilter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []string{"group.add_member"}},
+		{"limit", auditFilter{Limit: 1}, []string{"group.update"}},
+	}
+	for _, tt := range tests {
+		records, verified, err := sink.query(tt.filter)
+		if err != nil || !verified {
+			t.Fatalf("%s: query() = %v, verified %v", tt.name, err, verified)
+		}
+		got := []string{}
+		for _, record := range records {
+			got = append(got, record.Action)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: query() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -3,39 +3,26 @@ package handler
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/BedrockStreaming/ldoups/config"
 	"github.com/gin-gonic/gin"
 	"github.com/go-ldap/ldap/v3"
-	"gopkg.in/yaml.v2"
 )
 
-type config struct {
-	Ldap struct {
-		BaseDN string `yaml:"baseDN"`
-		RO     struct {
-			Username string `yaml:"username"`
-			Password string `yaml:"password"`
-		} `yaml:"ro"`
-		Url                     string            `yaml:"url"`
-		UserAttributes          map[string]string `yaml:"userAttributes"`
-		UsersObjectClassSearch  string            `yaml:"usersObjectClassSearch"`
-		GroupAttributes         map[string]string `yaml:"groupAttributes"`
-		GroupsObjectClassSearch string            `yaml:"groupsObjectClassSearch"`
-	} `yaml:"ldap"`
-}
-
 type profile struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 }
 
 type query struct {
-	Q string
+	Q      string
+	Status string
+	Owner  string
 }
 
 type entry struct {
@@ -43,6 +30,10 @@ type entry struct {
 	DN         string              `json:"dn"`
 	Attributes map[string][]string `json:"attributes"`
 	Options    map[string]string   `json:"options"`
+	Status     string              `json:"status,omitempty"`
+	ExpiresAt  *time.Time          `json:"expiresAt,omitempty"`
+	// MemberExpiry is the expiry of the time-bound members of groups
+	MemberExpiry map[string]memberExpiry `json:"memberExpiry,omitempty"`
 }
 
 // Sorting as done here : https://pkg.go.dev/sort#example-package-SortKeys
@@ -104,23 +95,37 @@ func prepareEntries(entriesL []*ldap.Entry) []entry {
 	return entries
 }
 
-var conf *config
+// currentConf holds the *config.Config in use, swapped on reload.
+var currentConf atomic.Value
 
-func (c *config) loadConf() {
-	yamlFile, err := ioutil.ReadFile("config.yaml")
-	if err != nil {
-		log.Printf("yamlFile.Get err #%v ", err)
+// conf returns the configuration in use. Handlers keep the value they got
+// for the rest of a request only when consistency matters.
+func conf() *config.Config {
+	return currentConf.Load().(*config.Config)
+}
+
+// LoadConf applies the configuration loaded by the config package.
+func LoadConf(c *config.Config) error {
+	if err := checkRules(c); err != nil {
+		return err
 	}
-	err = yaml.Unmarshal(yamlFile, c)
+	sink, err := newAuditSink(c)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		return fmt.Errorf("can't setup audit: %w", err)
 	}
-	conf = c
-}
-
-func LoadConf() {
-	var c config
-	c.loadConf()
+	currentConf.Store(c)
+	setupLogger()
+	setAudit(sink)
+	if err := setupWebhooks(); err != nil {
+		return fmt.Errorf("can't setup webhooks: %w", err)
+	}
+	if err := setupWatcher(); err != nil {
+		return fmt.Errorf("can't setup directory watch: %w", err)
+	}
+	if err := setupJobs(); err != nil {
+		return fmt.Errorf("can't setup jobs: %w", err)
+	}
+	return nil
 }
 
 type errorMessage struct {
@@ -130,12 +135,22 @@ type errorMessage struct {
 }
 
 func abort(c *gin.Context, err error, statusCode int) {
-	log.Print(err)
+	abortWithErrors(c, err, statusCode, make(map[string]string))
+}
+
+// abortWithErrors stops the handler chain and reports err along with
+// per-field errors, so clients can show every problem at once.
+func abortWithErrors(c *gin.Context, err error, statusCode int, errs map[string]string) {
+	event := requestLogger(c).Warn()
+	if statusCode >= http.StatusInternalServerError {
+		event = requestLogger(c).Error()
+	}
+	event.Err(err).Int("status", statusCode).Interface("errors", errs).Msg("request aborted")
 	var errorM errorMessage
 	errorM.Message = fmt.Sprintf("%s", err)
 	errorM.Status = statusCode
-	errorM.Errors = make(map[string]string)
-	c.JSON(statusCode, errorM)
+	errorM.Errors = errs
+	c.AbortWithStatusJSON(statusCode, errorM)
 }
 
 func Delete(c *gin.Context) {
@@ -144,16 +159,27 @@ func Delete(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
 
 	id := c.Param("id")
+	action := "group.delete"
+	if strings.HasPrefix(c.FullPath(), "/api/users") {
+		action = "user.delete"
+	}
+	before, err := readAttributes(ldp, id, []string{"*"})
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
 	delReq := ldap.NewDelRequest(id, []ldap.Control{})
 
-	if err := ldp.Del(delReq); err != nil {
+	err = ldp.Del(delReq)
+	ldp.recordAudit(action, id, before, nil, err)
+	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
@@ -165,7 +191,7 @@ func Get(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap Conn"), http.StatusInternalServerError)
 		return
@@ -175,6 +201,18 @@ func Get(c *gin.Context) {
 	attr := c.QueryArray("attr")
 	// rnge := c.QueryArray("range")
 	// flter := c.QueryArray("filter")
+	isUser := strings.HasPrefix(c.Request.URL.Path, "/api/users/cn=")
+
+	tag, err := entryTag(ldp, id, isUser)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.Header("ETag", tag)
+	if header := c.GetHeader("If-None-Match"); header != "" && matchTag(header, tag, true) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
 
 	filter := "(objectClass=*)"
 	searchReq := ldap.NewSearchRequest(id, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
@@ -190,8 +228,19 @@ func Get(c *gin.Context) {
 	entries := prepareEntries(result.Entries)
 
 	// Search for member of user
-	if strings.HasPrefix(c.Request.URL.Path, "/api/users/cn=") {
+	if isUser {
 		getGroups(c, &entries[0])
+		if err := setStatus(ldp, &entries[0]); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		expiries, err := memberExpiries(ldp.dir, id)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		entries[0].MemberExpiry = expiries
 	}
 
 	c.JSON(http.StatusOK, entries[0])
@@ -199,18 +248,47 @@ func Get(c *gin.Context) {
 }
 
 // https://cybernetist.com/2020/05/18/getting-started-with-go-ldap/
-func connect(c *gin.Context) *ldap.Conn {
-	l, err := ldap.DialURL(conf.Ldap.Url)
+func connect(c *gin.Context) *ldapConn {
+	dir, ok := lookupDirectory(c.GetHeader(directoryHeader))
+	if !ok {
+		abort(c, fmt.Errorf("unknown directory %q", c.GetHeader(directoryHeader)), http.StatusNotFound)
+		return nil
+	}
+	setDirectory(c, dir)
+
+	// Servers are tried in turn, the first one reachable is used
+	var l *ldap.Conn
+	err := errors.New("no ldap url configured")
+	for _, url := range strings.Fields(dir.Url) {
+		if l, err = ldap.DialURL(url); err == nil {
+			break
+		}
+	}
 	if err != nil {
+		ldapDials.WithLabelValues("failure").Inc()
 		abort(c, err, http.StatusInternalServerError)
 		return nil
 	}
-	return l
+	ldapDials.WithLabelValues("success").Inc()
+	conn := newLdapConn(l, requestLogger(c), dir)
+	conn.sourceIP = c.ClientIP()
+	conn.requestID = c.GetString("requestID")
+	return conn
 }
 
-func Login(l *ldap.Conn, c *gin.Context) bool {
+// authenticate logs in with the API key of a service account when the
+// request bears one, with the user credentials otherwise.
+func authenticate(l *ldapConn, c *gin.Context) bool {
+	if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+		return APIKeyLogin(l, c)
+	}
+	return Login(l, c)
+}
+
+func Login(l *ldapConn, c *gin.Context) bool {
 	username, password, hasAuth := c.Request.BasicAuth()
 	if !hasAuth {
+		loginFailures.WithLabelValues("missing_credentials").Inc()
 		c.Header("WWW-Authenticate", "Basic realm=Restricted")
 		abort(c, errors.New("Unauthenticated"), http.StatusUnauthorized)
 		return false
@@ -220,13 +298,32 @@ func Login(l *ldap.Conn, c *gin.Context) bool {
 	if userDN == "" {
 		return false
 	}
+	// Only ppolicy is enforced by the directory itself. The status is read
+	// with the read-only account, but only told once the password is checked
+	// so that disabled accounts can't be guessed.
+	status, statusErr := userStatus(l, userDN)
 
 	err := l.Bind(userDN, password)
 	if err != nil {
+		loginFailures.WithLabelValues("invalid_credentials").Inc()
 		c.Header("WWW-Authenticate", "Basic realm=Restricted")
 		abort(c, err, http.StatusUnauthorized)
 		return false
 	}
+	if statusErr != nil {
+		loginFailures.WithLabelValues("status_unavailable").Inc()
+		abort(c, fmt.Errorf("can't check the account status: %w", statusErr), http.StatusInternalServerError)
+		return false
+	}
+	if status == statusDisabled {
+		loginFailures.WithLabelValues("account_disabled").Inc()
+		c.Header("WWW-Authenticate", "Basic realm=Restricted")
+		abort(c, errors.New("account is disabled"), http.StatusUnauthorized)
+		return false
+	}
+	setActor(c, userDN)
+	l.logger = requestLogger(c)
+	l.actor = userDN
 	c.Header("Access-Control-Allow-Origin", "*")
 	if c.FullPath() == "/api/login" {
 		var profile profile
@@ -237,16 +334,16 @@ func Login(l *ldap.Conn, c *gin.Context) bool {
 	return true
 }
 
-func findUserDNAndMail(l *ldap.Conn, c *gin.Context, username string) (string, string) {
-	err := l.Bind(conf.Ldap.RO.Username, conf.Ldap.RO.Password)
+func findUserDNAndMail(l *ldapConn, c *gin.Context, username string) (string, string) {
+	err := l.Bind(l.dir.RO.Username, l.dir.RO.Password)
 	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return "", ""
 	}
 	filter := ""
-	filter = "(&(objectClass=" + conf.Ldap.UsersObjectClassSearch + ")(cn=" + username + "))"
+	filter = "(&(objectClass=" + l.dir.UsersObjectClassSearch + ")(cn=" + username + "))"
 
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"dn", "mail"}, []ldap.Control{})
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"dn", "mail"}, []ldap.Control{})
 
 	result, err := l.Search(searchReq)
 	if err != nil {
@@ -255,11 +352,12 @@ func findUserDNAndMail(l *ldap.Conn, c *gin.Context, username string) (string, s
 	}
 
 	if len(result.Entries) > 1 {
+		loginFailures.WithLabelValues("ambiguous_username").Inc()
 		abort(c, errors.New("username isn't unique, please contact administrator"), http.StatusConflict)
 	}
 
 	if len(result.Entries) == 0 {
-		return "cn=" + username + "," + conf.Ldap.BaseDN, ""
+		return "cn=" + username + "," + l.dir.BaseDN, ""
 	}
 
 	return result.Entries[0].DN, result.Entries[0].Attributes[0].Values[0]
@@ -274,10 +372,12 @@ func CORS(c *gin.Context) {
 
 func InitHandler(c *gin.Context) {
 	l := connect(c)
-	if l != nil && Login(l, c) {
+	if l != nil && authenticate(l, c) {
 		c.Set("LDAP", l)
 	}
 
 	c.Next()
-	l.Close()
+	if l != nil {
+		l.Close()
+	}
 }
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog"
+)
+
+// ldapConn wraps an LDAP connection to log every operation done through it,
+// with its latency and result code. Credentials are never logged. It also
+// carries the directory it is bound to and who it acts for, recorded in the
+// audit log.
+type ldapConn struct {
+	*ldap.Conn
+	logger    *zerolog.Logger
+	dir       directory
+	actor     string
+	sourceIP  string
+	requestID string
+	// source is the audit source of the changes, `api` when empty
+	source     string
+	generation uint64
+}
+
+// conns tracks the open connections, so that the ones opened with a previous
+// configuration can be drained on reload.
+var conns struct {
+	sync.Mutex
+	open map[*ldapConn]bool
+}
+
+func newLdapConn(l *ldap.Conn, logger *zerolog.Logger, dir directory) *ldapConn {
+	ldapConnections.Inc()
+	conn := &ldapConn{Conn: l, logger: logger, dir: dir, generation: generation()}
+	conns.Lock()
+	defer conns.Unlock()
+	if conns.open == nil {
+		conns.open = make(map[*ldapConn]bool)
+	}
+	conns.open[conn] = true
+	return conn
+}
+
+// Close closes the connection, once: handlers releasing it early leave
+// nothing to close to InitHandler.
+func (l *ldapConn) Close() {
+	conns.Lock()
+	open := conns.open[l]
+	delete(conns.open, l)
+	conns.Unlock()
+	if open {
+		ldapConnections.Dec()
+		l.Conn.Close()
+	}
+}
+
+// staleConns returns the open connections opened before the given
+// configuration generation.
+func staleConns(before uint64) []*ldapConn {
+	conns.Lock()
+	defer conns.Unlock()
+	var stale []*ldapConn
+	for conn := range conns.open {
+		if conn.generation < before {
+			stale = append(stale, conn)
+		}
+	}
+	return stale
+}
+
+func (l *ldapConn) done(operation string, dn string, start time.Time, err error) *zerolog.Event {
+	code := uint16(ldap.LDAPResultSuccess)
+	event := l.logger.Info()
+	if err != nil {
+		code = ldap.LDAPResultOther
+		var ldapErr *ldap.Error
+		if errors.As(err, &ldapErr) {
+			code = ldapErr.ResultCode
+		}
+		event = l.logger.Warn().Err(err)
+	}
+
+	result, ok := ldap.LDAPResultCodeMap[code]
+	if !ok {
+		result = strconv.Itoa(int(code))
+	}
+	ldapOperations.WithLabelValues(operation, result).Inc()
+	ldapDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	return event.
+		Str("ldap_operation", operation).
+		Str("dn", dn).
+		Dur("latency", time.Since(start)).
+		Uint16("result_code", code)
+}
+
+func (l *ldapConn) Bind(username, password string) error {
+	start := time.Now()
+	err := l.Conn.Bind(username, password)
+	l.done("bind", username, start, err).Msg("ldap")
+	return err
+}
+
+func (l *ldapConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	start := time.Now()
+	result, err := l.Conn.Search(searchRequest)
+	entries := 0
+	if result != nil {
+		entries = len(result.Entries)
+	}
+	l.done("search", searchRequest.BaseDN, start, err).
+		Str("filter", searchRequest.Filter).
+		Int("entries", entries).
+		Msg("ldap")
+	return result, err
+}
+
+// searchPageSize is the page size of the searches which may return more
+// entries than the server size limit.
+const searchPageSize = 500
+
+func (l *ldapConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	start := time.Now()
+	result, err := l.Conn.SearchWithPaging(searchRequest, pagingSize)
+	entries := 0
+	if result != nil {
+		entries = len(result.Entries)
+	}
+	l.done("search", searchRequest.BaseDN, start, err).
+		Str("filter", searchRequest.Filter).
+		Int("entries", entries).
+		Bool("paged", true).
+		Msg("ldap")
+	return result, err
+}
+
+func (l *ldapConn) Add(addRequest *ldap.AddRequest) error {
+	start := time.Now()
+	err := l.Conn.Add(addRequest)
+	l.done("add", addRequest.DN, start, err).Msg("ldap")
+	return err
+}
+
+func (l *ldapConn) Modify(modifyRequest *ldap.ModifyRequest) error {
+	start := time.Now()
+	err := l.Conn.Modify(modifyRequest)
+	l.done("modify", modifyRequest.DN, start, err).Msg("ldap")
+	return err
+}
+
+func (l *ldapConn) ModifyDN(modifyDNRequest *ldap.ModifyDNRequest) error {
+	start := time.Now()
+	err := l.Conn.ModifyDN(modifyDNRequest)
+	l.done("modify_dn", modifyDNRequest.DN, start, err).Msg("ldap")
+	return err
+}
+
+func (l *ldapConn) Del(delRequest *ldap.DelRequest) error {
+	start := time.Now()
+	err := l.Conn.Del(delRequest)
+	l.done("delete", delRequest.DN, start, err).Msg("ldap")
+	return err
+}
+
+func (l *ldapConn) PasswordModify(passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	start := time.Now()
+	result, err := l.Conn.PasswordModify(passwordModifyRequest)
+	l.done("password_modify", passwordModifyRequest.UserIdentity, start, err).Msg("ldap")
+	return result, err
+}
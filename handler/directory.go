@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+// directoryHeader selects the directory a request applies to, when it isn't
+// given as path prefix.
+const directoryHeader = "X-Ldoups-Directory"
+
+// directory is a configured directory along with its name.
+type directory struct {
+	name string
+	*config.Directory
+}
+
+// lookupDirectory returns the named directory, the default one for an empty
+// name.
+func lookupDirectory(name string) (directory, bool) {
+	if name == "" {
+		name = config.DefaultDirectory
+	}
+	d, ok := conf().Directory(name)
+	if !ok {
+		return directory{}, false
+	}
+	return directory{name: name, Directory: &d}, true
+}
+
+func defaultDirectory() directory {
+	d, _ := lookupDirectory(config.DefaultDirectory)
+	return d
+}
+
+// allDirectories returns the default directory followed by the named ones.
+func allDirectories() []directory {
+	dirs := []directory{defaultDirectory()}
+	for name := range conf().Directories {
+		if d, ok := lookupDirectory(name); ok {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// directoryOf returns the directory the request applies to, as selected when
+// connecting.
+func directoryOf(c *gin.Context) directory {
+	if d, ok := c.Get("directory"); ok {
+		return d.(directory)
+	}
+	if d, ok := lookupDirectory(c.GetHeader(directoryHeader)); ok {
+		return d
+	}
+	return defaultDirectory()
+}
+
+// auditName is the directory name recorded in the audit log and events,
+// left empty for the default directory.
+func (d directory) auditName() string {
+	if d.name == config.DefaultDirectory {
+		return ""
+	}
+	return d.name
+}
+
+// SelectDirectory serves `/api/{directory}/...` and `/scim/{directory}/...`
+// as `/api/...` and `/scim/...` for the named directory, as if it was given
+// with the X-Ldoups-Directory header. Routes take precedence over directory
+// names.
+func SelectDirectory(router *gin.Engine) http.Handler {
+	var once sync.Once
+	routes := make(map[string]bool)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Routes are all registered once requests are served
+		once.Do(func() {
+			for _, route := range router.Routes() {
+				if prefix, segment := splitPrefix(route.Path); prefix != "" {
+					routes[prefix+segment] = true
+				}
+			}
+		})
+
+		prefix, name := splitPrefix(r.URL.Path)
+		if _, ok := conf().Directories[name]; ok && prefix != "" && !routes[prefix+name] {
+			r.URL.Path = strings.TrimSuffix(prefix, "/") + strings.TrimPrefix(r.URL.Path, prefix+name)
+			r.URL.RawPath = ""
+			r.Header.Set(directoryHeader, name)
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// splitPrefix splits API and SCIM paths after their prefix, e.g. into
+// `/api/` and `users` for `/api/users/:id`.
+func splitPrefix(path string) (string, string) {
+	for _, prefix := range []string{"/api/", "/scim/"} {
+		if strings.HasPrefix(path, prefix) {
+			segment := strings.TrimPrefix(path, prefix)
+			if i := strings.Index(segment, "/"); i >= 0 {
+				segment = segment[:i]
+			}
+			return prefix, segment
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,528 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const dynamicGroupsBucket = "dynamic_groups"
+
+// dynamicDebounce is how long user changes are gathered before dynamic groups
+// are recomputed.
+const dynamicDebounce = 5 * time.Second
+
+// dynamicGroup is a group whose members are the users matching Filter below
+// BaseDN. Enabled groups are kept in sync by the scheduler and on user
+// changes.
+type dynamicGroup struct {
+	Directory string     `json:"directory,omitempty"`
+	Group     string     `json:"group"`
+	Filter    string     `json:"filter"`
+	BaseDN    string     `json:"baseDN,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	LastRunAt *time.Time `json:"lastRunAt,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// membersDiff is the change of the members of a dynamic group.
+type membersDiff struct {
+	Add     []string `json:"add"`
+	Remove  []string `json:"remove"`
+	Members int      `json:"members"`
+}
+
+type dynamicGroupInput struct {
+	Filter  string `json:"filter"`
+	BaseDN  string `json:"baseDN"`
+	Enabled bool   `json:"enabled"`
+}
+
+var (
+	errNoSuchDynamicGroup = errors.New("not a dynamic group")
+	errNotDynamicAdmin    = errors.New("only the group owners and the dynamic groups admins can manage it")
+	errNoDynamicMembers   = errors.New("the filter matches no user, and the group needs a member: set ldap.emptyMember")
+)
+
+// dynamicRuns serializes the reconciliations, so that concurrent ones don't
+// write the same members.
+var dynamicRuns sync.Mutex
+
+var dynamicTriggers struct {
+	sync.Once
+	pending chan string
+}
+
+func (g dynamicGroup) base(dir directory) string {
+	if g.BaseDN != "" {
+		return g.BaseDN
+	}
+	return dir.BaseDN
+}
+
+func dynamicGroupKey(dir directory, group string) string {
+	return dir.name + "\x00" + strings.ToLower(group)
+}
+
+func getDynamicGroup(dir directory, group string) (dynamicGroup, error) {
+	db, err := openStore()
+	if err != nil {
+		return dynamicGroup{}, err
+	}
+	var g dynamicGroup
+	err = db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx, dynamicGroupsBucket, dynamicGroupKey(dir, group), &g)
+	})
+	if err == errNotFound {
+		return g, errNoSuchDynamicGroup
+	}
+	return g, err
+}
+
+func saveDynamicGroup(dir directory, g dynamicGroup) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx, dynamicGroupsBucket, dynamicGroupKey(dir, g.Group), g)
+	})
+}
+
+// dynamicGroupsOf returns the dynamic groups of dir.
+func dynamicGroupsOf(dir directory) ([]dynamicGroup, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	groups := []dynamicGroup{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dynamicGroupsBucket))
+		if b == nil {
+			return nil
+		}
+		prefix := []byte(dir.name + "\x00")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			var g dynamicGroup
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			groups = append(groups, g)
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// checkDynamicGroup returns the errors of the definition of a dynamic group.
+func checkDynamicGroup(g dynamicGroup) map[string]string {
+	errs := make(map[string]string)
+	if _, err := ldap.CompileFilter(g.Filter); err != nil {
+		errs["filter"] = err.Error()
+	}
+	if g.BaseDN != "" {
+		if _, err := ldap.ParseDN(g.BaseDN); err != nil {
+			errs["baseDN"] = "must be a DN"
+		}
+	}
+	return errs
+}
+
+// foldDifference returns the values of a missing from b, ignoring case as
+// DNs do.
+func foldDifference(a []string, b []string) []string {
+	diff := []string{}
+	for _, value := range a {
+		if !containsFold(b, value) {
+			diff = append(diff, value)
+		}
+	}
+	return diff
+}
+
+// diffDynamicGroup computes the members of the group following its filter,
+// and returns them along with its current members. When the filter matches
+// nobody, the only member is `ldap.emptyMember`.
+func diffDynamicGroup(l *ldapConn, g dynamicGroup) (membersDiff, []string, error) {
+	filter := "(&(objectClass=" + l.dir.UsersObjectClassSearch + ")" + g.Filter + ")"
+	searchReq := ldap.NewSearchRequest(g.base(l.dir), ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"1.1"}, []ldap.Control{})
+	result, err := l.SearchWithPaging(searchReq, searchPageSize)
+	if err != nil {
+		return membersDiff{}, nil, err
+	}
+	var matching []string
+	for _, ent := range result.Entries {
+		matching = append(matching, ent.DN)
+	}
+	count := len(matching)
+	if count == 0 && l.dir.EmptyMember != "" {
+		matching = []string{l.dir.EmptyMember}
+	}
+	group, err := readAttributes(l, g.Group, []string{"member"})
+	if err != nil {
+		return membersDiff{}, nil, err
+	}
+	current := attributeValues(group, "member")
+	return membersDiff{
+		Add:     foldDifference(matching, current),
+		Remove:  foldDifference(current, matching),
+		Members: count,
+	}, current, nil
+}
+
+// reconcileDynamicGroup adds and removes the members of the group so that
+// they match its filter, and returns the changes done. Groups whose filter
+// matches nobody are left as they are without `ldap.emptyMember`,
+// as removing every member would be refused by the directory.
+func reconcileDynamicGroup(l *ldapConn, g dynamicGroup) (membersDiff, error) {
+	diff, current, err := diffDynamicGroup(l, g)
+	if err != nil || (len(diff.Add) == 0 && len(diff.Remove) == 0) {
+		return diff, err
+	}
+	if diff.Members == 0 && len(diff.Add) == 0 {
+		return membersDiff{Add: []string{}, Remove: []string{}}, errNoDynamicMembers
+	}
+
+	modReq := ldap.NewModifyRequest(g.Group, []ldap.Control{})
+	if len(diff.Add) > 0 {
+		modReq.Add("member", diff.Add)
+	}
+	if len(diff.Remove) > 0 {
+		modReq.Delete("member", diff.Remove)
+	}
+	if err := syncMemberUid(l, modReq, g.Group, diff.Add, diff.Remove); err != nil {
+		return diff, err
+	}
+	err = l.Modify(modReq)
+	after := append(foldDifference(current, diff.Remove), diff.Add...)
+	l.recordAudit("group.update", g.Group, map[string][]string{"member": current}, map[string][]string{"member": after}, err)
+	if err != nil {
+		return diff, err
+	}
+	for _, member := range diff.Remove {
+		if err := forgetMembership(l.dir, g.Group, member); err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
+
+// reconcileDynamicGroups recomputes the members of the enabled dynamic
+// groups of dir, with the read-write account.
+func reconcileDynamicGroups(dir directory) error {
+	dynamicRuns.Lock()
+	defer dynamicRuns.Unlock()
+	groups, err := dynamicGroupsOf(dir)
+	if err != nil {
+		return err
+	}
+	var enabled []dynamicGroup
+	for _, g := range groups {
+		if g.Enabled {
+			enabled = append(enabled, g)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	l, err := dialDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for _, g := range enabled {
+		diff, err := reconcileDynamicGroup(l, g)
+		ranAt := time.Now().UTC()
+		g.LastRunAt = &ranAt
+		g.LastError = ""
+		if err != nil {
+			g.LastError = err.Error()
+			l.logger.Warn().Err(err).Str("group", g.Group).Msg("can't reconcile dynamic group")
+		} else if len(diff.Add) > 0 || len(diff.Remove) > 0 {
+			l.logger.Info().Str("group", g.Group).Int("added", len(diff.Add)).Int("removed", len(diff.Remove)).Msg("dynamic group reconciled")
+		}
+		if err := saveDynamicGroup(dir, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupDynamicGroups recomputes dynamic groups shortly after users change,
+// whether through LDOups or in the directory with `watch.mode`.
+func setupDynamicGroups() {
+	dynamicTriggers.Do(func() {
+		dynamicTriggers.pending = make(chan string, 64)
+		subscribe(func(e event) {
+			if strings.HasPrefix(e.Type, "user.") {
+				select {
+				case dynamicTriggers.pending <- e.Directory:
+				default:
+				}
+			}
+		})
+		go func() {
+			for name := range dynamicTriggers.pending {
+				time.Sleep(dynamicDebounce)
+				names := map[string]bool{name: true}
+			drain:
+				for {
+					select {
+					case name := <-dynamicTriggers.pending:
+						names[name] = true
+					default:
+						break drain
+					}
+				}
+				for name := range names {
+					dir, ok := lookupDirectory(name)
+					if !ok || dir.RW.Username == "" {
+						continue
+					}
+					if err := reconcileDynamicGroups(dir); err != nil {
+						log.Error().Err(err).Str("directory", dir.name).Msg("can't reconcile dynamic groups")
+					}
+				}
+			}
+		}()
+	})
+}
+
+// checkDynamicGroupAdmin aborts with 403 and returns false unless the logged
+// in user is a dynamic groups admin, or an owner of the group allowed to
+// manage its members with `groupOwners.delegate`. The members are written
+// with the read-write account, so the directory ACLs can't decide.
+func checkDynamicGroupAdmin(c *gin.Context, l *ldapConn, group string) bool {
+	ok := false
+	var err error
+	if admins := l.dir.DynamicGroups.Admins; len(admins) > 0 {
+		ok, err = isMemberOfAny(l, l.actor, admins)
+	}
+	if err == nil && !ok && l.dir.GroupOwners.Delegate {
+		ok, err = ownsGroup(l, l.actor, group)
+	}
+	if err != nil {
+		abortDynamicGroups(c, err)
+		return false
+	}
+	if !ok {
+		abortDynamicGroups(c, errNotDynamicAdmin)
+	}
+	return ok
+}
+
+func abortDynamicGroups(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoSuchDynamicGroup), ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		abort(c, err, http.StatusNotFound)
+	case errors.Is(err, errNotDynamicAdmin), ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	case errors.Is(err, errNoDynamicMembers):
+		abort(c, err, http.StatusUnprocessableEntity)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// GetDynamicGroups lists the dynamic groups of the request directory.
+func GetDynamicGroups(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	groups, err := dynamicGroupsOf(ldp.dir)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// GetDynamicGroup returns the definition of a dynamic group.
+func GetDynamicGroup(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	g, err := getDynamicGroup(ldp.dir, c.Param("id"))
+	if err != nil {
+		abortDynamicGroups(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+// PreviewDynamicGroup returns the members a filter would add to and remove
+// from a group, the `filter` and `baseDN` query parameters defaulting to the
+// ones of the dynamic group.
+func PreviewDynamicGroup(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	g, err := getDynamicGroup(ldp.dir, c.Param("id"))
+	if err != nil && !errors.Is(err, errNoSuchDynamicGroup) {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	g.Group = c.Param("id")
+	if filter, ok := c.GetQuery("filter"); ok {
+		g.Filter = filter
+		g.BaseDN = c.Query("baseDN")
+	}
+	if errs := checkDynamicGroup(g); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	diff, _, err := diffDynamicGroup(ldp, g)
+	if err != nil {
+		abortDynamicGroups(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// SetDynamicGroup defines the filter of a dynamic group. Enabling it
+// reconciles its members at once.
+func SetDynamicGroup(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	var input dynamicGroupInput
+	if err := c.BindJSON(&input); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	g := dynamicGroup{
+		Directory: ldp.dir.auditName(),
+		Group:     c.Param("id"),
+		Filter:    input.Filter,
+		BaseDN:    input.BaseDN,
+		Enabled:   input.Enabled,
+		UpdatedBy: ldp.actor,
+		UpdatedAt: time.Now().UTC(),
+	}
+	errs := checkDynamicGroup(g)
+	if ldp.dir.RW.Username == "" {
+		// Dynamic groups are kept in sync with the read-write account
+		errs["enabled"] = "needs ldap.rw to be set"
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if _, err := readAttributes(ldp, g.Group, []string{"1.1"}); err != nil {
+		abortDynamicGroups(c, err)
+		return
+	}
+	if !checkDynamicGroupAdmin(c, ldp, g.Group) {
+		return
+	}
+
+	dynamicRuns.Lock()
+	defer dynamicRuns.Unlock()
+	diff := membersDiff{Add: []string{}, Remove: []string{}}
+	if g.Enabled {
+		delegated, err := delegatedConn(ldp)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		defer delegated.Close()
+		if diff, err = reconcileDynamicGroup(delegated, g); err != nil {
+			abortDynamicGroups(c, err)
+			return
+		}
+		ranAt := time.Now().UTC()
+		g.LastRunAt = &ranAt
+	}
+	if err := saveDynamicGroup(ldp.dir, g); err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"group":   g,
+		"changes": diff,
+	})
+}
+
+// DeleteDynamicGroup stops keeping the members of a group in sync, leaving
+// them as they are.
+func DeleteDynamicGroup(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	group := c.Param("id")
+	if !checkDynamicGroupAdmin(c, ldp, group) {
+		return
+	}
+	dynamicRuns.Lock()
+	defer dynamicRuns.Unlock()
+	if _, err := getDynamicGroup(ldp.dir, group); err != nil {
+		abortDynamicGroups(c, err)
+		return
+	}
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(dynamicGroupsBucket)).Delete([]byte(dynamicGroupKey(ldp.dir, group)))
+	})
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+const (
+	testAlice      = "cn=alice,ou=users,dc=example,dc=org"
+	testContractor = "cn=bob,ou=contractors,dc=example,dc=org"
+	testOps        = "cn=ops,ou=groups,dc=example,dc=org"
+)
+
+// newDynamicDirectory returns a fake directory with users of two
+// departments, and testGroup with a member of each one.
+func newDynamicDirectory(t *testing.T, emptyMember string) (*fakeDirectory, *ldapConn) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org":                {"objectClass": {"domain"}},
+		"ou=users,dc=example,dc=org":       {"objectClass": {"organizationalUnit"}},
+		"ou=contractors,dc=example,dc=org": {"objectClass": {"organizationalUnit"}},
+		testUser:                           {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "departmentNumber": {"ops"}},
+		testOtherDN:                        {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}, "departmentNumber": {"ops"}},
+		testAlice:                          {"objectClass": {"inetOrgPerson"}, "cn": {"alice"}, "departmentNumber": {"dev"}},
+		testContractor:                     {"objectClass": {"inetOrgPerson"}, "cn": {"bob"}, "departmentNumber": {"ops"}},
+		testGroup:                          {"objectClass": {"groupOfNames"}, "cn": {"devs"}, "member": {"CN=Jane,ou=users,dc=example,dc=org", testAlice}},
+		testOps:                            {"objectClass": {"groupOfNames"}, "cn": {"ops"}, "member": {testAlice}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		RW:                      testReader,
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		EmptyMember:             emptyMember,
+	}
+	useTestConfig(t, c)
+	return d, d.dial(t, defaultDirectory())
+}
+
+func TestFoldDifference(t *testing.T) {
+	got := foldDifference([]string{testUser, "CN=Jane,ou=users,dc=example,dc=org", testAlice}, []string{testOtherDN, testAlice})
+	if want := []string{testUser}; !reflect.DeepEqual(got, want) {
+		t.Errorf("foldDifference() = %q, want %q", got, want)
+	}
+	if got := foldDifference(nil, []string{testUser}); got == nil || len(got) != 0 {
+		t.Errorf("foldDifference() of nothing = %#v, want an empty list", got)
+	}
+}
+
+func TestDiffDynamicGroup(t *testing.T) {
+	_, l := newDynamicDirectory(t, "")
+
+	tests := []struct {
+		name    string
+		group   dynamicGroup
+		want    membersDiff
+		current []string
+	}{
+		{
+			"whole directory",
+			dynamicGroup{Group: testGroup, Filter: "(departmentNumber=ops)"},
+			membersDiff{Add: []string{testContractor, testUser}, Remove: []string{testAlice}, Members: 3},
+			[]string{"CN=Jane,ou=users,dc=example,dc=org", testAlice},
+		},
+		{
+			"below the base DN",
+			dynamicGroup{Group: testGroup, Filter: "(departmentNumber=ops)", BaseDN: "ou=users,dc=example,dc=org"},
+			membersDiff{Add: []string{testUser}, Remove: []string{testAlice}, Members: 2},
+			[]string{"CN=Jane,ou=users,dc=example,dc=org", testAlice},
+		},
+		{
+			"up to date",
+			dynamicGroup{Group: testOps, Filter: "(cn=alice)"},
+			membersDiff{Add: []string{}, Remove: []string{}, Members: 1},
+			[]string{testAlice},
+		},
+		{
+			"matching nobody",
+			dynamicGroup{Group: testOps, Filter: "(departmentNumber=hr)"},
+			membersDiff{Add: []string{}, Remove: []string{testAlice}, Members: 0},
+			[]string{testAlice},
+		},
+	}
+	for _, tt := range tests {
+		diff, current, err := diffDynamicGroup(l, tt.group)
+		if err != nil {
+			t.Fatalf("%s: diffDynamicGroup(): %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(diff, tt.want) || !reflect.DeepEqual(current, tt.current) {
+			t.Errorf("%s: diffDynamicGroup() = %+v, %q, want %+v, %q", tt.name, diff, current, tt.want, tt.current)
+		}
+	}
+}
+
+func TestReconcileDynamicGroup(t *testing.T) {
+	d, l := newDynamicDirectory(t, "")
+	if err := setMembershipExpiry(l.dir, timedMembership{Group: testGroup, Member: testAlice, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	g := dynamicGroup{Group: testGroup, Filter: "(departmentNumber=ops)", BaseDN: "ou=users,dc=example,dc=org"}
+	diff, err := reconcileDynamicGroup(l, g)
+	if err != nil {
+		t.Fatalf("reconcileDynamicGroup(): %v", err)
+	}
+	if want := (membersDiff{Add: []string{testUser}, Remove: []string{testAlice}, Members: 2}); !reflect.DeepEqual(diff, want) {
+		t.Errorf("reconcileDynamicGroup() = %+v, want %+v", diff, want)
+	}
+	if got, want := d.get(testGroup, "member"), []string{"CN=Jane,ou=users,dc=example,dc=org", testUser}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %q, want %q", got, want)
+	}
+	if memberships, _ := timedMemberships(l.dir, testGroup); len(memberships) != 0 {
+		t.Errorf("timed memberships = %+v, want the one of the removed member forgotten", memberships)
+	}
+	if diff, err := reconcileDynamicGroup(l, g); err != nil || len(diff.Add)+len(diff.Remove) != 0 {
+		t.Errorf("reconcileDynamicGroup() again = %+v, %v, want no change", diff, err)
+	}
+
+	// Removing every member would be refused by the directory
+	nobody := dynamicGroup{Group: testOps, Filter: "(departmentNumber=hr)"}
+	if _, err := reconcileDynamicGroup(l, nobody); !errors.Is(err, errNoDynamicMembers) {
+		t.Errorf("reconcileDynamicGroup() matching nobody = %v, want errNoDynamicMembers", err)
+	}
+	if got := d.get(testOps, "member"); !reflect.DeepEqual(got, []string{testAlice}) {
+		t.Errorf("members = %q, want them kept", got)
+	}
+}
+
+func TestReconcileDynamicGroupEmptyMember(t *testing.T) {
+	empty := "cn=empty,dc=example,dc=org"
+	d, l := newDynamicDirectory(t, empty)
+	g := dynamicGroup{Group: testOps, Filter: "(departmentNumber=hr)"}
+	diff, err := reconcileDynamicGroup(l, g)
+	if err != nil {
+		t.Fatalf("reconcileDynamicGroup(): %v", err)
+	}
+	if want := (membersDiff{Add: []string{empty}, Remove: []string{testAlice}, Members: 0}); !reflect.DeepEqual(diff, want) {
+		t.Errorf("reconcileDynamicGroup() = %+v, want %+v", diff, want)
+	}
+	if got := d.get(testOps, "member"); !reflect.DeepEqual(got, []string{empty}) {
+		t.Errorf("members = %q, want %s only", got, empty)
+	}
+
+	// The empty member is replaced once the filter matches
+	g.Filter = "(departmentNumber=dev)"
+	if _, err := reconcileDynamicGroup(l, g); err != nil {
+		t.Fatalf("reconcileDynamicGroup(): %v", err)
+	}
+	if got := d.get(testOps, "member"); !reflect.DeepEqual(got, []string{testAlice}) {
+		t.Errorf("members = %q, want %s only", got, testAlice)
+	}
+}
+
+func TestReconcileDynamicGroups(t *testing.T) {
+	d, l := newDynamicDirectory(t, "")
+	for _, g := range []dynamicGroup{
+		{Group: testGroup, Filter: "(departmentNumber=ops)", Enabled: true},
+		{Group: testOps, Filter: "(departmentNumber=hr)", Enabled: true},
+		{Group: "cn=disabled,ou=groups,dc=example,dc=org", Filter: "(departmentNumber=ops)"},
+	} {
+		if err := saveDynamicGroup(l.dir, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reconcileDynamicGroups(l.dir); err != nil {
+		t.Fatalf("reconcileDynamicGroups(): %v", err)
+	}
+	if got, want := d.get(testGroup, "member"), []string{"CN=Jane,ou=users,dc=example,dc=org", testContractor, testUser}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members of %s = %q, want %q", testGroup, got, want)
+	}
+
+	groups, err := dynamicGroupsOf(l.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups {
+		switch g.Group {
+		case testGroup:
+			if g.LastRunAt == nil || g.LastError != "" {
+				t.Errorf("%s: last run at %v, error %q, want a successful run", g.Group, g.LastRunAt, g.LastError)
+			}
+		case testOps:
+			if g.LastRunAt == nil || g.LastError != errNoDynamicMembers.Error() {
+				t.Errorf("%s: last run at %v, error %q, want %q", g.Group, g.LastRunAt, g.LastError, errNoDynamicMembers)
+			}
+		default:
+			if g.LastRunAt != nil {
+				t.Errorf("%s: last run at %v, want the disabled group left alone", g.Group, g.LastRunAt)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// readAttributes returns the values of the given attributes of the entry at
+// dn, keyed by the names as spelled in names. Attributes the entry doesn't
+// hold are left out.
+func readAttributes(l *ldapConn, dn string, names []string) (map[string][]string, error) {
+	searchReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, 0, 0, 0, false, "(objectClass=*)", names, []ldap.Control{})
+
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, errors.New("no such entry: " + dn)
+	}
+
+	return entryAttributes(result.Entries[0], names), nil
+}
+
+// entryAttributes returns the attribute values of ent, keyed by the names as
+// spelled in names when they match.
+func entryAttributes(ent *ldap.Entry, names []string) map[string][]string {
+	attributes := make(map[string][]string)
+	for _, attr := range ent.Attributes {
+		name := attr.Name
+		for _, n := range names {
+			if strings.EqualFold(n, attr.Name) {
+				name = n
+				break
+			}
+		}
+		attributes[name] = attr.Values
+	}
+	return attributes
+}
+
+// escapeDN escapes an attribute value to be used in a DN, as described in
+// RFC 4514 section 2.4.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, ch := range value {
+		switch {
+		case strings.ContainsRune(`"+,;<>\=`, ch),
+			i == 0 && (ch == ' ' || ch == '#'),
+			i == len(value)-1 && ch == ' ':
+			b.WriteRune('\\')
+			b.WriteRune(ch)
+		case ch == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
+
+// groupsOf returns the DNs of the groups dn is a member of, sorted.
+func groupsOf(l *ldapConn, dn string) ([]string, error) {
+	filter := "(&(objectClass=" + l.dir.GroupsObjectClassSearch + ")(member=" + ldap.EscapeFilter(dn) + "))"
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"dn"}, []ldap.Control{})
+
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	groupDNs := []string{}
+	for _, ent := range result.Entries {
+		groupDNs = append(groupDNs, ent.DN)
+	}
+	sort.Strings(groupDNs)
+	return groupDNs, nil
+}
+
+// attributeNames returns the configured attribute names, sorted.
+func attributeNames(attributes map[string]string) []string {
+	var names []string
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// diffModifications adds to modReq the changes turning the old attribute
+// values into the new ones: removed attributes are deleted, new ones added,
+// and changed ones either replaced when no value is kept or updated value by
+// value otherwise. It returns the number of changes added.
+func diffModifications(modReq *ldap.ModifyRequest, old map[string][]string, new map[string][]string) int {
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range new {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	count := 0
+	for _, name := range sorted {
+		oldValues, newValues := old[name], new[name]
+		switch {
+		case isEmpty(oldValues) && isEmpty(newValues):
+		case isEmpty(newValues):
+			modReq.Delete(name, []string{})
+			count++
+		case isEmpty(oldValues):
+			modReq.Add(name, newValues)
+			count++
+		default:
+			added := difference(newValues, oldValues)
+			removed := difference(oldValues, newValues)
+			if len(added) == 0 && len(removed) == 0 {
+				continue
+			}
+			if len(removed) == len(oldValues) {
+				modReq.Replace(name, newValues)
+				count++
+				continue
+			}
+			if len(removed) > 0 {
+				modReq.Delete(name, removed)
+				count++
+			}
+			if len(added) > 0 {
+				modReq.Add(name, added)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// difference returns the values of a which are not in b.
+func difference(a []string, b []string) []string {
+	var diff []string
+	for _, value := range a {
+		if !contains(b, value) {
+			diff = append(diff, value)
+		}
+	}
+	return diff
+}
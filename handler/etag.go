@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+var errStaleEntry = errors.New("entry has been modified since it was read")
+
+// entryTag returns a strong ETag for the entry at dn. It is derived from
+// entryCSN when the directory maintains it, otherwise from a hash of the
+// entry attributes (modifyTimestamp included when available). With
+// withGroups, the DNs of the groups the entry is member of are part of the
+// tag too, since they are returned as memberOf for users.
+func entryTag(l *ldapConn, dn string, withGroups bool) (string, error) {
+	searchReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, 0, 0, 0, false, "(objectClass=*)", []string{"*", "entryCSN", "modifyTimestamp"}, []ldap.Control{})
+
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", errors.New("no such entry: " + dn)
+	}
+
+	h := sha256.New()
+	ent := result.Entries[0]
+	if csn := ent.GetAttributeValue("entryCSN"); csn != "" {
+		h.Write([]byte("entryCSN:" + csn + "\n"))
+	} else {
+		var lines []string
+		for _, attr := range ent.Attributes {
+			if strings.EqualFold(attr.Name, "userPassword") {
+				continue
+			}
+			for _, value := range attr.Values {
+				lines = append(lines, strings.ToLower(attr.Name)+":"+value)
+			}
+		}
+		sort.Strings(lines)
+		h.Write([]byte(strings.Join(lines, "\n")))
+	}
+
+	if withGroups {
+		groupDNs, err := groupsOf(l, dn)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte("\nmemberOf:" + strings.Join(groupDNs, ";")))
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`, nil
+}
+
+// matchTag tells if tag is listed in an If-Match or If-None-Match header
+// value. Weak validators only match when weak is set, as If-None-Match uses
+// the weak comparison.
+func matchTag(header string, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces the If-Match precondition of the request on the
+// entry at dn. It aborts with 412 and returns false when the entry changed
+// since the client read it.
+func checkIfMatch(c *gin.Context, l *ldapConn, dn string, withGroups bool) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+
+	tag, err := entryTag(l, dn, withGroups)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			abort(c, err, http.StatusPreconditionFailed)
+		} else {
+			abort(c, err, http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	if !matchTag(header, tag, false) {
+		abort(c, errStaleEntry, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatchTag(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"abc"`, false, true},
+		{`"abc"`, true, true},
+		{`"def", "abc"`, false, true},
+		{`"def"`, true, false},
+		{`*`, false, true},
+		{`W/"abc"`, false, false},
+		{`W/"abc"`, true, true},
+		{`"def", W/"abc"`, true, true},
+		{`abc`, true, false},
+	}
+	for _, tt := range tests {
+		if got := matchTag(tt.header, `"abc"`, tt.weak); got != tt.want {
+			t.Errorf("matchTag(%s, weak %v) = %v, want %v", tt.header, tt.weak, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}},
+		testGroup:           {"objectClass": {"groupOfNames"}, "cn": {"devs"}, "member": {testUser}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		GroupsObjectClassSearch: "groupOfNames",
+	}
+	useTestConfig(t, c)
+	l := d.dial(t, defaultDirectory())
+	tag, err := entryTag(l, testUser, true)
+	if err != nil {
+		t.Fatalf("entryTag(): %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		dn     string
+		want   int
+	}{
+		{"no precondition", "", testUser, http.StatusOK},
+		{"current tag", tag, testUser, http.StatusOK},
+		{"any tag", "*", testUser, http.StatusOK},
+		{"stale tag", `"stale"`, testUser, http.StatusPreconditionFailed},
+		{"weak tag", "W/" + tag, testUser, http.StatusPreconditionFailed},
+		{"tag of another entry", tag, testGroup, http.StatusPreconditionFailed},
+		{"missing entry", tag, testOtherDN, http.StatusPreconditionFailed},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPut, "/api/users/"+tt.dn, nil)
+		if tt.header != "" {
+			ctx.Request.Header.Set("If-Match", tt.header)
+		}
+		ok := checkIfMatch(ctx, l, tt.dn, true)
+		if ok != (tt.want == http.StatusOK) || (!ok && w.Code != tt.want) {
+			t.Errorf("%s: checkIfMatch() = %v, status %d, want status %d", tt.name, ok, w.Code, tt.want)
+		}
+	}
+}
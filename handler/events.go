@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	eventHistorySize = 1000
+	eventBufferSize  = 256
+	eventKeepAlive   = 15 * time.Second
+)
+
+// event describes a change done to the directory, through LDOups or not.
+type event struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Source    string            `json:"source"`
+	Directory string            `json:"directory,omitempty"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor,omitempty"`
+	Target    string            `json:"target"`
+	Changes   []attributeChange `json:"changes,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	// Details tell more about events other than changes, e.g. warnings
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// matchEventType tells whether the event type matches one of the patterns,
+// matched with path.Match, e.g. `user.*`. No pattern matches every type.
+func matchEventType(patterns []string, eventType string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var subscribers struct {
+	sync.RWMutex
+	handlers map[int]func(event)
+	next     int
+	history  []event
+}
+
+// subscribe registers handler to be called with every published event, until
+// the returned function is called. Handlers are called synchronously and must
+// not block.
+func subscribe(handler func(event)) func() {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if subscribers.handlers == nil {
+		subscribers.handlers = make(map[int]func(event))
+	}
+	id := subscribers.next
+	subscribers.next++
+	subscribers.handlers[id] = handler
+	return func() {
+		subscribers.Lock()
+		defer subscribers.Unlock()
+		delete(subscribers.handlers, id)
+	}
+}
+
+func publish(e event) {
+	subscribers.Lock()
+	subscribers.history = append(subscribers.history, e)
+	if len(subscribers.history) > eventHistorySize {
+		subscribers.history = subscribers.history[len(subscribers.history)-eventHistorySize:]
+	}
+	subscribers.Unlock()
+
+	subscribers.RLock()
+	defer subscribers.RUnlock()
+	for _, handler := range subscribers.handlers {
+		handler(e)
+	}
+}
+
+// eventsAfter returns the recent events published after the one with the
+// given ID. Event IDs sort chronologically.
+func eventsAfter(id string) []event {
+	subscribers.RLock()
+	defer subscribers.RUnlock()
+	var events []event
+	for _, e := range subscribers.history {
+		if e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// GetEvents streams the changes of the request directory as Server-Sent
+// Events, optionally filtered by `type` patterns. Only audit admins read
+// them, as they carry the attributes before and after each change. Clients
+// reconnecting with Last-Event-ID first receive the recent events they
+// missed. Clients too slow to keep up, and every client on configuration
+// reload, are disconnected and catch up when reconnecting. The directory
+// connection is only used to authenticate the client, and released before
+// streaming.
+func GetEvents(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+	ldp.Close()
+
+	patterns := c.QueryArray("type")
+	dir := ldp.dir.auditName()
+	events := make(chan event, eventBufferSize)
+	lagging := make(chan struct{})
+	var once sync.Once
+	unsubscribe := subscribe(func(e event) {
+		if e.Directory != dir || !matchEventType(patterns, e.Type) {
+			return
+		}
+		select {
+		case events <- e:
+		default:
+			once.Do(func() { close(lagging) })
+		}
+	})
+	defer unsubscribe()
+
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("lastEventId")
+	}
+	var missed []event
+	if lastID != "" {
+		for _, e := range eventsAfter(lastID) {
+			if e.Directory == dir && matchEventType(patterns, e.Type) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Sent now, so that clients see the stream open before the first event
+	c.Writer.Flush()
+	reload := reloaded()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		if len(missed) > 0 {
+			e := missed[0]
+			missed = missed[1:]
+			lastID = e.ID
+			c.Render(-1, sse.Event{Id: e.ID, Event: e.Type, Data: e})
+			return true
+		}
+		select {
+		case e := <-events:
+			// Already sent while catching up
+			if e.ID <= lastID {
+				return true
+			}
+			c.Render(-1, sse.Event{Id: e.ID, Event: e.Type, Data: e})
+			return true
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			return true
+		case <-lagging:
+			return false
+		case <-reload:
+			// Clients reconnect, and authenticate with the new configuration
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetEventsAuditAdmins(t *testing.T) {
+	admin := "cn=admin,ou=users,dc=example,dc=org"
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		admin:               {"objectClass": {"inetOrgPerson"}, "cn": {"admin"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}},
+		"cn=auditors,ou=groups,dc=example,dc=org": {"objectClass": {"groupOfNames"}, "member": {admin}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		GroupsObjectClassSearch: "groupOfNames",
+		Audit:                   config.Audit{Admins: []string{"cn=auditors,ou=groups,dc=example,dc=org"}},
+	}
+	useTestConfig(t, c)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/events", func(c *gin.Context) {
+		l := d.dial(t, defaultDirectory())
+		l.actor = c.GetHeader("X-Actor")
+		c.Set("LDAP", l)
+		c.Next()
+		l.Close()
+	}, GetEvents)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(actor string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/events", nil)
+		req.Header.Set("X-Actor", actor)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get(testUser)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("events of a user = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp = get(admin)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("events of an audit admin = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	publish(event{ID: newID(), Type: "user.update", Source: "api", Target: testUser})
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "event:") {
+			if got := strings.TrimSpace(strings.TrimPrefix(lines.Text(), "event:")); got != "user.update" {
+				t.Errorf("event type = %s, want user.update", got)
+			}
+			return
+		}
+	}
+	t.Errorf("no event received: %v", lines.Err())
+}
@@ -0,0 +1,548 @@
+package handler
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog"
+)
+
+// fakeDirectory is an in-memory LDAP server for the tests. It serves binds,
+// searches and the write operations on entries keyed by their lowercased DN,
+// and refuses to leave a groupOfNames without member as directories do.
+type fakeDirectory struct {
+	sync.Mutex
+	listener net.Listener
+	entries  map[string]*fakeEntry
+	// fail makes an operation on a DN fail with a result code, keyed by
+	// the operation name and the lowercased DN, e.g. "modify cn=jdoe,...".
+	fail map[string]uint16
+	// writes are the successful write operations, as "<operation> <dn>".
+	writes []string
+}
+
+type fakeEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// newFakeDirectory starts a fake directory holding entries, the LDIF-like
+// attributes of each DN. It is stopped at the end of the test.
+func newFakeDirectory(t *testing.T, entries map[string]map[string][]string) *fakeDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{listener: listener, entries: make(map[string]*fakeEntry), fail: make(map[string]uint16)}
+	for dn, attributes := range entries {
+		d.put(dn, attributes)
+	}
+	go d.serve()
+	t.Cleanup(func() { listener.Close() })
+	return d
+}
+
+func (d *fakeDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) put(dn string, attributes map[string][]string) {
+	copied := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		copied[name] = append([]string{}, values...)
+	}
+	d.entries[strings.ToLower(dn)] = &fakeEntry{dn: dn, attributes: copied}
+}
+
+// get returns the values of an attribute of the entry at dn, nil when the
+// entry doesn't exist.
+func (d *fakeDirectory) get(dn string, name string) []string {
+	d.Lock()
+	defer d.Unlock()
+	ent, ok := d.entries[strings.ToLower(dn)]
+	if !ok {
+		return nil
+	}
+	return attributeValues(ent.attributes, name)
+}
+
+func (d *fakeDirectory) exists(dn string) bool {
+	d.Lock()
+	defer d.Unlock()
+	_, ok := d.entries[strings.ToLower(dn)]
+	return ok
+}
+
+// failOn makes the operation on dn fail with code.
+func (d *fakeDirectory) failOn(operation string, dn string, code uint16) {
+	d.Lock()
+	defer d.Unlock()
+	d.fail[operation+" "+strings.ToLower(dn)] = code
+}
+
+// dial returns a connection to the fake directory, for dir.
+func (d *fakeDirectory) dial(t *testing.T, dir directory) *ldapConn {
+	t.Helper()
+	conn, err := ldap.DialURL(d.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	l := newLdapConn(conn, &logger, dir)
+	t.Cleanup(l.Close)
+	return l
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{d.bind(op)}
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op)
+		case ldap.ApplicationModifyRequest:
+			responses = []*ber.Packet{d.modify(op)}
+		case ldap.ApplicationAddRequest:
+			responses = []*ber.Packet{d.add(op)}
+		case ldap.ApplicationDelRequest:
+			responses = []*ber.Packet{d.del(op)}
+		case ldap.ApplicationModifyDNRequest:
+			responses = []*ber.Packet{d.modifyDN(op)}
+		case ldap.ApplicationAbandonRequest:
+			continue
+		default:
+			responses = []*ber.Packet{fakeResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform)}
+		}
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func fakeResult(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldap.LDAPResultCodeMap[code], "diagnosticMessage"))
+	return p
+}
+
+func packetString(p *ber.Packet) string {
+	return p.Data.String()
+}
+
+// failed returns the result code set for the operation on dn with failOn.
+func (d *fakeDirectory) failed(operation string, dn string) uint16 {
+	return d.fail[operation+" "+strings.ToLower(dn)]
+}
+
+func (d *fakeDirectory) bind(op *ber.Packet) *ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	dn := packetString(op.Children[1])
+	password := packetString(op.Children[2])
+	if code := d.failed("bind", dn); code != 0 {
+		return fakeResult(ldap.ApplicationBindResponse, code)
+	}
+	if ent, ok := d.entries[strings.ToLower(dn)]; ok {
+		if stored := attributeValues(ent.attributes, "userPassword"); len(stored) > 0 && stored[0] != password {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+		}
+	}
+	return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+}
+
+func (d *fakeDirectory) search(op *ber.Packet) []*ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	base := strings.ToLower(packetString(op.Children[0]))
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var names []string
+	for _, name := range op.Children[7].Children {
+		names = append(names, packetString(name))
+	}
+
+	done := func(code uint16) *ber.Packet {
+		return fakeResult(ldap.ApplicationSearchResultDone, code)
+	}
+	if code := d.failed("search", base); code != 0 {
+		return []*ber.Packet{done(code)}
+	}
+	if _, ok := d.entries[base]; !ok && base != "" {
+		return []*ber.Packet{done(ldap.LDAPResultNoSuchObject)}
+	}
+
+	var keys []string
+	for key := range d.entries {
+		switch {
+		case key == base:
+		case scope == ldap.ScopeSingleLevel && fakeParent(key) == base:
+		case scope == ldap.ScopeWholeSubtree && (base == "" || strings.HasSuffix(key, ","+base)):
+		default:
+			continue
+		}
+		if scope == ldap.ScopeSingleLevel && key == base {
+			continue
+		}
+		if fakeMatch(filter, d.entries[key]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var responses []*ber.Packet
+	for _, key := range keys {
+		ent := d.entries[key]
+		p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ent.dn, "objectName"))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+		var attrNames []string
+		for name := range ent.attributes {
+			if fakeSelected(names, name) {
+				attrNames = append(attrNames, name)
+			}
+		}
+		sort.Strings(attrNames)
+		for _, name := range attrNames {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+			values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+			for _, value := range ent.attributes[name] {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+			}
+			attribute.AppendChild(values)
+			attributes.AppendChild(attribute)
+		}
+		p.AppendChild(attributes)
+		responses = append(responses, p)
+	}
+	return append(responses, done(ldap.LDAPResultSuccess))
+}
+
+func fakeParent(key string) string {
+	if i := strings.Index(key, ","); i >= 0 {
+		return key[i+1:]
+	}
+	return ""
+}
+
+// fakeSelected tells whether the attribute is returned for the requested
+// names: all of them when none or `*` are, none for `1.1`.
+func fakeSelected(names []string, name string) bool {
+	if len(names) == 0 || contains(names, "*") {
+		return true
+	}
+	return containsFold(names, name)
+}
+
+// fakeMatch evaluates a search filter on ent, comparing values ignoring case.
+func fakeMatch(filter *ber.Packet, ent *fakeEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !fakeMatch(child, ent) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if fakeMatch(child, ent) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !fakeMatch(filter.Children[0], ent)
+	case ldap.FilterPresent:
+		return len(attributeValues(ent.attributes, packetString(filter))) > 0 || strings.EqualFold(packetString(filter), "objectClass")
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		return containsFold(attributeValues(ent.attributes, packetString(filter.Children[0])), packetString(filter.Children[1]))
+	case ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		value := strings.ToLower(packetString(filter.Children[1]))
+		for _, v := range attributeValues(ent.attributes, packetString(filter.Children[0])) {
+			v = strings.ToLower(v)
+			if (filter.Tag == ldap.FilterGreaterOrEqual && v >= value) || (filter.Tag == ldap.FilterLessOrEqual && v <= value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterSubstrings:
+		for _, v := range attributeValues(ent.attributes, packetString(filter.Children[0])) {
+			if fakeSubstrings(strings.ToLower(v), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func fakeSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(packetString(part))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+			value = value[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, s)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (d *fakeDirectory) modify(op *ber.Packet) *ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	dn := packetString(op.Children[0])
+	result := func(code uint16) *ber.Packet {
+		return fakeResult(ldap.ApplicationModifyResponse, code)
+	}
+	if code := d.failed("modify", dn); code != 0 {
+		return result(code)
+	}
+	ent, ok := d.entries[strings.ToLower(dn)]
+	if !ok {
+		return result(ldap.LDAPResultNoSuchObject)
+	}
+
+	attributes := make(map[string][]string, len(ent.attributes))
+	for name, values := range ent.attributes {
+		attributes[name] = append([]string{}, values...)
+	}
+	for _, change := range op.Children[1].Children {
+		operation := change.Children[0].Value.(int64)
+		name := packetString(change.Children[1].Children[0])
+		var values []string
+		for _, value := range change.Children[1].Children[1].Children {
+			values = append(values, packetString(value))
+		}
+		if code := fakeApply(attributes, operation, name, values); code != ldap.LDAPResultSuccess {
+			return result(code)
+		}
+	}
+	if containsFold(attributeValues(attributes, "objectClass"), "groupOfNames") && len(attributeValues(attributes, "member")) == 0 {
+		return result(ldap.LDAPResultObjectClassViolation)
+	}
+	ent.attributes = attributes
+	d.writes = append(d.writes, "modify "+dn)
+	return result(ldap.LDAPResultSuccess)
+}
+
+// fakeApply applies a modification to attributes, returning its result
+// code.
+func fakeApply(attributes map[string][]string, operation int64, name string, values []string) uint16 {
+	stored := name
+	for n := range attributes {
+		if strings.EqualFold(n, name) {
+			stored = n
+		}
+	}
+	current := attributes[stored]
+	switch operation {
+	case ldap.AddAttribute:
+		for _, value := range values {
+			if containsFold(current, value) {
+				return ldap.LDAPResultAttributeOrValueExists
+			}
+			current = append(current, value)
+		}
+	case ldap.DeleteAttribute:
+		if len(current) == 0 {
+			return ldap.LDAPResultNoSuchAttribute
+		}
+		if len(values) == 0 {
+			current = nil
+		}
+		for _, value := range values {
+			if !containsFold(current, value) {
+				return ldap.LDAPResultNoSuchAttribute
+			}
+			var kept []string
+			for _, v := range current {
+				if !strings.EqualFold(v, value) {
+					kept = append(kept, v)
+				}
+			}
+			current = kept
+		}
+	case ldap.ReplaceAttribute:
+		current = values
+	default:
+		return ldap.LDAPResultUnwillingToPerform
+	}
+	if len(current) == 0 {
+		delete(attributes, stored)
+	} else {
+		attributes[stored] = current
+	}
+	return ldap.LDAPResultSuccess
+}
+
+func (d *fakeDirectory) add(op *ber.Packet) *ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	dn := packetString(op.Children[0])
+	if code := d.failed("add", dn); code != 0 {
+		return fakeResult(ldap.ApplicationAddResponse, code)
+	}
+	if _, ok := d.entries[strings.ToLower(dn)]; ok {
+		return fakeResult(ldap.ApplicationAddResponse, ldap.LDAPResultEntryAlreadyExists)
+	}
+	attributes := make(map[string][]string)
+	for _, attribute := range op.Children[1].Children {
+		name := packetString(attribute.Children[0])
+		for _, value := range attribute.Children[1].Children {
+			attributes[name] = append(attributes[name], packetString(value))
+		}
+	}
+	d.put(dn, attributes)
+	d.writes = append(d.writes, "add "+dn)
+	return fakeResult(ldap.ApplicationAddResponse, ldap.LDAPResultSuccess)
+}
+
+func (d *fakeDirectory) del(op *ber.Packet) *ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	dn := packetString(op)
+	key := strings.ToLower(dn)
+	if code := d.failed("delete", dn); code != 0 {
+		return fakeResult(ldap.ApplicationDelResponse, code)
+	}
+	if _, ok := d.entries[key]; !ok {
+		return fakeResult(ldap.ApplicationDelResponse, ldap.LDAPResultNoSuchObject)
+	}
+	for k := range d.entries {
+		if strings.HasSuffix(k, ","+key) {
+			return fakeResult(ldap.ApplicationDelResponse, ldap.LDAPResultNotAllowedOnNonLeaf)
+		}
+	}
+	delete(d.entries, key)
+	d.writes = append(d.writes, "delete "+dn)
+	return fakeResult(ldap.ApplicationDelResponse, ldap.LDAPResultSuccess)
+}
+
+func (d *fakeDirectory) modifyDN(op *ber.Packet) *ber.Packet {
+	d.Lock()
+	defer d.Unlock()
+	dn := packetString(op.Children[0])
+	rdn := packetString(op.Children[1])
+	result := func(code uint16) *ber.Packet {
+		return fakeResult(ldap.ApplicationModifyDNResponse, code)
+	}
+	if code := d.failed("modify_dn", dn); code != 0 {
+		return result(code)
+	}
+	ent, ok := d.entries[strings.ToLower(dn)]
+	if !ok {
+		return result(ldap.LDAPResultNoSuchObject)
+	}
+	oldRDN, parent, err := splitDN(dn)
+	if err != nil {
+		return result(ldap.LDAPResultInvalidDNSyntax)
+	}
+	if len(op.Children) > 3 {
+		parent = packetString(op.Children[3])
+		if _, ok := d.entries[strings.ToLower(parent)]; !ok {
+			return result(ldap.LDAPResultNoSuchObject)
+		}
+	}
+	newDN := rdn + "," + parent
+	if _, ok := d.entries[strings.ToLower(newDN)]; ok {
+		return result(ldap.LDAPResultEntryAlreadyExists)
+	}
+
+	if op.Children[2].Value.(bool) {
+		if name, value, ok := fakeRDN(oldRDN); ok {
+			fakeApply(ent.attributes, ldap.DeleteAttribute, name, []string{value})
+		}
+	}
+	if name, value, ok := fakeRDN(rdn); ok && !containsFold(attributeValues(ent.attributes, name), value) {
+		fakeApply(ent.attributes, ldap.AddAttribute, name, []string{value})
+	}
+	delete(d.entries, strings.ToLower(dn))
+	ent.dn = newDN
+	d.entries[strings.ToLower(newDN)] = ent
+	d.writes = append(d.writes, "modify_dn "+dn)
+	return result(ldap.LDAPResultSuccess)
+}
+
+func fakeRDN(rdn string) (string, string, bool) {
+	i := strings.Index(rdn, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return rdn[:i], rdn[i+1:], true
+}
+
+// useTestConfig makes c the configuration in use for the test, with a store
+// in a temporary directory and the watch disabled unless set.
+func useTestConfig(t *testing.T, c *config.Config) {
+	t.Helper()
+	if c.Store.Path == "" {
+		c.Store.Path = t.TempDir() + "/ldoups.db"
+	}
+	if c.Watch.Mode == "" {
+		c.Watch.Mode = "none"
+	}
+	previous := currentConf.Load()
+	currentConf.Store(c)
+	t.Cleanup(func() {
+		store.Lock()
+		if store.db != nil {
+			store.db.Close()
+			store.db = nil
+		}
+		store.Unlock()
+		if previous != nil {
+			currentConf.Store(previous)
+		}
+	})
+}
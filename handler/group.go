@@ -18,7 +18,7 @@ func GetGroups(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -36,19 +36,42 @@ func GetGroups(c *gin.Context) {
 
 	filter := ""
 	if query.Q != "" {
-		filter = "(&(objectClass=" + conf.Ldap.GroupsObjectClassSearch + ")(cn=*" + query.Q + "*))"
+		filter = "(&(objectClass=" + ldp.dir.GroupsObjectClassSearch + ")(cn=*" + query.Q + "*))"
 	} else {
-		filter = "(&(objectClass=" + conf.Ldap.GroupsObjectClassSearch + "))"
+		filter = "(&(objectClass=" + ldp.dir.GroupsObjectClassSearch + "))"
 	}
 
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
+	// Owners are always returned, to tell who manages the groups
+	if len(attr) > 0 && !containsFold(attr, ldp.dir.GroupOwners.Attribute) {
+		attr = append(attr, ldp.dir.GroupOwners.Attribute)
+	}
+	searchReq := ldap.NewSearchRequest(ldp.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
 
 	result, err := ldp.Search(searchReq)
 	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
+	if query.Owner != "" {
+		owner := query.Owner
+		if owner == "me" {
+			owner = ldp.actor
+		}
+		owned, err := ownedGroups(ldp, owner)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		var entries []*ldap.Entry
+		for _, ent := range result.Entries {
+			if containsFold(owned, ent.DN) {
+				entries = append(entries, ent)
+			}
+		}
+		result.Entries = entries
+	}
 	c.Header("Access-Control-Expose-Headers", "*")
+	entriesReturned.WithLabelValues("groups").Observe(float64(len(result.Entries)))
 
 	start := 0
 	end := 0
@@ -97,7 +120,7 @@ func UpdateGroup(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -109,14 +132,53 @@ func UpdateGroup(c *gin.Context) {
 		return
 	}
 
+	if !validate(c, group, ldp.dir.GroupAttributes, ldp.dir.GroupRules, false) {
+		return
+	}
+	if !checkIfMatch(c, ldp, c.Param("id"), false) {
+		return
+	}
+
+	before, err := readAttributes(ldp, group.DN, attributeNames(ldp.dir.GroupAttributes))
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	after := make(map[string][]string)
+	for attr, values := range before {
+		after[attr] = values
+	}
+
 	modReq := ldap.NewModifyRequest(group.DN, []ldap.Control{})
-	for attr, _ := range conf.Ldap.GroupAttributes {
+	for attr, _ := range ldp.dir.GroupAttributes {
 		if val, ok := group.Attributes[attr]; ok {
 			modReq.Replace(attr, val)
+			after[attr] = val
+		}
+	}
+	if members, ok := group.Attributes["member"]; ok {
+		if err := syncMemberUid(ldp, modReq, group.DN, difference(members, before["member"]), difference(before["member"], members)); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
 		}
 	}
 
-	if err := ldp.Modify(modReq); err != nil {
+	conn := ldp
+	if onlyMembersChange(before, after) {
+		var done func()
+		if conn, done, err = membersConn(ldp, group.DN); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		defer done()
+	}
+	err = conn.Modify(modReq)
+	conn.recordAudit("group.update", group.DN, before, after, err)
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	if err := forgetChangedMemberships(ldp.dir, group.DN, before["member"], after["member"]); err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
@@ -128,7 +190,7 @@ func AddGroup(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -140,20 +202,57 @@ func AddGroup(c *gin.Context) {
 		return
 	}
 
+	if !validate(c, group, ldp.dir.GroupAttributes, ldp.dir.GroupRules, true) {
+		return
+	}
+
+	attributes := attributeNames(ldp.dir.GroupAttributes)
+	gidNumber := 0
+	if isPosix(group, "posixGroup") {
+		var errs map[string]string
+		var err error
+		gidNumber, errs, err = preparePosixGroup(ldp, &group)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+			return
+		}
+		defer releaseNumber(ldp, "gidNumber", gidNumber)
+		for _, attr := range []string{"gidNumber", "memberUid"} {
+			if !contains(attributes, attr) {
+				attributes = append(attributes, attr)
+			}
+		}
+	}
+
 	addReq := ldap.NewAddRequest(group.DN, []ldap.Control{})
-	for attr, necessity := range conf.Ldap.GroupAttributes {
+	added := make(map[string][]string)
+	for _, attr := range attributes {
 		if val, ok := group.Attributes[attr]; ok {
 			addReq.Attribute(attr, val)
-		} else if necessity == "required" {
-			abort(c, errors.New("missing attribute: "+attr), http.StatusBadRequest)
-			return
+			added[attr] = val
 		}
 	}
 
-	if err := ldp.Add(addReq); err != nil {
+	err := ldp.Add(addReq)
+	ldp.recordAudit("group.create", group.DN, nil, added, err)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	if err := forgetChangedMemberships(ldp.dir, group.DN, nil, added["member"]); err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
+	if gidNumber != 0 {
+		if err := resolveCollision(ldp, group.DN, "gidNumber", gidNumber, ldp.dir.Posix.GIDNumbers); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+	}
 }
 
 func RemoveUser(c *gin.Context) {
@@ -162,45 +261,58 @@ func RemoveUser(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
 
-	// First, get all groups
-	filter := "(objectClass=" + conf.Ldap.GroupsObjectClassSearch + ")"
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{}, []ldap.Control{})
-
-	result, err := ldp.Search(searchReq)
-	if err != nil {
+	if err := removeFromGroups(ldp, c.Param("id")); err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
+}
+
+// removeFromGroups removes dn from the members of every group it belongs to.
+// A group can't lose its last member: it is replaced with `ldap.emptyMember`,
+// or kept when there is none.
+func removeFromGroups(l *ldapConn, dn string) error {
+	groupDNs, err := groupsOf(l, dn)
+	if err != nil {
+		return err
+	}
 
-	// Get id of user
-	id := c.Param("id")
+	for _, groupDN := range groupDNs {
+		group, err := readAttributes(l, groupDN, []string{"member"})
+		if err != nil {
+			return err
+		}
+		before := attributeValues(group, "member")
+		after := foldDifference(before, []string{dn})
 
-	// For each group remove user in member
-	for _, entry := range result.Entries {
-		modReq := ldap.NewModifyRequest(entry.DN, []ldap.Control{})
-		for _, attr := range entry.Attributes {
-			if attr.Name == "member" {
-				var newVal []string
-				// Check all values in member, and put them in list except if our user id
-				for _, value := range attr.Values {
-					if value != id {
-						newVal = append(newVal, value)
-					}
-				}
-				modReq.Replace("member", attr.Values)
+		modReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
+		if len(after) == 0 {
+			if l.dir.EmptyMember == "" {
+				l.logger.Warn().Str("group", groupDN).Str("member", dn).Msg("can't remove the last member of a group without ldap.emptyMember")
+				continue
 			}
+			after = []string{l.dir.EmptyMember}
+			modReq.Replace("member", after)
+		} else {
+			modReq.Delete("member", foldDifference(before, after))
+		}
+		if err := syncMemberUid(l, modReq, groupDN, nil, []string{dn}); err != nil {
+			return err
 		}
 
-		if err := ldp.Modify(modReq); err != nil {
-			abort(c, err, http.StatusInternalServerError)
-			return
+		err = l.Modify(modReq)
+		l.recordAudit("group.remove_member", groupDN, map[string][]string{"member": before}, map[string][]string{"member": after}, err)
+		if err != nil {
+			return err
+		}
+		if err := forgetMembership(l.dir, groupDN, dn); err != nil {
+			return err
 		}
 	}
-
+	return nil
 }
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+type serverStatus struct {
+	URL            string   `json:"url"`
+	Status         string   `json:"status"`
+	Latency        float64  `json:"latencyMs"`
+	NamingContexts []string `json:"namingContexts,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Status      string                        `json:"status"`
+	CheckedAt   time.Time                     `json:"checkedAt"`
+	Servers     []serverStatus                `json:"servers"`
+	Directories map[string]directoryReadiness `json:"directories,omitempty"`
+}
+
+// directoryReadiness is the readiness of a named directory, reported apart
+// from the default one.
+type directoryReadiness struct {
+	Status  string         `json:"status"`
+	Servers []serverStatus `json:"servers"`
+}
+
+var lastReadiness struct {
+	sync.Mutex
+	result  readiness
+	expires time.Time
+	// probing is closed once the probe in progress is done
+	probing chan struct{}
+}
+
+// Health tells the process is alive, without checking the directory.
+func Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Ready checks every directory server can be bound with the read-only
+// account and its root DSE read. It answers 503 when none of the default
+// directory can, so the instance is taken out of rotation. Named directories
+// without server available only make the status `degraded`. Results are
+// cached for `health.cacheTTL`. The endpoint is anonymous: only statuses are
+// returned, the failing servers and their errors are logged.
+func Ready(c *gin.Context) {
+	result := checkReadiness()
+	body := gin.H{"status": result.Status, "checkedAt": result.CheckedAt}
+	if len(result.Directories) > 0 {
+		directories := make(map[string]string)
+		for name, dir := range result.Directories {
+			directories[name] = dir.Status
+		}
+		body["directories"] = directories
+	}
+	if result.Status == "unavailable" {
+		c.JSON(http.StatusServiceUnavailable, body)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// checkReadiness returns the cached readiness, or probes the directories
+// again once it expired. Concurrent callers wait for the probe in progress
+// instead of probing too, the lock being released while probing.
+func checkReadiness() readiness {
+	lastReadiness.Lock()
+	for lastReadiness.probing != nil && !time.Now().Before(lastReadiness.expires) {
+		probing := lastReadiness.probing
+		lastReadiness.Unlock()
+		<-probing
+		lastReadiness.Lock()
+	}
+	if time.Now().Before(lastReadiness.expires) {
+		result := lastReadiness.result
+		lastReadiness.Unlock()
+		return result
+	}
+	probing := make(chan struct{})
+	lastReadiness.probing = probing
+	lastReadiness.Unlock()
+
+	result := probeDirectories()
+
+	lastReadiness.Lock()
+	lastReadiness.result = result
+	lastReadiness.expires = time.Now().Add(conf().Health.CacheTTL)
+	lastReadiness.probing = nil
+	lastReadiness.Unlock()
+	close(probing)
+	return result
+}
+
+func probeDirectories() readiness {
+	status, servers := probeDirectory(defaultDirectory())
+	result := readiness{Status: status, CheckedAt: time.Now().UTC(), Servers: servers}
+	for name := range conf().Directories {
+		dir, _ := lookupDirectory(name)
+		status, servers := probeDirectory(dir)
+		if result.Directories == nil {
+			result.Directories = make(map[string]directoryReadiness)
+		}
+		result.Directories[name] = directoryReadiness{Status: status, Servers: servers}
+		if status != "ok" && result.Status == "ok" {
+			result.Status = "degraded"
+		}
+	}
+	return result
+}
+
+// probeDirectory probes every server of dir, which is available when one of
+// them is.
+func probeDirectory(dir directory) (string, []serverStatus) {
+	status := "unavailable"
+	var servers []serverStatus
+	for _, url := range strings.Fields(dir.Url) {
+		server := probe(dir, url)
+		if server.Status == "ok" {
+			status = "ok"
+		}
+		servers = append(servers, server)
+	}
+	if status != "ok" {
+		log.Warn().Str("directory", dir.name).Interface("servers", servers).Msg("directory unavailable")
+	}
+	return status, servers
+}
+
+func probe(dir directory, url string) (status serverStatus) {
+	timeout := conf().Health.Timeout
+	status = serverStatus{URL: url, Status: "unavailable"}
+	start := time.Now()
+	defer func() {
+		status.Latency = float64(time.Since(start).Microseconds()) / 1000
+	}()
+
+	conn, err := ldap.DialURL(url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		ldapDials.WithLabelValues("failure").Inc()
+		status.Error = err.Error()
+		return status
+	}
+	ldapDials.WithLabelValues("success").Inc()
+	l := newLdapConn(conn, &log.Logger, dir)
+	defer l.Close()
+	l.SetTimeout(timeout)
+
+	if err := l.Bind(dir.RO.Username, dir.RO.Password); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	searchReq := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, int(timeout.Seconds()), false, "(objectClass=*)", []string{"namingContexts"}, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if len(result.Entries) > 0 {
+		status.NamingContexts = result.Entries[0].GetAttributeValues("namingContexts")
+	}
+
+	status.Status = "ok"
+	return status
+}
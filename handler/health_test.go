@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// unreachableURL returns the url of a port nothing listens on.
+func unreachableURL(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return "ldap://" + listener.Addr().String()
+}
+
+var testReader = config.Credentials{Username: "cn=reader,dc=example,dc=org", Password: "secret"}
+
+func resetReadiness(t *testing.T) {
+	lastReadiness.Lock()
+	lastReadiness.expires = time.Time{}
+	lastReadiness.Unlock()
+	t.Cleanup(func() {
+		lastReadiness.Lock()
+		lastReadiness.expires = time.Time{}
+		lastReadiness.Unlock()
+	})
+}
+
+func TestReady(t *testing.T) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+	})
+	down := unreachableURL(t)
+
+	tests := []struct {
+		name        string
+		url         string
+		labURL      string
+		wantCode    int
+		wantStatus  string
+		directories map[string]interface{}
+	}{
+		{"available", d.url(), "", http.StatusOK, "ok", nil},
+		{"degraded", down + " " + d.url(), down, http.StatusOK, "degraded", map[string]interface{}{"lab": "unavailable"}},
+		{"unavailable", down, d.url(), http.StatusServiceUnavailable, "unavailable", map[string]interface{}{"lab": "ok"}},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		c := &config.Config{}
+		c.Ldap = config.Directory{BaseDN: "dc=example,dc=org", Url: tt.url, RO: testReader}
+		if tt.labURL != "" {
+			c.Directories = map[string]config.Directory{"lab": {BaseDN: "dc=example,dc=org", Url: tt.labURL, RO: testReader}}
+		}
+		c.Health.CacheTTL = time.Minute
+		c.Health.Timeout = time.Second
+		useTestConfig(t, c)
+		resetReadiness(t)
+
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		Ready(ctx)
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid response %s: %v", tt.name, w.Body, err)
+		}
+		if w.Code != tt.wantCode || body["status"] != tt.wantStatus {
+			t.Errorf("%s: Ready() = %d %v, want %d %s", tt.name, w.Code, body["status"], tt.wantCode, tt.wantStatus)
+		}
+		if _, ok := body["servers"]; ok {
+			t.Errorf("%s: Ready() returned the servers to an anonymous caller: %s", tt.name, w.Body)
+		}
+		if directories, _ := body["directories"].(map[string]interface{}); !reflect.DeepEqual(directories, tt.directories) {
+			t.Errorf("%s: directories = %v, want %v", tt.name, directories, tt.directories)
+		}
+	}
+}
+
+// TestCheckReadinessCached checks that the result is cached, and that the
+// cache isn't locked while probing.
+func TestCheckReadinessCached(t *testing.T) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{BaseDN: "dc=example,dc=org", Url: d.url(), RO: testReader}
+	c.Health.CacheTTL = time.Minute
+	c.Health.Timeout = time.Second
+	useTestConfig(t, c)
+	resetReadiness(t)
+
+	first := checkReadiness()
+	d.failOn("bind", testReader.Username, ldap.LDAPResultUnavailable)
+	if second := checkReadiness(); second.CheckedAt != first.CheckedAt || second.Status != "ok" {
+		t.Errorf("checkReadiness() = %+v, want the cached result", second)
+	}
+
+	lastReadiness.Lock()
+	lastReadiness.expires = time.Time{}
+	probing := make(chan struct{})
+	lastReadiness.probing = probing
+	lastReadiness.Unlock()
+	done := make(chan readiness)
+	go func() {
+		done <- checkReadiness()
+	}()
+	// The waiting caller gets the result of the probe in progress
+	lastReadiness.Lock()
+	lastReadiness.result = readiness{Status: "degraded"}
+	lastReadiness.expires = time.Now().Add(time.Minute)
+	lastReadiness.probing = nil
+	lastReadiness.Unlock()
+	close(probing)
+	if result := <-done; result.Status != "degraded" {
+		t.Errorf("checkReadiness() = %s, want the result of the probe in progress", result.Status)
+	}
+}
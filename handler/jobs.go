@@ -0,0 +1,598 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	jobsBucket = "jobs"
+	// warningsBucket holds the expiry warnings already sent
+	warningsBucket = "expiry_warnings"
+	// failedJobsBucket holds the ID of the failed jobs retried by the
+	// scheduler, so that they are recorded once
+	failedJobsBucket = "failed_jobs"
+)
+
+// job is an action of the scheduler on a user: `warn` ahead of its expiry,
+// `disable` on expiry, `delete` after the grace period and `remove_member`
+// from Group at the end of a time-bound membership. A failed job is retried
+// on the next runs, its record keeping the number of Attempts.
+type job struct {
+	ID         string     `json:"id,omitempty"`
+	Directory  string     `json:"directory,omitempty"`
+	Action     string     `json:"action"`
+	Target     string     `json:"target"`
+	Group      string     `json:"group,omitempty"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	DueAt      time.Time  `json:"dueAt"`
+	ExecutedAt *time.Time `json:"executedAt,omitempty"`
+	DaysLeft   int        `json:"daysLeft,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts,omitempty"`
+}
+
+var jobs sync.Once
+
+// setupJobs starts the scheduler once a directory has a read-write account,
+// to remove the expired time-bound members, reconcile the dynamic groups and
+// expire the accounts of the directories with an expiry attribute. It runs
+// every `jobs.interval` and on configuration reload.
+func setupJobs() error {
+	scheduled := false
+	for _, dir := range allDirectories() {
+		if dir.RW.Username != "" {
+			scheduled = true
+		}
+	}
+	if !scheduled {
+		return nil
+	}
+	if _, err := openStore(); err != nil {
+		return err
+	}
+	setupDynamicGroups()
+	jobs.Do(func() {
+		go func() {
+			for {
+				runJobs()
+				select {
+				case <-time.After(conf().Jobs.Interval):
+				case <-reloaded():
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+func runJobs() {
+	for _, dir := range allDirectories() {
+		if dir.Expiry.Attribute != "" {
+			if err := expireAccounts(dir); err != nil {
+				log.Error().Err(err).Str("directory", dir.name).Msg("can't run expiry jobs")
+			}
+		}
+		if dir.RW.Username != "" {
+			if err := expireMemberships(dir); err != nil {
+				log.Error().Err(err).Str("directory", dir.name).Msg("can't remove expired members")
+			}
+			if err := reconcileDynamicGroups(dir); err != nil {
+				log.Error().Err(err).Str("directory", dir.name).Msg("can't reconcile dynamic groups")
+			}
+		}
+	}
+	pruneJobs()
+}
+
+// parseExpiry reads an expiry date in the format of `expiry.format`.
+// shadowExpire values of 0 or less mean the account doesn't expire.
+func parseExpiry(format string, value string) (time.Time, bool) {
+	switch format {
+	case "days":
+		days, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || days <= 0 {
+			return time.Time{}, false
+		}
+		return time.Unix(days*24*60*60, 0).UTC(), true
+	case "date":
+		t, err := time.Parse("2006-01-02", value)
+		return t, err == nil
+	default:
+		t, err := time.Parse("20060102150405Z0700", value)
+		return t.UTC(), err == nil
+	}
+}
+
+// formatExpiry is the parseExpiry counterpart. Days and dates are rounded
+// down to the day.
+func formatExpiry(format string, t time.Time) string {
+	t = t.UTC()
+	switch format {
+	case "days":
+		return strconv.FormatInt(t.Unix()/(24*60*60), 10)
+	case "date":
+		return t.Format("2006-01-02")
+	default:
+		return t.Format("20060102150405Z")
+	}
+}
+
+// expiryBases are the DNs where expiring users are searched, the disabled OU
+// being possibly out of the base DN.
+func expiryBases(dir directory) []string {
+	bases := []string{dir.BaseDN}
+	if dir.Accounts.DisabledOU != "" && !isUnder(dir.Accounts.DisabledOU, dir.BaseDN) {
+		bases = append(bases, dir.Accounts.DisabledOU)
+	}
+	return bases
+}
+
+// expiryJobs returns the actions due on the users of the directory having
+// an expiry date, executed or not, sorted by due date.
+func expiryJobs(l *ldapConn) ([]job, error) {
+	expiry := l.dir.Expiry
+	disabled, err := disabledAccounts(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	warned, err := sentWarnings(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var planned []job
+	for _, base := range expiryBases(l.dir) {
+		filter := "(&(objectClass=" + l.dir.UsersObjectClassSearch + ")(" + expiry.Attribute + "=*))"
+		searchReq := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, statusAttributes(l.dir), []ldap.Control{})
+		result, err := l.Search(searchReq)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ent := range result.Entries {
+			expiresAt, ok := parseExpiry(expiry.Format, ent.GetAttributeValue(expiry.Attribute))
+			if !ok {
+				continue
+			}
+			status := accountStatus(l.dir, ent.DN, entryAttributes(ent, nil), disabled)
+			add := func(action string, dueAt time.Time, daysLeft int) {
+				planned = append(planned, job{Directory: l.dir.auditName(), Action: action, Target: ent.DN, ExpiresAt: expiresAt, DueAt: dueAt, DaysLeft: daysLeft, Status: "upcoming"})
+			}
+
+			if status != statusDisabled && now.Before(expiresAt) {
+				for _, days := range expiry.WarnDays {
+					if !warned[warningKey(l.dir, ent.DN, expiresAt, days)] {
+						add("warn", expiresAt.AddDate(0, 0, -days), days)
+					}
+				}
+			}
+			if status != statusDisabled {
+				add("disable", expiresAt, 0)
+				continue
+			}
+			if expiry.GracePeriod > 0 {
+				// The grace period starts once disabled through LDOups and
+				// expired, accounts disabled otherwise being left alone
+				account, err := getDisabledAccount(l.dir, ent.DN)
+				if errors.Is(err, errNotFound) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				start := expiresAt
+				if account.DisabledAt.After(start) {
+					start = account.DisabledAt
+				}
+				add("delete", start.Add(expiry.GracePeriod), 0)
+			}
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool {
+		return planned[i].DueAt.Before(planned[j].DueAt)
+	})
+	return planned, nil
+}
+
+// warningKey identifies a warning sent days ahead of an expiry date, so that
+// moving the date warns again.
+func warningKey(dir directory, dn string, expiresAt time.Time, days int) string {
+	return fmt.Sprintf("%s:%s:%s:%d", dir.name, strings.ToLower(dn), expiresAt.Format(time.RFC3339), days)
+}
+
+// sentWarnings returns the keys of the warnings already sent for the users
+// of dir.
+func sentWarnings(dir directory) (map[string]bool, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	warned := make(map[string]bool)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(warningsBucket))
+		if b == nil {
+			return nil
+		}
+		prefix := dir.name + ":"
+		return b.ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(string(k), prefix) {
+				warned[string(k)] = true
+			}
+			return nil
+		})
+	})
+	return warned, err
+}
+
+// dialDirectory opens a connection to dir bound with the read-write
+// account, for the jobs run outside of requests.
+func dialDirectory(dir directory) (*ldapConn, error) {
+	return dialDirectoryAs(dir, dir.RW)
+}
+
+// dialDirectoryAs opens a connection to dir bound with creds.
+func dialDirectoryAs(dir directory, creds config.Credentials) (*ldapConn, error) {
+	var conn *ldap.Conn
+	err := errors.New("no ldap url configured")
+	for _, url := range strings.Fields(dir.Url) {
+		if conn, err = ldap.DialURL(url); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		ldapDials.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+	ldapDials.WithLabelValues("success").Inc()
+	l := newLdapConn(conn, &log.Logger, dir)
+	l.actor = creds.Username
+	l.source = "job"
+	if err := l.Bind(creds.Username, creds.Password); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// expireAccounts executes the expiry actions due on the users of dir.
+func expireAccounts(dir directory) error {
+	l, err := dialDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	planned, err := expiryJobs(l)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, j := range planned {
+		if j.DueAt.After(now) {
+			break
+		}
+		err := executeJob(l, j)
+		if err == errAlreadyDisabled {
+			continue
+		}
+		executedAt := time.Now().UTC()
+		j.ID = newID()
+		j.ExecutedAt = &executedAt
+		j.Status = "done"
+		if err != nil {
+			j.Status = "failed"
+			j.Error = err.Error()
+			l.logger.Warn().Err(err).Str("action", j.Action).Str("target", j.Target).Msg("expiry job failed")
+		}
+		if err := saveJob(l.dir, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func executeJob(l *ldapConn, j job) error {
+	switch j.Action {
+	case "warn":
+		publish(event{
+			ID:        newID(),
+			Type:      "user.expiry_warning",
+			Source:    "job",
+			Directory: l.dir.auditName(),
+			Time:      time.Now().UTC(),
+			Target:    j.Target,
+			Details: map[string]interface{}{
+				"expiresAt": j.ExpiresAt,
+				"daysLeft":  j.DaysLeft,
+			},
+		})
+		return nil
+	case "disable":
+		_, err := disableAccount(l, j.Target)
+		return err
+	case "delete":
+		before, err := readAttributes(l, j.Target, []string{"*"})
+		if err != nil {
+			return err
+		}
+		err = l.Del(ldap.NewDelRequest(j.Target, []ldap.Control{}))
+		l.recordAudit("user.delete", j.Target, before, nil, err)
+		if err != nil {
+			return err
+		}
+		if err := removeFromGroups(l, j.Target); err != nil {
+			return err
+		}
+		return deleteDisabledAccount(l.dir, j.Target)
+	}
+	return fmt.Errorf("unknown job action %q", j.Action)
+}
+
+func failedJobKey(dir directory, j job) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%s", dir.name, j.Action, strings.ToLower(j.Target), strings.ToLower(j.Group), j.DueAt.Format(time.RFC3339))
+}
+
+// saveJob records an executed job. The record of a job which failed before
+// is updated instead of adding one on every attempt.
+func saveJob(dir directory, j job) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		key := failedJobKey(dir, j)
+		j.Attempts = 1
+		var id string
+		if getJSON(tx, failedJobsBucket, key, &id) == nil {
+			var previous job
+			if getJSON(tx, jobsBucket, id, &previous) == nil {
+				j.ID = id
+				j.Attempts = previous.Attempts + 1
+			}
+		}
+		if j.Status == "failed" {
+			if err := putJSON(tx, failedJobsBucket, key, j.ID); err != nil {
+				return err
+			}
+		} else if b := tx.Bucket([]byte(failedJobsBucket)); b != nil {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if j.Action == "warn" {
+			if err := putJSON(tx, warningsBucket, warningKey(dir, j.Target, j.ExpiresAt, j.DaysLeft), j.ExecutedAt); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, jobsBucket, j.ID, j)
+	})
+}
+
+// pruneJobs forgets the jobs executed more than `jobs.retention` ago, and
+// the warnings of accounts expired for as long. Failed jobs being updated
+// when retried, the keys don't follow the execution time.
+func pruneJobs() {
+	before := time.Now().Add(-conf().Jobs.Retention)
+
+	db, err := openStore()
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(jobsBucket)); b != nil {
+			var expired [][]byte
+			b.ForEach(func(k, v []byte) error {
+				var j job
+				if json.Unmarshal(v, &j) == nil && j.ExecutedAt != nil && j.ExecutedAt.Before(before) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		if b := tx.Bucket([]byte(warningsBucket)); b != nil {
+			var expired [][]byte
+			b.ForEach(func(k, v []byte) error {
+				var sentAt time.Time
+				if json.Unmarshal(v, &sentAt) == nil && sentAt.Before(before) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("can't prune jobs")
+	}
+}
+
+// GetJobs returns the scheduled actions of the request directory: the ones due
+// within `days` (30 by default) and the `limit` last executed ones (100 by
+// default), filtered by `action` and `target`. Only audit admins read them.
+func GetJobs(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+
+	errs := make(map[string]string)
+	days, limit := 30, 100
+	for name, value := range map[string]*int{"days": &days, "limit": &limit} {
+		if raw := c.Query(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				errs[name] = "invalid " + name
+			}
+			*value = n
+		}
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errors.New("invalid query"), http.StatusBadRequest, errs)
+		return
+	}
+	action, target := c.Query("action"), c.Query("target")
+	match := func(j job) bool {
+		return (action == "" || j.Action == action) && (target == "" || strings.EqualFold(j.Target, target))
+	}
+
+	planned, err := membershipJobs(ldp.dir)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	if ldp.dir.Expiry.Attribute != "" {
+		expiries, err := expiryJobs(ldp)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		planned = append(planned, expiries...)
+	}
+	upcoming := []job{}
+	until := time.Now().AddDate(0, 0, days)
+	for _, j := range planned {
+		if !j.DueAt.After(until) && match(j) {
+			upcoming = append(upcoming, j)
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return upcoming[i].DueAt.Before(upcoming[j].DueAt)
+	})
+
+	executed := []job{}
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		if b == nil {
+			return nil
+		}
+		cursor := b.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if j.Directory == ldp.dir.auditName() && match(j) {
+				executed = append(executed, j)
+				if limit > 0 && len(executed) >= limit {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"upcoming": upcoming,
+		"executed": executed,
+	})
+}
+
+// expiryRequest tells an absent expiresAt, refused, from a null one.
+type expiryRequest struct {
+	ExpiresAt json.RawMessage `json:"expiresAt"`
+}
+
+// SetUserExpiry sets the expiry date of a user, or removes it when null.
+// Moving the date reschedules the jobs of the user.
+func SetUserExpiry(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	expiry := ldp.dir.Expiry
+	if expiry.Attribute == "" {
+		abort(c, errors.New("no expiry attribute configured"), http.StatusNotImplemented)
+		return
+	}
+	var req expiryRequest
+	if err := c.BindJSON(&req); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if len(req.ExpiresAt) == 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"expiresAt": "is required, null to remove the expiry"})
+		return
+	}
+	if err := json.Unmarshal(req.ExpiresAt, &expiresAt); err != nil {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"expiresAt": "must be an RFC 3339 date or null"})
+		return
+	}
+
+	dn := c.Param("id")
+	before, err := readAttributes(ldp, dn, []string{expiry.Attribute})
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	after := make(map[string][]string)
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	if expiresAt != nil {
+		value := formatExpiry(expiry.Format, *expiresAt)
+		modReq.Replace(expiry.Attribute, []string{value})
+		after[expiry.Attribute] = []string{value}
+	} else if len(attributeValues(before, expiry.Attribute)) > 0 {
+		modReq.Delete(expiry.Attribute, []string{})
+	}
+
+	if len(modReq.Changes) > 0 {
+		err = ldp.Modify(modReq)
+		ldp.recordAudit("user.expiry", dn, before, after, err)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"dn": dn, "expiresAt": accountExpiry(ldp.dir, after)})
+}
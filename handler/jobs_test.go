@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		format, value string
+		want          time.Time
+		ok            bool
+	}{
+		{"days", "19388", time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC), true},
+		{"days", "1", time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"days", "0", time.Time{}, false},
+		{"days", "-1", time.Time{}, false},
+		{"days", "soon", time.Time{}, false},
+		{"date", "2023-01-31", time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC), true},
+		{"date", "31/01/2023", time.Time{}, false},
+		{"generalizedTime", "20230131120000Z", time.Date(2023, 1, 31, 12, 0, 0, 0, time.UTC), true},
+		{"generalizedTime", "20230131120000+0100", time.Date(2023, 1, 31, 11, 0, 0, 0, time.UTC), true},
+		{"", "20230131120000Z", time.Date(2023, 1, 31, 12, 0, 0, 0, time.UTC), true},
+		{"generalizedTime", "2023-01-31", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseExpiry(tt.format, tt.value)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseExpiry(%q, %q) = %v, %v, want %v, %v", tt.format, tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatExpiry(t *testing.T) {
+	paris := time.FixedZone("CET", 3600)
+	tests := []struct {
+		format string
+		t      time.Time
+		want   string
+	}{
+		{"days", time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC), "19388"},
+		{"days", time.Date(2023, 1, 31, 23, 59, 59, 0, time.UTC), "19388"},
+		{"days", time.Date(2023, 2, 1, 0, 30, 0, 0, paris), "19388"},
+		{"date", time.Date(2023, 1, 31, 18, 0, 0, 0, time.UTC), "2023-01-31"},
+		{"date", time.Date(2023, 2, 1, 0, 30, 0, 0, paris), "2023-01-31"},
+		{"generalizedTime", time.Date(2023, 1, 31, 12, 0, 0, 0, paris), "20230131110000Z"},
+		{"", time.Date(2023, 1, 31, 12, 0, 0, 0, time.UTC), "20230131120000Z"},
+	}
+	for _, tt := range tests {
+		if got := formatExpiry(tt.format, tt.t); got != tt.want {
+			t.Errorf("formatExpiry(%q, %v) = %q, want %q", tt.format, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestExpiryRoundTrip(t *testing.T) {
+	expiresAt := time.Date(2027, 1, 31, 0, 0, 0, 0, time.UTC)
+	for _, format := range []string{"days", "date", "generalizedTime"} {
+		got, ok := parseExpiry(format, formatExpiry(format, expiresAt))
+		if !ok || !got.Equal(expiresAt) {
+			t.Errorf("%s: parseExpiry(formatExpiry(%v)) = %v, %v", format, expiresAt, got, ok)
+		}
+	}
+}
+
+// newExpiryDirectory returns a fake directory whose users expire, disabled
+// with ppolicy and deleted after a grace period of 30 days.
+func newExpiryDirectory(t *testing.T, users map[string]map[string][]string) (*fakeDirectory, directory) {
+	entries := map[string]map[string][]string{
+		"dc=example,dc=org":          {"objectClass": {"domain"}},
+		"ou=users,dc=example,dc=org": {"objectClass": {"organizationalUnit"}},
+	}
+	for dn, attributes := range users {
+		entries[dn] = attributes
+	}
+	d := newFakeDirectory(t, entries)
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		RW:                      config.Credentials{Username: "cn=admin,dc=example,dc=org", Password: "secret"},
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		Accounts:                config.Accounts{Disable: []string{"ppolicy"}},
+		Expiry: config.Expiry{
+			Attribute:   "shadowExpire",
+			Format:      "days",
+			WarnDays:    []int{7},
+			GracePeriod: 30 * 24 * time.Hour,
+		},
+	}
+	useTestConfig(t, c)
+	return d, defaultDirectory()
+}
+
+func expiringUser(name string, expiresAt time.Time, attributes ...string) map[string][]string {
+	user := map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {name}, "shadowExpire": {formatExpiry("days", expiresAt)}}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		user[attributes[i]] = []string{attributes[i+1]}
+	}
+	return user
+}
+
+func TestExpiryJobs(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	expired := today.AddDate(0, 0, -60)
+	soon := today.AddDate(0, 0, 5)
+	d, dir := newExpiryDirectory(t, map[string]map[string][]string{
+		"cn=expired,ou=users,dc=example,dc=org":  expiringUser("expired", expired),
+		"cn=disabled,ou=users,dc=example,dc=org": expiringUser("disabled", expired, "pwdAccountLockedTime", permanentLock),
+		"cn=outside,ou=users,dc=example,dc=org":  expiringUser("outside", expired, "pwdAccountLockedTime", permanentLock),
+		"cn=soon,ou=users,dc=example,dc=org":     expiringUser("soon", soon),
+	})
+	disabledAt := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+	if err := saveDisabledAccount(dir, disabledAccount{DN: "cn=disabled,ou=users,dc=example,dc=org", DisabledDN: "cn=disabled,ou=users,dc=example,dc=org", Strategies: []string{"ppolicy"}, DisabledAt: disabledAt}); err != nil {
+		t.Fatal(err)
+	}
+	l := d.dial(t, dir)
+
+	planned, err := expiryJobs(l)
+	if err != nil {
+		t.Fatalf("expiryJobs(): %v", err)
+	}
+	var got []string
+	for _, j := range planned {
+		got = append(got, j.Action+" "+j.Target+" "+j.DueAt.Format(time.RFC3339))
+	}
+	want := []string{
+		"disable cn=expired,ou=users,dc=example,dc=org " + expired.Format(time.RFC3339),
+		"warn cn=soon,ou=users,dc=example,dc=org " + soon.AddDate(0, 0, -7).Format(time.RFC3339),
+		"disable cn=soon,ou=users,dc=example,dc=org " + soon.Format(time.RFC3339),
+		"delete cn=disabled,ou=users,dc=example,dc=org " + disabledAt.Add(30*24*time.Hour).Format(time.RFC3339),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expiryJobs() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestExpireAccounts checks that accounts expired long ago are disabled
+// first, and only deleted once disabled for the grace period.
+func TestExpireAccounts(t *testing.T) {
+	expired := time.Now().UTC().AddDate(0, 0, -60)
+	user := "cn=expired,ou=users,dc=example,dc=org"
+	d, dir := newExpiryDirectory(t, map[string]map[string][]string{
+		user: expiringUser("expired", expired),
+	})
+
+	if err := expireAccounts(dir); err != nil {
+		t.Fatalf("expireAccounts(): %v", err)
+	}
+	if !d.exists(user) {
+		t.Fatal("the expired user was deleted without grace period")
+	}
+	if got := d.get(user, "pwdAccountLockedTime"); !reflect.DeepEqual(got, []string{permanentLock}) {
+		t.Errorf("pwdAccountLockedTime = %q, want %s", got, permanentLock)
+	}
+	if err := expireAccounts(dir); err != nil {
+		t.Fatalf("expireAccounts() again: %v", err)
+	}
+	if !d.exists(user) {
+		t.Fatal("the disabled user was deleted before the end of the grace period")
+	}
+
+	account, err := getDisabledAccount(dir, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.DisabledAt = account.DisabledAt.Add(-31 * 24 * time.Hour)
+	if err := saveDisabledAccount(dir, account); err != nil {
+		t.Fatal(err)
+	}
+	if err := expireAccounts(dir); err != nil {
+		t.Fatalf("expireAccounts() after the grace period: %v", err)
+	}
+	if d.exists(user) {
+		t.Error("the user wasn't deleted after the grace period")
+	}
+	if _, err := getDisabledAccount(dir, user); !errors.Is(err, errNotFound) {
+		t.Errorf("the deleted user is still recorded as disabled: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Query parameters and option names whose values never reach the logs.
+var secretNames = []string{"password", "secret", "token", "authorization"}
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// logFormat is the format of the global logger, which is only replaced when
+// the format changes.
+var logFormat string
+
+// setupLogger configures the global logger from conf().Log.
+func setupLogger() {
+	level, err := zerolog.ParseLevel(strings.ToLower(conf().Log.Level))
+	if err != nil {
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+
+	if conf().Log.Format == logFormat {
+		return
+	}
+	logFormat = conf().Log.Format
+	if logFormat == "console" {
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+	} else {
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	}
+}
+
+// requestLogger returns the logger of the request, carrying its ID, route
+// and actor.
+func requestLogger(c *gin.Context) *zerolog.Logger {
+	logger := zerolog.Ctx(c.Request.Context())
+	if logger.GetLevel() == zerolog.Disabled {
+		return &log.Logger
+	}
+	return logger
+}
+
+// RequestID tags the request with the X-Request-ID header sent by the client,
+// or a generated one, and attaches a logger carrying it to the request.
+func RequestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Set("requestID", id)
+	c.Header("X-Request-ID", id)
+
+	logger := log.Logger.With().Str("request_id", id).Str("route", c.FullPath()).Logger()
+	c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+}
+
+// setActor records the DN of the authenticated user, added to every
+// following log line of the request.
+func setActor(c *gin.Context, dn string) {
+	c.Set("actor", dn)
+	logger := requestLogger(c).With().Str("actor", dn).Logger()
+	c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+}
+
+// setDirectory records the directory the request applies to, added to every
+// following log line of the request unless it is the default one.
+func setDirectory(c *gin.Context, dir directory) {
+	c.Set("directory", dir)
+	if name := dir.auditName(); name != "" {
+		logger := requestLogger(c).With().Str("directory", name).Logger()
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+	}
+}
+
+// RequestLogger logs one line per request once it has been handled.
+func RequestLogger(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	logger := requestLogger(c)
+	event := logger.Info()
+	if status >= http.StatusInternalServerError {
+		event = logger.Error()
+	} else if status >= http.StatusBadRequest {
+		event = logger.Warn()
+	}
+	event.
+		Str("method", c.Request.Method).
+		Str("path", redactedPath(c.Request.URL)).
+		Str("client_ip", c.ClientIP()).
+		Int("status", status).
+		Dur("latency", time.Since(start)).
+		Int("size", c.Writer.Size()).
+		Msg("request")
+}
+
+// Recovery turns panics into 500 errors, logging them without dumping the
+// request, whose headers hold credentials.
+func Recovery(c *gin.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			requestLogger(c).Error().
+				Interface("panic", r).
+				Str("stack", string(debug.Stack())).
+				Msg("panic recovered")
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}()
+	c.Next()
+}
+
+// redactedPath returns the path and query of u, with secret values masked.
+func redactedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	for name := range query {
+		if isSecret(name) {
+			query[name] = []string{"REDACTED"}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// redactOptions returns a copy of options with secret values masked.
+func redactOptions(options map[string]string) map[string]string {
+	redacted := make(map[string]string, len(options))
+	for name, value := range options {
+		if isSecret(name) {
+			value = "REDACTED"
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// membershipsBucket holds the time-bound memberships. groupOfNames has no
+// per-value metadata, so their expiry is kept aside.
+const membershipsBucket = "memberships"
+
+// timedMembership is the membership of Member to Group, removed by the
+// scheduler at ExpiresAt.
+type timedMembership struct {
+	Directory string    `json:"directory,omitempty"`
+	Group     string    `json:"group"`
+	Member    string    `json:"member"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	AddedBy   string    `json:"addedBy,omitempty"`
+	AddedAt   time.Time `json:"addedAt"`
+	// AccessRequest is the approved request the membership comes from
+	AccessRequest string `json:"accessRequest,omitempty"`
+}
+
+// memberExpiry is the expiry of a member returned with its group.
+type memberExpiry struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+	Remaining string    `json:"remaining"`
+}
+
+// membershipPrefix is the key prefix of the memberships of group, or of
+// every group of dir when empty.
+func membershipPrefix(dir directory, group string) string {
+	if group == "" {
+		return dir.name + "\x00"
+	}
+	return dir.name + "\x00" + strings.ToLower(group) + "\x00"
+}
+
+func membershipKey(dir directory, group string, member string) string {
+	return membershipPrefix(dir, group) + strings.ToLower(member)
+}
+
+// setMembershipExpiry records that the membership ends at m.ExpiresAt.
+func setMembershipExpiry(dir directory, m timedMembership) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	m.Directory = dir.auditName()
+	return db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx, membershipsBucket, membershipKey(dir, m.Group, m.Member), m)
+	})
+}
+
+// forgetMembership drops the expiry of a membership, once removed or made
+// permanent.
+func forgetMembership(dir directory, group string, member string) error {
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(membershipsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(membershipKey(dir, group, member)))
+	})
+}
+
+// forgetChangedMemberships drops the expiry of the members of group removed
+// between before and after, and of the ones added, which are added
+// permanently. Members changed along with their expiry set it again.
+func forgetChangedMemberships(dir directory, group string, before []string, after []string) error {
+	changed := append(foldDifference(before, after), foldDifference(after, before)...)
+	for _, member := range changed {
+		if err := forgetMembership(dir, group, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timedMemberships returns the time-bound memberships of group, or of every
+// group of dir when empty, sorted by expiry.
+func timedMemberships(dir directory, group string) ([]timedMembership, error) {
+	db, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	memberships := []timedMembership{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(membershipsBucket))
+		if b == nil {
+			return nil
+		}
+		prefix := []byte(membershipPrefix(dir, group))
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			var m timedMembership
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			memberships = append(memberships, m)
+		}
+		return nil
+	})
+	sort.SliceStable(memberships, func(i, j int) bool {
+		return memberships[i].ExpiresAt.Before(memberships[j].ExpiresAt)
+	})
+	return memberships, err
+}
+
+// memberExpiries returns the expiry of the time-bound members of group, by
+// member DN.
+func memberExpiries(dir directory, group string) (map[string]memberExpiry, error) {
+	memberships, err := timedMemberships(dir, group)
+	if err != nil || len(memberships) == 0 {
+		return nil, err
+	}
+	expiries := make(map[string]memberExpiry, len(memberships))
+	for _, m := range memberships {
+		remaining := time.Until(m.ExpiresAt).Round(time.Second)
+		if remaining < 0 {
+			remaining = 0
+		}
+		expiries[m.Member] = memberExpiry{ExpiresAt: m.ExpiresAt, Remaining: remaining.String()}
+	}
+	return expiries, nil
+}
+
+// membershipJobs returns the removals of the time-bound members of dir.
+func membershipJobs(dir directory) ([]job, error) {
+	memberships, err := timedMemberships(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	planned := []job{}
+	for _, m := range memberships {
+		planned = append(planned, job{Directory: dir.auditName(), Action: "remove_member", Target: m.Member, Group: m.Group, ExpiresAt: m.ExpiresAt, DueAt: m.ExpiresAt, Status: "upcoming"})
+	}
+	return planned, nil
+}
+
+// expireMemberships removes the time-bound members of dir whose membership
+// expired. Failed removals are retried on the next run.
+func expireMemberships(dir directory) error {
+	memberships, err := timedMemberships(dir, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var due []timedMembership
+	for _, m := range memberships {
+		if !m.ExpiresAt.After(now) {
+			due = append(due, m)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	l, err := dialDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for _, m := range due {
+		err := changeMember(l, m.Group, m.Member, false)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			// The group is gone, and the membership with it
+			err = forgetMembership(dir, m.Group, m.Member)
+		}
+
+		executedAt := time.Now().UTC()
+		j := job{ID: newID(), Directory: dir.auditName(), Action: "remove_member", Target: m.Member, Group: m.Group, ExpiresAt: m.ExpiresAt, DueAt: m.ExpiresAt, ExecutedAt: &executedAt, Status: "done"}
+		if err != nil {
+			j.Status = "failed"
+			j.Error = err.Error()
+			l.logger.Warn().Err(err).Str("group", m.Group).Str("member", m.Member).Msg("can't remove expired member")
+		}
+		if err := saveJob(dir, j); err != nil {
+			return err
+		}
+		if err == nil && m.AccessRequest != "" {
+			if err := expireAccessRequest(l, m.AccessRequest); err != nil {
+				log.Warn().Err(err).Str("directory", dir.name).Str("request", m.AccessRequest).Msg("can't mark access request expired")
+			}
+		}
+	}
+	return nil
+}
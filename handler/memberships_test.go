@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTimedMemberships(t *testing.T) {
+	useTestConfig(t, &config.Config{})
+	dir := directory{name: config.DefaultDirectory, Directory: &config.Directory{}}
+	lab := directory{name: "lab", Directory: &config.Directory{}}
+	ops := "cn=ops,ou=groups,dc=example,dc=org"
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, m := range []struct {
+		dir    directory
+		group  string
+		member string
+		in     time.Duration
+	}{
+		{dir, testGroup, testUser, 2 * time.Hour},
+		{dir, "CN=Devs,ou=groups,dc=example,dc=org", testOtherDN, time.Hour},
+		{dir, ops, testUser, -time.Hour},
+		{lab, testGroup, testUser, time.Minute},
+	} {
+		if err := setMembershipExpiry(m.dir, timedMembership{Group: m.group, Member: m.member, ExpiresAt: now.Add(m.in)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := func(group string) []string {
+		t.Helper()
+		memberships, err := timedMemberships(dir, group)
+		if err != nil {
+			t.Fatalf("timedMemberships(): %v", err)
+		}
+		members := []string{}
+		for _, m := range memberships {
+			members = append(members, m.Member+" "+m.Group)
+		}
+		return members
+	}
+
+	want := []string{testOtherDN + " CN=Devs,ou=groups,dc=example,dc=org", testUser + " " + testGroup}
+	if got := members(testGroup); !reflect.DeepEqual(got, want) {
+		t.Errorf("timedMemberships(%s) = %q, want %q, by expiry", testGroup, got, want)
+	}
+	if got := members(""); len(got) != 3 || got[0] != testUser+" "+ops {
+		t.Errorf("timedMemberships() = %q, want the 3 ones of the directory, by expiry", got)
+	}
+
+	expiries, err := memberExpiries(dir, testGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry := expiries[testOtherDN]; !expiry.ExpiresAt.Equal(now.Add(time.Hour)) || expiry.Remaining == "0s" {
+		t.Errorf("expiry of %s = %+v", testOtherDN, expiry)
+	}
+	if expiries, _ := memberExpiries(dir, ops); expiries[testUser].Remaining != "0s" {
+		t.Errorf("remaining time of an expired membership = %s, want 0s", expiries[testUser].Remaining)
+	}
+
+	// Members added or removed lose their expiry, the others keep it
+	if err := forgetChangedMemberships(dir, testGroup, []string{testUser, testOtherDN}, []string{"CN=Jane,ou=users,dc=example,dc=org", testGroup}); err != nil {
+		t.Fatal(err)
+	}
+	if got := members(testGroup); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("timedMemberships(%s) = %q, want %q", testGroup, got, want[:1])
+	}
+	if memberships, _ := timedMemberships(lab, testGroup); len(memberships) != 1 {
+		t.Errorf("timedMemberships() of another directory = %+v, want it kept", memberships)
+	}
+}
+
+// executedJobs returns the jobs executed in dir.
+func executedJobs(t *testing.T, dir directory) []job {
+	t.Helper()
+	db, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	executed := []job{}
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if j.Directory == dir.auditName() {
+				executed = append(executed, j)
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return executed
+}
+
+func TestExpireMemberships(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	d, l := newAccessDirectory(t)
+	ops := "cn=ops,ou=groups,dc=example,dc=org"
+	gone := "cn=gone,ou=groups,dc=example,dc=org"
+	d.Lock()
+	d.put(ops, map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"ops"}, "member": {testUser}})
+	d.Unlock()
+	d.failOn("modify", ops, ldap.LDAPResultInsufficientAccessRights)
+
+	endsAt := time.Now().Add(time.Hour)
+	r := pendingAccessRequest(t, l, &endsAt)
+	if w := decide(l, ApproveAccessRequest, testOtherDN, r.ID); w.Code != http.StatusOK {
+		t.Fatalf("approve = %d %s", w.Code, w.Body)
+	}
+	past := time.Now().Add(-time.Minute).UTC()
+	for _, m := range []timedMembership{
+		{Group: testGroup, Member: testUser, ExpiresAt: past, AccessRequest: r.ID},
+		{Group: testGroup, Member: testOtherDN, ExpiresAt: endsAt},
+		{Group: gone, Member: testUser, ExpiresAt: past},
+		{Group: ops, Member: testUser, ExpiresAt: past},
+	} {
+		if err := setMembershipExpiry(l.dir, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The failed removal is retried on the next run
+	for i := 0; i < 2; i++ {
+		if err := expireMemberships(l.dir); err != nil {
+			t.Fatalf("expireMemberships(): %v", err)
+		}
+	}
+	if got := d.get(testGroup, "member"); !reflect.DeepEqual(got, []string{testOtherDN}) {
+		t.Errorf("members of %s = %q, want the expired one removed", testGroup, got)
+	}
+	if got := d.get(ops, "member"); !reflect.DeepEqual(got, []string{testUser}) {
+		t.Errorf("members of %s = %q, want the member kept on failure", ops, got)
+	}
+	if r := storedAccessRequest(t, l, r.ID); r.Status != accessExpired {
+		t.Errorf("access request = %s, want expired", r.Status)
+	}
+
+	memberships, err := timedMemberships(l.dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[string]bool{}
+	for _, m := range memberships {
+		remaining[m.Group+" "+m.Member] = true
+	}
+	if want := map[string]bool{testGroup + " " + testOtherDN: true, ops + " " + testUser: true}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("memberships = %v, want %v", remaining, want)
+	}
+
+	statuses := map[string]string{}
+	for _, j := range executedJobs(t, l.dir) {
+		if j.Action != "remove_member" || j.Target != testUser {
+			t.Errorf("job = %+v, want the removal of %s", j, testUser)
+		}
+		statuses[j.Group] = j.Status
+		if j.Group == ops && j.Attempts != 2 {
+			t.Errorf("failed job attempts = %d, want 2, recorded once", j.Attempts)
+		}
+	}
+	if want := map[string]string{testGroup: "done", gone: "done", ops: "failed"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("jobs = %v, want %v", statuses, want)
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ldoups",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latencies, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	ldapOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "ldap_operations_total",
+		Help:      "LDAP operations, by operation and result code.",
+	}, []string{"operation", "result"})
+
+	ldapDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ldoups",
+		Name:      "ldap_operation_duration_seconds",
+		Help:      "LDAP operation latencies, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	loginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "login_failures_total",
+		Help:      "Failed logins, by reason.",
+	}, []string{"reason"})
+
+	entriesReturned = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ldoups",
+		Name:      "entries_returned",
+		Help:      "Entries found by list requests, by resource.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"resource"})
+
+	ldapConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ldoups",
+		Name:      "ldap_connections_open",
+		Help:      "LDAP connections currently open.",
+	})
+
+	ldapDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "ldap_dials_total",
+		Help:      "LDAP connection attempts, by result.",
+	}, []string{"result"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads, by trigger (signal or file) and result.",
+	}, []string{"trigger", "result"})
+
+	configReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ldoups",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successful configuration reload.",
+	})
+
+	directoryChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "directory_changes_total",
+		Help:      "Changes done outside of LDOups seen by the directory watcher, by event type.",
+	}, []string{"type"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ldoups",
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Webhook delivery attempts, by endpoint and resulting delivery status.",
+	}, []string{"endpoint", "status"})
+)
+
+// Metrics records the count and latency of requests per gin route.
+func Metrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	httpDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+}
+
+// MetricsHandler exposes the metrics in the Prometheus format.
+var MetricsHandler = gin.WrapH(promhttp.Handler())
@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type memberRequest struct {
+	DN        string     `json:"dn"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+var errAlreadyMember = errors.New("already a member")
+
+// ownersOf returns the owners of the group at groupDN, users or groups.
+func ownersOf(l *ldapConn, groupDN string) ([]string, error) {
+	attributes, err := readAttributes(l, groupDN, []string{l.dir.GroupOwners.Attribute})
+	if err != nil {
+		return nil, err
+	}
+	return attributeValues(attributes, l.dir.GroupOwners.Attribute), nil
+}
+
+// nestedGroupsOf returns the groups dn belongs to, directly or through other
+// groups.
+func nestedGroupsOf(l *ldapConn, dn string) ([]string, error) {
+	seen := map[string]bool{}
+	var groupDNs []string
+	next := []string{dn}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		for _, member := range current {
+			parents, err := groupsOf(l, member)
+			if err != nil {
+				return nil, err
+			}
+			for _, parent := range parents {
+				if key := strings.ToLower(parent); !seen[key] {
+					seen[key] = true
+					groupDNs = append(groupDNs, parent)
+					next = append(next, parent)
+				}
+			}
+		}
+	}
+	return groupDNs, nil
+}
+
+// ownsGroup tells whether dn owns the group at groupDN, being one of its
+// owners or a member of an owner group, nested or not.
+func ownsGroup(l *ldapConn, dn string, groupDN string) (bool, error) {
+	owners, err := ownersOf(l, groupDN)
+	if err != nil || len(owners) == 0 {
+		return false, err
+	}
+	if containsFold(owners, dn) {
+		return true, nil
+	}
+	groupDNs, err := nestedGroupsOf(l, dn)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groupDNs {
+		if containsFold(owners, group) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownedGroups returns the DNs of the groups dn owns, directly or through the
+// groups it belongs to.
+func ownedGroups(l *ldapConn, dn string) ([]string, error) {
+	groupDNs, err := nestedGroupsOf(l, dn)
+	if err != nil {
+		return nil, err
+	}
+	attr := l.dir.GroupOwners.Attribute
+	filter := "(" + attr + "=" + ldap.EscapeFilter(dn) + ")"
+	for _, group := range groupDNs {
+		filter += "(" + attr + "=" + ldap.EscapeFilter(group) + ")"
+	}
+	filter = "(&(objectClass=" + l.dir.GroupsObjectClassSearch + ")(|" + filter + "))"
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"1.1"}, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	owned := []string{}
+	for _, ent := range result.Entries {
+		owned = append(owned, ent.DN)
+	}
+	return owned, nil
+}
+
+// delegatedConn opens a connection bound with the read-write account, acting
+// for the user of l in the logs and the audit log.
+func delegatedConn(l *ldapConn) (*ldapConn, error) {
+	delegated, err := dialDirectory(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	delegated.logger = l.logger
+	delegated.actor = l.actor
+	delegated.sourceIP = l.sourceIP
+	delegated.requestID = l.requestID
+	delegated.source = l.source
+	return delegated, nil
+}
+
+// membersConn returns the connection changing the members of the group at
+// groupDN: a delegated one when `groupOwners.delegate` is set and the logged
+// in user owns the group, l otherwise. The returned function closes it.
+func membersConn(l *ldapConn, groupDN string) (*ldapConn, func(), error) {
+	if !l.dir.GroupOwners.Delegate {
+		return l, func() {}, nil
+	}
+	owner, err := ownsGroup(l, l.actor, groupDN)
+	if err != nil || !owner {
+		return l, func() {}, err
+	}
+	delegated, err := delegatedConn(l)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.logger.Debug().Str("group", groupDN).Msg("member change delegated to group owner")
+	return delegated, delegated.Close, nil
+}
+
+// onlyMembersChange tells whether the attributes changed between before and
+// after are only the members.
+func onlyMembersChange(before map[string][]string, after map[string][]string) bool {
+	modReq := ldap.NewModifyRequest("", []ldap.Control{})
+	diffModifications(modReq, before, after)
+	for _, change := range modReq.Changes {
+		if !strings.EqualFold(change.Modification.Type, "member") {
+			return false
+		}
+	}
+	return len(modReq.Changes) > 0
+}
+
+func abortGroupChange(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errAlreadyMember):
+		abort(c, err, http.StatusConflict)
+	case ldap.IsErrorAnyOf(err, ldap.LDAPResultNoSuchObject, ldap.LDAPResultNoSuchAttribute):
+		abort(c, err, http.StatusNotFound)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// AddGroupMember adds a member to a group, until `expiresAt` when given.
+// The expiry of a current member is set or extended the same way. Owners of
+// the group can add members with `groupOwners.delegate`.
+func AddGroupMember(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	var req memberRequest
+	if err := c.BindJSON(&req); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	errs := make(map[string]string)
+	if _, err := ldap.ParseDN(req.DN); err != nil || req.DN == "" {
+		errs["dn"] = "must be a DN"
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			errs["expiresAt"] = "must be in the future"
+		} else if ldp.dir.RW.Username == "" {
+			// Expired members are removed with the read-write account
+			errs["expiresAt"] = "needs ldap.rw to be set"
+		}
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	groupDN := c.Param("id")
+	// The member must be visible to the logged in user, not only to the
+	// read-write account
+	if _, err := readAttributes(ldp, req.DN, []string{"1.1"}); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"dn": "no such entry"})
+			return
+		}
+		abortGroupChange(c, err)
+		return
+	}
+	members, err := readAttributes(ldp, groupDN, []string{"member"})
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	var stored string
+	for _, value := range attributeValues(members, "member") {
+		if strings.EqualFold(value, req.DN) {
+			stored = value
+		}
+	}
+	if stored != "" && req.ExpiresAt == nil {
+		abortGroupChange(c, fmt.Errorf("%w: %s", errAlreadyMember, req.DN))
+		return
+	}
+
+	conn, done, err := membersConn(ldp, groupDN)
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	defer done()
+	if stored != "" {
+		// Setting the expiry of a member needs the rights to remove it,
+		// which rewriting the value checks without changing the members
+		req.DN = stored
+		modReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
+		modReq.Delete("member", []string{stored})
+		modReq.Add("member", []string{stored})
+		err = conn.Modify(modReq)
+	} else {
+		err = changeMember(conn, groupDN, req.DN, true)
+	}
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	if req.ExpiresAt == nil {
+		err = forgetMembership(ldp.dir, groupDN, req.DN)
+	} else {
+		err = setMembershipExpiry(ldp.dir, timedMembership{Group: groupDN, Member: req.DN, ExpiresAt: req.ExpiresAt.UTC(), AddedBy: ldp.actor, AddedAt: time.Now().UTC()})
+	}
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveGroupMember removes a member from a group. Owners of the group can
+// remove members with `groupOwners.delegate`.
+func RemoveGroupMember(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	groupDN := c.Param("id")
+	member := c.Param("member")
+	members, err := readAttributes(ldp, groupDN, []string{"member"})
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	// Members are removed as stored
+	found := false
+	for _, value := range attributeValues(members, "member") {
+		if strings.EqualFold(value, member) {
+			member = value
+			found = true
+		}
+	}
+	if !found {
+		abort(c, fmt.Errorf("%s isn't a member of %s", member, groupDN), http.StatusNotFound)
+		return
+	}
+
+	conn, done, err := membersConn(ldp, groupDN)
+	if err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	defer done()
+	if err := changeMember(conn, groupDN, member, false); err != nil {
+		abortGroupChange(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+func TestOwnsGroup(t *testing.T) {
+	leads := "cn=leads,ou=groups,dc=example,dc=org"
+	managers := "cn=managers,ou=groups,dc=example,dc=org"
+	prod := "cn=prod,ou=groups,dc=example,dc=org"
+	loopA := "cn=loop-a,ou=groups,dc=example,dc=org"
+	loopB := "cn=loop-b,ou=groups,dc=example,dc=org"
+	orphan := "cn=orphan,ou=groups,dc=example,dc=org"
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}},
+		testOtherDN:         {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}},
+		leads:               {"objectClass": {"groupOfNames"}, "member": {testUser}},
+		managers:            {"objectClass": {"groupOfNames"}, "member": {leads}},
+		prod:                {"objectClass": {"groupOfNames"}, "member": {testOtherDN}, "owner": {managers}},
+		testGroup:           {"objectClass": {"groupOfNames"}, "member": {testUser}, "owner": {"CN=Jane,ou=users,dc=example,dc=org"}},
+		loopA:               {"objectClass": {"groupOfNames"}, "member": {loopB, testOtherDN}},
+		loopB:               {"objectClass": {"groupOfNames"}, "member": {loopA}, "owner": {loopA}},
+		orphan:              {"objectClass": {"groupOfNames"}, "member": {testUser}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		GroupsObjectClassSearch: "groupOfNames",
+		GroupOwners:             config.GroupOwners{Attribute: "owner"},
+	}
+	useTestConfig(t, c)
+	l := d.dial(t, defaultDirectory())
+
+	tests := []struct {
+		name  string
+		dn    string
+		group string
+		want  bool
+	}{
+		{"through nested groups", testUser, prod, true},
+		{"owner group", leads, prod, true},
+		{"member of the group only", testOtherDN, prod, false},
+		{"owner, DN case aside", testOtherDN, testGroup, true},
+		{"member of the group, not owner", testUser, testGroup, false},
+		{"through a group loop", testOtherDN, loopB, true},
+		{"group without owner", testUser, orphan, false},
+	}
+	for _, tt := range tests {
+		got, err := ownsGroup(l, tt.dn, tt.group)
+		if err != nil {
+			t.Fatalf("%s: ownsGroup(): %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: ownsGroup(%s, %s) = %v, want %v", tt.name, tt.dn, tt.group, got, tt.want)
+		}
+	}
+
+	for dn, want := range map[string][]string{testUser: {prod}, testOtherDN: {testGroup, loopB}} {
+		got, err := ownedGroups(l, dn)
+		if err != nil {
+			t.Fatalf("ownedGroups(): %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ownedGroups(%s) = %q, want %q", dn, got, want)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var errTestFailed = errors.New("test operation failed")
+
+// PatchUser applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// to the user, depending on the request Content-Type. Patches apply to the
+// user as returned by Get, e.g. `/attributes/mail/-` adds a mail value.
+func PatchUser(c *gin.Context) {
+	dir := directoryOf(c)
+	patchEntry(c, dir.UserAttributes, dir.UserRules, true)
+}
+
+// PatchGroup is the PatchUser counterpart for groups.
+func PatchGroup(c *gin.Context) {
+	dir := directoryOf(c)
+	patchEntry(c, dir.GroupAttributes, dir.GroupRules, false)
+}
+
+func patchEntry(c *gin.Context, attributes map[string]string, rules map[string]rule, isUser bool) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	id := c.Param("id")
+	if !checkIfMatch(c, ldp, id, isUser) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+
+	current, err := readAttributes(ldp, id, attributeNames(attributes))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		abort(c, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	if isUser {
+		groupDNs, err := groupsOf(ldp, id)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		current["memberOf"] = groupDNs
+	}
+
+	doc := map[string]interface{}{
+		"id":         id,
+		"dn":         id,
+		"attributes": toDocument(current),
+	}
+
+	var patched interface{}
+	switch c.ContentType() {
+	case mergePatchType, "application/json":
+		var patch interface{}
+		if err = json.Unmarshal(body, &patch); err == nil {
+			patched = mergePatch(doc, patch)
+		}
+	case jsonPatchType:
+		var ops []patchOperation
+		if err = json.Unmarshal(body, &ops); err == nil {
+			patched, err = applyPatch(doc, ops)
+		}
+	default:
+		abort(c, errors.New("unsupported patch type: "+c.ContentType()), http.StatusUnsupportedMediaType)
+		return
+	}
+	if errors.Is(err, errTestFailed) {
+		abort(c, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+
+	patchedEntry, errs := fromDocument(patched)
+	if len(errs) == 0 && patchedEntry.DN != id {
+		errs["dn"] = "dn can't be patched"
+	}
+	for name := range patchedEntry.Attributes {
+		if _, ok := attributes[name]; !ok && !(isUser && name == "memberOf") {
+			errs[name] = "attribute is not managed"
+		}
+	}
+	if isUser {
+		checkShell(ldp.dir, patchedEntry, errs)
+	}
+	if len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if !validate(c, patchedEntry, attributes, rules, true) {
+		return
+	}
+
+	memberOf, hasMemberOf := patchedEntry.Attributes["memberOf"]
+	delete(patchedEntry.Attributes, "memberOf")
+	oldMemberOf := current["memberOf"]
+	delete(current, "memberOf")
+
+	action := "group.update"
+	if isUser {
+		action = "user.update"
+	}
+	modReq := ldap.NewModifyRequest(id, []ldap.Control{})
+	if diffModifications(modReq, current, patchedEntry.Attributes) > 0 {
+		if !isUser {
+			members := patchedEntry.Attributes["member"]
+			if err := syncMemberUid(ldp, modReq, id, difference(members, current["member"]), difference(current["member"], members)); err != nil {
+				abort(c, err, http.StatusInternalServerError)
+				return
+			}
+		}
+		conn := ldp
+		if !isUser && onlyMembersChange(current, patchedEntry.Attributes) {
+			var done func()
+			if conn, done, err = membersConn(ldp, id); err != nil {
+				abort(c, err, http.StatusInternalServerError)
+				return
+			}
+			defer done()
+		}
+		err := conn.Modify(modReq)
+		conn.recordAudit(action, id, current, patchedEntry.Attributes, err)
+		if err != nil {
+			abortGroupChange(c, err)
+			return
+		}
+		if !isUser {
+			if err := forgetChangedMemberships(ldp.dir, id, current["member"], patchedEntry.Attributes["member"]); err != nil {
+				abort(c, err, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if isUser && (len(difference(memberOf, oldMemberOf)) > 0 || len(difference(oldMemberOf, memberOf)) > 0) {
+		if !hasMemberOf {
+			memberOf = []string{}
+		}
+		setGroup(c, id, memberOf)
+	}
+}
+
+// toDocument converts attribute values to their generic JSON representation,
+// which patches are applied to.
+func toDocument(attributes map[string][]string) map[string]interface{} {
+	doc := make(map[string]interface{})
+	for name, values := range attributes {
+		var vals []interface{}
+		for _, value := range values {
+			vals = append(vals, value)
+		}
+		doc[name] = vals
+	}
+	return doc
+}
+
+// fromDocument converts back a patched document to an entry. A single string
+// is accepted as a one-value attribute and an empty attribute is removed.
+func fromDocument(doc interface{}) (entry, map[string]string) {
+	var e entry
+	errs := make(map[string]string)
+
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		errs["dn"] = "document must be an object"
+		return e, errs
+	}
+	e.DN, _ = root["dn"].(string)
+	e.Attributes = make(map[string][]string)
+
+	attributes, ok := root["attributes"].(map[string]interface{})
+	if !ok {
+		if root["attributes"] != nil {
+			errs["attributes"] = "attributes must be an object"
+		}
+		return e, errs
+	}
+	for name, vals := range attributes {
+		var values []string
+		switch v := vals.(type) {
+		case nil:
+		case string:
+			values = []string{v}
+		case []interface{}:
+			for _, val := range v {
+				s, ok := val.(string)
+				if !ok {
+					errs[name] = "values must be strings"
+					break
+				}
+				values = append(values, s)
+			}
+		default:
+			errs[name] = "values must be an array of strings"
+		}
+		if len(values) > 0 {
+			e.Attributes[name] = values
+		}
+	}
+	return e, errs
+}
+
+// mergePatch applies a JSON Merge Patch as described in RFC 7396: objects are
+// merged recursively, null removes a member and anything else replaces it.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
+
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyPatch applies JSON Patch operations as described in RFC 6902. The
+// whole patch fails if any operation does.
+func applyPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op patchOperation) apply(doc interface{}) (interface{}, error) {
+	if op.Path == nil {
+		return nil, errors.New("missing path")
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if err := json.Unmarshal(*op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New("missing from")
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getPointer(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(*op.Path+"/", *op.From+"/") && *op.Path != *op.From {
+				return nil, errors.New("can't move a value into itself")
+			}
+			if doc, err = removePointer(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addPointer(doc, path, value)
+	case "remove":
+		return removePointer(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removePointer(doc, path); err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	case "test":
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errTestFailed
+		}
+		return doc, nil
+	}
+	return nil, errors.New("unknown operation")
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("invalid pointer: " + pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= length || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index: " + token)
+	}
+	return i, nil
+}
+
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[token]
+			if !ok {
+				return nil, errors.New("path not found: " + token)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errors.New("path not found: " + token)
+		}
+	}
+	return doc, nil
+}
+
+// updatePointer calls fn on the container holding the last token of path and
+// returns the document with the updated container in place.
+func updatePointer(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, errors.New("path not found: " + path[0])
+		}
+		updated, err := updatePointer(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = updated
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(node))
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updatePointer(node[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = updated
+		return node, nil
+	}
+	return nil, errors.New("path not found: " + path[0])
+}
+
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updatePointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			i, err := arrayIndex(token, len(node)+1)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, errors.New("path not found: " + token)
+	})
+}
+
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+	return updatePointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, errors.New("path not found: " + token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i:i], node[i+1:]...), nil
+		}
+		return nil, errors.New("path not found: " + token)
+	})
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for name, child := range v {
+			m[name] = deepCopy(child)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, child := range v {
+			s[i] = deepCopy(child)
+		}
+		return s
+	}
+	return value
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return value
+}
+
+// TestMergePatch runs the examples of RFC 7396 appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got := mergePatch(decodeJSON(t, tt.target), decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %v", tt.target, tt.patch, got, want)
+		}
+	}
+}
+
+// TestApplyPatch runs examples of RFC 6902 appendix A.
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"add object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"append array element", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{"remove object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"move value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"copy value", `{"foo":{"bar":"baz"}}`, `[{"op":"copy","from":"/foo","path":"/qux"}]`, `{"foo":{"bar":"baz"},"qux":{"bar":"baz"}}`},
+		{"test value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"add nested object", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"add array value", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`},
+		{"replace document", `{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+	}
+	for _, tt := range tests {
+		var ops []patchOperation
+		if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+			t.Fatalf("%s: invalid patch: %v", tt.name, err)
+		}
+		got, err := applyPatch(decodeJSON(t, tt.doc), ops)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, patch string
+	}{
+		{"missing target", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{"remove missing member", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{"out of bounds index", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{"leading zero index", `{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{"missing path", `{"foo":"bar"}`, `[{"op":"add","value":"qux"}]`},
+		{"missing value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{"missing from", `{"foo":"bar"}`, `[{"op":"move","path":"/baz"}]`},
+		{"invalid pointer", `{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`},
+		{"move into itself", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{"unknown operation", `{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`},
+		{"remove document", `{"foo":"bar"}`, `[{"op":"remove","path":""}]`},
+	}
+	for _, tt := range tests {
+		var ops []patchOperation
+		if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+			t.Fatalf("%s: invalid patch: %v", tt.name, err)
+		}
+		if _, err := applyPatch(decodeJSON(t, tt.doc), ops); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestApplyPatchTestFailed(t *testing.T) {
+	tests := []string{
+		`[{"op":"test","path":"/baz","value":"bar"}]`,
+		`[{"op":"test","path":"/foo/1","value":"2"}]`,
+		`[{"op":"replace","path":"/baz","value":"boo"},{"op":"test","path":"/baz","value":"qux"}]`,
+	}
+	for _, patch := range tests {
+		var ops []patchOperation
+		if err := json.Unmarshal([]byte(patch), &ops); err != nil {
+			t.Fatalf("invalid patch %s: %v", patch, err)
+		}
+		if _, err := applyPatch(decodeJSON(t, `{"baz":"qux","foo":["a",2,"c"]}`), ops); !errors.Is(err, errTestFailed) {
+			t.Errorf("%s: got error %v, want errTestFailed", patch, err)
+		}
+	}
+}
+
+func TestFromDocument(t *testing.T) {
+	tests := []struct {
+		doc        string
+		attributes map[string][]string
+		errs       []string
+	}{
+		{`{"dn":"cn=jdoe","attributes":{"cn":["jdoe"],"mail":"jdoe@example.org"}}`, map[string][]string{"cn": {"jdoe"}, "mail": {"jdoe@example.org"}}, nil},
+		{`{"dn":"cn=jdoe","attributes":{"cn":["jdoe"],"mail":[],"sn":null}}`, map[string][]string{"cn": {"jdoe"}}, nil},
+		{`{"dn":"cn=jdoe","attributes":{"cn":[1]}}`, map[string][]string{}, []string{"cn"}},
+		{`{"dn":"cn=jdoe","attributes":{"cn":{"a":"b"}}}`, map[string][]string{}, []string{"cn"}},
+		{`{"dn":"cn=jdoe","attributes":"cn"}`, map[string][]string{}, []string{"attributes"}},
+		{`["cn=jdoe"]`, nil, []string{"dn"}},
+	}
+	for _, tt := range tests {
+		e, errs := fromDocument(decodeJSON(t, tt.doc))
+		var fields []string
+		for field := range errs {
+			fields = append(fields, field)
+		}
+		if !reflect.DeepEqual(fields, tt.errs) {
+			t.Errorf("fromDocument(%s) errors = %v, want %v", tt.doc, errs, tt.errs)
+		}
+		if !reflect.DeepEqual(e.Attributes, tt.attributes) {
+			t.Errorf("fromDocument(%s) = %v, want %v", tt.doc, e.Attributes, tt.attributes)
+		}
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "mail": {"jdoe@example.org"}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		GroupsObjectClassSearch: "groupOfNames",
+		UserAttributes:          map[string]string{"cn": "required", "mail": ""},
+	}
+	useTestConfig(t, c)
+	l := d.dial(t, defaultDirectory())
+
+	tests := []struct {
+		name string
+		dn   string
+		want int
+	}{
+		{"existing user", testUser, http.StatusOK},
+		{"missing user", testOtherDN, http.StatusNotFound},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPatch, "/api/users/"+tt.dn, strings.NewReader(`{"attributes":{"mail":["john@example.org"]}}`))
+		ctx.Request.Header.Set("Content-Type", mergePatchType)
+		ctx.Params = gin.Params{{Key: "id", Value: tt.dn}}
+		ctx.Set("LDAP", l)
+		PatchUser(ctx)
+		if w.Code != tt.want {
+			t.Errorf("%s: PatchUser() = %d %s, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+	if got := d.get(testUser, "mail"); !reflect.DeepEqual(got, []string{"john@example.org"}) {
+		t.Errorf("mail = %q, want john@example.org", got)
+	}
+}
@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// posixUserAttributes are filled for posixAccount users, whether they are
+// in `userAttributes` or not.
+var posixUserAttributes = []string{"uidNumber", "gidNumber", "homeDirectory", "loginShell"}
+
+// allocations holds the uid and gid numbers allocated to entries being
+// added, so that concurrent requests don't get the same ones.
+var allocations struct {
+	sync.Mutex
+	pending map[string]bool
+}
+
+var errNoFreeNumber = errors.New("no free number left in range")
+
+func isPosix(e entry, objectClass string) bool {
+	return containsFold(attributeValues(e.Attributes, "objectClass"), objectClass)
+}
+
+// checkShell returns the error of a loginShell which isn't one of `shells`.
+func checkShell(dir directory, e entry, errs map[string]string) {
+	for _, shell := range attributeValues(e.Attributes, "loginShell") {
+		if !contains(dir.Posix.Shells, shell) {
+			errs["loginShell"] = fmt.Sprintf("%q must be one of %s", shell, strings.Join(dir.Posix.Shells, ", "))
+		}
+	}
+}
+
+// usedNumbers returns the numbers of attr in use in the directory, along
+// with the ones being allocated.
+func usedNumbers(l *ldapConn, attr string) (map[int]bool, error) {
+	filter := "(" + attr + "=*)"
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{attr}, []ldap.Control{})
+	result, err := l.SearchWithPaging(searchReq, searchPageSize)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]bool)
+	for _, ent := range result.Entries {
+		for _, value := range ent.GetAttributeValues(attr) {
+			if n, err := strconv.Atoi(value); err == nil {
+				used[n] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+func allocationKey(l *ldapConn, attr string, n int) string {
+	return l.dir.name + ":" + attr + ":" + strconv.Itoa(n)
+}
+
+// allocateNumber returns the lowest number of r free for attr, reserved
+// until released.
+func allocateNumber(l *ldapConn, attr string, r config.IDRange) (int, error) {
+	used, err := usedNumbers(l, attr)
+	if err != nil {
+		return 0, err
+	}
+	allocations.Lock()
+	defer allocations.Unlock()
+	if allocations.pending == nil {
+		allocations.pending = make(map[string]bool)
+	}
+	for n := r.Min; n <= r.Max; n++ {
+		if !used[n] && !allocations.pending[allocationKey(l, attr, n)] {
+			allocations.pending[allocationKey(l, attr, n)] = true
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %w [%d, %d]", attr, errNoFreeNumber, r.Min, r.Max)
+}
+
+func releaseNumber(l *ldapConn, attr string, n int) {
+	allocations.Lock()
+	defer allocations.Unlock()
+	delete(allocations.pending, allocationKey(l, attr, n))
+}
+
+// numberOwners returns the DNs of the entries having n as attr. Only
+// posixGroup gidNumbers are unique, users share theirs.
+func numberOwners(l *ldapConn, attr string, n int) ([]string, error) {
+	filter := "(" + attr + "=" + strconv.Itoa(n) + ")"
+	if attr == "gidNumber" {
+		filter = "(&(objectClass=posixGroup)" + filter + ")"
+	}
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"1.1"}, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	var dns []string
+	for _, ent := range result.Entries {
+		dns = append(dns, strings.ToLower(ent.DN))
+	}
+	sort.Strings(dns)
+	return dns, nil
+}
+
+// numberTaken tells whether n is already the attr of another entry than dn.
+func numberTaken(l *ldapConn, attr string, n int, dn string) (bool, error) {
+	owners, err := numberOwners(l, attr, n)
+	if err != nil {
+		return false, err
+	}
+	for _, owner := range owners {
+		if owner != strings.ToLower(dn) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// preparePosixUser fills the POSIX attributes missing from a posixAccount
+// user: uidNumber allocated, gidNumber, home directory and shell defaulted.
+// It returns the allocated uidNumber, to be released once the user is added,
+// and the invalid attributes.
+func preparePosixUser(l *ldapConn, user *entry) (int, map[string]string, error) {
+	posix := l.dir.Posix
+	errs := make(map[string]string)
+	checkShell(l.dir, *user, errs)
+	uid := attributeValues(user.Attributes, "uid")
+	if len(uid) == 0 {
+		errs["uid"] = "required by posixAccount"
+	}
+	if _, ok := user.Attributes["gidNumber"]; !ok && posix.DefaultGIDNumber == 0 {
+		errs["gidNumber"] = "missing attribute"
+	}
+	if values, ok := user.Attributes["uidNumber"]; ok {
+		n, err := strconv.Atoi(strings.Join(values, ""))
+		if err != nil {
+			errs["uidNumber"] = "must be an integer"
+		} else if taken, err := numberTaken(l, "uidNumber", n, user.DN); err != nil {
+			return 0, nil, err
+		} else if taken {
+			errs["uidNumber"] = "already in use"
+		}
+	}
+	if len(errs) > 0 {
+		return 0, errs, nil
+	}
+
+	allocated := 0
+	if _, ok := user.Attributes["uidNumber"]; !ok {
+		n, err := allocateNumber(l, "uidNumber", posix.UIDNumbers)
+		if err != nil {
+			return 0, nil, err
+		}
+		allocated = n
+		user.Attributes["uidNumber"] = []string{strconv.Itoa(n)}
+	}
+	if _, ok := user.Attributes["gidNumber"]; !ok {
+		user.Attributes["gidNumber"] = []string{strconv.Itoa(posix.DefaultGIDNumber)}
+	}
+	if _, ok := user.Attributes["homeDirectory"]; !ok {
+		user.Attributes["homeDirectory"] = []string{strings.ReplaceAll(posix.HomeDirectory, "{uid}", uid[0])}
+	}
+	if _, ok := user.Attributes["loginShell"]; !ok {
+		user.Attributes["loginShell"] = []string{posix.DefaultShell}
+	}
+	return allocated, nil, nil
+}
+
+// preparePosixGroup allocates the gidNumber of a posixGroup and sets its
+// memberUid from its members. It returns the allocated gidNumber, to be
+// released once the group is added.
+func preparePosixGroup(l *ldapConn, group *entry) (int, map[string]string, error) {
+	allocated := 0
+	if values, ok := group.Attributes["gidNumber"]; ok {
+		n, err := strconv.Atoi(strings.Join(values, ""))
+		if err != nil {
+			return 0, map[string]string{"gidNumber": "must be an integer"}, nil
+		}
+		taken, err := numberTaken(l, "gidNumber", n, group.DN)
+		if err != nil {
+			return 0, nil, err
+		}
+		if taken {
+			return 0, map[string]string{"gidNumber": "already in use"}, nil
+		}
+	} else {
+		// Primary gidNumbers of users are taken too, to avoid their private groups
+		n, err := allocateNumber(l, "gidNumber", l.dir.Posix.GIDNumbers)
+		if err != nil {
+			return 0, nil, err
+		}
+		allocated = n
+		group.Attributes["gidNumber"] = []string{strconv.Itoa(n)}
+	}
+
+	var uids []string
+	for _, member := range group.Attributes["member"] {
+		uid, err := memberUidOf(l, member)
+		if err != nil {
+			releaseNumber(l, "gidNumber", allocated)
+			return 0, nil, err
+		}
+		if uid != "" && !contains(uids, uid) {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) > 0 {
+		group.Attributes["memberUid"] = uids
+	}
+	return allocated, nil, nil
+}
+
+// resolveCollision moves the entry at dn to another number of r when
+// another LDOups instance allocated it the same attr meanwhile. The entry
+// with the greatest DN moves, so that only one of them does.
+func resolveCollision(l *ldapConn, dn string, attr string, n int, r config.IDRange) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		dns, err := numberOwners(l, attr, n)
+		if err != nil {
+			return err
+		}
+		if len(dns) < 2 || dns[0] == strings.ToLower(dn) {
+			return nil
+		}
+
+		next, err := allocateNumber(l, attr, r)
+		if err != nil {
+			return err
+		}
+		modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+		modReq.Replace(attr, []string{strconv.Itoa(next)})
+		err = l.Modify(modReq)
+		releaseNumber(l, attr, next)
+		action := "group.update"
+		if attr == "uidNumber" {
+			action = "user.update"
+		}
+		l.recordAudit(action, dn, map[string][]string{attr: {strconv.Itoa(n)}}, map[string][]string{attr: {strconv.Itoa(next)}}, err)
+		if err != nil {
+			return err
+		}
+		l.logger.Warn().Str("dn", dn).Int(attr, n).Int("new"+attr, next).Msg("number allocated twice, reallocated")
+		n = next
+	}
+	return nil
+}
+
+// memberUidOf returns the uid of the member at dn, read from its RDN when
+// the entry is gone.
+func memberUidOf(l *ldapConn, dn string) (string, error) {
+	attributes, err := readAttributes(l, dn, []string{"uid"})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || len(parsed.RDNs) == 0 {
+			return "", nil
+		}
+		for _, attr := range parsed.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "uid") {
+				return attr.Value, nil
+			}
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if uids := attributeValues(attributes, "uid"); len(uids) > 0 {
+		return uids[0], nil
+	}
+	return "", nil
+}
+
+// syncMemberUid adds to modReq the memberUid changes following the members
+// added to and removed from a posixGroup, so that both stay in sync.
+func syncMemberUid(l *ldapConn, modReq *ldap.ModifyRequest, groupDN string, added []string, removed []string) error {
+	group, err := readAttributes(l, groupDN, []string{"objectClass", "memberUid"})
+	if err != nil {
+		return err
+	}
+	if !containsFold(attributeValues(group, "objectClass"), "posixGroup") {
+		return nil
+	}
+
+	current := attributeValues(group, "memberUid")
+	var add, del []string
+	for _, dn := range added {
+		uid, err := memberUidOf(l, dn)
+		if err != nil {
+			return err
+		}
+		if uid != "" && !contains(current, uid) && !contains(add, uid) {
+			add = append(add, uid)
+		}
+	}
+	for _, dn := range removed {
+		uid, err := memberUidOf(l, dn)
+		if err != nil {
+			return err
+		}
+		if uid != "" && contains(current, uid) && !contains(del, uid) {
+			del = append(del, uid)
+		}
+	}
+	if len(add) > 0 {
+		modReq.Add("memberUid", add)
+	}
+	if len(del) > 0 {
+		modReq.Delete("memberUid", del)
+	}
+	return nil
+}
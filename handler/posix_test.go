@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+const (
+	testPosixUser  = "uid=jdoe,ou=users,dc=example,dc=org"
+	testPosixOther = "uid=jane,ou=users,dc=example,dc=org"
+	testPosixGroup = "cn=devs,ou=groups,dc=example,dc=org"
+)
+
+// newPosixDirectory returns a fake directory with two POSIX users and a
+// POSIX group, and its configuration allocating numbers from [10000, 10003].
+func newPosixDirectory(t *testing.T) *fakeDirectory {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org":           {"objectClass": {"domain"}},
+		"ou=users,dc=example,dc=org":  {"objectClass": {"organizationalUnit"}},
+		"ou=groups,dc=example,dc=org": {"objectClass": {"organizationalUnit"}},
+		testPosixUser:                 {"objectClass": {"inetOrgPerson", "posixAccount"}, "uid": {"jdoe"}, "uidNumber": {"10000"}, "gidNumber": {"10001"}},
+		testPosixOther:                {"objectClass": {"inetOrgPerson", "posixAccount"}, "uid": {"jane"}, "uidNumber": {"10002"}, "gidNumber": {"10001"}},
+		testPosixGroup:                {"objectClass": {"groupOfNames", "posixGroup"}, "cn": {"devs"}, "gidNumber": {"10000"}, "member": {testPosixUser}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		Posix: config.Posix{
+			UIDNumbers:       config.IDRange{Min: 10000, Max: 10003},
+			GIDNumbers:       config.IDRange{Min: 10000, Max: 10003},
+			DefaultGIDNumber: 100,
+			HomeDirectory:    "/home/{uid}",
+			Shells:           []string{"/bin/bash", "/bin/zsh"},
+			DefaultShell:     "/bin/bash",
+		},
+	}
+	useTestConfig(t, c)
+	return d
+}
+
+func TestAllocateNumber(t *testing.T) {
+	d := newPosixDirectory(t)
+	l := d.dial(t, defaultDirectory())
+	r := l.dir.Posix.UIDNumbers
+
+	var allocated []int
+	t.Cleanup(func() {
+		for _, n := range allocated {
+			releaseNumber(l, "uidNumber", n)
+		}
+	})
+	for _, want := range []int{10001, 10003} {
+		n, err := allocateNumber(l, "uidNumber", r)
+		if err != nil {
+			t.Fatalf("allocateNumber(): %v", err)
+		}
+		allocated = append(allocated, n)
+		if n != want {
+			t.Errorf("allocateNumber() = %d, want %d", n, want)
+		}
+	}
+	if _, err := allocateNumber(l, "uidNumber", r); !errors.Is(err, errNoFreeNumber) {
+		t.Errorf("allocateNumber() of a full range = %v, want errNoFreeNumber", err)
+	}
+
+	// The numbers being allocated of another directory are free here
+	other := *l
+	other.dir.name = "lab"
+	if n, err := allocateNumber(&other, "uidNumber", r); err != nil || n != 10001 {
+		t.Errorf("allocateNumber() in another directory = %d, %v, want 10001", n, err)
+	} else {
+		releaseNumber(&other, "uidNumber", n)
+	}
+
+	releaseNumber(l, "uidNumber", 10001)
+	allocated = allocated[1:]
+	if n, err := allocateNumber(l, "uidNumber", r); err != nil || n != 10001 {
+		t.Errorf("allocateNumber() once released = %d, %v, want 10001", n, err)
+	} else {
+		allocated = append(allocated, n)
+	}
+}
+
+func TestPreparePosixUser(t *testing.T) {
+	d := newPosixDirectory(t)
+	l := d.dial(t, defaultDirectory())
+
+	tests := []struct {
+		name       string
+		dn         string
+		attributes map[string][]string
+		errs       map[string]string
+	}{
+		{"uidNumber of another user", "uid=new,ou=users,dc=example,dc=org", map[string][]string{"uid": {"new"}, "uidNumber": {"10000"}}, map[string]string{"uidNumber": "already in use"}},
+		{"invalid uidNumber", "uid=new,ou=users,dc=example,dc=org", map[string][]string{"uid": {"new"}, "uidNumber": {"ten"}}, map[string]string{"uidNumber": "must be an integer"}},
+		{"missing uid", "cn=new,ou=users,dc=example,dc=org", map[string][]string{}, map[string]string{"uid": "required by posixAccount"}},
+		{"unknown shell", "uid=new,ou=users,dc=example,dc=org", map[string][]string{"uid": {"new"}, "loginShell": {"/bin/fish"}}, map[string]string{"loginShell": `"/bin/fish" must be one of /bin/bash, /bin/zsh`}},
+		{"own uidNumber", testPosixUser, map[string][]string{"uid": {"jdoe"}, "uidNumber": {"10000"}}, nil},
+	}
+	for _, tt := range tests {
+		user := entry{DN: tt.dn, Attributes: tt.attributes}
+		allocated, errs, err := preparePosixUser(l, &user)
+		if err != nil {
+			t.Fatalf("%s: preparePosixUser(): %v", tt.name, err)
+		}
+		if allocated != 0 {
+			t.Errorf("%s: preparePosixUser() allocated %d", tt.name, allocated)
+		}
+		if len(errs) > 0 || len(tt.errs) > 0 {
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Errorf("%s: preparePosixUser() errors = %v, want %v", tt.name, errs, tt.errs)
+			}
+		}
+	}
+
+	user := entry{DN: "uid=new,ou=users,dc=example,dc=org", Attributes: map[string][]string{"uid": {"new"}}}
+	allocated, errs, err := preparePosixUser(l, &user)
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("preparePosixUser() = %v, %v", errs, err)
+	}
+	defer releaseNumber(l, "uidNumber", allocated)
+	want := map[string][]string{
+		"uid":           {"new"},
+		"uidNumber":     {"10001"},
+		"gidNumber":     {"100"},
+		"homeDirectory": {"/home/new"},
+		"loginShell":    {"/bin/bash"},
+	}
+	if allocated != 10001 || !reflect.DeepEqual(user.Attributes, want) {
+		t.Errorf("preparePosixUser() = %d, %v, want 10001, %v", allocated, user.Attributes, want)
+	}
+}
+
+func TestPreparePosixGroup(t *testing.T) {
+	d := newPosixDirectory(t)
+	l := d.dial(t, defaultDirectory())
+
+	group := entry{DN: "cn=ops,ou=groups,dc=example,dc=org", Attributes: map[string][]string{"gidNumber": {"10000"}}}
+	if _, errs, err := preparePosixGroup(l, &group); err != nil || errs["gidNumber"] != "already in use" {
+		t.Errorf("preparePosixGroup() with the gidNumber of another group = %v, %v, want already in use", errs, err)
+	}
+	// Users share their gidNumber, it isn't taken by them
+	group.Attributes["gidNumber"] = []string{"10001"}
+	if _, errs, err := preparePosixGroup(l, &group); err != nil || len(errs) > 0 {
+		t.Errorf("preparePosixGroup() with the gidNumber of users = %v, %v", errs, err)
+	}
+
+	gone := "uid=gone,ou=users,dc=example,dc=org"
+	group = entry{DN: "cn=ops,ou=groups,dc=example,dc=org", Attributes: map[string][]string{"member": {testPosixUser, testPosixOther, gone, testPosixUser}}}
+	allocated, errs, err := preparePosixGroup(l, &group)
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("preparePosixGroup() = %v, %v", errs, err)
+	}
+	defer releaseNumber(l, "gidNumber", allocated)
+	if allocated != 10002 {
+		t.Errorf("allocated gidNumber = %d, want 10002, the lowest number no entry has", allocated)
+	}
+	if got := group.Attributes["memberUid"]; !reflect.DeepEqual(got, []string{"jdoe", "jane", "gone"}) {
+		t.Errorf("memberUid = %q, want jdoe, jane and gone", got)
+	}
+}
+
+func TestResolveCollision(t *testing.T) {
+	d := newPosixDirectory(t)
+	d.Lock()
+	d.put(testPosixOther, map[string][]string{"objectClass": {"inetOrgPerson", "posixAccount"}, "uid": {"jane"}, "uidNumber": {"10000"}})
+	d.Unlock()
+	l := d.dial(t, defaultDirectory())
+	r := l.dir.Posix.UIDNumbers
+
+	// The entry with the lowest DN keeps its number
+	if err := resolveCollision(l, testPosixOther, "uidNumber", 10000, r); err != nil {
+		t.Fatalf("resolveCollision(): %v", err)
+	}
+	if got := d.get(testPosixOther, "uidNumber"); !reflect.DeepEqual(got, []string{"10000"}) {
+		t.Errorf("uidNumber of %s = %q, want it kept", testPosixOther, got)
+	}
+
+	if err := resolveCollision(l, testPosixUser, "uidNumber", 10000, r); err != nil {
+		t.Fatalf("resolveCollision(): %v", err)
+	}
+	if got := d.get(testPosixUser, "uidNumber"); !reflect.DeepEqual(got, []string{"10001"}) {
+		t.Errorf("uidNumber of %s = %q, want 10001", testPosixUser, got)
+	}
+	if got := d.get(testPosixOther, "uidNumber"); !reflect.DeepEqual(got, []string{"10000"}) {
+		t.Errorf("uidNumber of %s = %q, want it kept", testPosixOther, got)
+	}
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/rs/zerolog/log"
+)
+
+// drainTimeout is how long the connections opened with the previous
+// configuration may finish their requests before being closed.
+const drainTimeout = 30 * time.Second
+
+var reloads struct {
+	sync.Mutex
+	generation uint64
+	done       chan struct{}
+}
+
+func generation() uint64 {
+	reloads.Lock()
+	defer reloads.Unlock()
+	return reloads.generation
+}
+
+// reloaded returns a channel closed on the next configuration reload, for
+// the long-running tasks which must start over with the new configuration.
+func reloaded() <-chan struct{} {
+	reloads.Lock()
+	defer reloads.Unlock()
+	if reloads.done == nil {
+		reloads.done = make(chan struct{})
+	}
+	return reloads.done
+}
+
+// Reload validates and applies a configuration loaded again by the config
+// package. On error the configuration in use is kept. Requests in progress
+// end with the configuration they started with, their connections are then
+// drained.
+func Reload(c *config.Config, trigger string, err error) {
+	if err == nil {
+		err = applyReload(c)
+	}
+	if err != nil {
+		configReloads.WithLabelValues(trigger, "failure").Inc()
+		log.Error().Err(err).Str("trigger", trigger).Msg("configuration reload failed, keeping the current one")
+		return
+	}
+	configReloads.WithLabelValues(trigger, "success").Inc()
+	configReloadTime.SetToCurrentTime()
+	log.Info().Str("trigger", trigger).Msg("configuration reloaded")
+}
+
+// applyReload switches to c once everything it needs could be opened. The
+// store, the only thing the services can't be set up without, is opened
+// before switching, so that nothing is started with a configuration which
+// isn't applied.
+func applyReload(c *config.Config) error {
+	previous := conf()
+	if c.Store.Path != previous.Store.Path {
+		return errors.New("store.path can't change without restart")
+	}
+	if c.Server.Host != previous.Server.Host || c.Server.Port != previous.Server.Port {
+		log.Warn().Msg("server.host and server.port changes are applied on restart")
+	}
+	if err := checkRules(c); err != nil {
+		return err
+	}
+	sink, err := newAuditSink(c)
+	if err != nil {
+		return err
+	}
+	if needsStore(c) {
+		if _, err := openStore(); err != nil {
+			if closer, ok := sink.(io.Closer); ok && sink != currentAudit() {
+				closer.Close()
+			}
+			return err
+		}
+	}
+
+	currentConf.Store(c)
+	setupLogger()
+	setAudit(sink)
+	resetWatched(previous)
+	for _, setup := range []func() error{setupWebhooks, setupWatcher, setupJobs} {
+		if err := setup(); err != nil {
+			log.Error().Err(err).Msg("can't set up a service with the reloaded configuration")
+		}
+	}
+
+	reloads.Lock()
+	reloads.generation++
+	current := reloads.generation
+	if reloads.done != nil {
+		close(reloads.done)
+	}
+	reloads.done = make(chan struct{})
+	reloads.Unlock()
+
+	go drainConns(current)
+	return nil
+}
+
+// needsStore tells whether the webhooks or the jobs of c keep their state in
+// the store.
+func needsStore(c *config.Config) bool {
+	if len(c.Webhooks.Endpoints) > 0 || c.Ldap.RW.Username != "" {
+		return true
+	}
+	for _, d := range c.Directories {
+		if d.RW.Username != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// drainConns waits for the connections opened before the given generation
+// to be closed, and closes the ones still open after drainTimeout.
+func drainConns(before uint64) {
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		if len(staleConns(before)) == 0 {
+			log.Debug().Msg("connections of the previous configuration drained")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stale := staleConns(before)
+	for _, conn := range stale {
+		conn.Close()
+	}
+	log.Warn().Int("connections", len(stale)).Msg("connections of the previous configuration closed after drain timeout")
+}
@@ -0,0 +1,1346 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) interface over the directory. SCIM
+// attributes are mapped onto LDAP attributes by `scim.userMapping` and
+// `scim.groupMapping`, and resource ids are entry DNs, as for the rest of
+// the API.
+
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimEnterpriseSchema   = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimListSchema         = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimPatchSchema        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimBulkResponseSchema = "urn:ietf:params:scim:api:messages:2.0:BulkResponse"
+	scimContentType        = "application/scim+json"
+
+	scimMaxBulkOperations = 1000
+	scimMaxPayloadSize    = 1 << 20
+)
+
+// Multi-valued complex SCIM attributes, whose values are held in `value`.
+var scimMultiValued = map[string]bool{
+	"emails":           true,
+	"phoneNumbers":     true,
+	"ims":              true,
+	"photos":           true,
+	"entitlements":     true,
+	"roles":            true,
+	"x509Certificates": true,
+	"members":          true,
+}
+
+var defaultScimUserMapping = map[string]string{
+	"userName":        "cn",
+	"name.givenName":  "givenName",
+	"name.familyName": "sn",
+	"displayName":     "displayName",
+	"emails":          "mail",
+}
+
+var defaultScimGroupMapping = map[string]string{
+	"displayName": "cn",
+	"members":     "member",
+}
+
+type scimResourceType struct {
+	Name              string
+	Endpoint          string
+	Schema            string
+	URL               string
+	Mapping           map[string]string
+	Attributes        map[string]string
+	Rules             map[string]rule
+	ObjectClassSearch string
+	ObjectClasses     []string
+	RDN               string
+	BaseDN            string
+}
+
+func scimURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	if name := directoryOf(c).auditName(); name != "" {
+		return scheme + "://" + c.Request.Host + "/scim/" + name + "/v2"
+	}
+	return scheme + "://" + c.Request.Host + "/scim/v2"
+}
+
+func scimUsers(c *gin.Context) scimResourceType {
+	dir := directoryOf(c)
+	rt := scimResourceType{
+		Name:              "User",
+		Endpoint:          "/Users",
+		Schema:            scimUserSchema,
+		URL:               scimURL(c) + "/Users",
+		Mapping:           conf().Scim.UserMapping,
+		Attributes:        dir.UserAttributes,
+		Rules:             dir.UserRules,
+		ObjectClassSearch: dir.UsersObjectClassSearch,
+		ObjectClasses:     conf().Scim.UserObjectClasses,
+		BaseDN:            conf().Scim.UsersDN,
+	}
+	if len(rt.Mapping) == 0 {
+		rt.Mapping = defaultScimUserMapping
+	}
+	rt.RDN = rt.Mapping["userName"]
+	return rt.withDefaults(dir)
+}
+
+func scimGroups(c *gin.Context) scimResourceType {
+	dir := directoryOf(c)
+	rt := scimResourceType{
+		Name:              "Group",
+		Endpoint:          "/Groups",
+		Schema:            scimGroupSchema,
+		URL:               scimURL(c) + "/Groups",
+		Mapping:           conf().Scim.GroupMapping,
+		Attributes:        dir.GroupAttributes,
+		Rules:             dir.GroupRules,
+		ObjectClassSearch: dir.GroupsObjectClassSearch,
+		ObjectClasses:     conf().Scim.GroupObjectClasses,
+		BaseDN:            conf().Scim.GroupsDN,
+	}
+	if len(rt.Mapping) == 0 {
+		rt.Mapping = defaultScimGroupMapping
+	}
+	rt.RDN = rt.Mapping["displayName"]
+	return rt.withDefaults(dir)
+}
+
+func (rt scimResourceType) withDefaults(dir directory) scimResourceType {
+	if len(rt.ObjectClasses) == 0 {
+		rt.ObjectClasses = []string{rt.ObjectClassSearch}
+	}
+	// scim.usersDN and scim.groupsDN are DNs of the default directory
+	if rt.BaseDN == "" || dir.auditName() != "" {
+		rt.BaseDN = dir.BaseDN
+	}
+	if rt.RDN == "" {
+		rt.RDN = "cn"
+	}
+	return rt
+}
+
+// action returns the audit action of an operation on the resource type.
+func (rt scimResourceType) action(operation string) string {
+	return strings.ToLower(rt.Name) + "." + operation
+}
+
+// ldapAttributes returns the LDAP attributes the resource type is mapped to.
+func (rt scimResourceType) ldapAttributes() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, attr := range rt.Mapping {
+		if !seen[attr] {
+			seen[attr] = true
+			names = append(names, attr)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mappedAttributes returns the configured attributes the resource type is
+// mapped to, the only ones a replace changes.
+func (rt scimResourceType) mappedAttributes() map[string]string {
+	mapped := make(map[string]string)
+	names := rt.ldapAttributes()
+	for name, necessity := range rt.Attributes {
+		if containsFold(names, name) {
+			mapped[name] = necessity
+		}
+	}
+	return mapped
+}
+
+type scimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.Detail
+}
+
+func newScimError(status int, scimType string, err error) *scimError {
+	return &scimError{Status: status, ScimType: scimType, Detail: err.Error()}
+}
+
+// scimLdapError maps an LDAP error to the matching SCIM error.
+func scimLdapError(err error) *scimError {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return newScimError(http.StatusInternalServerError, "", err)
+	}
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultNoSuchObject:
+		return newScimError(http.StatusNotFound, "", err)
+	case ldap.LDAPResultEntryAlreadyExists:
+		return newScimError(http.StatusConflict, "uniqueness", err)
+	case ldap.LDAPResultInsufficientAccessRights:
+		return newScimError(http.StatusForbidden, "", err)
+	case ldap.LDAPResultObjectClassViolation, ldap.LDAPResultConstraintViolation,
+		ldap.LDAPResultInvalidAttributeSyntax, ldap.LDAPResultNotAllowedOnRDN,
+		ldap.LDAPResultUndefinedAttributeType, ldap.LDAPResultAttributeOrValueExists,
+		ldap.LDAPResultInvalidDNSyntax, ldap.LDAPResultNamingViolation:
+		return newScimError(http.StatusBadRequest, "invalidValue", err)
+	}
+	return newScimError(http.StatusInternalServerError, "", err)
+}
+
+func (e *scimError) body() map[string]interface{} {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+	return body
+}
+
+func scimAbort(c *gin.Context, err *scimError) {
+	requestLogger(c).Warn().Err(err).Int("status", err.Status).Msg("request aborted")
+	c.Header("Content-Type", scimContentType)
+	c.AbortWithStatusJSON(err.Status, err.body())
+}
+
+func scimJSON(c *gin.Context, statusCode int, body interface{}) {
+	c.Header("Content-Type", scimContentType)
+	c.JSON(statusCode, body)
+}
+
+// toResource builds the SCIM representation of an entry from its LDAP
+// attributes. groupDNs, when not nil, are returned as the user groups.
+func (rt scimResourceType) toResource(dn string, attrs map[string][]string, groupDNs []string, version string) map[string]interface{} {
+	res := map[string]interface{}{
+		"schemas": []string{rt.Schema},
+		"id":      dn,
+	}
+	for path, attr := range rt.Mapping {
+		if values := attrs[attr]; len(values) > 0 {
+			rt.setValue(res, path, values)
+		}
+	}
+
+	if groupDNs != nil {
+		var groups []interface{}
+		for _, groupDN := range groupDNs {
+			groups = append(groups, map[string]interface{}{
+				"value": groupDN,
+				"$ref":  strings.TrimSuffix(rt.URL, rt.Endpoint) + "/Groups/" + url.PathEscape(groupDN),
+			})
+		}
+		res["groups"] = groups
+	}
+
+	meta := map[string]interface{}{
+		"resourceType": rt.Name,
+		"location":     rt.URL + "/" + url.PathEscape(dn),
+	}
+	if t, err := time.Parse("20060102150405Z", firstValue(attrs["createTimestamp"])); err == nil {
+		meta["created"] = t.Format(time.RFC3339)
+	}
+	if t, err := time.Parse("20060102150405Z", firstValue(attrs["modifyTimestamp"])); err == nil {
+		meta["lastModified"] = t.Format(time.RFC3339)
+	}
+	// A strong tag, as If-Match and bulk versions use the strong comparison
+	if version != "" {
+		meta["version"] = version
+	}
+	res["meta"] = meta
+	return res
+}
+
+func (rt scimResourceType) setValue(res map[string]interface{}, path string, values []string) {
+	container := res
+	name := path
+	if strings.HasPrefix(path, "enterprise.") {
+		container = subObject(res, scimEnterpriseSchema)
+		res["schemas"] = []string{rt.Schema, scimEnterpriseSchema}
+		name = strings.TrimPrefix(path, "enterprise.")
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		container = subObject(container, name[:i])
+		name = name[i+1:]
+	}
+
+	switch {
+	case scimMultiValued[name]:
+		var list []interface{}
+		for i, value := range values {
+			v := map[string]interface{}{"value": value}
+			if i == 0 && name != "members" {
+				v["primary"] = true
+			}
+			list = append(list, v)
+		}
+		container[name] = list
+	case name == "manager":
+		container[name] = map[string]interface{}{"value": values[0]}
+	default:
+		container[name] = values[0]
+	}
+}
+
+func subObject(container map[string]interface{}, name string) map[string]interface{} {
+	if sub, ok := container[name].(map[string]interface{}); ok {
+		return sub
+	}
+	sub := make(map[string]interface{})
+	container[name] = sub
+	return sub
+}
+
+// lookup returns the value at a mapping path in a SCIM resource, attribute
+// names being case insensitive.
+func lookup(res map[string]interface{}, path string) (interface{}, bool) {
+	container := res
+	if strings.HasPrefix(path, "enterprise.") {
+		ext, ok := lookupName(res, scimEnterpriseSchema)
+		if container, _ = ext.(map[string]interface{}); !ok || container == nil {
+			return nil, false
+		}
+		path = strings.TrimPrefix(path, "enterprise.")
+	}
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		sub, ok := lookupName(container, name)
+		if container, _ = sub.(map[string]interface{}); !ok || container == nil {
+			return nil, false
+		}
+	}
+	return lookupName(container, names[len(names)-1])
+}
+
+func lookupName(container map[string]interface{}, name string) (interface{}, bool) {
+	for key, value := range container {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// scimValues converts a SCIM attribute value to LDAP values.
+func scimValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case bool, float64:
+		return []string{fmt.Sprint(v)}, nil
+	case map[string]interface{}:
+		sub, _ := lookupName(v, "value")
+		return scimValues(sub)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			vals, err := scimValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, vals...)
+		}
+		return values, nil
+	}
+	return nil, errors.New("unsupported value")
+}
+
+// fromResource returns the LDAP attributes of a SCIM resource, along with
+// the errors of the attributes which can't be converted.
+func (rt scimResourceType) fromResource(res map[string]interface{}) (map[string][]string, map[string]string) {
+	attrs := make(map[string][]string)
+	errs := make(map[string]string)
+	for path, attr := range rt.Mapping {
+		value, ok := lookup(res, path)
+		if !ok {
+			continue
+		}
+		values, err := scimValues(value)
+		if err != nil {
+			errs[path] = err.Error()
+			continue
+		}
+		for _, v := range values {
+			if v != "" && !contains(attrs[attr], v) {
+				attrs[attr] = append(attrs[attr], v)
+			}
+		}
+	}
+	return attrs, errs
+}
+
+func invalidValue(errs map[string]string) *scimError {
+	var details []string
+	for path, msg := range errs {
+		details = append(details, path+": "+msg)
+	}
+	sort.Strings(details)
+	return newScimError(http.StatusBadRequest, "invalidValue", errors.New(strings.Join(details, ", ")))
+}
+
+// filterAttribute maps a SCIM attribute path used in filters to an LDAP
+// attribute.
+func (rt scimResourceType) filterAttribute(path string) string {
+	path = strings.TrimPrefix(path, rt.Schema+":")
+	if strings.HasPrefix(path, scimEnterpriseSchema+":") {
+		path = "enterprise." + strings.TrimPrefix(path, scimEnterpriseSchema+":")
+	}
+	switch strings.ToLower(path) {
+	case "id":
+		return "entryDN"
+	case "meta.created":
+		return "createTimestamp"
+	case "meta.lastmodified":
+		return "modifyTimestamp"
+	}
+	for p, attr := range rt.Mapping {
+		if strings.EqualFold(p, path) || strings.EqualFold(p+".value", path) {
+			return attr
+		}
+	}
+	return ""
+}
+
+func (rt scimResourceType) read(l *ldapConn, dn string) (map[string]interface{}, *scimError) {
+	names := append(rt.ldapAttributes(), "objectClass", "createTimestamp", "modifyTimestamp")
+	attrs, err := readAttributes(l, dn, names)
+	if err != nil {
+		return nil, scimLdapError(err)
+	}
+	if !containsFold(attrs["objectClass"], rt.ObjectClassSearch) {
+		return nil, newScimError(http.StatusNotFound, "", errors.New(rt.Name+" not found: "+dn))
+	}
+
+	isUser := rt.Name == "User"
+	var groupDNs []string
+	if isUser {
+		if groupDNs, err = groupsOf(l, dn); err != nil {
+			return nil, scimLdapError(err)
+		}
+	}
+	version, err := entryTag(l, dn, isUser)
+	if err != nil {
+		return nil, scimLdapError(err)
+	}
+	return rt.toResource(dn, attrs, groupDNs, version), nil
+}
+
+func (rt scimResourceType) list(l *ldapConn, expr string, startIndex int, count int) (map[string]interface{}, *scimError) {
+	filter := "(objectClass=" + rt.ObjectClassSearch + ")"
+	if expr != "" {
+		f, err := parseScimFilter(expr)
+		if err != nil {
+			return nil, newScimError(http.StatusBadRequest, "invalidFilter", err)
+		}
+		ldapFilter, err := f.ldapFilter(rt.filterAttribute)
+		if err != nil {
+			return nil, newScimError(http.StatusBadRequest, "invalidFilter", err)
+		}
+		filter = "(&" + filter + ldapFilter + ")"
+	}
+
+	names := append(rt.ldapAttributes(), "createTimestamp", "modifyTimestamp")
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, names, []ldap.Control{})
+
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, scimLdapError(err)
+	}
+	entriesReturned.WithLabelValues("scim_" + strings.ToLower(rt.Name) + "s").Observe(float64(len(result.Entries)))
+	sort.Slice(result.Entries, func(i, j int) bool {
+		return result.Entries[i].DN < result.Entries[j].DN
+	})
+
+	start := startIndex - 1
+	if start > len(result.Entries) {
+		start = len(result.Entries)
+	}
+	end := start + count
+	if end > len(result.Entries) {
+		end = len(result.Entries)
+	}
+
+	resources := []interface{}{}
+	for _, ent := range result.Entries[start:end] {
+		var groupDNs []string
+		if rt.Name == "User" {
+			if groupDNs, err = groupsOf(l, ent.DN); err != nil {
+				return nil, scimLdapError(err)
+			}
+		}
+		resources = append(resources, rt.toResource(ent.DN, entryAttributes(ent, names), groupDNs, ""))
+	}
+
+	return map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(result.Entries),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	}, nil
+}
+
+func (rt scimResourceType) create(l *ldapConn, res map[string]interface{}) (map[string]interface{}, *scimError) {
+	attrs, errs := rt.fromResource(res)
+	if len(errs) > 0 {
+		return nil, invalidValue(errs)
+	}
+	rdn := attrs[rt.RDN]
+	if len(rdn) == 0 {
+		return nil, newScimError(http.StatusBadRequest, "invalidValue", errors.New("missing attribute mapped to "+rt.RDN))
+	}
+	dn := rt.RDN + "=" + escapeDN(rdn[0]) + "," + rt.BaseDN
+	if _, ok := attrs["objectClass"]; !ok {
+		attrs["objectClass"] = rt.ObjectClasses
+	}
+
+	if errs := validateEntry(entry{DN: dn, Attributes: attrs}, rt.Attributes, rt.Rules, true); len(errs) > 0 {
+		return nil, invalidValue(errs)
+	}
+
+	addReq := ldap.NewAddRequest(dn, []ldap.Control{})
+	for name, values := range attrs {
+		addReq.Attribute(name, values)
+	}
+	err := l.Add(addReq)
+	l.recordAudit(rt.action("create"), dn, nil, attrs, err)
+	if err != nil {
+		return nil, scimLdapError(err)
+	}
+	if err := forgetChangedMemberships(l.dir, dn, nil, attrs["member"]); err != nil {
+		return nil, scimLdapError(err)
+	}
+
+	if serr := rt.setPassword(l, dn, res); serr != nil {
+		return nil, serr
+	}
+	return rt.read(l, dn)
+}
+
+func (rt scimResourceType) replace(l *ldapConn, dn string, res map[string]interface{}) (map[string]interface{}, *scimError) {
+	if _, serr := rt.read(l, dn); serr != nil {
+		return nil, serr
+	}
+	current, err := readAttributes(l, dn, rt.ldapAttributes())
+	if err != nil {
+		return nil, scimLdapError(err)
+	}
+	attrs, errs := rt.fromResource(res)
+	if len(errs) > 0 {
+		return nil, invalidValue(errs)
+	}
+	// A full replace: the mapped attributes left out are deleted
+	if errs := validateEntry(entry{DN: dn, Attributes: attrs}, rt.mappedAttributes(), rt.Rules, true); len(errs) > 0 {
+		return nil, invalidValue(errs)
+	}
+
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	if diffModifications(modReq, current, attrs) > 0 {
+		err := l.Modify(modReq)
+		l.recordAudit(rt.action("update"), dn, current, attrs, err)
+		if err != nil {
+			return nil, scimLdapError(err)
+		}
+		if err := forgetChangedMemberships(l.dir, dn, current["member"], attrs["member"]); err != nil {
+			return nil, scimLdapError(err)
+		}
+	}
+
+	if serr := rt.setPassword(l, dn, res); serr != nil {
+		return nil, serr
+	}
+	return rt.read(l, dn)
+}
+
+func (rt scimResourceType) setPassword(l *ldapConn, dn string, res map[string]interface{}) *scimError {
+	value, ok := lookupName(res, "password")
+	if !ok || rt.Name != "User" {
+		return nil
+	}
+	password, ok := value.(string)
+	if !ok || password == "" {
+		return newScimError(http.StatusBadRequest, "invalidValue", errors.New("password must be a string"))
+	}
+	passwdModReq := ldap.NewPasswordModifyRequest(dn, "", password)
+	_, err := l.PasswordModify(passwdModReq)
+	// Password values are redacted by the audit, only the change is recorded
+	l.recordAudit("user.password", dn, map[string][]string{"userPassword": {"old"}}, map[string][]string{"userPassword": {"new"}}, err)
+	if err != nil {
+		return scimLdapError(err)
+	}
+	return nil
+}
+
+type scimPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// patch applies the operations to the current SCIM representation of the
+// entry, then replaces the entry with the result.
+func (rt scimResourceType) patch(l *ldapConn, dn string, req scimPatchRequest) (map[string]interface{}, *scimError) {
+	if !contains(req.Schemas, scimPatchSchema) {
+		return nil, newScimError(http.StatusBadRequest, "invalidSyntax", errors.New("missing schema "+scimPatchSchema))
+	}
+	res, serr := rt.read(l, dn)
+	if serr != nil {
+		return nil, serr
+	}
+	for _, op := range req.Operations {
+		if serr := rt.applyPatchOperation(res, op); serr != nil {
+			return nil, serr
+		}
+	}
+	return rt.replace(l, dn, res)
+}
+
+func (rt scimResourceType) applyPatchOperation(res map[string]interface{}, op scimPatchOperation) *scimError {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return newScimError(http.StatusBadRequest, "invalidSyntax", errors.New("unknown operation: "+op.Op))
+	}
+
+	if op.Path == "" {
+		values, ok := op.Value.(map[string]interface{})
+		if !ok || kind == "remove" {
+			return newScimError(http.StatusBadRequest, "noTarget", errors.New("missing path"))
+		}
+		for name, value := range values {
+			if serr := rt.applyPatchOperation(res, scimPatchOperation{Op: op.Op, Path: name, Value: value}); serr != nil {
+				return serr
+			}
+		}
+		return nil
+	}
+
+	container := res
+	path := strings.TrimPrefix(op.Path, rt.Schema+":")
+	if strings.HasPrefix(path, scimEnterpriseSchema) {
+		container = subObject(res, scimEnterpriseSchema)
+		path = strings.TrimPrefix(strings.TrimPrefix(path, scimEnterpriseSchema), ":")
+		if path == "" {
+			values, ok := op.Value.(map[string]interface{})
+			if !ok {
+				return newScimError(http.StatusBadRequest, "invalidValue", errors.New("extension value must be an object"))
+			}
+			for name, value := range values {
+				container[name] = value
+			}
+			return nil
+		}
+	}
+
+	var attr, valueFilter, sub string
+	if i := strings.Index(path, "["); i > 0 {
+		j := strings.Index(path, "]")
+		if j < i {
+			return newScimError(http.StatusBadRequest, "invalidPath", errors.New("invalid path: "+op.Path))
+		}
+		attr, valueFilter, sub = path[:i], path[i+1:j], strings.TrimPrefix(path[j+1:], ".")
+	} else if i := strings.Index(path, "."); i > 0 {
+		attr, sub = path[:i], path[i+1:]
+	} else {
+		attr = path
+	}
+	for key := range container {
+		if strings.EqualFold(key, attr) {
+			attr = key
+		}
+	}
+
+	if valueFilter != "" {
+		f, err := parseScimFilter(valueFilter)
+		if err != nil {
+			return newScimError(http.StatusBadRequest, "invalidFilter", err)
+		}
+		items, _ := container[attr].([]interface{})
+		var kept []interface{}
+		matched := false
+		for _, item := range items {
+			value, ok := item.(map[string]interface{})
+			if !ok || !f.matches(value, "") {
+				kept = append(kept, item)
+				continue
+			}
+			matched = true
+			switch {
+			case kind == "remove" && sub == "":
+			case kind == "remove":
+				delete(value, sub)
+				kept = append(kept, value)
+			case sub == "":
+				kept = append(kept, op.Value)
+			default:
+				value[sub] = op.Value
+				kept = append(kept, value)
+			}
+		}
+		if !matched && kind != "add" {
+			return newScimError(http.StatusBadRequest, "noTarget", errors.New("no value matches "+op.Path))
+		}
+		container[attr] = kept
+		return nil
+	}
+
+	if sub != "" {
+		if kind == "remove" {
+			if obj, ok := container[attr].(map[string]interface{}); ok {
+				delete(obj, sub)
+			}
+			return nil
+		}
+		subObject(container, attr)[sub] = op.Value
+		return nil
+	}
+
+	switch kind {
+	case "remove":
+		if values, ok := op.Value.([]interface{}); ok {
+			// Remove the given values only, as sent by some clients for members
+			items, _ := container[attr].([]interface{})
+			var kept []interface{}
+			for _, item := range items {
+				itemValues, _ := scimValues(item)
+				removed := false
+				for _, value := range values {
+					v, _ := scimValues(value)
+					if len(v) > 0 && len(itemValues) > 0 && v[0] == itemValues[0] {
+						removed = true
+					}
+				}
+				if !removed {
+					kept = append(kept, item)
+				}
+			}
+			container[attr] = kept
+		} else {
+			delete(container, attr)
+		}
+	case "add":
+		if items, ok := container[attr].([]interface{}); ok || scimMultiValued[attr] {
+			if values, ok := op.Value.([]interface{}); ok {
+				items = append(items, values...)
+			} else {
+				items = append(items, op.Value)
+			}
+			container[attr] = items
+		} else {
+			container[attr] = op.Value
+		}
+	case "replace":
+		container[attr] = op.Value
+	}
+	return nil
+}
+
+func (rt scimResourceType) delete(l *ldapConn, dn string) *scimError {
+	if _, serr := rt.read(l, dn); serr != nil {
+		return serr
+	}
+	before, err := readAttributes(l, dn, []string{"*"})
+	if err != nil {
+		return scimLdapError(err)
+	}
+	err = l.Del(ldap.NewDelRequest(dn, []ldap.Control{}))
+	l.recordAudit(rt.action("delete"), dn, before, nil, err)
+	if err != nil {
+		return scimLdapError(err)
+	}
+	if rt.Name == "User" {
+		if err := removeFromGroups(l, dn); err != nil {
+			return scimLdapError(err)
+		}
+	}
+	return nil
+}
+
+func ScimGetUsers(c *gin.Context) {
+	scimList(c, scimUsers(c))
+}
+
+func ScimGetUser(c *gin.Context) {
+	scimGet(c, scimUsers(c))
+}
+
+func ScimCreateUser(c *gin.Context) {
+	scimCreate(c, scimUsers(c))
+}
+
+func ScimReplaceUser(c *gin.Context) {
+	scimReplace(c, scimUsers(c))
+}
+
+func ScimPatchUser(c *gin.Context) {
+	scimPatch(c, scimUsers(c))
+}
+
+func ScimDeleteUser(c *gin.Context) {
+	scimDelete(c, scimUsers(c))
+}
+
+func ScimGetGroups(c *gin.Context) {
+	scimList(c, scimGroups(c))
+}
+
+func ScimGetGroup(c *gin.Context) {
+	scimGet(c, scimGroups(c))
+}
+
+func ScimCreateGroup(c *gin.Context) {
+	scimCreate(c, scimGroups(c))
+}
+
+func ScimReplaceGroup(c *gin.Context) {
+	scimReplace(c, scimGroups(c))
+}
+
+func ScimPatchGroup(c *gin.Context) {
+	scimPatch(c, scimGroups(c))
+}
+
+func ScimDeleteGroup(c *gin.Context) {
+	scimDelete(c, scimGroups(c))
+}
+
+func scimConn(c *gin.Context) (*ldapConn, bool) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		scimAbort(c, newScimError(http.StatusInternalServerError, "", errors.New("can't get ldap conn")))
+		return nil, false
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		scimAbort(c, newScimError(http.StatusInternalServerError, "", errors.New("can't get ldap conn")))
+		return nil, false
+	}
+	return ldp, true
+}
+
+// scimCheckIfMatch is the SCIM counterpart of checkIfMatch.
+func scimCheckIfMatch(c *gin.Context, l *ldapConn, dn string, isUser bool) bool {
+	if serr := scimMatchVersion(l, dn, isUser, c.GetHeader("If-Match")); serr != nil {
+		scimAbort(c, serr)
+		return false
+	}
+	return true
+}
+
+// scimMatchVersion checks the version the client expects the entry at dn to
+// have, given as If-Match header or as bulk operation version.
+func scimMatchVersion(l *ldapConn, dn string, isUser bool, version string) *scimError {
+	if version == "" {
+		return nil
+	}
+	tag, err := entryTag(l, dn, isUser)
+	if err != nil {
+		return scimLdapError(err)
+	}
+	if !matchTag(version, tag, false) {
+		return newScimError(http.StatusPreconditionFailed, "", errStaleEntry)
+	}
+	return nil
+}
+
+func scimList(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	maxResults := conf().Scim.MaxResults
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(maxResults)))
+	if err != nil || count > maxResults {
+		count = maxResults
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	resp, serr := rt.list(ldp, c.Query("filter"), startIndex, count)
+	if serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	scimJSON(c, http.StatusOK, resp)
+}
+
+func scimGet(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	res, serr := rt.read(ldp, c.Param("id"))
+	if serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	version := res["meta"].(map[string]interface{})["version"].(string)
+	c.Header("ETag", version)
+	if header := c.GetHeader("If-None-Match"); header != "" && matchTag(header, version, true) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	scimJSON(c, http.StatusOK, res)
+}
+
+func scimCreate(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+		scimAbort(c, newScimError(http.StatusBadRequest, "invalidSyntax", err))
+		return
+	}
+
+	res, serr := rt.create(ldp, body)
+	if serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	c.Header("Location", res["meta"].(map[string]interface{})["location"].(string))
+	scimJSON(c, http.StatusCreated, res)
+}
+
+func scimReplace(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+		scimAbort(c, newScimError(http.StatusBadRequest, "invalidSyntax", err))
+		return
+	}
+
+	id := c.Param("id")
+	if !scimCheckIfMatch(c, ldp, id, rt.Name == "User") {
+		return
+	}
+	res, serr := rt.replace(ldp, id, body)
+	if serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	scimJSON(c, http.StatusOK, res)
+}
+
+func scimPatch(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	var req scimPatchRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		scimAbort(c, newScimError(http.StatusBadRequest, "invalidSyntax", err))
+		return
+	}
+
+	id := c.Param("id")
+	if !scimCheckIfMatch(c, ldp, id, rt.Name == "User") {
+		return
+	}
+	res, serr := rt.patch(ldp, id, req)
+	if serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	scimJSON(c, http.StatusOK, res)
+}
+
+func scimDelete(c *gin.Context, rt scimResourceType) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	if !scimCheckIfMatch(c, ldp, id, rt.Name == "User") {
+		return
+	}
+	if serr := rt.delete(ldp, id); serr != nil {
+		scimAbort(c, serr)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type scimBulkOperation struct {
+	Method  string          `json:"method"`
+	BulkID  string          `json:"bulkId"`
+	Version string          `json:"version"`
+	Path    string          `json:"path"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type scimBulkRequest struct {
+	Schemas      []string            `json:"schemas"`
+	FailOnErrors int                 `json:"failOnErrors"`
+	Operations   []scimBulkOperation `json:"Operations"`
+}
+
+// ScimBulk runs bulk operations in order. A `bulkId:<id>` reference in an
+// operation is replaced by the id of the resource created by the operation
+// with that bulkId.
+func ScimBulk(c *gin.Context) {
+	ldp, ok := scimConn(c)
+	if !ok {
+		return
+	}
+
+	var req scimBulkRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, scimMaxPayloadSize))
+	if err := decoder.Decode(&req); err != nil {
+		scimAbort(c, newScimError(http.StatusBadRequest, "invalidSyntax", err))
+		return
+	}
+	if len(req.Operations) > scimMaxBulkOperations {
+		scimAbort(c, newScimError(http.StatusRequestEntityTooLarge, "", fmt.Errorf("too many operations, maximum is %d", scimMaxBulkOperations)))
+		return
+	}
+
+	users, groups := scimUsers(c), scimGroups(c)
+	ids := make(map[string]string)
+	results := []interface{}{}
+	failures := 0
+	for _, op := range req.Operations {
+		data := op.Data
+		path := op.Path
+		for bulkID, id := range ids {
+			quoted, _ := json.Marshal(id)
+			data = bytes.ReplaceAll(data, []byte(`"bulkId:`+bulkID+`"`), quoted)
+			path = strings.ReplaceAll(path, "bulkId:"+bulkID, id)
+		}
+
+		result := map[string]interface{}{"method": op.Method}
+		if op.BulkID != "" {
+			result["bulkId"] = op.BulkID
+		}
+
+		var rt scimResourceType
+		var id string
+		switch {
+		case strings.HasPrefix(path, "/Users"):
+			rt, id = users, strings.TrimPrefix(strings.TrimPrefix(path, "/Users"), "/")
+		case strings.HasPrefix(path, "/Groups"):
+			rt, id = groups, strings.TrimPrefix(strings.TrimPrefix(path, "/Groups"), "/")
+		}
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+
+		var res map[string]interface{}
+		var serr *scimError
+		status := http.StatusOK
+		switch {
+		case rt.Name == "":
+			serr = newScimError(http.StatusBadRequest, "invalidPath", errors.New("invalid path: "+op.Path))
+		case id != "" && op.Version != "":
+			// As the If-Match header of single requests
+			serr = scimMatchVersion(ldp, id, rt.Name == "User", op.Version)
+		}
+		switch {
+		case serr != nil:
+		case strings.EqualFold(op.Method, http.MethodPost) && id == "":
+			status = http.StatusCreated
+			var body map[string]interface{}
+			if err := json.Unmarshal(data, &body); err != nil {
+				serr = newScimError(http.StatusBadRequest, "invalidSyntax", err)
+			} else {
+				res, serr = rt.create(ldp, body)
+			}
+		case strings.EqualFold(op.Method, http.MethodPut) && id != "":
+			var body map[string]interface{}
+			if err := json.Unmarshal(data, &body); err != nil {
+				serr = newScimError(http.StatusBadRequest, "invalidSyntax", err)
+			} else {
+				res, serr = rt.replace(ldp, id, body)
+			}
+		case strings.EqualFold(op.Method, http.MethodPatch) && id != "":
+			var patch scimPatchRequest
+			if err := json.Unmarshal(data, &patch); err != nil {
+				serr = newScimError(http.StatusBadRequest, "invalidSyntax", err)
+			} else {
+				res, serr = rt.patch(ldp, id, patch)
+			}
+		case strings.EqualFold(op.Method, http.MethodDelete) && id != "":
+			status = http.StatusNoContent
+			serr = rt.delete(ldp, id)
+			result["location"] = rt.URL + "/" + url.PathEscape(id)
+		default:
+			serr = newScimError(http.StatusBadRequest, "invalidSyntax", errors.New("invalid operation: "+op.Method+" "+op.Path))
+		}
+
+		if serr != nil {
+			requestLogger(c).Warn().Err(serr).Str("path", op.Path).Str("method", op.Method).Msg("bulk operation failed")
+			failures++
+			result["status"] = strconv.Itoa(serr.Status)
+			result["response"] = serr.body()
+		} else {
+			result["status"] = strconv.Itoa(status)
+			if res != nil {
+				meta := res["meta"].(map[string]interface{})
+				result["location"] = meta["location"]
+				result["version"] = meta["version"]
+				if op.BulkID != "" {
+					ids[op.BulkID] = res["id"].(string)
+				}
+			}
+		}
+		results = append(results, result)
+
+		if req.FailOnErrors > 0 && failures >= req.FailOnErrors {
+			break
+		}
+	}
+
+	scimJSON(c, http.StatusOK, map[string]interface{}{
+		"schemas":    []string{scimBulkResponseSchema},
+		"Operations": results,
+	})
+}
+
+func ScimServiceProviderConfig(c *gin.Context) {
+	maxResults := conf().Scim.MaxResults
+	scimJSON(c, http.StatusOK, map[string]interface{}{
+		"schemas":          []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"documentationUri": "https://github.com/BedrockStreaming/ldoups",
+		"patch":            map[string]interface{}{"supported": true},
+		"bulk": map[string]interface{}{
+			"supported":      true,
+			"maxOperations":  scimMaxBulkOperations,
+			"maxPayloadSize": scimMaxPayloadSize,
+		},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": maxResults},
+		"changePassword": map[string]interface{}{"supported": true},
+		"sort":           map[string]interface{}{"supported": false},
+		"etag":           map[string]interface{}{"supported": true},
+		"authenticationSchemes": []interface{}{
+			map[string]interface{}{
+				"type":        "httpbasic",
+				"name":        "HTTP Basic",
+				"description": "Authentication with a directory account, as for the rest of the API",
+			},
+		},
+		"meta": map[string]interface{}{
+			"resourceType": "ServiceProviderConfig",
+			"location":     scimURL(c) + "/ServiceProviderConfig",
+		},
+	})
+}
+
+// schemas describes the SCIM attributes a resource type is mapped to.
+func (rt scimResourceType) schemas(c *gin.Context) []interface{} {
+	core := make(map[string]map[string]interface{})
+	enterprise := make(map[string]map[string]interface{})
+	for _, path := range attributeNames(rt.Mapping) {
+		attrs := core
+		name := path
+		if strings.HasPrefix(path, "enterprise.") {
+			attrs = enterprise
+			name = strings.TrimPrefix(path, "enterprise.")
+		}
+		sub := ""
+		if i := strings.Index(name, "."); i > 0 {
+			name, sub = name[:i], name[i+1:]
+		}
+
+		definition := map[string]interface{}{
+			"name":        name,
+			"type":        "string",
+			"multiValued": scimMultiValued[name],
+			"required":    rt.Attributes[rt.Mapping[path]] == "required",
+			"mutability":  "readWrite",
+			"returned":    "default",
+			"uniqueness":  "none",
+		}
+		if name == rt.Mapping["userName"] || path == "userName" {
+			definition["uniqueness"] = "server"
+		}
+		if scimMultiValued[name] || name == "manager" {
+			definition["type"] = "complex"
+			definition["subAttributes"] = []interface{}{
+				map[string]interface{}{"name": "value", "type": "string", "multiValued": false},
+			}
+		}
+		if sub != "" {
+			parent, ok := attrs[name]
+			if !ok {
+				parent = map[string]interface{}{
+					"name":          name,
+					"type":          "complex",
+					"multiValued":   false,
+					"mutability":    "readWrite",
+					"returned":      "default",
+					"subAttributes": []interface{}{},
+				}
+				attrs[name] = parent
+			}
+			definition["name"] = sub
+			parent["subAttributes"] = append(parent["subAttributes"].([]interface{}), definition)
+			continue
+		}
+		attrs[name] = definition
+	}
+
+	toList := func(attrs map[string]map[string]interface{}) []interface{} {
+		var names []string
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var list []interface{}
+		for _, name := range names {
+			list = append(list, attrs[name])
+		}
+		return list
+	}
+	schemas := []interface{}{
+		map[string]interface{}{
+			"schemas":    []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":         rt.Schema,
+			"name":       rt.Name,
+			"attributes": toList(core),
+			"meta": map[string]interface{}{
+				"resourceType": "Schema",
+				"location":     scimURL(c) + "/Schemas/" + rt.Schema,
+			},
+		},
+	}
+	if len(enterprise) > 0 {
+		schemas = append(schemas, map[string]interface{}{
+			"schemas":    []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":         scimEnterpriseSchema,
+			"name":       "EnterpriseUser",
+			"attributes": toList(enterprise),
+			"meta": map[string]interface{}{
+				"resourceType": "Schema",
+				"location":     scimURL(c) + "/Schemas/" + scimEnterpriseSchema,
+			},
+		})
+	}
+	return schemas
+}
+
+func (rt scimResourceType) resourceType(c *gin.Context) map[string]interface{} {
+	resourceType := map[string]interface{}{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+		"id":       rt.Name,
+		"name":     rt.Name,
+		"endpoint": rt.Endpoint,
+		"schema":   rt.Schema,
+		"meta": map[string]interface{}{
+			"resourceType": "ResourceType",
+			"location":     scimURL(c) + "/ResourceTypes/" + rt.Name,
+		},
+	}
+	for path := range rt.Mapping {
+		if strings.HasPrefix(path, "enterprise.") {
+			resourceType["schemaExtensions"] = []interface{}{
+				map[string]interface{}{"schema": scimEnterpriseSchema, "required": false},
+			}
+		}
+	}
+	return resourceType
+}
+
+func ScimSchemas(c *gin.Context) {
+	schemas := append(scimUsers(c).schemas(c), scimGroups(c).schemas(c)...)
+	if id := c.Param("id"); id != "" {
+		for _, schema := range schemas {
+			if schema.(map[string]interface{})["id"] == id {
+				scimJSON(c, http.StatusOK, schema)
+				return
+			}
+		}
+		scimAbort(c, newScimError(http.StatusNotFound, "", errors.New("schema not found: "+id)))
+		return
+	}
+	scimJSON(c, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(schemas),
+		"startIndex":   1,
+		"itemsPerPage": len(schemas),
+		"Resources":    schemas,
+	})
+}
+
+func ScimResourceTypes(c *gin.Context) {
+	resourceTypes := []interface{}{scimUsers(c).resourceType(c), scimGroups(c).resourceType(c)}
+	if id := c.Param("id"); id != "" {
+		for _, resourceType := range resourceTypes {
+			if resourceType.(map[string]interface{})["id"] == id {
+				scimJSON(c, http.StatusOK, resourceType)
+				return
+			}
+		}
+		scimAbort(c, newScimError(http.StatusNotFound, "", errors.New("resource type not found: "+id)))
+		return
+	}
+	scimJSON(c, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resourceTypes),
+		"startIndex":   1,
+		"itemsPerPage": len(resourceTypes),
+		"Resources":    resourceTypes,
+	})
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func containsFold(slice []string, elem string) bool {
+	for _, e := range slice {
+		if strings.EqualFold(e, elem) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// SCIM filters (RFC 7644 section 3.4.2.2) are parsed into a tree of
+// scimFilter nodes, which can be translated to an LDAP filter or evaluated
+// against the values of a multi-valued complex attribute (e.g. in PATCH
+// paths such as `members[value eq "cn=jdoe,dc=example,dc=org"]`).
+type scimFilter struct {
+	Op       string // and, or, not, pr, eq, ne, co, sw, ew, gt, ge, lt, le
+	Path     string
+	Value    interface{}
+	Children []*scimFilter
+}
+
+var errInvalidFilter = errors.New("invalid filter")
+
+var scimComparisons = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseScimFilter parses a SCIM filter expression.
+func parseScimFilter(expr string) (*scimFilter, error) {
+	tokens, err := tokenizeScimFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.or("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", errInvalidFilter, p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func tokenizeScimFilter(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch ch := expr[i]; {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '(' || ch == ')' || ch == '[' || ch == ']':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("%w: unterminated string", errInvalidFilter)
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(expr) && !strings.ContainsRune(" \t()[]\"", rune(expr[j])); j++ {
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *scimFilterParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("%w: expected %q, got %q", errInvalidFilter, token, got)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or(prefix string) (*scimFilter, error) {
+	left, err := p.and(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{Op: "or", Children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) and(prefix string) (*scimFilter, error) {
+	left, err := p.factor(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.factor(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{Op: "and", Children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) factor(prefix string) (*scimFilter, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("%w: unexpected end of filter", errInvalidFilter)
+	case strings.EqualFold(token, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.or(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &scimFilter{Op: "not", Children: []*scimFilter{f}}, nil
+	case token == "(":
+		f, err := p.or(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+
+	path := prefix + token
+	if p.peek() == "[" {
+		// Value filter on a complex attribute, e.g. emails[type eq "work"]
+		p.next()
+		f, err := p.or(path + ".")
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect("]")
+	}
+
+	op := strings.ToLower(p.next())
+	if op == "pr" {
+		return &scimFilter{Op: op, Path: path}, nil
+	}
+	if !scimComparisons[op] {
+		return nil, fmt.Errorf("%w: unknown operator %q", errInvalidFilter, op)
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(p.next()), &value); err != nil {
+		return nil, fmt.Errorf("%w: invalid value for %s", errInvalidFilter, path)
+	}
+	return &scimFilter{Op: op, Path: path, Value: value}, nil
+}
+
+// ldapFilter translates f to an LDAP filter; attribute maps a SCIM attribute
+// path to an LDAP attribute, or returns an empty string when the path can't
+// be filtered on.
+func (f *scimFilter) ldapFilter(attribute func(path string) string) (string, error) {
+	switch f.Op {
+	case "and", "or":
+		var b strings.Builder
+		if f.Op == "and" {
+			b.WriteString("(&")
+		} else {
+			b.WriteString("(|")
+		}
+		for _, child := range f.Children {
+			filter, err := child.ldapFilter(attribute)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(filter)
+		}
+		b.WriteString(")")
+		return b.String(), nil
+	case "not":
+		filter, err := f.Children[0].ldapFilter(attribute)
+		if err != nil {
+			return "", err
+		}
+		return "(!" + filter + ")", nil
+	}
+
+	attr := attribute(f.Path)
+	if attr == "" {
+		return "", fmt.Errorf("%w: can't filter on %s", errInvalidFilter, f.Path)
+	}
+	if f.Op == "pr" {
+		return "(" + attr + "=*)", nil
+	}
+
+	var value string
+	switch v := f.Value.(type) {
+	case string:
+		value = v
+		if attr == "modifyTimestamp" || attr == "createTimestamp" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return "", fmt.Errorf("%w: invalid date %q", errInvalidFilter, v)
+			}
+			value = t.UTC().Format("20060102150405Z")
+		}
+	case bool:
+		value = strings.ToUpper(fmt.Sprint(v))
+	case float64:
+		value = fmt.Sprint(v)
+	default:
+		return "", fmt.Errorf("%w: can't compare %s to null", errInvalidFilter, f.Path)
+	}
+	value = ldap.EscapeFilter(value)
+
+	switch f.Op {
+	case "eq":
+		return "(" + attr + "=" + value + ")", nil
+	case "ne":
+		return "(!(" + attr + "=" + value + "))", nil
+	case "co":
+		return "(" + attr + "=*" + value + "*)", nil
+	case "sw":
+		return "(" + attr + "=" + value + "*)", nil
+	case "ew":
+		return "(" + attr + "=*" + value + ")", nil
+	case "ge":
+		return "(" + attr + ">=" + value + ")", nil
+	case "le":
+		return "(" + attr + "<=" + value + ")", nil
+	case "gt":
+		return "(&(" + attr + ">=" + value + ")(!(" + attr + "=" + value + ")))", nil
+	case "lt":
+		return "(&(" + attr + "<=" + value + ")(!(" + attr + "=" + value + ")))", nil
+	}
+	return "", errInvalidFilter
+}
+
+// matches evaluates f against one value of a multi-valued complex attribute,
+// whose sub-attributes are addressed relatively to prefix.
+func (f *scimFilter) matches(value map[string]interface{}, prefix string) bool {
+	switch f.Op {
+	case "and":
+		return f.Children[0].matches(value, prefix) && f.Children[1].matches(value, prefix)
+	case "or":
+		return f.Children[0].matches(value, prefix) || f.Children[1].matches(value, prefix)
+	case "not":
+		return !f.Children[0].matches(value, prefix)
+	}
+
+	sub := strings.TrimPrefix(strings.ToLower(f.Path), strings.ToLower(prefix))
+	var actual interface{}
+	for name, v := range value {
+		if strings.ToLower(name) == sub {
+			actual = v
+		}
+	}
+	if f.Op == "pr" {
+		return actual != nil && actual != ""
+	}
+
+	a, b := fmt.Sprint(actual), fmt.Sprint(f.Value)
+	switch f.Op {
+	case "eq":
+		return actual != nil && a == b
+	case "ne":
+		return actual == nil || a != b
+	case "co":
+		return strings.Contains(a, b)
+	case "sw":
+		return strings.HasPrefix(a, b)
+	case "ew":
+		return strings.HasSuffix(a, b)
+	case "gt":
+		return a > b
+	case "ge":
+		return a >= b
+	case "lt":
+		return a < b
+	case "le":
+		return a <= b
+	}
+	return false
+}
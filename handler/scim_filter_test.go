@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScimFilterLdapFilter(t *testing.T) {
+	attributes := map[string]string{
+		"username":          "cn",
+		"name.familyname":   "sn",
+		"emails.value":      "mail",
+		"active":            "active",
+		"meta.lastmodified": "modifyTimestamp",
+	}
+	attribute := func(path string) string {
+		return attributes[strings.ToLower(path)]
+	}
+
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`userName eq "jdoe"`, "(cn=jdoe)"},
+		{`userName EQ "jdoe"`, "(cn=jdoe)"},
+		{`userName ne "jdoe"`, "(!(cn=jdoe))"},
+		{`userName co "do"`, "(cn=*do*)"},
+		{`userName sw "jd"`, "(cn=jd*)"},
+		{`userName ew "oe"`, "(cn=*oe)"},
+		{`userName pr`, "(cn=*)"},
+		{`userName ge "j"`, "(cn>=j)"},
+		{`userName le "j"`, "(cn<=j)"},
+		{`userName gt "j"`, "(&(cn>=j)(!(cn=j)))"},
+		{`userName lt "j"`, "(&(cn<=j)(!(cn=j)))"},
+		{`userName eq "a*b(c)"`, `(cn=a\2ab\28c\29)`},
+		{`active eq true`, "(active=TRUE)"},
+		{`meta.lastModified gt "2021-01-02T03:04:05+01:00"`, "(&(modifyTimestamp>=20210102020405Z)(!(modifyTimestamp=20210102020405Z)))"},
+		{`name.familyName eq "Doe" and userName sw "j"`, "(&(sn=Doe)(cn=j*))"},
+		{`name.familyName eq "Doe" or userName sw "j" and userName ew "e"`, "(|(sn=Doe)(&(cn=j*)(cn=*e)))"},
+		{`(name.familyName eq "Doe" or userName sw "j") and userName ew "e"`, "(&(|(sn=Doe)(cn=j*))(cn=*e))"},
+		{`not (userName eq "jdoe")`, "(!(cn=jdoe))"},
+		{`emails[value ew "@example.org"]`, "(mail=*@example.org)"},
+		{`userName eq "say \"hi\""`, `(cn=say "hi")`},
+	}
+	for _, tt := range tests {
+		f, err := parseScimFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseScimFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		got, err := f.ldapFilter(attribute)
+		if err != nil {
+			t.Errorf("ldapFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ldapFilter(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestScimFilterErrors(t *testing.T) {
+	attribute := func(path string) string {
+		if strings.ToLower(path) == "username" {
+			return "cn"
+		}
+		return ""
+	}
+
+	tests := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName eq jdoe`,
+		`userName is "jdoe"`,
+		`userName eq "jdoe`,
+		`(userName eq "jdoe"`,
+		`userName eq "jdoe")`,
+		`not userName eq "jdoe"`,
+		`userName eq "jdoe" and`,
+		`emails[value eq "a"`,
+		`title eq "boss"`,
+		`userName eq null`,
+	}
+	for _, filter := range tests {
+		f, err := parseScimFilter(filter)
+		if err == nil {
+			_, err = f.ldapFilter(attribute)
+		}
+		if !errors.Is(err, errInvalidFilter) {
+			t.Errorf("filter %q: got error %v, want errInvalidFilter", filter, err)
+		}
+	}
+}
+
+func TestScimFilterMatches(t *testing.T) {
+	member := map[string]interface{}{
+		"value":   "cn=jdoe,dc=example,dc=org",
+		"display": "John Doe",
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`members[value eq "cn=jdoe,dc=example,dc=org"]`, true},
+		{`members[VALUE eq "cn=jdoe,dc=example,dc=org"]`, true},
+		{`members[value eq "cn=other,dc=example,dc=org"]`, false},
+		{`members[value ne "cn=other,dc=example,dc=org"]`, true},
+		{`members[display co "Doe"]`, true},
+		{`members[display sw "John"]`, true},
+		{`members[display ew "John"]`, false},
+		{`members[type pr]`, false},
+		{`members[display pr]`, true},
+		{`members[type eq "direct"]`, false},
+		{`members[type ne "direct"]`, true},
+		{`members[display sw "John" and value sw "cn=jdoe"]`, true},
+		{`members[display sw "Jane" or value sw "cn=jdoe"]`, true},
+		{`members[not (display sw "John")]`, false},
+	}
+	for _, tt := range tests {
+		f, err := parseScimFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseScimFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if got := f.matches(member, "members."); got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
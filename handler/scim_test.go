@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+// newScimDirectory returns a fake directory with two users, mail being
+// required for users.
+func newScimDirectory(t *testing.T) *fakeDirectory {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org":          {"objectClass": {"domain"}},
+		"ou=users,dc=example,dc=org": {"objectClass": {"organizationalUnit"}},
+		testUser:                     {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "sn": {"Doe"}, "mail": {"jdoe@example.org"}, "employeeType": {"staff"}},
+		testOtherDN:                  {"objectClass": {"inetOrgPerson"}, "cn": {"jane"}, "sn": {"Doe"}, "mail": {"jane@example.org"}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		UsersObjectClassSearch:  "inetOrgPerson",
+		GroupsObjectClassSearch: "groupOfNames",
+		UserAttributes:          map[string]string{"mail": "required", "employeeType": "required"},
+	}
+	useTestConfig(t, c)
+	return d
+}
+
+func testScimUsers() scimResourceType {
+	rt := scimResourceType{
+		Name:              "User",
+		Schema:            scimUserSchema,
+		Mapping:           defaultScimUserMapping,
+		Attributes:        defaultDirectory().UserAttributes,
+		ObjectClassSearch: "inetOrgPerson",
+		RDN:               "cn",
+	}
+	return rt.withDefaults(defaultDirectory())
+}
+
+// TestScimReplaceRequired checks that a replace leaving out a required
+// attribute is refused instead of deleting it, and that the required
+// attributes SCIM doesn't map are kept.
+func TestScimReplaceRequired(t *testing.T) {
+	d := newScimDirectory(t)
+	l := d.dial(t, defaultDirectory())
+	rt := testScimUsers()
+
+	_, serr := rt.replace(l, testUser, map[string]interface{}{"userName": "jdoe", "name": map[string]interface{}{"familyName": "Doe"}})
+	if serr == nil || serr.Status != http.StatusBadRequest {
+		t.Fatalf("replace() without mail = %v, want %d", serr, http.StatusBadRequest)
+	}
+	if got := d.get(testUser, "mail"); !reflect.DeepEqual(got, []string{"jdoe@example.org"}) {
+		t.Errorf("mail = %q, want it kept", got)
+	}
+
+	_, serr = rt.replace(l, testUser, map[string]interface{}{"userName": "jdoe", "name": map[string]interface{}{"familyName": "Doe"}, "emails": []interface{}{map[string]interface{}{"value": "john@example.org"}}})
+	if serr != nil {
+		t.Fatalf("replace(): %v", serr)
+	}
+	if got := d.get(testUser, "mail"); !reflect.DeepEqual(got, []string{"john@example.org"}) {
+		t.Errorf("mail = %q, want john@example.org", got)
+	}
+	if got := d.get(testUser, "employeeType"); !reflect.DeepEqual(got, []string{"staff"}) {
+		t.Errorf("employeeType = %q, want it kept", got)
+	}
+}
+
+// TestScimBulkVersion checks that bulk operations with a stale version are
+// refused as requests with a stale If-Match header.
+func TestScimBulkVersion(t *testing.T) {
+	d := newScimDirectory(t)
+	l := d.dial(t, defaultDirectory())
+	rt := testScimUsers()
+	res, serr := rt.read(l, testOtherDN)
+	if serr != nil {
+		t.Fatalf("read(): %v", serr)
+	}
+	version := res["meta"].(map[string]interface{})["version"].(string)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:BulkRequest"},
+		"Operations": []map[string]interface{}{
+			{"method": "DELETE", "path": "/Users/" + testUser, "version": `"stale"`},
+			{"method": "DELETE", "path": "/Users/" + testOtherDN, "version": version},
+		},
+	})
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/scim/v2/Bulk", bytes.NewReader(body))
+	c.Set("LDAP", l)
+	ScimBulk(c)
+
+	var resp struct {
+		Operations []struct {
+			Status string `json:"status"`
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	if len(resp.Operations) != 2 {
+		t.Fatalf("response = %s, want 2 operations", w.Body)
+	}
+	if got := resp.Operations[0].Status; got != "412" {
+		t.Errorf("stale operation status = %s, want 412", got)
+	}
+	if !d.exists(testUser) {
+		t.Error("the entry of the stale operation was deleted")
+	}
+	if got := resp.Operations[1].Status; got != "204" {
+		t.Errorf("current operation status = %s, want 204", got)
+	}
+	if d.exists(testOtherDN) {
+		t.Error("the entry of the current operation wasn't deleted")
+	}
+}
@@ -0,0 +1,419 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// snapshot is the state of the users and groups of a directory, their
+// memberships being the `member` values of the groups. Secret attributes are
+// left out.
+type snapshot struct {
+	Directory string          `json:"directory,omitempty"`
+	BaseDN    string          `json:"baseDN"`
+	TakenAt   time.Time       `json:"takenAt"`
+	Users     []snapshotEntry `json:"users"`
+	Groups    []snapshotEntry `json:"groups"`
+}
+
+type snapshotEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+// snapshotChange is the change of an entry between two snapshots: `added`,
+// `removed` or `modified`.
+type snapshotChange struct {
+	Change  string            `json:"change"`
+	Kind    string            `json:"kind"`
+	DN      string            `json:"dn"`
+	Changes []attributeChange `json:"changes,omitempty"`
+	before  map[string][]string
+	after   map[string][]string
+}
+
+type snapshotDiff struct {
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Changes []snapshotChange `json:"changes"`
+}
+
+type diffRequest struct {
+	From *snapshot `json:"from"`
+	// To is the live directory when missing
+	To *snapshot `json:"to"`
+}
+
+// DiffOptions are the options of the diff command.
+type DiffOptions struct {
+	Directory string
+	// Format is `json`, `ldif` or `text`
+	Format string
+}
+
+var diffFormats = []string{"json", "ldif", "text"}
+
+// takeSnapshot returns the users and groups l can read.
+func takeSnapshot(l *ldapConn) (snapshot, error) {
+	snap := snapshot{Directory: l.dir.auditName(), BaseDN: l.dir.BaseDN, TakenAt: time.Now().UTC()}
+	var err error
+	if snap.Users, err = snapshotEntries(l, l.dir.UsersObjectClassSearch, l.dir.UserAttributes); err != nil {
+		return snap, err
+	}
+	snap.Groups, err = snapshotEntries(l, l.dir.GroupsObjectClassSearch, l.dir.GroupAttributes)
+	return snap, err
+}
+
+func snapshotEntries(l *ldapConn, objectClass string, attributes map[string]string) ([]snapshotEntry, error) {
+	names := []string{"member"}
+	for _, name := range attributeNames(attributes) {
+		if !isSecret(name) && !strings.EqualFold(name, "member") {
+			names = append(names, name)
+		}
+	}
+	filter := "(objectClass=" + objectClass + ")"
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, names, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	entries := []snapshotEntry{}
+	for _, ent := range result.Entries {
+		attrs := entryAttributes(ent, names)
+		for _, values := range attrs {
+			sort.Strings(values)
+		}
+		entries = append(entries, snapshotEntry{DN: ent.DN, Attributes: attrs})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DN < entries[j].DN })
+	return entries, nil
+}
+
+// parseSnapshot reads a snapshot written by takeSnapshot.
+func parseSnapshot(data []byte) (snapshot, error) {
+	var snap snapshot
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&snap); err != nil {
+		return snap, fmt.Errorf("can't parse snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// diffSnapshots returns the entries added, removed and modified from from to
+// to, DNs being compared case-insensitively.
+func diffSnapshots(from snapshot, to snapshot) snapshotDiff {
+	diff := snapshotDiff{From: from.TakenAt, To: to.TakenAt, Changes: []snapshotChange{}}
+	kinds := []struct {
+		name     string
+		from, to []snapshotEntry
+	}{
+		{"user", from.Users, to.Users},
+		{"group", from.Groups, to.Groups},
+	}
+	for _, kind := range kinds {
+		before := make(map[string]snapshotEntry, len(kind.from))
+		for _, e := range kind.from {
+			before[strings.ToLower(e.DN)] = e
+		}
+		after := make(map[string]bool, len(kind.to))
+		for _, e := range kind.to {
+			after[strings.ToLower(e.DN)] = true
+			old, ok := before[strings.ToLower(e.DN)]
+			if !ok {
+				diff.Changes = append(diff.Changes, snapshotChange{Change: "added", Kind: kind.name, DN: e.DN, after: e.Attributes})
+			} else if len(diffAttributes(old.Attributes, e.Attributes)) > 0 {
+				diff.Changes = append(diff.Changes, snapshotChange{Change: "modified", Kind: kind.name, DN: e.DN, before: old.Attributes, after: e.Attributes})
+			}
+		}
+		for _, e := range kind.from {
+			if !after[strings.ToLower(e.DN)] {
+				diff.Changes = append(diff.Changes, snapshotChange{Change: "removed", Kind: kind.name, DN: e.DN, before: e.Attributes})
+			}
+		}
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		if diff.Changes[i].Kind != diff.Changes[j].Kind {
+			return diff.Changes[i].Kind == "user"
+		}
+		return diff.Changes[i].DN < diff.Changes[j].DN
+	})
+	for i := range diff.Changes {
+		diff.Changes[i].Changes = diffAttributes(diff.Changes[i].before, diff.Changes[i].after)
+	}
+	return diff
+}
+
+// writeDiff writes diff in format: `json`, `ldif` change records or `text`.
+func writeDiff(w io.Writer, diff snapshotDiff, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	case "ldif":
+		writeDiffLDIF(w, diff)
+	case "text":
+		writeDiffText(w, diff)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+func writeDiffText(w io.Writer, diff snapshotDiff) {
+	symbols := map[string]string{"added": "+", "modified": "~", "removed": "-"}
+	counts := make(map[string]int)
+	fmt.Fprintf(w, "Changes from %s to %s\n", diff.From.Format(time.RFC3339), diff.To.Format(time.RFC3339))
+	for _, change := range diff.Changes {
+		counts[change.Change]++
+		fmt.Fprintf(w, "%s %s %s\n", symbols[change.Change], change.Kind, change.DN)
+		if change.Change == "modified" {
+			for _, attr := range change.Changes {
+				writeValueChanges(w, attr)
+			}
+		}
+	}
+	if len(diff.Changes) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	fmt.Fprintf(w, "%d added, %d modified, %d removed.\n", counts["added"], counts["modified"], counts["removed"])
+}
+
+// writeDiffLDIF writes diff as LDIF change records turning the first
+// snapshot into the second one. Groups are added after users, and removed
+// before them.
+func writeDiffLDIF(w io.Writer, diff snapshotDiff) {
+	fmt.Fprintln(w, "version: 1")
+	var removed []snapshotChange
+	for _, change := range diff.Changes {
+		if change.Change == "removed" {
+			removed = append([]snapshotChange{change}, removed...)
+			continue
+		}
+		fmt.Fprintln(w)
+		writeLDIFLine(w, "dn", change.DN)
+		switch change.Change {
+		case "added":
+			fmt.Fprintln(w, "changetype: add")
+			for _, name := range attributeNamesOf(change.after) {
+				for _, value := range change.after[name] {
+					writeLDIFLine(w, name, value)
+				}
+			}
+		case "modified":
+			fmt.Fprintln(w, "changetype: modify")
+			for _, attr := range change.Changes {
+				writeLDIFModification(w, attr)
+			}
+		}
+	}
+	for _, change := range removed {
+		fmt.Fprintln(w)
+		writeLDIFLine(w, "dn", change.DN)
+		fmt.Fprintln(w, "changetype: delete")
+	}
+}
+
+// writeLDIFModification writes the modification of an attribute: a replace
+// for single values, the removed and added values otherwise.
+func writeLDIFModification(w io.Writer, attr attributeChange) {
+	switch {
+	case len(attr.After) == 0:
+		fmt.Fprintln(w, "delete: "+attr.Attribute)
+		fmt.Fprintln(w, "-")
+	case len(attr.Before) <= 1 && len(attr.After) == 1:
+		fmt.Fprintln(w, "replace: "+attr.Attribute)
+		writeLDIFLine(w, attr.Attribute, attr.After[0])
+		fmt.Fprintln(w, "-")
+	default:
+		if removed := difference(attr.Before, attr.After); len(removed) > 0 {
+			fmt.Fprintln(w, "delete: "+attr.Attribute)
+			for _, value := range removed {
+				writeLDIFLine(w, attr.Attribute, value)
+			}
+			fmt.Fprintln(w, "-")
+		}
+		if added := difference(attr.After, attr.Before); len(added) > 0 {
+			fmt.Fprintln(w, "add: "+attr.Attribute)
+			for _, value := range added {
+				writeLDIFLine(w, attr.Attribute, value)
+			}
+			fmt.Fprintln(w, "-")
+		}
+	}
+}
+
+// writeLDIFLine writes an attribute value, base64 encoded when it isn't a
+// safe string (RFC 2849).
+func writeLDIFLine(w io.Writer, name string, value string) {
+	if ldifSafe(value) {
+		fmt.Fprintf(w, "%s: %s\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%s:: %s\n", name, base64.StdEncoding.EncodeToString([]byte(value)))
+}
+
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if strings.ContainsAny(value[:1], " :<") || strings.HasSuffix(value, " ") || !utf8.ValidString(value) {
+		return false
+	}
+	for _, r := range value {
+		if r == 0 || r == '\n' || r == '\r' || r > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// GetSnapshot returns a snapshot of the users and groups the logged in user
+// can read, to be compared later with PostDiff.
+func GetSnapshot(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	snap, err := takeSnapshot(ldp)
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, snap)
+}
+
+// PostDiff compares the `from` snapshot with the `to` one, or with the live
+// directory when missing, and returns the changes as `json`, `ldif` or
+// `text` with the `format` parameter.
+func PostDiff(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if !contains(diffFormats, format) {
+		abort(c, fmt.Errorf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	var req diffRequest
+	if err := c.BindJSON(&req); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	if req.From == nil {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"from": "missing attribute"})
+		return
+	}
+	if req.To == nil {
+		snap, err := takeSnapshot(ldp)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		req.To = &snap
+	}
+
+	diff := diffSnapshots(*req.From, *req.To)
+	if format == "json" {
+		c.JSON(http.StatusOK, diff)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeDiff(&buf, diff, format); err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", buf.Bytes())
+}
+
+// commandConn loads c for a read-only command run outside of the server,
+// and opens a connection to the directory named name, bound with its
+// read-only account. The audit sink and the local database, owned by the
+// server, are left alone. The returned function closes the connection.
+func commandConn(c *config.Config, name string) (*ldapConn, func(), error) {
+	currentConf.Store(c)
+	setupLogger()
+
+	dir, ok := lookupDirectory(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown directory %q", name)
+	}
+	l, err := dialDirectoryAs(dir, dir.RO)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.source = "cli"
+	return l, func() { l.Close() }, nil
+}
+
+// SnapshotCommand writes a snapshot of a directory to w, read with its
+// read-only account.
+func SnapshotCommand(c *config.Config, directory string, w io.Writer) error {
+	l, done, err := commandConn(c, directory)
+	if err != nil {
+		return err
+	}
+	defer done()
+	snap, err := takeSnapshot(l)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// DiffCommand writes the changes between the from and to snapshots to w,
+// to being the live directory when nil.
+func DiffCommand(c *config.Config, from []byte, to []byte, opts DiffOptions, w io.Writer) error {
+	fromSnap, err := parseSnapshot(from)
+	if err != nil {
+		return err
+	}
+	var toSnap snapshot
+	if to != nil {
+		if toSnap, err = parseSnapshot(to); err != nil {
+			return err
+		}
+	} else {
+		l, done, err := commandConn(c, opts.Directory)
+		if err != nil {
+			return err
+		}
+		defer done()
+		if toSnap, err = takeSnapshot(l); err != nil {
+			return err
+		}
+	}
+	return writeDiff(w, diffSnapshots(fromSnap, toSnap), opts.Format)
+}
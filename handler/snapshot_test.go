@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteLDIFLine(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"jdoe", "cn: jdoe\n"},
+		{"", "cn: \n"},
+		{"John Doe", "cn: John Doe\n"},
+		{"a:b<c", "cn: a:b<c\n"},
+		{" jdoe", "cn:: IGpkb2U=\n"},
+		{"jdoe ", "cn:: amRvZSA=\n"},
+		{":jdoe", "cn:: Ompkb2U=\n"},
+		{"<jdoe", "cn:: PGpkb2U=\n"},
+		{"Zoë", "cn:: Wm/Dqw==\n"},
+		{"line\nbreak", "cn:: bGluZQpicmVhaw==\n"},
+		{"carriage\rreturn", "cn:: Y2FycmlhZ2UNcmV0dXJu\n"},
+		{"nul\x00", "cn:: bnVsAA==\n"},
+		{"\xff", "cn:: /w==\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeLDIFLine(&b, "cn", tt.value)
+		if got := b.String(); got != tt.want {
+			t.Errorf("writeLDIFLine(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWriteLDIFModification(t *testing.T) {
+	tests := []struct {
+		name   string
+		change attributeChange
+		want   string
+	}{
+		{"delete", attributeChange{Attribute: "mail", Before: []string{"a@example.org"}}, "delete: mail\n-\n"},
+		{"replace single value", attributeChange{Attribute: "sn", Before: []string{"Doe"}, After: []string{"Smith"}}, "replace: sn\nsn: Smith\n-\n"},
+		{"add single value", attributeChange{Attribute: "sn", After: []string{"Doe"}}, "replace: sn\nsn: Doe\n-\n"},
+		{"add and remove values", attributeChange{Attribute: "member", Before: []string{"cn=a", "cn=b"}, After: []string{"cn=b", "cn=c"}}, "delete: member\nmember: cn=a\n-\nadd: member\nmember: cn=c\n-\n"},
+		{"add values", attributeChange{Attribute: "member", Before: []string{"cn=a"}, After: []string{"cn=a", "cn=b"}}, "add: member\nmember: cn=b\n-\n"},
+		{"remove values", attributeChange{Attribute: "member", Before: []string{"cn=a", "cn=b"}, After: []string{"cn=a"}}, "delete: member\nmember: cn=b\n-\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeLDIFModification(&b, tt.change)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDiffLDIF(t *testing.T) {
+	from := snapshot{
+		Users: []snapshotEntry{
+			{DN: "cn=jdoe,dc=example,dc=org", Attributes: map[string][]string{"cn": {"jdoe"}, "sn": {"Doe"}}},
+			{DN: "cn=old,dc=example,dc=org", Attributes: map[string][]string{"cn": {"old"}, "sn": {"Old"}}},
+		},
+		Groups: []snapshotEntry{
+			{DN: "cn=devs,dc=example,dc=org", Attributes: map[string][]string{"cn": {"devs"}, "member": {"cn=old,dc=example,dc=org"}}},
+		},
+	}
+	to := snapshot{
+		Users: []snapshotEntry{
+			{DN: "cn=jdoe,dc=example,dc=org", Attributes: map[string][]string{"cn": {"jdoe"}, "sn": {"Smith"}}},
+			{DN: "cn=new,dc=example,dc=org", Attributes: map[string][]string{"cn": {"new"}, "sn": {"Zoë"}}},
+		},
+		Groups: []snapshotEntry{
+			{DN: "cn=ops,dc=example,dc=org", Attributes: map[string][]string{"cn": {"ops"}, "member": {"cn=new,dc=example,dc=org"}}},
+		},
+	}
+	want := `version: 1
+
+dn: cn=jdoe,dc=example,dc=org
+changetype: modify
+replace: sn
+sn: Smith
+-
+
+dn: cn=new,dc=example,dc=org
+changetype: add
+cn: new
+sn:: Wm/Dqw==
+
+dn: cn=ops,dc=example,dc=org
+changetype: add
+cn: ops
+member: cn=new,dc=example,dc=org
+
+dn: cn=devs,dc=example,dc=org
+changetype: delete
+
+dn: cn=old,dc=example,dc=org
+changetype: delete
+`
+	var b strings.Builder
+	writeDiffLDIF(&b, diffSnapshots(from, to))
+	if got := b.String(); got != want {
+		t.Errorf("writeDiffLDIF() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyExpiry is the comment token giving the date a key expires on, e.g.
+// `jdoe@laptop expires=2027-01-31`.
+const sshKeyExpiry = "expires="
+
+type sshKey struct {
+	Fingerprint string     `json:"fingerprint"`
+	Type        string     `json:"type"`
+	Bits        int        `json:"bits"`
+	Comment     string     `json:"comment,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Expired     bool       `json:"expired,omitempty"`
+	Weak        bool       `json:"weak,omitempty"`
+	Key         string     `json:"key"`
+}
+
+type sshKeyRequest struct {
+	Key       string     `json:"key"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+var (
+	errWeakKey      = errors.New("weak key")
+	errKeyExists    = errors.New("key already added")
+	errKeyNotFound  = errors.New("key not found")
+	errNotKeysAdmin = errors.New("only the user and ssh keys admins can manage its keys")
+)
+
+// parseSSHKey parses an authorized_keys line, and rejects DSA keys and RSA
+// keys shorter than `sshKeys.minRSABits`.
+func parseSSHKey(dir directory, line string) (sshKey, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return sshKey{}, err
+	}
+	key := sshKey{
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Type:        pub.Type(),
+		Comment:     comment,
+		Key:         strings.TrimSpace(line),
+	}
+
+	switch pub.Type() {
+	case ssh.KeyAlgoDSA:
+		return key, fmt.Errorf("%w: DSA keys aren't accepted", errWeakKey)
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519:
+		key.Bits = 256
+	default:
+		if crypto, ok := pub.(ssh.CryptoPublicKey); ok {
+			switch k := crypto.CryptoPublicKey().(type) {
+			case *rsa.PublicKey:
+				key.Bits = k.N.BitLen()
+			case *ecdsa.PublicKey:
+				key.Bits = k.Curve.Params().BitSize
+			}
+		}
+		if pub.Type() == ssh.KeyAlgoRSA && key.Bits < dir.SSHKeys.MinRSABits {
+			return key, fmt.Errorf("%w: RSA keys must be at least %d bits, not %d", errWeakKey, dir.SSHKeys.MinRSABits, key.Bits)
+		}
+	}
+
+	for _, field := range strings.Fields(comment) {
+		if strings.HasPrefix(field, sshKeyExpiry) {
+			if t, err := time.Parse("2006-01-02", strings.TrimPrefix(field, sshKeyExpiry)); err == nil {
+				key.ExpiresAt = &t
+				key.Expired = !time.Now().Before(t)
+			}
+		}
+	}
+	return key, nil
+}
+
+// sshKeysOf returns the keys of the user at dn, along with the attributes
+// read. Weak keys added before are flagged, so that they can be revoked,
+// values which aren't keys are left out.
+func sshKeysOf(l *ldapConn, dn string) ([]sshKey, map[string][]string, error) {
+	attributes, err := readAttributes(l, dn, []string{"objectClass", l.dir.SSHKeys.Attribute})
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := []sshKey{}
+	for _, value := range attributeValues(attributes, l.dir.SSHKeys.Attribute) {
+		key, err := parseSSHKey(l.dir, value)
+		if err != nil && !errors.Is(err, errWeakKey) {
+			l.logger.Warn().Err(err).Str("dn", dn).Msg("invalid ssh key")
+			continue
+		}
+		key.Weak = err != nil
+		keys = append(keys, key)
+	}
+	return keys, attributes, nil
+}
+
+// sshKeysTarget returns the user whose keys are managed, `me` being the
+// logged in user. Only `sshKeys.admins` members manage the keys of others.
+func sshKeysTarget(c *gin.Context, l *ldapConn) (string, error) {
+	dn := c.Param("id")
+	if dn == "me" || strings.EqualFold(dn, l.actor) {
+		return l.actor, nil
+	}
+	admins := l.dir.SSHKeys.Admins
+	if len(admins) == 0 {
+		return dn, nil
+	}
+	admin, err := isMemberOfAny(l, l.actor, admins)
+	if err != nil {
+		return "", err
+	}
+	if !admin {
+		return "", errNotKeysAdmin
+	}
+	return dn, nil
+}
+
+func abortSSHKeys(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNotKeysAdmin):
+		abort(c, err, http.StatusForbidden)
+	case errors.Is(err, errKeyExists):
+		abort(c, err, http.StatusConflict)
+	case errors.Is(err, errKeyNotFound), ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		abort(c, err, http.StatusNotFound)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// GetSSHKeys lists the SSH keys of a user, with their fingerprint, type,
+// size and expiry date.
+func GetSSHKeys(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	dn, err := sshKeysTarget(c, ldp)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	keys, _, err := sshKeysOf(ldp, dn)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// AddSSHKey adds a key to a user, with an optional expiry date kept in its
+// comment.
+func AddSSHKey(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	var req sshKeyRequest
+	if err := c.BindJSON(&req); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	dn, err := sshKeysTarget(c, ldp)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+
+	line := strings.TrimSpace(req.Key)
+	if req.ExpiresAt != nil {
+		line += " " + sshKeyExpiry + req.ExpiresAt.UTC().Format("2006-01-02")
+	}
+	key, err := parseSSHKey(ldp.dir, line)
+	if err != nil {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"key": err.Error()})
+		return
+	}
+	if key.Expired {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, map[string]string{"expiresAt": "already expired"})
+		return
+	}
+
+	keys, before, err := sshKeysOf(ldp, dn)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	for _, k := range keys {
+		if k.Fingerprint == key.Fingerprint {
+			abortSSHKeys(c, fmt.Errorf("%w: %s", errKeyExists, key.Fingerprint))
+			return
+		}
+	}
+
+	attr := ldp.dir.SSHKeys.Attribute
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	if class := ldp.dir.SSHKeys.ObjectClass; !containsFold(attributeValues(before, "objectClass"), class) {
+		modReq.Add("objectClass", []string{class})
+	}
+	modReq.Add(attr, []string{key.Key})
+
+	err = ldp.Modify(modReq)
+	ldp.recordAudit("user.add_ssh_key", dn, map[string][]string{attr: attributeValues(before, attr)}, map[string][]string{attr: append(attributeValues(before, attr), key.Key)}, err)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, key)
+}
+
+// RevokeSSHKey removes the key of a user with the given SHA256 fingerprint.
+func RevokeSSHKey(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	dn, err := sshKeysTarget(c, ldp)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	// Fingerprints hold slashes, they are matched with a catch-all parameter
+	fingerprint := strings.TrimPrefix(c.Param("fingerprint"), "/")
+	keys, before, err := sshKeysOf(ldp, dn)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+
+	attr := ldp.dir.SSHKeys.Attribute
+	var revoked []string
+	for _, k := range keys {
+		if k.Fingerprint == fingerprint || k.Fingerprint == "SHA256:"+fingerprint {
+			revoked = append(revoked, k.Key)
+		}
+	}
+	if len(revoked) == 0 {
+		abortSSHKeys(c, fmt.Errorf("%w: %s", errKeyNotFound, fingerprint))
+		return
+	}
+	// Values are deleted as stored, whatever their spacing
+	var values []string
+	for _, value := range attributeValues(before, attr) {
+		if contains(revoked, strings.TrimSpace(value)) {
+			values = append(values, value)
+		}
+	}
+
+	modReq := ldap.NewModifyRequest(dn, []ldap.Control{})
+	modReq.Delete(attr, values)
+	err = ldp.Modify(modReq)
+	ldp.recordAudit("user.revoke_ssh_key", dn, map[string][]string{attr: attributeValues(before, attr)}, map[string][]string{attr: difference(attributeValues(before, attr), values)}, err)
+	if err != nil {
+		abortSSHKeys(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
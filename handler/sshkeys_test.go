@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey returns the authorized_keys line of public, followed by
+// comment.
+func authorizedKey(t *testing.T, public interface{}, comment string) string {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + comment
+}
+
+func TestParseSSHKey(t *testing.T) {
+	dir := directory{name: config.DefaultDirectory, Directory: &config.Directory{SSHKeys: config.SSHKeys{MinRSABits: 3072}}}
+
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 3072)
+	shortRSAKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var dsaKey dsa.PrivateKey
+	dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160)
+	dsa.GenerateKey(&dsaKey, rand.Reader)
+
+	tests := []struct {
+		name     string
+		line     string
+		keyType  string
+		bits     int
+		weak     bool
+		invalid  bool
+		expiring bool
+		expired  bool
+	}{
+		{"ed25519", authorizedKey(t, edPublic, "jdoe@laptop"), ssh.KeyAlgoED25519, 256, false, false, false, false},
+		{"ecdsa", authorizedKey(t, &ecdsaKey.PublicKey, "jdoe@laptop"), ssh.KeyAlgoECDSA384, 384, false, false, false, false},
+		{"rsa", authorizedKey(t, &rsaKey.PublicKey, "jdoe@laptop"), ssh.KeyAlgoRSA, 3072, false, false, false, false},
+		{"short rsa", authorizedKey(t, &shortRSAKey.PublicKey, "jdoe@laptop"), ssh.KeyAlgoRSA, 2048, true, false, false, false},
+		{"dsa", authorizedKey(t, &dsaKey.PublicKey, "jdoe@laptop"), ssh.KeyAlgoDSA, 0, true, false, false, false},
+		{"expiring", authorizedKey(t, edPublic, "jdoe@laptop expires=2999-01-31"), ssh.KeyAlgoED25519, 256, false, false, true, false},
+		{"expired", authorizedKey(t, edPublic, "expires=2000-01-31 jdoe@laptop"), ssh.KeyAlgoED25519, 256, false, false, true, true},
+		{"invalid expiry", authorizedKey(t, edPublic, "expires=someday"), ssh.KeyAlgoED25519, 256, false, false, false, false},
+		{"invalid key", "ssh-ed25519 AAAA jdoe@laptop", "", 0, false, true, false, false},
+	}
+	for _, tt := range tests {
+		key, err := parseSSHKey(dir, "  "+tt.line+"\n")
+		switch {
+		case tt.invalid:
+			if err == nil || errors.Is(err, errWeakKey) {
+				t.Errorf("%s: parseSSHKey() = %v, want a parse error", tt.name, err)
+			}
+			continue
+		case tt.weak:
+			if !errors.Is(err, errWeakKey) {
+				t.Errorf("%s: parseSSHKey() = %v, want errWeakKey", tt.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: parseSSHKey(): %v", tt.name, err)
+			continue
+		}
+		if key.Type != tt.keyType || key.Bits != tt.bits {
+			t.Errorf("%s: key = %s %d bits, want %s %d bits", tt.name, key.Type, key.Bits, tt.keyType, tt.bits)
+		}
+		if key.Key != tt.line || !strings.HasPrefix(key.Fingerprint, "SHA256:") {
+			t.Errorf("%s: key = %q, fingerprint %s", tt.name, key.Key, key.Fingerprint)
+		}
+		if (key.ExpiresAt != nil) != tt.expiring || key.Expired != tt.expired {
+			t.Errorf("%s: expiry = %v, expired %v, want expiring %v, expired %v", tt.name, key.ExpiresAt, key.Expired, tt.expiring, tt.expired)
+		}
+	}
+
+	key, _ := parseSSHKey(dir, authorizedKey(t, edPublic, "expires=2999-01-31"))
+	if want := time.Date(2999, 1, 31, 0, 0, 0, 0, time.UTC); key.ExpiresAt == nil || !key.ExpiresAt.Equal(want) {
+		t.Errorf("expiry = %v, want %s", key.ExpiresAt, want)
+	}
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// store keeps the state ldoups needs across restarts, such as the webhook
+// delivery queue. It is opened on first use.
+var store struct {
+	sync.Mutex
+	db   *bolt.DB
+	path string
+}
+
+var errNotFound = errors.New("not found")
+
+func openStore() (*bolt.DB, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	path := conf().Store.Path
+	if store.db != nil {
+		if store.path != path {
+			return nil, fmt.Errorf("store already opened at %s, restart to use %s", store.path, path)
+		}
+		return store.db, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("can't open store %s: %w", path, err)
+	}
+	store.db = db
+	store.path = path
+	return db, nil
+}
+
+// newID returns a random identifier whose lexical order follows creation
+// time, so that bucket keys iterate chronologically.
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+func putJSON(tx *bolt.Tx, bucket string, key string, value interface{}) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func getJSON(tx *bolt.Tx, bucket string, key string, value interface{}) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return errNotFound
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return errNotFound
+	}
+	return json.Unmarshal(data, value)
+}
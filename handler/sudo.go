@@ -0,0 +1,458 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// sudoRule is a sudoRole entry (sudoers.ldap schema), named after its cn.
+type sudoRule struct {
+	Name        string   `json:"name"`
+	DN          string   `json:"dn,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Users       []string `json:"users"`
+	Hosts       []string `json:"hosts"`
+	Commands    []string `json:"commands"`
+	RunAsUsers  []string `json:"runAsUsers,omitempty"`
+	RunAsGroups []string `json:"runAsGroups,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	Order       *float64 `json:"order,omitempty"`
+	// MatchedBy tells which sudoUser value applies the rule to a user
+	MatchedBy string `json:"matchedBy,omitempty"`
+}
+
+var sudoAttributes = []string{"cn", "description", "sudoUser", "sudoHost", "sudoCommand", "sudoRunAs", "sudoRunAsUser", "sudoRunAsGroup", "sudoOption", "sudoOrder"}
+
+var (
+	sudoOptionPattern = regexp.MustCompile(`^!?[A-Za-z_]+([+-]?=.*)?$`)
+	errNoSuchRule     = errors.New("no such sudo rule")
+)
+
+func sudoRuleDN(l *ldapConn, name string) string {
+	return "cn=" + escapeDN(name) + "," + l.dir.Sudo.BaseDN
+}
+
+func sudoRuleOf(ent *ldap.Entry) sudoRule {
+	rule := sudoRule{
+		Name:        ent.GetAttributeValue("cn"),
+		DN:          ent.DN,
+		Description: ent.GetAttributeValue("description"),
+		Users:       ent.GetAttributeValues("sudoUser"),
+		Hosts:       ent.GetAttributeValues("sudoHost"),
+		Commands:    ent.GetAttributeValues("sudoCommand"),
+		// sudoRunAs is the deprecated sudoRunAsUser
+		RunAsUsers:  append(ent.GetAttributeValues("sudoRunAsUser"), ent.GetAttributeValues("sudoRunAs")...),
+		RunAsGroups: ent.GetAttributeValues("sudoRunAsGroup"),
+		Options:     ent.GetAttributeValues("sudoOption"),
+	}
+	if order, err := strconv.ParseFloat(ent.GetAttributeValue("sudoOrder"), 64); err == nil {
+		rule.Order = &order
+	}
+	return rule
+}
+
+// attributes returns the sudoRole attributes of the rule, empty ones
+// included so that they are removed on update.
+func (r sudoRule) attributes() map[string][]string {
+	attributes := map[string][]string{
+		"sudoUser":       r.Users,
+		"sudoHost":       r.Hosts,
+		"sudoCommand":    r.Commands,
+		"sudoRunAsUser":  r.RunAsUsers,
+		"sudoRunAsGroup": r.RunAsGroups,
+		"sudoOption":     r.Options,
+		"description":    nil,
+		"sudoOrder":      nil,
+	}
+	if r.Description != "" {
+		attributes["description"] = []string{r.Description}
+	}
+	if r.Order != nil {
+		attributes["sudoOrder"] = []string{strconv.FormatFloat(*r.Order, 'f', -1, 64)}
+	}
+	return attributes
+}
+
+func hasSpace(value string) bool {
+	return strings.IndexFunc(value, func(r rune) bool { return r == ' ' || r == '\t' }) >= 0
+}
+
+// validateSudoRule returns the invalid fields of the rule, as sudo would
+// parse them.
+func validateSudoRule(r sudoRule) map[string]string {
+	errs := make(map[string]string)
+	if r.Name == "" {
+		errs["name"] = "missing attribute"
+	} else if strings.EqualFold(r.Name, "defaults") {
+		errs["name"] = "defaults holds the global options, not a rule"
+	}
+	for field, values := range map[string][]string{"users": r.Users, "hosts": r.Hosts, "commands": r.Commands} {
+		if isEmpty(values) {
+			errs[field] = "attribute is required"
+		}
+	}
+	for field, values := range map[string][]string{"users": r.Users, "hosts": r.Hosts, "runAsUsers": r.RunAsUsers, "runAsGroups": r.RunAsGroups} {
+		for _, value := range values {
+			name := strings.TrimPrefix(value, "!")
+			switch {
+			case name == "" || hasSpace(name):
+				errs[field] = fmt.Sprintf("%q is not a valid name", value)
+			case strings.HasPrefix(name, "#") || strings.HasPrefix(name, "%#"):
+				if _, err := strconv.Atoi(strings.TrimLeft(name, "%#")); err != nil {
+					errs[field] = fmt.Sprintf("%q is not a valid id", value)
+				}
+			}
+		}
+	}
+	for _, value := range r.Commands {
+		command := strings.TrimSpace(strings.TrimPrefix(value, "!"))
+		// Commands may be preceded by their digest, e.g. `sha256:<digest> /bin/ls`
+		if fields := strings.Fields(command); len(fields) > 1 && strings.HasPrefix(fields[0], "sha") && strings.Contains(fields[0], ":") {
+			command = strings.TrimSpace(strings.TrimPrefix(command, fields[0]))
+		}
+		if command != "ALL" && command != "sudoedit" && !strings.HasPrefix(command, "sudoedit ") && !strings.HasPrefix(command, "/") {
+			errs["commands"] = fmt.Sprintf("%q must be ALL or a fully qualified path", value)
+		}
+	}
+	for _, value := range r.Options {
+		if !sudoOptionPattern.MatchString(value) {
+			errs["options"] = fmt.Sprintf("%q is not a valid option", value)
+		}
+	}
+	if r.Order != nil && *r.Order < 0 {
+		errs["order"] = "must be positive"
+	}
+	return errs
+}
+
+// sortSudoRules sorts rules as sudo applies them, by sudoOrder then name.
+// Rules without order come first, the last matching rule winning.
+func sortSudoRules(rules []sudoRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		oi, oj := 0.0, 0.0
+		if rules[i].Order != nil {
+			oi = *rules[i].Order
+		}
+		if rules[j].Order != nil {
+			oj = *rules[j].Order
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return rules[i].Name < rules[j].Name
+	})
+}
+
+func searchSudoRules(l *ldapConn, filter string) ([]sudoRule, error) {
+	searchReq := ldap.NewSearchRequest(l.dir.Sudo.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, "(&(objectClass=sudoRole)"+filter+")", sudoAttributes, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	rules := []sudoRule{}
+	for _, ent := range result.Entries {
+		// cn=defaults holds the global options, not a rule
+		if strings.EqualFold(ent.GetAttributeValue("cn"), "defaults") {
+			continue
+		}
+		rules = append(rules, sudoRuleOf(ent))
+	}
+	sortSudoRules(rules)
+	return rules, nil
+}
+
+func getSudoRule(l *ldapConn, name string) (sudoRule, error) {
+	searchReq := ldap.NewSearchRequest(sudoRuleDN(l, name), ldap.ScopeBaseObject, 0, 0, 0, false, "(objectClass=sudoRole)", sudoAttributes, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(result.Entries) == 0) {
+		return sudoRule{}, fmt.Errorf("%w: %s", errNoSuchRule, name)
+	}
+	if err != nil {
+		return sudoRule{}, err
+	}
+	return sudoRuleOf(result.Entries[0]), nil
+}
+
+func abortSudo(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoSuchRule):
+		abort(c, err, http.StatusNotFound)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists):
+		abort(c, err, http.StatusConflict)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		abort(c, err, http.StatusForbidden)
+	default:
+		abort(c, err, http.StatusInternalServerError)
+	}
+}
+
+// GetSudoRules lists the sudo rules in the order sudo applies them,
+// filtered by `user`, `host` or `command` values.
+func GetSudoRules(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	filter := ""
+	for param, attr := range map[string]string{"user": "sudoUser", "host": "sudoHost", "command": "sudoCommand"} {
+		if value := c.Query(param); value != "" {
+			filter += "(" + attr + "=" + ldap.EscapeFilter(value) + ")"
+		}
+	}
+	rules, err := searchSudoRules(ldp, filter)
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	entriesReturned.WithLabelValues("sudo_rules").Observe(float64(len(rules)))
+	c.JSON(http.StatusOK, rules)
+}
+
+func GetSudoRule(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	rule, err := getSudoRule(ldp, c.Param("name"))
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func AddSudoRule(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	var rule sudoRule
+	if err := c.BindJSON(&rule); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	if errs := validateSudoRule(rule); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	rule.DN = sudoRuleDN(ldp, rule.Name)
+	addReq := ldap.NewAddRequest(rule.DN, []ldap.Control{})
+	added := map[string][]string{"objectClass": {"top", "sudoRole"}, "cn": {rule.Name}}
+	for attr, values := range rule.attributes() {
+		if len(values) > 0 {
+			added[attr] = values
+		}
+	}
+	for attr, values := range added {
+		addReq.Attribute(attr, values)
+	}
+
+	err := ldp.Add(addReq)
+	ldp.recordAudit("sudo_rule.create", rule.DN, nil, added, err)
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateSudoRule replaces the rule, the name in the path being kept.
+func UpdateSudoRule(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	var rule sudoRule
+	if err := c.BindJSON(&rule); err != nil {
+		abort(c, err, http.StatusBadRequest)
+		return
+	}
+	current, err := getSudoRule(ldp, c.Param("name"))
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	rule.Name, rule.DN = current.Name, current.DN
+	if errs := validateSudoRule(rule); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+
+	after := rule.attributes()
+	// The deprecated sudoRunAs is replaced by sudoRunAsUser
+	after["sudoRunAs"] = nil
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	before, err := readAttributes(ldp, rule.DN, names)
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	modReq := ldap.NewModifyRequest(rule.DN, []ldap.Control{})
+	if diffModifications(modReq, before, after) > 0 {
+		err = ldp.Modify(modReq)
+		ldp.recordAudit("sudo_rule.update", rule.DN, before, after, err)
+		if err != nil {
+			abortSudo(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func DeleteSudoRule(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	rule, err := getSudoRule(ldp, c.Param("name"))
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	err = ldp.Del(ldap.NewDelRequest(rule.DN, []ldap.Control{}))
+	ldp.recordAudit("sudo_rule.delete", rule.DN, rule.attributes(), nil, err)
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// sudoUserNames returns the sudoUser values naming the user at dn: its uid
+// and uidNumber, and its groups by name and gidNumber, through member,
+// memberUid or primary gidNumber.
+func sudoUserNames(l *ldapConn, dn string) (map[string]bool, error) {
+	user, err := readAttributes(l, dn, []string{"uid", "uidNumber", "gidNumber"})
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{"ALL": true}
+	uids := attributeValues(user, "uid")
+	for _, uid := range uids {
+		names[uid] = true
+	}
+	for _, n := range attributeValues(user, "uidNumber") {
+		names["#"+n] = true
+	}
+
+	filter := "(member=" + ldap.EscapeFilter(dn) + ")"
+	for _, uid := range uids {
+		filter += "(memberUid=" + ldap.EscapeFilter(uid) + ")"
+	}
+	for _, n := range attributeValues(user, "gidNumber") {
+		filter += "(&(objectClass=posixGroup)(gidNumber=" + ldap.EscapeFilter(n) + "))"
+		names["%#"+n] = true
+	}
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, "(|"+filter+")", []string{"cn", "gidNumber"}, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range result.Entries {
+		for _, cn := range ent.GetAttributeValues("cn") {
+			names["%"+cn] = true
+		}
+		for _, n := range ent.GetAttributeValues("gidNumber") {
+			names["%#"+n] = true
+		}
+	}
+	return names, nil
+}
+
+// matchSudoUser returns the sudoUser value applying the rule to one of
+// names, the last matching value winning as in sudoers lists. A negated
+// value excludes the user.
+func matchSudoUser(users []string, names map[string]bool) string {
+	matched := ""
+	for _, value := range users {
+		negated := strings.HasPrefix(value, "!")
+		if !names[strings.TrimPrefix(value, "!")] {
+			continue
+		}
+		matched = value
+		if negated {
+			matched = ""
+		}
+	}
+	return matched
+}
+
+// GetUserSudoRules returns the sudo rules applying to a user, directly or
+// through its groups, each with the sudoUser value it matched.
+func GetUserSudoRules(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+
+	names, err := sudoUserNames(ldp, c.Param("id"))
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	rules, err := searchSudoRules(ldp, "")
+	if err != nil {
+		abortSudo(c, err)
+		return
+	}
+	applying := []sudoRule{}
+	for _, rule := range rules {
+		if rule.MatchedBy = matchSudoUser(rule.Users, names); rule.MatchedBy != "" {
+			applying = append(applying, rule)
+		}
+	}
+	c.JSON(http.StatusOK, applying)
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestValidateSudoRule(t *testing.T) {
+	valid := func() sudoRule {
+		return sudoRule{
+			Name:     "admins",
+			Users:    []string{"%admins"},
+			Hosts:    []string{"ALL"},
+			Commands: []string{"ALL"},
+		}
+	}
+	order := func(f float64) *float64 { return &f }
+
+	tests := []struct {
+		name   string
+		change func(r *sudoRule)
+		errs   []string
+	}{
+		{"valid", func(r *sudoRule) {}, nil},
+		{"full", func(r *sudoRule) {
+			r.Users = []string{"jdoe", "!jane", "#1000", "%#2000", "+netgroup"}
+			r.Hosts = []string{"web01", "!db01"}
+			r.Commands = []string{"/usr/bin/systemctl restart nginx", "!/bin/su", "sudoedit /etc/hosts", "sha256:abcd /bin/ls"}
+			r.RunAsUsers = []string{"root"}
+			r.RunAsGroups = []string{"wheel"}
+			r.Options = []string{"!authenticate", "env_keep+=SSH_AUTH_SOCK", "timestamp_timeout=5"}
+			r.Order = order(10)
+		}, nil},
+		{"missing name", func(r *sudoRule) { r.Name = "" }, []string{"name"}},
+		{"defaults", func(r *sudoRule) { r.Name = "Defaults" }, []string{"name"}},
+		{"missing fields", func(r *sudoRule) { r.Users, r.Hosts, r.Commands = nil, []string{""}, nil }, []string{"commands", "hosts", "users"}},
+		{"user with space", func(r *sudoRule) { r.Users = []string{"john doe"} }, []string{"users"}},
+		{"negated nothing", func(r *sudoRule) { r.Hosts = []string{"!"} }, []string{"hosts"}},
+		{"invalid uid", func(r *sudoRule) { r.RunAsUsers = []string{"#root"} }, []string{"runAsUsers"}},
+		{"invalid gid", func(r *sudoRule) { r.RunAsGroups = []string{"%#wheel"} }, []string{"runAsGroups"}},
+		{"relative command", func(r *sudoRule) { r.Commands = []string{"systemctl"} }, []string{"commands"}},
+		{"relative command after digest", func(r *sudoRule) { r.Commands = []string{"sha256:abcd ls"} }, []string{"commands"}},
+		{"invalid option", func(r *sudoRule) { r.Options = []string{"env keep"} }, []string{"options"}},
+		{"negative order", func(r *sudoRule) { r.Order = order(-1) }, []string{"order"}},
+	}
+	for _, tt := range tests {
+		r := valid()
+		tt.change(&r)
+		var fields []string
+		for field := range validateSudoRule(r) {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, tt.errs) {
+			t.Errorf("%s: invalid fields %v, want %v", tt.name, fields, tt.errs)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 
@@ -18,7 +17,7 @@ func GetUsers(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -36,12 +35,12 @@ func GetUsers(c *gin.Context) {
 
 	filter := ""
 	if query.Q != "" {
-		filter = "(&(objectClass=" + conf.Ldap.UsersObjectClassSearch + ")(cn=*" + query.Q + "*))"
+		filter = "(&(objectClass=" + ldp.dir.UsersObjectClassSearch + ")(cn=*" + query.Q + "*))"
 	} else {
-		filter = "(&(objectClass=" + conf.Ldap.UsersObjectClassSearch + "))"
+		filter = "(&(objectClass=" + ldp.dir.UsersObjectClassSearch + "))"
 	}
 
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
+	searchReq := ldap.NewSearchRequest(ldp.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, statusSearchAttributes(ldp.dir, attr), []ldap.Control{})
 
 	result, err := ldp.Search(searchReq)
 	if err != nil {
@@ -50,22 +49,38 @@ func GetUsers(c *gin.Context) {
 	}
 	c.Header("Access-Control-Expose-Headers", "*")
 
+	// Statuses are partly kept by LDOups, so they are filtered here
+	entries := prepareEntries(result.Entries)
+	if err := setStatuses(ldp, entries, attr); err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	if query.Status != "" {
+		var matching []entry
+		for _, entry := range entries {
+			if entry.Status == query.Status {
+				matching = append(matching, entry)
+			}
+		}
+		entries = matching
+	}
+	entriesReturned.WithLabelValues("users").Observe(float64(len(entries)))
+
 	start := 0
 	end := 0
 	if len(rnge) > 0 {
 		fmt.Sscanf(rnge[0], "[%d,%d]", &start, &end)
-		if end > len(result.Entries) {
-			end = len(result.Entries)
+		if end > len(entries) {
+			end = len(entries)
 		}
 	} else {
 		start = 0
-		end = len(result.Entries)
+		end = len(entries)
 	}
 
-	c.Header("Content-Range", fmt.Sprintf("posts %d-%d/%d", start, end, len(result.Entries)))
+	c.Header("Content-Range", fmt.Sprintf("posts %d-%d/%d", start, end, len(entries)))
 
-	if len(result.Entries) > 0 {
-		entries := prepareEntries(result.Entries)
+	if len(entries) > 0 {
 		if len(srt) > 0 {
 			re, _ := regexp.Compile(`\w+`)
 			params := re.FindAllString(srt[0], -1)
@@ -102,7 +117,7 @@ func UpdateUser(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -115,10 +130,33 @@ func UpdateUser(c *gin.Context) {
 	}
 	c.Set("user", user)
 
+	if !validate(c, user, ldp.dir.UserAttributes, ldp.dir.UserRules, false) {
+		return
+	}
+	errs := make(map[string]string)
+	if checkShell(ldp.dir, user, errs); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if !checkIfMatch(c, ldp, c.Param("id"), true) {
+		return
+	}
+
+	before, err := readAttributes(ldp, user.DN, attributeNames(ldp.dir.UserAttributes))
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	after := make(map[string][]string)
+	for attr, values := range before {
+		after[attr] = values
+	}
+
 	modReq := ldap.NewModifyRequest(user.DN, []ldap.Control{})
-	for attr, _ := range conf.Ldap.UserAttributes {
+	for attr, _ := range ldp.dir.UserAttributes {
 		if val, ok := user.Attributes[attr]; ok {
 			modReq.Replace(attr, val)
+			after[attr] = val
 			if attr == "memberOf" {
 				setGroup(c, user.DN, val)
 			}
@@ -130,7 +168,9 @@ func UpdateUser(c *gin.Context) {
 		setGroup(c, user.DN, val)
 	}
 
-	if err := ldp.Modify(modReq); err != nil {
+	err = ldp.Modify(modReq)
+	ldp.recordAudit("user.update", user.DN, before, after, err)
+	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
@@ -142,7 +182,7 @@ func AddUser(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -155,13 +195,38 @@ func AddUser(c *gin.Context) {
 	}
 	c.Set("user", user)
 
+	if !validate(c, user, ldp.dir.UserAttributes, ldp.dir.UserRules, true) {
+		return
+	}
+
+	attributes := attributeNames(ldp.dir.UserAttributes)
+	uidNumber := 0
+	if isPosix(user, "posixAccount") {
+		var errs map[string]string
+		var err error
+		uidNumber, errs, err = preparePosixUser(ldp, &user)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if len(errs) > 0 {
+			abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+			return
+		}
+		defer releaseNumber(ldp, "uidNumber", uidNumber)
+		for _, attr := range posixUserAttributes {
+			if !contains(attributes, attr) {
+				attributes = append(attributes, attr)
+			}
+		}
+	}
+
 	addReq := ldap.NewAddRequest(user.DN, []ldap.Control{})
-	for attr, _ := range conf.Ldap.UserAttributes {
+	added := make(map[string][]string)
+	for _, attr := range attributes {
 		if val, ok := user.Attributes[attr]; ok {
 			addReq.Attribute(attr, val)
-		} else {
-			abort(c, errors.New("missing attribute: "+attr), http.StatusUnprocessableEntity)
-			return
+			added[attr] = val
 		}
 	}
 	// Handle memberOf
@@ -169,10 +234,18 @@ func AddUser(c *gin.Context) {
 		setGroup(c, user.DN, val)
 	}
 
-	if err := ldp.Add(addReq); err != nil {
+	err := ldp.Add(addReq)
+	ldp.recordAudit("user.create", user.DN, nil, added, err)
+	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 		return
 	}
+	if uidNumber != 0 {
+		if err := resolveCollision(ldp, user.DN, "uidNumber", uidNumber, ldp.dir.Posix.UIDNumbers); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+	}
 }
 
 func setGroup(c *gin.Context, userDN string, groupDNs []string) {
@@ -181,7 +254,7 @@ func setGroup(c *gin.Context, userDN string, groupDNs []string) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -189,7 +262,7 @@ func setGroup(c *gin.Context, userDN string, groupDNs []string) {
 
 	// First get old groups
 	filter := "(&(objectClass=*)(member=" + userDN + "))"
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{}, []ldap.Control{})
+	searchReq := ldap.NewSearchRequest(ldp.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{}, []ldap.Control{})
 
 	result, err := ldp.Search(searchReq)
 	if err != nil {
@@ -222,14 +295,24 @@ func setGroup(c *gin.Context, userDN string, groupDNs []string) {
 			return
 		}
 
-		values := result.Entries[0].Attributes[0].Values
+		oldValues := result.Entries[0].Attributes[0].Values
 
-		values = append(values, userDN)
+		values := append(append([]string{}, oldValues...), userDN)
 
 		modReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
 		modReq.Replace("member", values)
+		if err := syncMemberUid(ldp, modReq, groupDN, []string{userDN}, nil); err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
 
-		if err := ldp.Modify(modReq); err != nil {
+		err = ldp.Modify(modReq)
+		ldp.recordAudit("group.add_member", groupDN, map[string][]string{"member": oldValues}, map[string][]string{"member": values}, err)
+		if err != nil {
+			abort(c, err, http.StatusInternalServerError)
+			return
+		}
+		if err := forgetMembership(ldp.dir, groupDN, userDN); err != nil {
 			abort(c, err, http.StatusInternalServerError)
 			return
 		}
@@ -244,8 +327,7 @@ func setGroup(c *gin.Context, userDN string, groupDNs []string) {
 			}
 		}
 		if !match {
-			log.Print("remove user from group:")
-			log.Print(groupDN)
+			requestLogger(c).Debug().Str("user", userDN).Str("group", groupDN).Msg("remove user from group")
 			filter := "(objectClass=*)"
 			searchReq := ldap.NewSearchRequest(groupDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"member"}, []ldap.Control{})
 
@@ -255,13 +337,23 @@ func setGroup(c *gin.Context, userDN string, groupDNs []string) {
 				return
 			}
 
-			values := result.Entries[0].Attributes[0].Values
-			values = removeElement(values, userDN)
+			oldValues := result.Entries[0].Attributes[0].Values
+			values := removeElement(oldValues, userDN)
 
 			modReq := ldap.NewModifyRequest(groupDN, []ldap.Control{})
 			modReq.Replace("member", values)
+			if err := syncMemberUid(ldp, modReq, groupDN, nil, []string{userDN}); err != nil {
+				abort(c, err, http.StatusInternalServerError)
+				return
+			}
 
-			if err := ldp.Modify(modReq); err != nil {
+			err = ldp.Modify(modReq)
+			ldp.recordAudit("group.remove_member", groupDN, map[string][]string{"member": oldValues}, map[string][]string{"member": values}, err)
+			if err != nil {
+				abort(c, err, http.StatusInternalServerError)
+				return
+			}
+			if err := forgetMembership(ldp.dir, groupDN, userDN); err != nil {
 				abort(c, err, http.StatusInternalServerError)
 				return
 			}
@@ -285,7 +377,7 @@ func SetPassword(c *gin.Context) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -307,12 +399,15 @@ func SetPassword(c *gin.Context) {
 	}
 
 	if _, ok := user.Options["password"]; !ok {
-		fmt.Println(user.Options)
+		requestLogger(c).Debug().Interface("options", redactOptions(user.Options)).Msg("no password to set")
 		return
 	}
 
 	passwdModReq := ldap.NewPasswordModifyRequest(userDN, "", user.Options["password"])
-	if _, err := ldp.PasswordModify(passwdModReq); err != nil {
+	_, err := ldp.PasswordModify(passwdModReq)
+	// Password values are redacted by the audit, only the change is recorded
+	ldp.recordAudit("user.password", userDN, map[string][]string{"userPassword": {"old"}}, map[string][]string{"userPassword": {"new"}}, err)
+	if err != nil {
 		abort(c, err, http.StatusInternalServerError)
 	}
 }
@@ -323,7 +418,7 @@ func getGroups(c *gin.Context, entry *entry) {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
 	}
-	ldp, ok := l.(*ldap.Conn)
+	ldp, ok := l.(*ldapConn)
 	if !ok {
 		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
 		return
@@ -331,8 +426,8 @@ func getGroups(c *gin.Context, entry *entry) {
 
 	attr := c.QueryArray("attr")
 
-	filter := "(&(objectClass=" + conf.Ldap.GroupsObjectClassSearch + ")(member=" + entry.DN + "))"
-	searchReq := ldap.NewSearchRequest(conf.Ldap.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
+	filter := "(&(objectClass=" + ldp.dir.GroupsObjectClassSearch + ")(member=" + entry.DN + "))"
+	searchReq := ldap.NewSearchRequest(ldp.dir.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attr, []ldap.Control{})
 
 	result, err := ldp.Search(searchReq)
 	if err != nil {
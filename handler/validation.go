@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type rule = config.Rule
+
+var errInvalidEntry = errors.New("invalid attributes")
+
+var telephoneRe = regexp.MustCompile(`^\+?[0-9][0-9 ().\-/]*$`)
+
+// Syntax checkers, indexed by the name used in the `syntax` rule field.
+var syntaxes = map[string]func(string) bool{
+	"mail": func(v string) bool {
+		addr, err := mail.ParseAddress(v)
+		return err == nil && addr.Address == v
+	},
+	"telephone": func(v string) bool {
+		return telephoneRe.MatchString(v)
+	},
+	"integer": func(v string) bool {
+		_, err := strconv.Atoi(v)
+		return err == nil
+	},
+	"dn": func(v string) bool {
+		_, err := ldap.ParseDN(v)
+		return err == nil && v != ""
+	},
+}
+
+// checkRules reports the rules of every directory using an unknown syntax
+// or an invalid pattern.
+func checkRules(c *config.Config) error {
+	var problems []string
+	directories := map[string]config.Directory{"ldap": c.Ldap}
+	for name, d := range c.Directories {
+		directories["directories."+name] = d
+	}
+	for path, d := range directories {
+		for prefix, rules := range map[string]map[string]rule{path + ".userRules": d.UserRules, path + ".groupRules": d.GroupRules} {
+			for name, r := range rules {
+				if _, ok := syntaxes[r.Syntax]; r.Syntax != "" && !ok {
+					problems = append(problems, fmt.Sprintf("%s.%s.syntax: unknown syntax %q", prefix, name, r.Syntax))
+				}
+				if r.Pattern == "" {
+					continue
+				}
+				if _, err := regexp.Compile(r.Pattern); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.%s.pattern: %s", prefix, name, err))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &config.ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// rulePatterns caches the compiled rule patterns of the configuration
+// generation in use.
+var rulePatterns struct {
+	sync.Mutex
+	generation uint64
+	compiled   map[string]*regexp.Regexp
+}
+
+// rulePattern returns the compiled pattern, nil for an empty one.
+func rulePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	current := generation()
+	rulePatterns.Lock()
+	defer rulePatterns.Unlock()
+	if rulePatterns.compiled == nil || rulePatterns.generation != current {
+		rulePatterns.compiled = make(map[string]*regexp.Regexp)
+		rulePatterns.generation = current
+	}
+	if re, ok := rulePatterns.compiled[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rulePatterns.compiled[pattern] = re
+	return re, nil
+}
+
+// checkRule returns a message describing why values break the rule, or an
+// empty string when they are valid. The rule was checked by checkRules.
+func checkRule(r rule, values []string) string {
+	if r.SingleValued && len(values) > 1 {
+		return "attribute is single-valued"
+	}
+	re, err := rulePattern(r.Pattern)
+	if err != nil {
+		return fmt.Sprintf("invalid pattern %s: %s", r.Pattern, err)
+	}
+	for _, value := range values {
+		if valid, ok := syntaxes[r.Syntax]; ok && !valid(value) {
+			return fmt.Sprintf("%q is not a valid %s", value, r.Syntax)
+		}
+		if re != nil && !re.MatchString(value) {
+			return fmt.Sprintf("%q does not match %s", value, r.Pattern)
+		}
+		if len(r.Enum) > 0 && !contains(r.Enum, value) {
+			return fmt.Sprintf("%q is not an allowed value", value)
+		}
+		if r.MaxLength > 0 && utf8.RuneCountInString(value) > r.MaxLength {
+			return fmt.Sprintf("%q is longer than %d characters", value, r.MaxLength)
+		}
+	}
+	return ""
+}
+
+// validateEntry checks e against the configured attributes and their rules.
+// When complete, e holds the whole entry (creation, patch) and every required
+// attribute must be present; otherwise a required attribute can be omitted
+// but not emptied. It returns all field errors found, keyed by attribute name.
+func validateEntry(e entry, attributes map[string]string, rules map[string]rule, complete bool) map[string]string {
+	errs := make(map[string]string)
+	for attr, necessity := range attributes {
+		if necessity != "required" {
+			continue
+		}
+		values, ok := e.Attributes[attr]
+		if !ok && complete {
+			errs[attr] = "missing attribute"
+		} else if ok && isEmpty(values) {
+			errs[attr] = "attribute is required"
+		}
+	}
+	for attr, r := range rules {
+		values, ok := e.Attributes[attr]
+		if !ok {
+			continue
+		}
+		if _, found := errs[attr]; found {
+			continue
+		}
+		if msg := checkRule(r, values); msg != "" {
+			errs[attr] = msg
+		}
+	}
+	return errs
+}
+
+// validate aborts with 422 and returns false when e is not valid.
+func validate(c *gin.Context, e entry, attributes map[string]string, rules map[string]rule, complete bool) bool {
+	if errs := validateEntry(e, attributes, rules, complete); len(errs) > 0 {
+		abortWithErrors(c, errInvalidEntry, http.StatusUnprocessableEntity, errs)
+		return false
+	}
+	return true
+}
+
+func isEmpty(values []string) bool {
+	for _, value := range values {
+		if value != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(slice []string, elem string) bool {
+	for _, e := range slice {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
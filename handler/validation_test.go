@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckRules(t *testing.T) {
+	c := &config.Config{
+		Ldap: config.Directory{
+			UserRules: map[string]config.Rule{
+				"uid":  {Pattern: "^[a-z]+$"},
+				"mail": {Syntax: "mail"},
+			},
+		},
+		Directories: map[string]config.Directory{
+			"lab": {
+				GroupRules: map[string]config.Rule{
+					"cn": {Pattern: "^[a-z"},
+					"l":  {Syntax: "city"},
+				},
+			},
+		},
+	}
+	err := checkRules(c)
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("checkRules() = %v, want a validation error", err)
+	}
+	want := []string{
+		"directories.lab.groupRules.cn.pattern: error parsing regexp: missing closing ]: `[a-z`",
+		`directories.lab.groupRules.l.syntax: unknown syntax "city"`,
+	}
+	if !reflect.DeepEqual(validationErr.Problems, want) {
+		t.Errorf("checkRules() problems = %q, want %q", validationErr.Problems, want)
+	}
+}
+
+func TestCheckRule(t *testing.T) {
+	c := &config.Config{
+		Ldap: config.Directory{
+			UserRules: map[string]config.Rule{
+				"uid":  {Pattern: "^[a-z]+$", MaxLength: 8},
+				"mail": {Syntax: "mail", SingleValued: true},
+				"type": {Enum: []string{"staff", "contractor"}},
+			},
+		},
+	}
+	if err := checkRules(c); err != nil {
+		t.Fatalf("checkRules(): %v", err)
+	}
+	rules := c.Ldap.UserRules
+
+	tests := []struct {
+		attribute string
+		values    []string
+		want      string
+	}{
+		{"uid", []string{"jdoe"}, ""},
+		{"uid", []string{"JDoe"}, `"JDoe" does not match ^[a-z]+$`},
+		{"uid", []string{"johnathan"}, `"johnathan" is longer than 8 characters`},
+		{"mail", []string{"jdoe@example.org"}, ""},
+		{"mail", []string{"John <jdoe@example.org>"}, `"John <jdoe@example.org>" is not a valid mail`},
+		{"mail", []string{"a@example.org", "b@example.org"}, "attribute is single-valued"},
+		{"type", []string{"staff", "contractor"}, ""},
+		{"type", []string{"intern"}, `"intern" is not an allowed value`},
+	}
+	for _, tt := range tests {
+		if got := checkRule(rules[tt.attribute], tt.values); got != tt.want {
+			t.Errorf("checkRule(%s, %q) = %q, want %q", tt.attribute, tt.values, got, tt.want)
+		}
+	}
+}
+
+// TestUpdateUserInvalid checks that the password of a user whose update is
+// refused isn't set by the next handler.
+func TestUpdateUserInvalid(t *testing.T) {
+	d := newFakeDirectory(t, map[string]map[string][]string{
+		"dc=example,dc=org": {"objectClass": {"domain"}},
+		testUser:            {"objectClass": {"inetOrgPerson"}, "cn": {"jdoe"}, "mail": {"jdoe@example.org"}},
+	})
+	c := &config.Config{}
+	c.Ldap = config.Directory{
+		BaseDN:                  "dc=example,dc=org",
+		Url:                     d.url(),
+		GroupsObjectClassSearch: "groupOfNames",
+		UserAttributes:          map[string]string{"mail": ""},
+		UserRules:               map[string]config.Rule{"mail": {Syntax: "mail"}},
+	}
+	useTestConfig(t, c)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/api/users/:id", func(c *gin.Context) {
+		c.Set("LDAP", d.dial(t, defaultDirectory()))
+	}, UpdateUser, SetPassword)
+	w := httptest.NewRecorder()
+	body := `{"dn":"` + testUser + `","attributes":{"mail":["jdoe"]},"options":{"password":"s3cret"}}`
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/users/"+testUser, strings.NewReader(body)))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("UpdateUser() = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	decoder := json.NewDecoder(w.Body)
+	var msg errorMessage
+	if err := decoder.Decode(&msg); err != nil || msg.Errors["mail"] == "" {
+		t.Errorf("response = %+v, %v, want a mail error", msg, err)
+	}
+	if err := decoder.Decode(&msg); err != io.EOF {
+		t.Errorf("SetPassword() ran after UpdateUser() refused the entry: %+v", msg)
+	}
+}
@@ -0,0 +1,674 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	watchTimeout     = 10 * time.Second
+	watchDedupWindow = 10 * time.Second
+)
+
+var errUnsupported = errors.New("unsupported by the directory")
+
+// watchedEntry is the last known state of a user or group, Version being
+// its entryCSN, or its modifyTimestamp when the directory doesn't provide
+// one.
+type watchedEntry struct {
+	DN         string
+	Kind       string
+	Actor      string
+	Version    string
+	Attributes map[string][]string
+}
+
+// watcher follows the users and groups of a directory changed outside of
+// LDOups. Entries are keyed by entryUUID, or by DN when the directory doesn't
+// provide one. dir is only used by the watching goroutine.
+type watcher struct {
+	sync.Mutex
+	name    string
+	dir     directory
+	entries map[string]*watchedEntry
+	loaded  bool
+	mode    string
+}
+
+// watchers holds the watcher of each configured directory.
+var watchers struct {
+	sync.Mutex
+	running map[string]*watcher
+}
+
+// recent holds the versions of the entries written through LDOups, and the
+// entries it deleted, which the watcher doesn't publish twice. Changes done
+// meanwhile outside of LDOups have another version and are published.
+var recent struct {
+	sync.Mutex
+	versions map[string]time.Time
+}
+
+func recentKey(dir directory, dn string, version string) string {
+	return dir.name + ":" + strings.ToLower(dn) + ":" + version
+}
+
+// entryVersion returns the entryCSN of an entry, or its modifyTimestamp.
+func entryVersion(attributes map[string][]string) string {
+	for _, name := range []string{"entryCSN", "modifyTimestamp"} {
+		if values := attributeValues(attributes, name); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// markChanged records the version of the entry at dn written by l, read back
+// from the directory. An empty version stands for a deleted entry.
+func (l *ldapConn) markChanged(dn string) {
+	if conf().Watch.Mode == "none" || l.Conn == nil {
+		return
+	}
+	version := ""
+	attributes, err := readAttributes(l, dn, []string{"entryCSN", "modifyTimestamp"})
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+	case err != nil:
+		l.logger.Debug().Err(err).Str("target", dn).Msg("can't read the version of the changed entry")
+		return
+	default:
+		if version = entryVersion(attributes); version == "" {
+			return
+		}
+	}
+
+	recent.Lock()
+	defer recent.Unlock()
+	if recent.versions == nil {
+		recent.versions = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for key, t := range recent.versions {
+		if now.Sub(t) > dedupWindow() {
+			delete(recent.versions, key)
+		}
+	}
+	recent.versions[recentKey(l.dir, dn, version)] = now
+}
+
+func changedThroughAPI(dir directory, dn string, version string) bool {
+	recent.Lock()
+	defer recent.Unlock()
+	t, ok := recent.versions[recentKey(dir, dn, version)]
+	return ok && time.Since(t) < dedupWindow()
+}
+
+// dedupWindow is how long a change done through LDOups may take to come
+// back from the directory.
+func dedupWindow() time.Duration {
+	if conf().Watch.Mode == "poll" && 2*conf().Watch.Interval > watchDedupWindow {
+		return 2 * conf().Watch.Interval
+	}
+	return watchDedupWindow
+}
+
+// setupWatcher starts following each directory not followed yet when
+// `watch.mode` is set.
+func setupWatcher() error {
+	if conf().Watch.Mode == "none" {
+		return nil
+	}
+	watchers.Lock()
+	defer watchers.Unlock()
+	if watchers.running == nil {
+		watchers.running = make(map[string]*watcher)
+	}
+	for _, dir := range allDirectories() {
+		if _, ok := watchers.running[dir.name]; !ok {
+			w := &watcher{name: dir.name}
+			watchers.running[dir.name] = w
+			go w.run()
+		}
+	}
+	return nil
+}
+
+// run follows the directory with syncrepl, persistent search or polling,
+// reconnecting when the connection is lost. In auto mode, the first one
+// supported by the directory is used. It stops once the directory is removed
+// from the configuration.
+func (w *watcher) run() {
+	backoff := time.Second
+	for {
+		reload := reloaded()
+		dir, ok := lookupDirectory(w.name)
+		if !ok {
+			watchers.Lock()
+			if watchers.running[w.name] == w {
+				delete(watchers.running, w.name)
+			}
+			watchers.Unlock()
+			log.Info().Str("directory", w.name).Msg("directory watch stopped")
+			return
+		}
+		w.dir = dir
+		mode := conf().Watch.Mode
+		if mode == "none" {
+			<-reload
+			continue
+		}
+		w.Lock()
+		if mode == "auto" && w.mode != "" {
+			mode = w.mode
+		}
+		w.Unlock()
+
+		start := time.Now()
+		var err error
+		switch mode {
+		case "auto":
+			for _, mode = range []string{"syncrepl", "psearch", "poll"} {
+				if err = w.watchWith(mode); !errors.Is(err, errUnsupported) {
+					break
+				}
+				log.Info().Str("directory", w.name).Str("mode", mode).Msg("watch mode unsupported by the directory")
+			}
+		default:
+			err = w.watchWith(mode)
+		}
+
+		select {
+		case <-reload:
+			log.Info().Str("directory", w.name).Str("mode", mode).Msg("directory watch restarted with the new configuration")
+			backoff = time.Second
+			continue
+		default:
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn().Err(err).Str("directory", w.name).Str("mode", mode).Dur("retry_in", backoff).Msg("directory watch interrupted")
+		select {
+		case <-time.After(backoff):
+		case <-reload:
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (w *watcher) watchWith(mode string) error {
+	var err error
+	for _, url := range strings.Fields(w.dir.Url) {
+		switch mode {
+		case "syncrepl":
+			err = w.watchSyncrepl(url)
+		case "psearch":
+			err = w.watchPersistentSearch(url)
+		case "poll":
+			err = w.watchPoll(url)
+		}
+		if errors.Is(err, errUnsupported) {
+			return err
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("directory", w.name).Str("url", url).Str("mode", mode).Msg("can't watch directory")
+		}
+	}
+	return err
+}
+
+// closeOnReload calls stop when the configuration is reloaded, so that a
+// watch blocked on the directory starts over. The returned function stops
+// waiting for the reload.
+func closeOnReload(stop func()) func() {
+	done := make(chan struct{})
+	reload := reloaded()
+	go func() {
+		select {
+		case <-reload:
+			stop()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// resetWatched forgets the known entries of the directories whose watched
+// scope changed since the previous configuration.
+func resetWatched(previous *config.Config) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	for name, w := range watchers.running {
+		dir, ok := lookupDirectory(name)
+		before, found := previous.Directory(name)
+		if ok && found && conf().Watch.Mode == previous.Watch.Mode &&
+			dir.BaseDN == before.BaseDN &&
+			dir.UsersObjectClassSearch == before.UsersObjectClassSearch &&
+			dir.GroupsObjectClassSearch == before.GroupsObjectClassSearch {
+			continue
+		}
+		w.Lock()
+		w.entries = nil
+		w.loaded = false
+		w.mode = ""
+		w.Unlock()
+	}
+}
+
+func watchFilter(dir directory) string {
+	return "(|(objectClass=" + dir.UsersObjectClassSearch + ")(objectClass=" + dir.GroupsObjectClassSearch + "))"
+}
+
+var watchAttributes = []string{"*", "entryUUID", "entryCSN", "modifiersName", "modifyTimestamp"}
+
+func openStream(dir directory, url string) (*streamConn, error) {
+	s, err := dialStream(url, watchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.bind(dir.RO.Username, dir.RO.Password); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// searchDone returns the error ending a streamed search. A rejected critical
+// control means the directory doesn't support the mode.
+func searchDone(err error) error {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultUnavailableCriticalExtension {
+		return fmt.Errorf("%w: %s", errUnsupported, ldapErr)
+	}
+	if err == nil {
+		return errors.New("search ended by the directory")
+	}
+	return err
+}
+
+func (w *watcher) watchSyncrepl(url string) error {
+	s, err := openStream(w.dir, url)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	defer closeOnReload(func() { s.Close() })()
+
+	if err := s.search(w.dir.BaseDN, watchFilter(w.dir), watchAttributes, []ldap.Control{syncRequestControl()}); err != nil {
+		return err
+	}
+
+	snapshot := make(map[string]*watchedEntry)
+	refreshing := true
+	for {
+		packet, err := s.read()
+		if err != nil {
+			return err
+		}
+		switch packet.Children[1].Tag {
+		case ldap.ApplicationSearchResultEntry:
+			ent, controls, err := decodeEntry(packet)
+			if err != nil {
+				return err
+			}
+			state, uuid, err := syncState(controls[controlTypeSyncState])
+			if err != nil {
+				return err
+			}
+			switch {
+			case state == syncStateDelete:
+				w.removeWatched(uuid)
+			case refreshing:
+				if watched := newWatchedEntry(w.dir, ent); watched != nil {
+					snapshot[uuid] = watched
+				}
+			case state == syncStateAdd || state == syncStateModify:
+				w.applyWatched(uuid, ent)
+			}
+		case applicationIntermediateResponse:
+			info, err := decodeSyncInfo(packet)
+			if err != nil {
+				return err
+			}
+			if info.refreshDeletes {
+				for _, uuid := range info.uuids {
+					w.removeWatched(uuid)
+				}
+			}
+			if refreshing && info.refreshDone {
+				refreshing = false
+				w.reconcileWatched(snapshot, "syncrepl")
+			}
+		case ldap.ApplicationSearchResultDone:
+			return searchDone(ldap.GetLDAPError(packet))
+		}
+	}
+}
+
+func (w *watcher) watchPersistentSearch(url string) error {
+	s, err := openStream(w.dir, url)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	defer closeOnReload(func() { s.Close() })()
+
+	// Changes are only returned from now on, so the current entries are read
+	// once the persistent search is registered. Changes in between are
+	// applied twice, which has no effect.
+	if err := s.search(w.dir.BaseDN, watchFilter(w.dir), watchAttributes, []ldap.Control{persistentSearchControl()}); err != nil {
+		return err
+	}
+	// A rejected control is answered right away
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := s.read()
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		packet = nil
+	case err != nil:
+		return err
+	case packet.Children[1].Tag == ldap.ApplicationSearchResultDone:
+		return searchDone(ldap.GetLDAPError(packet))
+	}
+	s.SetReadDeadline(time.Time{})
+
+	l, err := dialWatch(w.dir, url)
+	if err != nil {
+		return err
+	}
+	snapshot, err := searchWatched(l, watchFilter(w.dir))
+	l.Close()
+	if err != nil {
+		return err
+	}
+	w.reconcileWatched(snapshot, "psearch")
+
+	for {
+		if packet == nil {
+			if packet, err = s.read(); err != nil {
+				return err
+			}
+		}
+		switch packet.Children[1].Tag {
+		case ldap.ApplicationSearchResultEntry:
+			ent, controls, err := decodeEntry(packet)
+			if err != nil {
+				return err
+			}
+			changeType, previousDN := entryChange(controls[controlTypeEntryChangeNotification])
+			key := watchKey(ent)
+			switch changeType {
+			case persistentSearchDelete:
+				w.removeWatched(key)
+			case persistentSearchModDN:
+				if ent.GetAttributeValue("entryUUID") == "" && previousDN != "" {
+					w.renameWatched(strings.ToLower(previousDN), key)
+				}
+				w.applyWatched(key, ent)
+			default:
+				w.applyWatched(key, ent)
+			}
+		case ldap.ApplicationSearchResultDone:
+			return searchDone(ldap.GetLDAPError(packet))
+		}
+		packet = nil
+	}
+}
+
+// watchPoll reads the entries modified since the last poll, according to
+// their modifyTimestamp, and lists every entry to find the deleted ones.
+func (w *watcher) watchPoll(url string) error {
+	l, err := dialWatch(w.dir, url)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	reload := reloaded()
+
+	since := time.Now()
+	snapshot, err := searchWatched(l, watchFilter(w.dir))
+	if err != nil {
+		return err
+	}
+	w.reconcileWatched(snapshot, "poll")
+
+	for {
+		select {
+		case <-time.After(conf().Watch.Interval):
+		case <-reload:
+			return errors.New("configuration reloaded")
+		}
+
+		// modifyTimestamp has a one second precision
+		next := time.Now()
+		filter := "(&" + watchFilter(w.dir) + "(modifyTimestamp>=" + since.Add(-time.Second).UTC().Format("20060102150405Z") + "))"
+		changed, err := searchWatched(l, filter)
+		if err != nil {
+			return err
+		}
+		for key, watched := range changed {
+			w.applyWatchedEntry(key, watched)
+		}
+
+		searchReq := ldap.NewSearchRequest(w.dir.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, watchFilter(w.dir), []string{"entryUUID"}, []ldap.Control{})
+		result, err := l.Search(searchReq)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool)
+		for _, ent := range result.Entries {
+			present[watchKey(ent)] = true
+		}
+		w.Lock()
+		var deleted []string
+		for key := range w.entries {
+			if !present[key] {
+				deleted = append(deleted, key)
+			}
+		}
+		w.Unlock()
+		for _, key := range deleted {
+			w.removeWatched(key)
+		}
+		since = next
+	}
+}
+
+func dialWatch(dir directory, url string) (*ldapConn, error) {
+	conn, err := ldap.DialURL(url)
+	if err != nil {
+		ldapDials.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+	ldapDials.WithLabelValues("success").Inc()
+	l := newLdapConn(conn, &log.Logger, dir)
+	l.SetTimeout(watchTimeout)
+	if err := l.Bind(dir.RO.Username, dir.RO.Password); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func searchWatched(l *ldapConn, filter string) (map[string]*watchedEntry, error) {
+	searchReq := ldap.NewSearchRequest(l.dir.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, watchAttributes, []ldap.Control{})
+	result, err := l.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*watchedEntry)
+	for _, ent := range result.Entries {
+		if watched := newWatchedEntry(l.dir, ent); watched != nil {
+			entries[watchKey(ent)] = watched
+		}
+	}
+	return entries, nil
+}
+
+// operationalWatchAttributes are read to follow the entries, but aren't part
+// of their changes.
+var operationalWatchAttributes = []string{"entryUUID", "entryCSN", "modifiersName", "modifyTimestamp"}
+
+func watchKey(ent *ldap.Entry) string {
+	if uuid := ent.GetAttributeValue("entryUUID"); uuid != "" {
+		return strings.ToLower(uuid)
+	}
+	return strings.ToLower(ent.DN)
+}
+
+// newWatchedEntry returns the state of a user or group entry, or nil for
+// other entries.
+func newWatchedEntry(dir directory, ent *ldap.Entry) *watchedEntry {
+	watched := &watchedEntry{
+		DN:         ent.DN,
+		Actor:      ent.GetAttributeValue("modifiersName"),
+		Version:    ent.GetAttributeValue("entryCSN"),
+		Attributes: make(map[string][]string),
+	}
+	for _, objectClass := range ent.GetAttributeValues("objectClass") {
+		switch {
+		case strings.EqualFold(objectClass, dir.UsersObjectClassSearch):
+			watched.Kind = "user"
+		case strings.EqualFold(objectClass, dir.GroupsObjectClassSearch):
+			watched.Kind = "group"
+		}
+	}
+	if watched.Kind == "" {
+		return nil
+	}
+	if watched.Version == "" {
+		watched.Version = ent.GetAttributeValue("modifyTimestamp")
+	}
+	for _, attribute := range ent.Attributes {
+		if containsFold(operationalWatchAttributes, attribute.Name) {
+			continue
+		}
+		watched.Attributes[attribute.Name] = attribute.Values
+	}
+	return watched
+}
+
+func (w *watcher) applyWatched(key string, ent *ldap.Entry) {
+	if watched := newWatchedEntry(w.dir, ent); watched != nil {
+		w.applyWatchedEntry(key, watched)
+	}
+}
+
+// applyWatchedEntry records the new state of an entry, and publishes how it
+// changed.
+func (w *watcher) applyWatchedEntry(key string, watched *watchedEntry) {
+	w.Lock()
+	// Changes are only published once the entries were read completely
+	if !w.loaded {
+		w.Unlock()
+		return
+	}
+	previous := w.entries[key]
+	w.entries[key] = watched
+	w.Unlock()
+
+	if previous == nil {
+		w.recordDirectoryChange(watched.Kind+".create", watched.DN, watched.Actor, watched.Version, nil, watched.Attributes)
+		return
+	}
+	if !strings.EqualFold(previous.DN, watched.DN) {
+		w.recordDirectoryChange(watched.Kind+".rename", watched.DN, watched.Actor, watched.Version, map[string][]string{"dn": {previous.DN}}, map[string][]string{"dn": {watched.DN}})
+	}
+
+	changes := diffAttributes(previous.Attributes, watched.Attributes)
+	if len(changes) == 0 {
+		return
+	}
+	if watched.Kind == "group" && len(changes) == 1 && strings.EqualFold(changes[0].Attribute, "member") {
+		before, after := changes[0].Before, changes[0].After
+		member := map[string][]string{"member": before}
+		if len(difference(after, before)) > 0 {
+			w.recordDirectoryChange("group.add_member", watched.DN, watched.Actor, watched.Version, member, map[string][]string{"member": after})
+		}
+		if len(difference(before, after)) > 0 {
+			w.recordDirectoryChange("group.remove_member", watched.DN, watched.Actor, watched.Version, member, map[string][]string{"member": after})
+		}
+		return
+	}
+	w.recordDirectoryChange(watched.Kind+".update", watched.DN, watched.Actor, watched.Version, previous.Attributes, watched.Attributes)
+}
+
+func (w *watcher) removeWatched(key string) {
+	w.Lock()
+	previous := w.entries[key]
+	delete(w.entries, key)
+	w.Unlock()
+
+	if previous != nil {
+		w.recordDirectoryChange(previous.Kind+".delete", previous.DN, "", "", previous.Attributes, nil)
+	}
+}
+
+func (w *watcher) renameWatched(from string, to string) {
+	w.Lock()
+	defer w.Unlock()
+	if watched, ok := w.entries[from]; ok {
+		delete(w.entries, from)
+		w.entries[to] = watched
+	}
+}
+
+// reconcileWatched replaces the known entries with a complete read of the
+// directory. The first read is silent, later ones (after a reconnection)
+// publish what changed meanwhile.
+func (w *watcher) reconcileWatched(snapshot map[string]*watchedEntry, mode string) {
+	w.Lock()
+	loaded := w.loaded
+	if !loaded {
+		w.entries = snapshot
+		w.loaded = true
+	}
+	if conf().Watch.Mode == "auto" {
+		w.mode = mode
+	}
+	var deleted []string
+	if loaded {
+		for key := range w.entries {
+			if _, ok := snapshot[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+	}
+	w.Unlock()
+	log.Info().Str("directory", w.name).Str("mode", mode).Int("entries", len(snapshot)).Msg("following directory changes")
+
+	if !loaded {
+		return
+	}
+	for key, watched := range snapshot {
+		w.applyWatchedEntry(key, watched)
+	}
+	for _, key := range deleted {
+		w.removeWatched(key)
+	}
+}
+
+// recordDirectoryChange audits and publishes a change seen in the directory,
+// unless it was done through LDOups and so already published: the entry has
+// the version written by LDOups, or was deleted by it (empty version).
+func (w *watcher) recordDirectoryChange(action string, target string, actor string, version string, before map[string][]string, after map[string][]string) {
+	if changedThroughAPI(w.dir, target, version) {
+		return
+	}
+	directoryChanges.WithLabelValues(action).Inc()
+	l := &ldapConn{logger: &log.Logger, dir: w.dir, actor: actor}
+	l.recordChange("directory", action, target, before, after, nil)
+}
@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	applicationIntermediateResponse = 25
+
+	controlTypeSyncRequest             = "1.3.6.1.4.1.4203.1.9.1.1"
+	controlTypeSyncState               = "1.3.6.1.4.1.4203.1.9.1.2"
+	controlTypePersistentSearch        = "2.16.840.1.113730.3.4.3"
+	controlTypeEntryChangeNotification = "2.16.840.1.113730.3.4.7"
+
+	syncModeRefreshAndPersist = 3
+
+	syncStatePresent = 0
+	syncStateAdd     = 1
+	syncStateModify  = 2
+	syncStateDelete  = 3
+
+	persistentSearchAdd    = 1
+	persistentSearchDelete = 2
+	persistentSearchModify = 4
+	persistentSearchModDN  = 8
+)
+
+// streamConn is a bare LDAP connection, used for the searches which never
+// end and so can't go through ldap.Conn.Search: syncrepl (RFC 4533) and
+// persistent search (draft-ietf-ldapext-psearch). Messages are read one at
+// a time.
+type streamConn struct {
+	net.Conn
+	messageID int64
+}
+
+func dialStream(rawURL string, timeout time.Duration) (*streamConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	host := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	case "ldapi":
+		// As ldap.DialURL does
+		socket := u.Path
+		if socket == "" || socket == "/" {
+			socket = "/var/run/slapd/ldapi"
+		}
+		conn, err = dialer.Dial("unix", socket)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{Conn: conn}, nil
+}
+
+func (s *streamConn) send(op *ber.Packet, controls []ldap.Control) error {
+	s.messageID++
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, s.messageID, "MessageID"))
+	packet.AppendChild(op)
+	if len(controls) > 0 {
+		packet.AppendChild(encodeControls(controls))
+	}
+	_, err := s.Write(packet.Bytes())
+	return err
+}
+
+func encodeControls(controls []ldap.Control) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	for _, control := range controls {
+		packet.AppendChild(control.Encode())
+	}
+	return packet
+}
+
+func (s *streamConn) read() (*ber.Packet, error) {
+	packet, err := ber.ReadPacket(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(packet.Children) < 2 {
+		return nil, errors.New("invalid LDAP message")
+	}
+	return packet, nil
+}
+
+func (s *streamConn) bind(username string, password string) error {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, username, "User Name"))
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Password"))
+	if err := s.send(op, nil); err != nil {
+		return err
+	}
+	packet, err := s.read()
+	if err != nil {
+		return err
+	}
+	return ldap.GetLDAPError(packet)
+}
+
+func (s *streamConn) search(baseDN string, filter string, attributes []string, controls []ldap.Control) error {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, baseDN, "Base DN"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.ScopeWholeSubtree), "Scope"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.NeverDerefAliases), "Deref Aliases"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	op.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	compiled, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return err
+	}
+	op.AppendChild(compiled)
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attribute := range attributes {
+		attrs.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute"))
+	}
+	op.AppendChild(attrs)
+	return s.send(op, controls)
+}
+
+// rawControl is a control sent with a pre-encoded value.
+type rawControl struct {
+	controlType string
+	critical    bool
+	value       *ber.Packet
+}
+
+func (c rawControl) GetControlType() string {
+	return c.controlType
+}
+
+func (c rawControl) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.controlType, "Control Type"))
+	if c.critical {
+		packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	}
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value")
+	value.AppendChild(c.value)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c rawControl) String() string {
+	return fmt.Sprintf("Control Type: %q  Criticality: %t", c.controlType, c.critical)
+}
+
+func syncRequestControl() ldap.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sync Request")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(syncModeRefreshAndPersist), "Mode"))
+	return rawControl{controlType: controlTypeSyncRequest, critical: true, value: value}
+}
+
+func persistentSearchControl() ldap.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Persistent Search")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(persistentSearchAdd|persistentSearchDelete|persistentSearchModify|persistentSearchModDN), "Change Types"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Changes Only"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Return ECs"))
+	return rawControl{controlType: controlTypePersistentSearch, critical: true, value: value}
+}
+
+// decodeEntry returns the entry of a SearchResultEntry message, and the
+// values of its controls by type.
+func decodeEntry(packet *ber.Packet) (*ldap.Entry, map[string]*ber.Packet, error) {
+	op := packet.Children[1]
+	if len(op.Children) < 2 {
+		return nil, nil, errors.New("invalid search result entry")
+	}
+	dn, _ := op.Children[0].Value.(string)
+	entry := &ldap.Entry{DN: dn}
+	for _, child := range op.Children[1].Children {
+		if len(child.Children) < 2 {
+			continue
+		}
+		name, _ := child.Children[0].Value.(string)
+		attribute := &ldap.EntryAttribute{Name: name}
+		for _, value := range child.Children[1].Children {
+			attribute.Values = append(attribute.Values, string(value.ByteValue))
+			attribute.ByteValues = append(attribute.ByteValues, value.ByteValue)
+		}
+		entry.Attributes = append(entry.Attributes, attribute)
+	}
+
+	controls := make(map[string]*ber.Packet)
+	if len(packet.Children) > 2 {
+		for _, control := range packet.Children[2].Children {
+			if len(control.Children) < 2 {
+				continue
+			}
+			controlType, _ := control.Children[0].Value.(string)
+			value := control.Children[len(control.Children)-1]
+			if value.Tag != ber.TagOctetString {
+				continue
+			}
+			decoded, err := ber.DecodePacketErr(value.Data.Bytes())
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid control %s: %w", controlType, err)
+			}
+			controls[controlType] = decoded
+		}
+	}
+	return entry, controls, nil
+}
+
+// syncState decodes a Sync State control: the entry state and its
+// entryUUID.
+func syncState(value *ber.Packet) (int64, string, error) {
+	if value == nil || len(value.Children) < 2 {
+		return 0, "", errors.New("invalid sync state control")
+	}
+	state, _ := value.Children[0].Value.(int64)
+	return state, formatUUID(value.Children[1].Data.Bytes()), nil
+}
+
+// entryChange decodes an Entry Change Notification control: the change type
+// and the previous DN of renamed entries.
+func entryChange(value *ber.Packet) (int64, string) {
+	if value == nil || len(value.Children) == 0 {
+		return 0, ""
+	}
+	changeType, _ := value.Children[0].Value.(int64)
+	previousDN := ""
+	if len(value.Children) > 1 && value.Children[1].Tag == ber.TagOctetString {
+		previousDN = value.Children[1].Data.String()
+	}
+	return changeType, previousDN
+}
+
+// syncInfo is a decoded Sync Info intermediate response.
+type syncInfo struct {
+	refreshDone    bool
+	refreshDeletes bool
+	uuids          []string
+}
+
+func decodeSyncInfo(packet *ber.Packet) (*syncInfo, error) {
+	op := packet.Children[1]
+	var value *ber.Packet
+	for _, child := range op.Children {
+		if child.ClassType == ber.ClassContext && child.Tag == 1 {
+			value = child
+		}
+	}
+	if value == nil {
+		return nil, errors.New("intermediate response without value")
+	}
+	choice, err := ber.DecodePacketErr(value.Data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	info := &syncInfo{}
+	switch choice.Tag {
+	case 0:
+		// newcookie, cookies aren't used as the refresh is always complete
+	case 1, 2:
+		// refreshDelete and refreshPresent, refreshDone defaults to true
+		info.refreshDone = true
+		for _, child := range choice.Children {
+			if child.Tag == ber.TagBoolean {
+				info.refreshDone, _ = child.Value.(bool)
+			}
+		}
+	case 3:
+		for _, child := range choice.Children {
+			switch child.Tag {
+			case ber.TagBoolean:
+				info.refreshDeletes, _ = child.Value.(bool)
+			case ber.TagSet:
+				for _, uuid := range child.Children {
+					info.uuids = append(info.uuids, formatUUID(uuid.Data.Bytes()))
+				}
+			}
+		}
+	}
+	return info, nil
+}
+
+func formatUUID(b []byte) string {
+	if len(b) != 16 {
+		return fmt.Sprintf("%x", b)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDialStream(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	socket := t.TempDir() + "/ldapi"
+	unix, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	for _, rawURL := range []string{
+		"ldap://" + tcp.Addr().String(),
+		"ldapi://" + (&url.URL{Path: socket}).EscapedPath(),
+	} {
+		s, err := dialStream(rawURL, time.Second)
+		if err != nil {
+			t.Errorf("dialStream(%s): %v", rawURL, err)
+			continue
+		}
+		s.Close()
+	}
+	if _, err := dialStream("http://"+tcp.Addr().String(), time.Second); err == nil {
+		t.Error("dialStream() of an http:// url didn't fail")
+	}
+}
@@ -0,0 +1,534 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	deliveriesBucket = "webhook_deliveries"
+	queueBucket      = "webhook_queue"
+)
+
+type deliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Latency    float64   `json:"latencyMs"`
+}
+
+type delivery struct {
+	ID          string            `json:"id"`
+	Endpoint    string            `json:"endpoint"`
+	Event       event             `json:"event"`
+	Status      string            `json:"status"`
+	Attempts    []deliveryAttempt `json:"attempts"`
+	Remaining   int               `json:"remainingAttempts"`
+	NextAttempt time.Time         `json:"nextAttempt,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+var webhooks struct {
+	sync.Once
+	wake chan struct{}
+
+	// published are the events not queued in the store yet, as subscribers
+	// must not wait on the store
+	sync.Mutex
+	published []event
+	queue     chan struct{}
+}
+
+// setupWebhooks starts the delivery worker once webhooks are configured.
+// Deliveries are queued in the store, so that they survive restarts.
+func setupWebhooks() error {
+	if len(conf().Webhooks.Endpoints) == 0 {
+		return nil
+	}
+	if _, err := openStore(); err != nil {
+		return err
+	}
+	webhooks.Do(func() {
+		webhooks.wake = make(chan struct{}, 1)
+		webhooks.queue = make(chan struct{}, 1)
+		subscribe(publishedEvent)
+		go queueDeliveries()
+		go deliverWebhooks()
+	})
+	return nil
+}
+
+// publishedEvent hands the published event to queueDeliveries.
+func publishedEvent(e event) {
+	webhooks.Lock()
+	webhooks.published = append(webhooks.published, e)
+	webhooks.Unlock()
+	select {
+	case webhooks.queue <- struct{}{}:
+	default:
+	}
+}
+
+// queueDeliveries queues the deliveries of the published events, in the
+// order they were published.
+func queueDeliveries() {
+	for range webhooks.queue {
+		webhooks.Lock()
+		published := webhooks.published
+		webhooks.published = nil
+		webhooks.Unlock()
+		for _, e := range published {
+			enqueueDeliveries(e)
+		}
+	}
+}
+
+func webhookEndpointNamed(name string) (config.WebhookEndpoint, bool) {
+	for _, endpoint := range conf().Webhooks.Endpoints {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return config.WebhookEndpoint{}, false
+}
+
+// matchDirectory tells whether the event directory, empty for the default
+// one, is one of names. No name matches every directory.
+func matchDirectory(names []string, directory string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	if directory == "" {
+		directory = config.DefaultDirectory
+	}
+	for _, name := range names {
+		if name == directory {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueDeliveries queues the deliveries of e to the endpoints subscribed
+// to it.
+func enqueueDeliveries(e event) {
+	var queued []delivery
+	for _, endpoint := range conf().Webhooks.Endpoints {
+		if matchEventType(endpoint.Events, e.Type) && matchDirectory(endpoint.Directories, e.Directory) {
+			queued = append(queued, delivery{
+				ID:          newID(),
+				Endpoint:    endpoint.Name,
+				Event:       e,
+				Status:      "pending",
+				Attempts:    []deliveryAttempt{},
+				Remaining:   conf().Webhooks.MaxAttempts,
+				NextAttempt: e.Time,
+				CreatedAt:   e.Time,
+			})
+		}
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	db, err := openStore()
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, d := range queued {
+				if err := putJSON(tx, deliveriesBucket, d.ID, d); err != nil {
+					return err
+				}
+				if err := putJSON(tx, queueBucket, d.ID, d.NextAttempt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Error().Err(err).Str("event", e.Type).Str("target", e.Target).Msg("can't queue webhook deliveries")
+		return
+	}
+	wakeWebhooks()
+}
+
+func wakeWebhooks() {
+	select {
+	case webhooks.wake <- struct{}{}:
+	default:
+	}
+}
+
+func deliverWebhooks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-webhooks.wake:
+		}
+
+		for _, id := range dueDeliveries(time.Now()) {
+			attemptDelivery(id)
+		}
+		if time.Since(lastPrune) > time.Hour {
+			pruneDeliveries()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+func dueDeliveries(now time.Time) []string {
+	db, err := openStore()
+	if err != nil {
+		log.Error().Err(err).Msg("can't read webhook queue")
+		return nil
+	}
+	var ids []string
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(queueBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var next time.Time
+			if json.Unmarshal(v, &next) == nil && !next.After(now) {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	return ids
+}
+
+func attemptDelivery(id string) {
+	db, err := openStore()
+	if err != nil {
+		return
+	}
+	var d delivery
+	if err := db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx, deliveriesBucket, id, &d)
+	}); err != nil {
+		log.Error().Err(err).Str("delivery", id).Msg("can't read webhook delivery")
+		return
+	}
+
+	attempt := deliveryAttempt{Time: time.Now().UTC()}
+	endpoint, ok := webhookEndpointNamed(d.Endpoint)
+	if ok {
+		attempt.StatusCode, err = postWebhook(endpoint, d)
+	} else {
+		err = errors.New("endpoint no longer configured")
+	}
+	attempt.Latency = float64(time.Since(attempt.Time).Microseconds()) / 1000
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	d.Attempts = append(d.Attempts, attempt)
+	d.Remaining--
+
+	event := log.Info()
+	switch {
+	case err == nil:
+		d.Status = "delivered"
+		d.NextAttempt = time.Time{}
+	case !ok || d.Remaining <= 0:
+		d.Status = "failed"
+		d.NextAttempt = time.Time{}
+		event = log.Error().Err(err)
+	default:
+		d.NextAttempt = time.Now().UTC().Add(webhookBackoff(conf().Webhooks.MaxAttempts - d.Remaining))
+		event = log.Warn().Err(err).Time("next_attempt", d.NextAttempt)
+	}
+	webhookDeliveries.WithLabelValues(d.Endpoint, d.Status).Inc()
+	event.Str("delivery", d.ID).Str("endpoint", d.Endpoint).Str("event", d.Event.Type).
+		Int("attempt", len(d.Attempts)).Int("status_code", attempt.StatusCode).Msg("webhook delivery")
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if d.Status != "pending" {
+			if b := tx.Bucket([]byte(queueBucket)); b != nil {
+				if err := b.Delete([]byte(d.ID)); err != nil {
+					return err
+				}
+			}
+		} else if err := putJSON(tx, queueBucket, d.ID, d.NextAttempt); err != nil {
+			return err
+		}
+		return putJSON(tx, deliveriesBucket, d.ID, d)
+	}); err != nil {
+		log.Error().Err(err).Str("delivery", d.ID).Msg("can't update webhook delivery")
+	}
+}
+
+// webhookBackoff doubles the delay after each failed attempt.
+func webhookBackoff(attempts int) time.Duration {
+	backoff, maxBackoff := conf().Webhooks.Backoff, conf().Webhooks.MaxBackoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// signWebhook returns the HMAC-SHA256 of the timestamp and body, so that
+// receivers can check the payload origin and reject replays.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(endpoint config.WebhookEndpoint, d delivery) (int, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ldoups-webhook")
+	req.Header.Set("X-Ldoups-Event", d.Event.Type)
+	req.Header.Set("X-Ldoups-Delivery", d.ID)
+	req.Header.Set("X-Ldoups-Timestamp", timestamp)
+	if endpoint.Secret != "" {
+		req.Header.Set("X-Ldoups-Signature", signWebhook(endpoint.Secret, timestamp, body))
+	}
+
+	resp, err := (&http.Client{Timeout: conf().Webhooks.Timeout}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// pruneDeliveries removes finished deliveries older than
+// `webhooks.retention` from the delivery log.
+func pruneDeliveries() {
+	before := time.Now().Add(-conf().Webhooks.Retention)
+
+	db, err := openStore()
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(deliveriesBucket))
+		if b == nil {
+			return nil
+		}
+		// Deleting with the cursor would skip the following key
+		var expired [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var d delivery
+			if json.Unmarshal(v, &d) != nil {
+				continue
+			}
+			if !d.CreatedAt.Before(before) {
+				break
+			}
+			if d.Status != "pending" {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("can't prune webhook deliveries")
+	}
+}
+
+// GetWebhookDeliveries returns the delivery log, most recent first,
+// filtered by the endpoint, event and status query parameters. Only audit
+// admins read it.
+func GetWebhookDeliveries(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			abortWithErrors(c, errors.New("invalid query"), http.StatusBadRequest, map[string]string{"limit": "invalid limit"})
+			return
+		}
+	}
+	endpoint, eventType, status := c.Query("endpoint"), c.Query("event"), c.Query("status")
+	dir := directoryOf(c).auditName()
+
+	deliveries := []delivery{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(deliveriesBucket))
+		if b == nil {
+			return nil
+		}
+		cursor := b.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.Event.Directory == dir &&
+				(endpoint == "" || d.Endpoint == endpoint) &&
+				(eventType == "" || d.Event.Type == eventType) &&
+				(status == "" || d.Status == status) {
+				deliveries = append(deliveries, d)
+				if limit > 0 && len(deliveries) >= limit {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// getDelivery reads the delivery given in the path, which must be one of an
+// event of the request directory.
+func getDelivery(c *gin.Context, tx *bolt.Tx, d *delivery) error {
+	if err := getJSON(tx, deliveriesBucket, c.Param("id"), d); err != nil {
+		return err
+	}
+	if d.Event.Directory != directoryOf(c).auditName() {
+		return errNotFound
+	}
+	return nil
+}
+
+func GetWebhookDelivery(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	var d delivery
+	err = db.View(func(tx *bolt.Tx) error {
+		return getDelivery(c, tx, &d)
+	})
+	if errors.Is(err, errNotFound) {
+		abort(c, errors.New("delivery not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// RedeliverWebhook queues a delivery again, with `webhooks.maxAttempts`
+// new attempts. Previous attempts are kept in the log. Only audit admins
+// redeliver.
+func RedeliverWebhook(c *gin.Context) {
+	l, ok := c.Get("LDAP")
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	ldp, ok := l.(*ldapConn)
+	if !ok {
+		abort(c, errors.New("can't get ldap conn"), http.StatusInternalServerError)
+		return
+	}
+	if !checkAuditAdmin(c, ldp) {
+		return
+	}
+
+	db, err := openStore()
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	var d delivery
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := getDelivery(c, tx, &d); err != nil {
+			return err
+		}
+		d.Status = "pending"
+		d.Remaining = conf().Webhooks.MaxAttempts
+		d.NextAttempt = time.Now().UTC()
+		if err := putJSON(tx, queueBucket, d.ID, d.NextAttempt); err != nil {
+			return err
+		}
+		return putJSON(tx, deliveriesBucket, d.ID, d)
+	})
+	if errors.Is(err, errNotFound) {
+		abort(c, errors.New("delivery not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		abort(c, err, http.StatusInternalServerError)
+		return
+	}
+	wakeWebhooks()
+	c.JSON(http.StatusAccepted, d)
+}
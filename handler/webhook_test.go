@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BedrockStreaming/ldoups/config"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		secret, timestamp, body, want string
+	}{
+		{"secret", "1700000000", `{"id":"1"}`, "sha256=086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"},
+		{"other", "1700000000", `{"id":"1"}`, ""},
+		{"secret", "1700000001", `{"id":"1"}`, ""},
+		{"secret", "1700000000", `{"id":"2"}`, ""},
+	}
+	reference := signWebhook(tests[0].secret, tests[0].timestamp, []byte(tests[0].body))
+	for _, tt := range tests {
+		got := signWebhook(tt.secret, tt.timestamp, []byte(tt.body))
+		if tt.want != "" && got != tt.want {
+			t.Errorf("signWebhook(%s, %s, %s) = %s, want %s", tt.secret, tt.timestamp, tt.body, got, tt.want)
+		}
+		if tt.want == "" && got == reference {
+			t.Errorf("signWebhook(%s, %s, %s) signs as another payload", tt.secret, tt.timestamp, tt.body)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	c := &config.Config{}
+	c.Webhooks.Backoff = 10 * time.Second
+	c.Webhooks.MaxBackoff = time.Minute
+	useTestConfig(t, c)
+
+	want := []time.Duration{10 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute, time.Minute}
+	for attempts, backoff := range want {
+		if got := webhookBackoff(attempts); got != backoff {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempts, got, backoff)
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	c := &config.Config{}
+	c.Webhooks.Timeout = time.Second
+	useTestConfig(t, c)
+
+	status := http.StatusNoContent
+	received := make(chan bool, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature := signWebhook("secret", r.Header.Get("X-Ldoups-Timestamp"), body)
+		received <- hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Ldoups-Signature"))) &&
+			r.Header.Get("X-Ldoups-Event") == "user.update" && r.Header.Get("X-Ldoups-Delivery") == "1"
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	endpoint := config.WebhookEndpoint{Name: "receiver", Url: receiver.URL, Secret: "secret"}
+	d := delivery{ID: "1", Endpoint: "receiver", Event: event{ID: "1", Type: "user.update", Target: testUser}}
+	if code, err := postWebhook(endpoint, d); code != http.StatusNoContent || err != nil {
+		t.Errorf("postWebhook() = %d, %v, want %d", code, err, http.StatusNoContent)
+	}
+	if !<-received {
+		t.Error("the receiver got an invalid signature or headers")
+	}
+
+	status = http.StatusBadGateway
+	if code, err := postWebhook(endpoint, d); code != http.StatusBadGateway || err == nil {
+		t.Errorf("postWebhook() = %d, %v, want %d and an error", code, err, http.StatusBadGateway)
+	}
+	<-received
+}
+
+func TestEnqueueDeliveries(t *testing.T) {
+	c := &config.Config{}
+	c.Webhooks.MaxAttempts = 3
+	c.Webhooks.Endpoints = []config.WebhookEndpoint{
+		{Name: "users", Events: []string{"user.*"}},
+		{Name: "lab", Directories: []string{"lab"}},
+		{Name: "all"},
+	}
+	useTestConfig(t, c)
+	webhooks.wake = make(chan struct{}, 1)
+
+	now := time.Now().UTC()
+	enqueueDeliveries(event{ID: newID(), Type: "user.update", Time: now, Target: testUser})
+	enqueueDeliveries(event{ID: newID(), Type: "group.update", Time: now.Add(time.Hour), Target: testGroup})
+
+	due := dueDeliveries(now)
+	if len(due) != 2 {
+		t.Fatalf("%d deliveries due, want 2 (users and all)", len(due))
+	}
+	if later := dueDeliveries(now.Add(time.Hour)); len(later) != 3 {
+		t.Errorf("%d deliveries due in an hour, want 3", len(later))
+	}
+}
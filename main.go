@@ -3,21 +3,21 @@ package main
 import (
 	"embed"
 	"flag"
+	"fmt"
+	"io"
 	"io/fs"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 
+	"github.com/BedrockStreaming/ldoups/config"
 	"github.com/BedrockStreaming/ldoups/handler"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
-	"gopkg.in/yaml.v2"
-	// "fmt"
 )
 
 var (
@@ -27,30 +27,6 @@ var (
 //go:embed static
 var embededFiles embed.FS
 
-type config struct {
-	Server struct {
-		Host string `yaml:"host"`
-		Port string `yaml:"port"`
-	} `yaml:"server"`
-}
-
-var confPath *string
-var conf *config
-
-func (c *config) loadConf() {
-	yamlFile, err := ioutil.ReadFile(*confPath)
-	if err != nil {
-		log.Printf("yamlFile.Get err #%v ", err)
-		os.Exit(1)
-	}
-	err = yaml.Unmarshal(yamlFile, c)
-	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
-		os.Exit(1)
-	}
-	conf = c
-}
-
 type embedFileSystem struct {
 	http.FileSystem
 }
@@ -61,15 +37,36 @@ func (e embedFileSystem) Exists(prefix string, path string) bool {
 }
 
 func main() {
-	confPath = flag.String("conf", "config.yaml", "Config path")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apply":
+			os.Exit(apply(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshot(os.Args[2:]))
+		case "diff":
+			os.Exit(diff(os.Args[2:]))
+		}
+	}
+
+	confPath := flag.String("conf", "config.yaml", "Config path")
 	flag.Parse()
 
-	var c config
-	c.loadConf()
-	handler.LoadConf()
-	router := gin.Default()
+	conf, err := config.Load(*confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := handler.LoadConf(conf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := config.Watch(*confPath, handler.Reload); err != nil {
+		log.Warn().Err(err).Str("path", *confPath).Msg("can't watch config file, reload with SIGHUP only")
+	}
+	router := gin.New()
 
 	staticFiles := getFileSystem(gin.Mode() != gin.ReleaseMode)
+	router.Use(handler.RequestID, handler.RequestLogger, handler.Metrics, handler.Recovery)
 	router.Use(handler.CORS, static.Serve("/", staticFiles))
 	router.NoRoute(handler.CORS, func(c *gin.Context) {
 		_, file := path.Split(c.Request.RequestURI)
@@ -81,6 +78,10 @@ func main() {
 		}
 	})
 
+	router.GET("/metrics", handler.MetricsHandler)
+	router.GET("/healthz", handler.Health)
+	router.GET("/readyz", handler.Ready)
+
 	router.GET("/api/login", handler.InitHandler)
 	router.OPTIONS("/api/login", handler.CORS)
 	router.GET("/api/users", handler.CORS, handler.InitHandler, handler.GetUsers)
@@ -88,31 +89,98 @@ func main() {
 	router.OPTIONS("/api/users", handler.CORS)
 	router.GET("/api/users/:id", handler.InitHandler, handler.Get)
 	router.PUT("/api/users/:id", handler.InitHandler, handler.UpdateUser, handler.SetPassword)
+	router.PATCH("/api/users/:id", handler.InitHandler, handler.PatchUser)
 	router.PUT("/api/users/password", handler.InitHandler, handler.SetPassword)
 	router.DELETE("/api/users/:id", handler.InitHandler, handler.Delete, handler.RemoveUser)
+	router.POST("/api/users/:id/disable", handler.InitHandler, handler.DisableUser)
+	router.POST("/api/users/:id/enable", handler.InitHandler, handler.EnableUser)
+	router.POST("/api/users/:id/lock", handler.InitHandler, handler.LockUser)
+	router.POST("/api/users/:id/unlock", handler.InitHandler, handler.UnlockUser)
+	router.PUT("/api/users/:id/expiry", handler.InitHandler, handler.SetUserExpiry)
+	router.GET("/api/users/:id/ssh-keys", handler.InitHandler, handler.GetSSHKeys)
+	router.POST("/api/users/:id/ssh-keys", handler.InitHandler, handler.AddSSHKey)
+	router.DELETE("/api/users/:id/ssh-keys/*fingerprint", handler.InitHandler, handler.RevokeSSHKey)
+	router.GET("/api/users/:id/sudo-rules", handler.InitHandler, handler.GetUserSudoRules)
+	router.GET("/api/jobs", handler.InitHandler, handler.GetJobs)
 	router.OPTIONS("/api/users/:id", handler.CORS)
 	router.GET("/api/groups", handler.InitHandler, handler.GetGroups)
 	router.POST("/api/groups", handler.InitHandler, handler.AddGroup)
 	router.OPTIONS("/api/groups", handler.CORS)
 	router.GET("/api/groups/:id", handler.InitHandler, handler.Get)
 	router.PUT("/api/groups/:id", handler.InitHandler, handler.UpdateGroup)
+	router.PATCH("/api/groups/:id", handler.InitHandler, handler.PatchGroup)
 	router.DELETE("/api/groups/:id", handler.InitHandler, handler.Delete)
+	router.POST("/api/groups/:id/members", handler.InitHandler, handler.AddGroupMember)
+	router.DELETE("/api/groups/:id/members/:member", handler.InitHandler, handler.RemoveGroupMember)
+	router.GET("/api/groups/:id/dynamic", handler.InitHandler, handler.GetDynamicGroup)
+	router.PUT("/api/groups/:id/dynamic", handler.InitHandler, handler.SetDynamicGroup)
+	router.DELETE("/api/groups/:id/dynamic", handler.InitHandler, handler.DeleteDynamicGroup)
+	router.GET("/api/groups/:id/dynamic/preview", handler.InitHandler, handler.PreviewDynamicGroup)
+	router.GET("/api/dynamic-groups", handler.InitHandler, handler.GetDynamicGroups)
 	router.OPTIONS("/api/groups/:id", handler.CORS)
+	router.GET("/api/sudo-rules", handler.InitHandler, handler.GetSudoRules)
+	router.POST("/api/sudo-rules", handler.InitHandler, handler.AddSudoRule)
+	router.GET("/api/sudo-rules/:name", handler.InitHandler, handler.GetSudoRule)
+	router.PUT("/api/sudo-rules/:name", handler.InitHandler, handler.UpdateSudoRule)
+	router.DELETE("/api/sudo-rules/:name", handler.InitHandler, handler.DeleteSudoRule)
+	router.GET("/api/access-requests", handler.InitHandler, handler.GetAccessRequests)
+	router.POST("/api/access-requests", handler.InitHandler, handler.AddAccessRequest)
+	router.GET("/api/access-requests/:id", handler.InitHandler, handler.GetAccessRequest)
+	router.POST("/api/access-requests/:id/approve", handler.InitHandler, handler.ApproveAccessRequest)
+	router.POST("/api/access-requests/:id/deny", handler.InitHandler, handler.DenyAccessRequest)
+	router.POST("/api/access-requests/:id/cancel", handler.InitHandler, handler.CancelAccessRequest)
+	router.GET("/api/service-accounts", handler.InitHandler, handler.GetServiceAccounts)
+	router.POST("/api/service-accounts", handler.InitHandler, handler.AddServiceAccount)
+	router.DELETE("/api/service-accounts/:name", handler.InitHandler, handler.DeleteServiceAccount)
+	router.GET("/api/service-accounts/:name/keys", handler.InitHandler, handler.GetAPIKeys)
+	router.POST("/api/service-accounts/:name/keys", handler.InitHandler, handler.AddAPIKey)
+	router.POST("/api/service-accounts/:name/keys/:key/rotate", handler.InitHandler, handler.RotateAPIKey)
+	router.DELETE("/api/service-accounts/:name/keys/:key", handler.InitHandler, handler.RevokeAPIKey)
+	router.POST("/api/apply", handler.InitHandler, handler.Apply)
+	router.GET("/api/snapshot", handler.InitHandler, handler.GetSnapshot)
+	router.POST("/api/snapshot/diff", handler.InitHandler, handler.PostDiff)
+	router.GET("/api/audit", handler.InitHandler, handler.GetAudit)
+	router.GET("/api/events", handler.InitHandler, handler.GetEvents)
+	router.GET("/api/webhooks/deliveries", handler.InitHandler, handler.GetWebhookDeliveries)
+	router.GET("/api/webhooks/deliveries/:id", handler.InitHandler, handler.GetWebhookDelivery)
+	router.POST("/api/webhooks/deliveries/:id/redeliver", handler.InitHandler, handler.RedeliverWebhook)
 
-	router.Run(conf.Server.Host + ":" + conf.Server.Port)
+	router.GET("/scim/v2/ServiceProviderConfig", handler.ScimServiceProviderConfig)
+	router.GET("/scim/v2/Schemas", handler.ScimSchemas)
+	router.GET("/scim/v2/Schemas/:id", handler.ScimSchemas)
+	router.GET("/scim/v2/ResourceTypes", handler.ScimResourceTypes)
+	router.GET("/scim/v2/ResourceTypes/:id", handler.ScimResourceTypes)
+	router.GET("/scim/v2/Users", handler.InitHandler, handler.ScimGetUsers)
+	router.POST("/scim/v2/Users", handler.InitHandler, handler.ScimCreateUser)
+	router.GET("/scim/v2/Users/:id", handler.InitHandler, handler.ScimGetUser)
+	router.PUT("/scim/v2/Users/:id", handler.InitHandler, handler.ScimReplaceUser)
+	router.PATCH("/scim/v2/Users/:id", handler.InitHandler, handler.ScimPatchUser)
+	router.DELETE("/scim/v2/Users/:id", handler.InitHandler, handler.ScimDeleteUser)
+	router.GET("/scim/v2/Groups", handler.InitHandler, handler.ScimGetGroups)
+	router.POST("/scim/v2/Groups", handler.InitHandler, handler.ScimCreateGroup)
+	router.GET("/scim/v2/Groups/:id", handler.InitHandler, handler.ScimGetGroup)
+	router.PUT("/scim/v2/Groups/:id", handler.InitHandler, handler.ScimReplaceGroup)
+	router.PATCH("/scim/v2/Groups/:id", handler.InitHandler, handler.ScimPatchGroup)
+	router.DELETE("/scim/v2/Groups/:id", handler.InitHandler, handler.ScimDeleteGroup)
+	router.POST("/scim/v2/Bulk", handler.InitHandler, handler.ScimBulk)
+
+	// Directories can be selected by path prefix, which is stripped before routing
+	if err := http.ListenAndServe(conf.Server.Host+":"+conf.Server.Port, handler.SelectDirectory(router)); err != nil {
+		log.Fatal().Err(err).Msg("can't serve")
+	}
 
 	if err := g.Wait(); err != nil {
-		log.Fatal(err)
+		log.Fatal().Err(err).Send()
 	}
 }
 
 func getFileSystem(useOS bool) static.ServeFileSystem {
 	if useOS {
-		log.Print("using live mode")
+		log.Info().Msg("using live mode")
 		return static.LocalFile("static", false)
 	}
 
-	log.Print("using embed mode")
+	log.Info().Msg("using embed mode")
 	fsys, err := fs.Sub(embededFiles, "static")
 	if err != nil {
 		panic(err)
@@ -122,3 +190,135 @@ func getFileSystem(useOS bool) static.ServeFileSystem {
 		FileSystem: http.FS(fsys),
 	}
 }
+
+// apply runs `ldoups apply [flags] <file>`, sending a declarative document
+// read from file, or stdin with `-`, to a running LDOups server. It
+// authenticates with the API key of LDOUPS_TOKEN, or as -user with the
+// password of LDOUPS_PASSWORD.
+func apply(args []string) int {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	serverURL := flags.String("url", "http://localhost:8000", "URL of the LDOups server")
+	directory := flags.String("directory", "", "Directory to apply to, the default one when empty")
+	user := flags.String("user", "", "User to log in as, when LDOUPS_TOKEN isn't set")
+	dryRun := flags.Bool("dry-run", false, "Only print the plan")
+	prune := flags.Bool("prune", false, "Delete the entries of the document owner missing from it")
+	adopt := flags.Bool("adopt", false, "Take over the existing entries no document manages")
+	output := flags.String("o", "text", "Output format: text or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: ldoups apply [flags] <file|->")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*output != "text" && *output != "json") {
+		flags.Usage()
+		return 2
+	}
+	opts := handler.ApplyOptions{
+		URL:       *serverURL,
+		Directory: *directory,
+		Token:     os.Getenv("LDOUPS_TOKEN"),
+		Username:  *user,
+		Password:  os.Getenv("LDOUPS_PASSWORD"),
+		DryRun:    *dryRun,
+		Prune:     *prune,
+		Adopt:     *adopt,
+		Output:    *output,
+	}
+	if opts.Token == "" && opts.Username == "" {
+		fmt.Fprintln(os.Stderr, "LDOUPS_TOKEN or -user is required")
+		return 2
+	}
+
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := handler.ApplyCommand(data, opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// snapshot runs `ldoups snapshot [flags]`, writing a snapshot of the users
+// and groups to stdout or a file.
+func snapshot(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	confPath := flags.String("conf", "config.yaml", "Config path")
+	directory := flags.String("directory", "", "Directory to snapshot, the default one when empty")
+	output := flags.String("o", "-", "File to write the snapshot to, stdout with -")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	conf, err := config.Load(*confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := handler.SnapshotCommand(conf, *directory, w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// diff runs `ldoups diff [flags] <from> [to]`, writing the changes between
+// two snapshots, or a snapshot and the live directory.
+func diff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	confPath := flags.String("conf", "config.yaml", "Config path, to compare with the live directory")
+	directory := flags.String("directory", "", "Directory to compare with, the default one when empty")
+	format := flags.String("format", "text", "Output format: text, json or ldif")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: ldoups diff [flags] <from> [to]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	from, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var to []byte
+	var conf *config.Config
+	if flags.NArg() == 2 {
+		to, err = os.ReadFile(flags.Arg(1))
+	} else {
+		conf, err = config.Load(*confPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	opts := handler.DiffOptions{Directory: *directory, Format: *format}
+	if err := handler.DiffCommand(conf, from, to, opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}